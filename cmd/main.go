@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/viper"
 	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/events"
+	"github.com/tebrizetayi/ledgerservice/internal/grpcapi"
 	"github.com/tebrizetayi/ledgerservice/internal/storage"
 	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
 
@@ -19,6 +28,11 @@ import (
 
 func main() {
 	config := initConfig()
+
+	// Log as JSON, including what goes through the log package
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: config.App.LogLevel}))
+	slog.SetDefault(logger)
+
 	db, err := connectToDatabase(config.DB)
 	if err != nil {
 		log.Fatalf("Failed to connect to the database: %v", err)
@@ -28,42 +42,132 @@ func main() {
 
 	defer db.Close()
 
-	// Make a channel to listen for an interrupt or terminate signal from the OS.
-	// Use a buffered channel because the signal package requires it.
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-
-	// Make a channel to listen for errors coming from the listener. Use a
-	// buffered channel so the goroutine can exit if we don't collect this error.
-	serverErrors := make(chan error, 1)
+	// Stop on an interrupt or terminate signal from the OS, letting the
+	// background jobs and in-flight requests wind down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Services
 	storageClient := storage.NewStorageClient(db)
-	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
-	controller := api.NewController(transactionManager)
-
-	// Start the HTTP service listening for requests.
-	api := http.Server{
-		Addr:           fmt.Sprintf(":%s", config.App.Port),
-		Handler:        api.NewAPI(controller),
-		MaxHeaderBytes: 1 << 20,
+	managerOptions := []transactionmanager.Option{
+		transactionmanager.WithLogger(logger),
+		transactionmanager.WithLimits(transactionmanager.Limits{
+			AllowNegative:      config.App.AllowDebits,
+			OverdraftTolerance: config.App.OverdraftTolerance,
+			AllowZeroAmount:    config.App.AllowZeroAmount,
+			CurrencyAmounts:    config.App.CurrencyAmounts,
+			MaxTransferAmount:  config.App.MaxTransferAmount,
+			CreditCap:          config.App.CreditCap,
+		}),
+		transactionmanager.WithMaxConcurrentPerUser(config.App.MaxConcurrentPerUser, config.App.QueueConcurrentPerUser),
+		transactionmanager.WithRecomputeChunkSize(config.App.RecomputeChunkSize),
+		transactionmanager.WithEstimatedCounts(config.App.EstimateCountsFrom),
+		transactionmanager.WithMonotonicTimestamps(config.App.MonotonicTimestamps),
+		transactionmanager.WithDuplicateWindow(config.App.DuplicateWindow, config.App.RejectDuplicates),
+		transactionmanager.WithCreditHold(config.App.HoldPercent, config.App.HoldDuration),
+		transactionmanager.WithRoundingMode(config.App.RoundingMode),
+		transactionmanager.WithMaxDecimalPlaces(config.App.MaxDecimalPlaces),
+		transactionmanager.WithMaxBackdate(config.App.MaxBackdate),
+		transactionmanager.WithMaxForwardSkew(config.App.MaxForwardSkew),
+		transactionmanager.WithStatementJobs(config.App.StatementQueueSize, config.App.MaxStatementJobs, config.App.StatementJobTTL),
+		transactionmanager.WithReturnExisting(config.App.ReturnExisting),
+		transactionmanager.WithResponseReplay(config.App.ResponseReplayTTL),
+		transactionmanager.WithAddTimeout(config.App.AddTimeout),
+		transactionmanager.WithOverdraftAccounts(config.App.OverdraftAccounts...),
+		transactionmanager.WithWebhooks(config.App.WebhookURL, config.App.WebhookBackoff),
+	}
+	if len(config.App.ReasonCodes) > 0 {
+		managerOptions = append(managerOptions, transactionmanager.WithReasonCodes(config.App.ReasonCodes...))
+	}
+	if config.App.FeePercent.IsPositive() {
+		managerOptions = append(managerOptions, transactionmanager.WithAmountTransformer(transactionmanager.PercentageFee{Percent: config.App.FeePercent}))
+	}
+	var eventSink *events.WebhookSink
+	if config.App.EventsWebhookURL != "" {
+		eventSink = events.NewWebhookSink(config.App.EventsWebhookURL, config.App.EventsWebhookSecret,
+			events.WithTimeout(config.App.EventsWebhookTimeout),
+			events.WithRetries(config.App.EventsWebhookMaxRetries, config.App.EventsWebhookBackoff),
+			events.WithWorkers(config.App.EventsWebhookWorkers, config.App.EventsWebhookQueueSize),
+			events.WithDeadLetters(storageClient.DeadLetterRepository),
+			events.WithLogger(logger))
+		managerOptions = append(managerOptions, transactionmanager.WithEventSink(eventSink))
+	}
+	if len(config.App.ExchangeRates) > 0 {
+		managerOptions = append(managerOptions, transactionmanager.WithExchangeRates(config.App.ExchangeRates))
+	}
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, managerOptions...)
+	if config.App.HoldPercent.IsPositive() {
+		go transactionManager.RunHoldSweeper(ctx, config.App.HoldSweepInterval)
+	}
+	if config.App.WebhookURL != "" {
+		go transactionManager.RunWebhookRetrier(ctx, config.App.WebhookRetryInterval)
 	}
+	if config.App.SchedulerInterval > 0 {
+		go transactionManager.RunScheduler(ctx, config.App.SchedulerInterval)
+	}
+	go transactionManager.RunStatementWorkers(ctx, config.App.StatementWorkers)
+	var controllerOptions []api.ControllerOption
+	if config.App.JSONNaming == "camelCase" {
+		controllerOptions = append(controllerOptions, api.WithJSONNaming(api.CamelCase))
+	}
+	if config.App.AmountConvention == "direction" {
+		controllerOptions = append(controllerOptions, api.WithAmountConvention(api.DirectionAmounts))
+	}
+	if config.App.RequireIdempotencyKey {
+		controllerOptions = append(controllerOptions, api.WithRequireIdempotencyKey(true))
+	}
+	controller := api.NewController(transactionManager, controllerOptions...)
 
-	go func() {
-		log.Printf("main : API Listening %s", config.App.Port)
-		serverErrors <- api.ListenAndServe()
-	}()
+	apiOptions := []api.APIOption{
+		api.WithAdminToken(config.App.AdminToken),
+		api.WithLogger(logger),
+		api.WithReadinessCheck("database", db.PingContext),
+		api.WithShutdownTimeout(config.App.ShutdownTimeout),
+		api.WithRateLimit(config.App.RateLimit, config.App.RateBurst),
+	}
+	if config.App.CompressionLevel != 0 {
+		apiOptions = append(apiOptions, api.WithCompression(config.App.CompressionMinSize, config.App.CompressionLevel))
+	}
+	if config.App.MultiTenant {
+		apiOptions = append(apiOptions, api.WithTenantHeader())
+	}
 
-	// =========================================================================
-	// Shutdown
-	// Blocking main and waiting for shutdown.
-	select {
-	case err := <-serverErrors:
-		log.Fatalf("main : Error starting server: %+v", err)
+	// Serve gRPC next to HTTP when a port is set for it
+	grpcDone := make(chan struct{})
+	if config.App.GRPCPort != "" {
+		var grpcOptions []grpcapi.Option
+		if config.App.MultiTenant {
+			grpcOptions = append(grpcOptions, grpcapi.WithTenantMetadata())
+		}
+		grpcServer := grpcapi.NewServer(transactionManager, grpcOptions...)
+		go func() {
+			defer close(grpcDone)
+			err := grpcapi.Run(ctx, grpcServer, fmt.Sprintf(":%s", config.App.GRPCPort), config.App.ShutdownTimeout)
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				log.Printf("main : gRPC : %v", err)
+			case err != nil:
+				log.Fatalf("main : gRPC : %v", err)
+			}
+		}()
+	} else {
+		close(grpcDone)
+	}
 
-	case sig := <-shutdown:
-		log.Printf("main : %v : Start shutdown..", sig)
+	// Serve until a shutdown signal, then drain the in-flight requests
+	if err := api.NewAPI(controller, apiOptions...).Run(ctx, fmt.Sprintf(":%s", config.App.Port)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("main : %v", err)
 	}
+	<-grpcDone
+	if eventSink != nil {
+		// Give the events still being posted as long as the requests got
+		waitCtx, cancel := context.WithTimeout(context.Background(), config.App.ShutdownTimeout)
+		if err := eventSink.Wait(waitCtx); err != nil {
+			log.Printf("main : Events still undelivered: %v", err)
+		}
+		cancel()
+	}
+	log.Printf("main : Shutdown complete")
 }
 
 type Config struct {
@@ -72,6 +176,141 @@ type Config struct {
 }
 type AppConfig struct {
 	Port string
+	// GRPCPort serves the gRPC API on this port as well, off when empty
+	GRPCPort string
+	// JSONNaming is either snake_case (default) or camelCase
+	JSONNaming string
+	// AdminToken is the bearer token for the /admin endpoints, which are
+	// disabled when it is empty
+	AdminToken string
+	// MultiTenant scopes every request to the tenant in its X-Tenant-ID
+	// header
+	MultiTenant bool
+	// AmountConvention is either signed (default) or direction, where
+	// amounts are always positive and sent with a credit or debit direction
+	AmountConvention string
+	// CompressionLevel gzips responses of at least CompressionMinSize bytes
+	// at this level from 1 (fastest) to 9 (smallest), off when zero
+	CompressionLevel   int
+	CompressionMinSize int
+	// RequireIdempotencyKey rejects writes without an idempotency key
+	RequireIdempotencyKey bool
+	// AllowDebits accepts negative amounts as debits, on by default
+	AllowDebits bool
+	// OverdraftAccounts are the users whose debits may take their balance
+	// below zero, given as UUIDs separated by commas
+	OverdraftAccounts []uuid.UUID
+	// OverdraftTolerance lets debits exceed the available balance by up to
+	// this much, e.g. to absorb rounding
+	OverdraftTolerance decimal.Decimal
+	// AllowZeroAmount lets zero-value transactions through validation
+	AllowZeroAmount bool
+	// MaxConcurrentPerUser caps the transactions in flight for one user,
+	// unlimited when zero. Calls over the cap get 429 unless
+	// QueueConcurrentPerUser makes them wait for a slot.
+	MaxConcurrentPerUser   int
+	QueueConcurrentPerUser bool
+	// ReasonCodes replaces the default reason code vocabulary when set
+	ReasonCodes []string
+	// RecomputeChunkSize makes balance recomputes read the transactions in
+	// chunks of this many rows instead of locking the user throughout
+	RecomputeChunkSize int
+	// EstimateCountsFrom makes history totals estimated from the table
+	// statistics once the estimate reaches this many rows, exact when zero
+	EstimateCountsFrom int64
+	// MonotonicTimestamps keeps server timestamps from going backwards per
+	// user when the clock is set back
+	MonotonicTimestamps bool
+	// DuplicateWindow flags keyless transactions repeating the user's amount
+	// within it, disabled when zero. RejectDuplicates turns the flag into a
+	// 409.
+	DuplicateWindow  time.Duration
+	RejectDuplicates bool
+	// CurrencyAmounts are the minimum and maximum transaction amounts per
+	// currency, given as CODE:MIN:MAX pairs separated by commas
+	CurrencyAmounts map[string]transactionmanager.AmountLimits
+	// MaxTransferAmount caps a single transfer, unlimited when zero
+	MaxTransferAmount decimal.Decimal
+	// CreditCap caps the total credited to a user, unlimited when zero
+	CreditCap decimal.Decimal
+	// FeePercent of every credit is booked as a FEE debit along with it,
+	// none when zero
+	FeePercent decimal.Decimal
+	// HoldPercent of every credit is held back from the available balance
+	// for HoldDuration, released by a sweeper running every
+	// HoldSweepInterval
+	HoldPercent       decimal.Decimal
+	HoldDuration      time.Duration
+	HoldSweepInterval time.Duration
+	// AddTimeout bounds how long adding a transaction may take, unbounded
+	// when zero
+	AddTimeout time.Duration
+	// ReturnExisting answers retries with the transaction they repeat
+	// instead of an error
+	ReturnExisting bool
+	// ResponseReplayTTL is how long the response to a keyed transaction is
+	// replayed to retries, after which the key can be used again. Off when
+	// zero.
+	ResponseReplayTTL time.Duration
+	// RoundingMode rounds amounts converted between currencies: half_up
+	// (default), half_even or down
+	RoundingMode transactionmanager.RoundingMode
+	// MaxDecimalPlaces rejects amounts with more digits after the decimal
+	// point, unlimited when negative
+	MaxDecimalPlaces int32
+	// MaxBackdate rejects transactions sent with a created_at further in
+	// the past, unless imported through the admin backfill endpoint.
+	// Unlimited when zero.
+	MaxBackdate time.Duration
+	// MaxForwardSkew rejects transactions sent with a created_at further
+	// ahead of the server's clock, backfills included. Unlimited when zero.
+	MaxForwardSkew time.Duration
+	// ExchangeRates converts balances to the currency users ask for or
+	// prefer and transfers to the receiver's currency, given as FROM/TO:RATE
+	// entries separated by commas. Without them balances are only shown in
+	// the account currency and transfers between currencies are refused.
+	ExchangeRates transactionmanager.StaticRates
+	// WebhookURL receives an event for every transaction added, none when
+	// empty. Due deliveries are posted every WebhookRetryInterval and failed
+	// ones retried after WebhookBackoff, doubling with every failure.
+	WebhookURL           string
+	WebhookBackoff       time.Duration
+	WebhookRetryInterval time.Duration
+	// EventsWebhookURL receives every TransactionCreated event as JSON,
+	// signed with EventsWebhookSecret, none when empty. A post taking longer
+	// than EventsWebhookTimeout fails and failed posts are retried up to
+	// EventsWebhookMaxRetries times, EventsWebhookBackoff apart and doubling,
+	// before the event is written to the dead-letter table.
+	EventsWebhookURL        string
+	EventsWebhookSecret     string
+	EventsWebhookTimeout    time.Duration
+	EventsWebhookMaxRetries int
+	EventsWebhookBackoff    time.Duration
+	// EventsWebhookWorkers is how many events are posted at once. Up to
+	// EventsWebhookQueueSize more wait for a worker; events published while
+	// the queue is full go to the dead-letter table.
+	EventsWebhookWorkers   int
+	EventsWebhookQueueSize int
+	// SchedulerInterval is how often scheduled transactions that are due
+	// get posted. Zero turns the scheduler off.
+	SchedulerInterval time.Duration
+	// StatementWorkers is how many statements are generated at once. Up to
+	// StatementQueueSize more jobs wait for a worker, and finished jobs are
+	// kept for StatementJobTTL, at most MaxStatementJobs of them.
+	StatementWorkers   int
+	StatementQueueSize int
+	StatementJobTTL    time.Duration
+	MaxStatementJobs   int
+	// RateLimit is how many requests per second each user may make, in
+	// bursts of up to RateBurst. Zero turns rate limiting off.
+	RateLimit float64
+	RateBurst int
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// shutdown before they are aborted
+	ShutdownTimeout time.Duration
+	// LogLevel is the lowest level logged: debug, info (default), warn or
+	// error
+	LogLevel slog.Level
 }
 
 type DBConfig struct {
@@ -85,6 +324,26 @@ type DBConfig struct {
 
 func initConfig() Config {
 	viper.AutomaticEnv()
+	viper.SetDefault("HOLD_SWEEP_INTERVAL", time.Minute)
+	viper.SetDefault("WEBHOOK_BACKOFF", 10*time.Second)
+	viper.SetDefault("WEBHOOK_RETRY_INTERVAL", time.Second)
+	viper.SetDefault("EVENTS_WEBHOOK_TIMEOUT", events.DefaultTimeout)
+	viper.SetDefault("EVENTS_WEBHOOK_MAX_RETRIES", events.DefaultMaxRetries)
+	viper.SetDefault("EVENTS_WEBHOOK_BACKOFF", events.DefaultBackoff)
+	viper.SetDefault("EVENTS_WEBHOOK_WORKERS", events.DefaultWorkers)
+	viper.SetDefault("EVENTS_WEBHOOK_QUEUE_SIZE", events.DefaultQueueSize)
+	viper.SetDefault("SCHEDULER_INTERVAL", time.Second)
+	viper.SetDefault("STATEMENT_WORKERS", transactionmanager.DefaultStatementWorkers)
+	viper.SetDefault("STATEMENT_QUEUE_SIZE", transactionmanager.DefaultStatementQueueSize)
+	viper.SetDefault("STATEMENT_JOB_TTL", transactionmanager.DefaultStatementJobTTL)
+	viper.SetDefault("MAX_STATEMENT_JOBS", transactionmanager.DefaultMaxStatementJobs)
+	viper.SetDefault("RATE_LIMIT", api.DefaultRateLimit)
+	viper.SetDefault("RATE_BURST", api.DefaultRateBurst)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", api.DefaultShutdownTimeout)
+	viper.SetDefault("ALLOW_DEBITS", true)
+	viper.SetDefault("COMPRESSION_MIN_SIZE", api.DefaultCompressionMinSize)
+	viper.SetDefault("MAX_DECIMAL_PLACES", -1)
+	viper.SetDefault("MAX_FORWARD_SKEW", 5*time.Minute)
 
 	return Config{
 		DB: DBConfig{
@@ -96,11 +355,146 @@ func initConfig() Config {
 			SSLMode:  viper.GetString("PGSSLMODE"),
 		},
 		App: AppConfig{
-			Port: viper.GetString("PORT"),
+			Port:                    viper.GetString("PORT"),
+			GRPCPort:                viper.GetString("GRPC_PORT"),
+			JSONNaming:              viper.GetString("JSON_NAMING"),
+			AdminToken:              viper.GetString("ADMIN_TOKEN"),
+			MultiTenant:             viper.GetBool("MULTI_TENANT"),
+			AmountConvention:        viper.GetString("AMOUNT_CONVENTION"),
+			CompressionLevel:        parseCompressionLevel(viper.GetInt("COMPRESSION_LEVEL")),
+			CompressionMinSize:      viper.GetInt("COMPRESSION_MIN_SIZE"),
+			RequireIdempotencyKey:   viper.GetBool("REQUIRE_IDEMPOTENCY_KEY"),
+			AllowDebits:             viper.GetBool("ALLOW_DEBITS"),
+			OverdraftAccounts:       parseOverdraftAccounts(viper.GetString("OVERDRAFT_ACCOUNTS")),
+			OverdraftTolerance:      decimal.NewFromFloat(viper.GetFloat64("OVERDRAFT_TOLERANCE")),
+			AllowZeroAmount:         viper.GetBool("ALLOW_ZERO_AMOUNT"),
+			MaxConcurrentPerUser:    viper.GetInt("MAX_CONCURRENT_PER_USER"),
+			QueueConcurrentPerUser:  viper.GetBool("QUEUE_CONCURRENT_PER_USER"),
+			ReasonCodes:             strings.FieldsFunc(viper.GetString("REASON_CODES"), func(r rune) bool { return r == ',' }),
+			RecomputeChunkSize:      viper.GetInt("RECOMPUTE_CHUNK_SIZE"),
+			EstimateCountsFrom:      viper.GetInt64("ESTIMATE_COUNTS_FROM"),
+			MonotonicTimestamps:     viper.GetBool("MONOTONIC_TIMESTAMPS"),
+			DuplicateWindow:         viper.GetDuration("DUPLICATE_WINDOW"),
+			RejectDuplicates:        viper.GetBool("REJECT_DUPLICATES"),
+			CurrencyAmounts:         parseCurrencyAmounts(viper.GetString("CURRENCY_AMOUNT_LIMITS")),
+			MaxTransferAmount:       decimal.NewFromFloat(viper.GetFloat64("MAX_TRANSFER_AMOUNT")),
+			CreditCap:               decimal.NewFromFloat(viper.GetFloat64("CREDIT_CAP")),
+			FeePercent:              decimal.NewFromFloat(viper.GetFloat64("FEE_PERCENT")),
+			HoldPercent:             decimal.NewFromFloat(viper.GetFloat64("HOLD_PERCENT")),
+			HoldDuration:            viper.GetDuration("HOLD_DURATION"),
+			HoldSweepInterval:       viper.GetDuration("HOLD_SWEEP_INTERVAL"),
+			AddTimeout:              viper.GetDuration("ADD_TIMEOUT"),
+			ReturnExisting:          viper.GetBool("RETURN_EXISTING"),
+			ResponseReplayTTL:       viper.GetDuration("RESPONSE_REPLAY_TTL"),
+			RoundingMode:            parseRoundingMode(viper.GetString("ROUNDING_MODE")),
+			MaxDecimalPlaces:        viper.GetInt32("MAX_DECIMAL_PLACES"),
+			MaxBackdate:             viper.GetDuration("MAX_BACKDATE"),
+			MaxForwardSkew:          viper.GetDuration("MAX_FORWARD_SKEW"),
+			WebhookURL:              viper.GetString("WEBHOOK_URL"),
+			WebhookBackoff:          viper.GetDuration("WEBHOOK_BACKOFF"),
+			WebhookRetryInterval:    viper.GetDuration("WEBHOOK_RETRY_INTERVAL"),
+			EventsWebhookURL:        viper.GetString("EVENTS_WEBHOOK_URL"),
+			EventsWebhookSecret:     viper.GetString("EVENTS_WEBHOOK_SECRET"),
+			EventsWebhookTimeout:    viper.GetDuration("EVENTS_WEBHOOK_TIMEOUT"),
+			EventsWebhookMaxRetries: viper.GetInt("EVENTS_WEBHOOK_MAX_RETRIES"),
+			EventsWebhookBackoff:    viper.GetDuration("EVENTS_WEBHOOK_BACKOFF"),
+			EventsWebhookWorkers:    viper.GetInt("EVENTS_WEBHOOK_WORKERS"),
+			EventsWebhookQueueSize:  viper.GetInt("EVENTS_WEBHOOK_QUEUE_SIZE"),
+			SchedulerInterval:       viper.GetDuration("SCHEDULER_INTERVAL"),
+			StatementWorkers:        viper.GetInt("STATEMENT_WORKERS"),
+			StatementQueueSize:      viper.GetInt("STATEMENT_QUEUE_SIZE"),
+			StatementJobTTL:         viper.GetDuration("STATEMENT_JOB_TTL"),
+			MaxStatementJobs:        viper.GetInt("MAX_STATEMENT_JOBS"),
+			RateLimit:               viper.GetFloat64("RATE_LIMIT"),
+			RateBurst:               viper.GetInt("RATE_BURST"),
+			ShutdownTimeout:         viper.GetDuration("SHUTDOWN_TIMEOUT"),
+			LogLevel:                parseLogLevel(viper.GetString("LOG_LEVEL")),
 		},
 	}
 }
 
+// parseRoundingMode reads ROUNDING_MODE, defaulting to half_up
+func parseRoundingMode(value string) transactionmanager.RoundingMode {
+	mode, err := transactionmanager.ParseRoundingMode(value)
+	if err != nil {
+		log.Fatalf("Invalid ROUNDING_MODE: %v", err)
+	}
+	return mode
+}
+
+// parseLogLevel reads LOG_LEVEL, defaulting to info
+func parseLogLevel(value string) slog.Level {
+	var level slog.Level
+	if value == "" {
+		return level
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	return level
+}
+
+// parseCompressionLevel checks COMPRESSION_LEVEL is zero or a gzip level
+func parseCompressionLevel(level int) int {
+	if level != 0 && !api.ValidCompressionLevel(level) {
+		log.Fatalf("Invalid COMPRESSION_LEVEL %d, expected 1 to 9 or 0 to turn compression off", level)
+	}
+	return level
+}
+
+// parseOverdraftAccounts reads user IDs separated by commas
+func parseOverdraftAccounts(value string) []uuid.UUID {
+	var userIDs []uuid.UUID
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' }) {
+		userID, err := uuid.Parse(strings.TrimSpace(entry))
+		if err != nil {
+			log.Fatalf("Invalid OVERDRAFT_ACCOUNTS entry %q: %v", entry, err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// parseCurrencyAmounts reads amount limits like "USD:1:10000,JPY:100:1000000".
+// A zero minimum or maximum leaves that side unlimited.
+func parseCurrencyAmounts(value string) map[string]transactionmanager.AmountLimits {
+	limits := map[string]transactionmanager.AmountLimits{}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' }) {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 {
+			log.Fatalf("Invalid CURRENCY_AMOUNT_LIMITS entry %q, expected CODE:MIN:MAX", entry)
+		}
+		minAmount, err := decimal.NewFromString(parts[1])
+		if err != nil {
+			log.Fatalf("Invalid minimum in CURRENCY_AMOUNT_LIMITS entry %q: %v", entry, err)
+		}
+		maxAmount, err := decimal.NewFromString(parts[2])
+		if err != nil {
+			log.Fatalf("Invalid maximum in CURRENCY_AMOUNT_LIMITS entry %q: %v", entry, err)
+		}
+		limits[strings.ToUpper(parts[0])] = transactionmanager.AmountLimits{MinAmount: minAmount, MaxAmount: maxAmount}
+	}
+	return limits
+}
+
+// parseExchangeRates reads exchange rates like "USD/EUR:0.92,USD/JPY:151.2"
+func parseExchangeRates(value string) transactionmanager.StaticRates {
+	rates := transactionmanager.StaticRates{}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' }) {
+		pair, rateValue, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		from, to, isPair := strings.Cut(pair, "/")
+		if !ok || !isPair {
+			log.Fatalf("Invalid EXCHANGE_RATES entry %q, expected FROM/TO:RATE", entry)
+		}
+		rate, err := decimal.NewFromString(rateValue)
+		if err != nil || !rate.IsPositive() {
+			log.Fatalf("Invalid rate in EXCHANGE_RATES entry %q, expected a positive number", entry)
+		}
+		rates[strings.ToUpper(from)+"/"+strings.ToUpper(to)] = rate
+	}
+	return rates
+}
+
 func connectToDatabase(dBConfig DBConfig) (*sql.DB, error) {
 	connectionString := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// GetUserLimits returns the limit overrides of a user
+func (c *Controller) GetUserLimits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	limits, err := c.transactionmanager.GetUserLimits(ctx, userID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, limits)
+}
+
+// SetUserLimits replaces the limit overrides of a user. Fields left out or
+// set to null fall back to the global limits.
+func (c *Controller) SetUserLimits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var limits transactionmanager.UserLimits
+	if err := decodeJSON(r, &limits); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limits, err = c.transactionmanager.SetUserLimits(ctx, userID, limits)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, limits)
+}
+
+// AdjustBalanceRequest is the request body for adjusting a user's balance by
+// hand
+type AdjustBalanceRequest struct {
+	// Amount is signed, negative to take money off the balance
+	Amount   float64 `json:"amount"`
+	Operator string  `json:"operator"`
+	Reason   string  `json:"reason"`
+	// IdempotencyKey is either a UUID or a printable ASCII string of at most
+	// 255 characters
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// AdjustBalance books a manual adjustment of a user's balance together with
+// an audit entry of who made it and why, and returns both with 201 Created
+func (c *Controller) AdjustBalance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var adjustBalanceRequest AdjustBalanceRequest
+	if err := decodeJSON(r, &adjustBalanceRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey, err := c.writeIdempotencyKey(adjustBalanceRequest.IdempotencyKey)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adjustment, err := c.transactionmanager.AdjustBalance(ctx, userID, decimal.NewFromFloat(adjustBalanceRequest.Amount), idempotencyKey, adjustBalanceRequest.Operator, adjustBalanceRequest.Reason)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, adjustment)
+}
+
+// DeleteTransaction soft deletes a transaction, voiding it, and returns it
+// with its deleted_at
+func (c *Controller) DeleteTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := c.transactionmanager.DeleteTransaction(ctx, transactionID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, deleted)
+}
+
+// GetAuditEntries lists the audit entries of a user's manual adjustments,
+// oldest first
+func (c *Controller) GetAuditEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := c.transactionmanager.GetAuditEntries(ctx, userID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, entries)
+}
+
+const (
+	defaultReportPageSize = 100
+	maxReportPageSize     = 1000
+)
+
+// GetReconciliationReport lists users whose stored balance disagrees with
+// the sum of their transactions. Pass the returned next_cursor as ?after= to
+// fetch the next page.
+func (c *Controller) GetReconciliationReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	after := uuid.Nil
+	if value := r.URL.Query().Get("after"); value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid cursor %v", err), http.StatusBadRequest)
+			return
+		}
+		after = parsed
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultReportPageSize
+	}
+	if limit > maxReportPageSize {
+		limit = maxReportPageSize
+	}
+
+	report, err := c.transactionmanager.GetReconciliationReport(ctx, after, limit)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, report)
+}
+
+// GetOrphanedTransactions lists transactions whose user doesn't exist, in ID
+// order. Pass the returned next_cursor as ?after= to fetch the next page.
+func (c *Controller) GetOrphanedTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	after := uuid.Nil
+	if value := r.URL.Query().Get("after"); value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid cursor %v", err), http.StatusBadRequest)
+			return
+		}
+		after = parsed
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultReportPageSize
+	}
+	if limit > maxReportPageSize {
+		limit = maxReportPageSize
+	}
+
+	report, err := c.transactionmanager.GetOrphanedTransactions(ctx, after, limit)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, report)
+}
+
+const (
+	defaultRecentUsers = 20
+	maxRecentUsers     = 100
+)
+
+// GetRecentUsers lists the most recently created users, newest first.
+// ?limit= is clamped to between 1 and 100 and defaults to 20.
+func (c *Controller) GetRecentUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultRecentUsers
+	}
+	if limit > maxRecentUsers {
+		limit = maxRecentUsers
+	}
+
+	users, err := c.transactionmanager.GetRecentUsers(ctx, limit)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, users)
+}
+
+// MutationResult is shared by the admin endpoints that change many rows at
+// once, so operators can tell how much an operation actually changed
+type MutationResult struct {
+	Affected int `json:"affected"`
+}
+
+// RecomputeResponse reports a balance recompute. Affected is the number of
+// users whose balance was corrected.
+type RecomputeResponse struct {
+	MutationResult
+	transactionmanager.RecomputeProgress
+}
+
+// RecomputeBalances rebuilds stored balances from the transactions, for the
+// user given by ?user_id= or for every user when it is left out. Users are
+// processed ?batch_size= at a time and progress is logged after each batch.
+func (c *Controller) RecomputeBalances(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID := uuid.Nil
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+			return
+		}
+		userID = parsed
+	}
+
+	batchSize, err := strconv.Atoi(r.URL.Query().Get("batch_size"))
+	if err != nil || batchSize < 1 {
+		batchSize = transactionmanager.DefaultRecomputeBatchSize
+	}
+
+	result, err := c.transactionmanager.RecomputeBalances(ctx, userID, batchSize, func(progress transactionmanager.RecomputeProgress) {
+		log.Printf("recompute balances : processed %d users, corrected %d", progress.Processed, progress.Corrected)
+	})
+	if err != nil {
+		httpError(w, fmt.Sprintf("Recompute stopped after %d users: %v", result.Processed, err), errorStatusCode(err))
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, RecomputeResponse{
+		MutationResult:    MutationResult{Affected: result.Corrected},
+		RecomputeProgress: result,
+	})
+}
+
+// csvFlushEvery is how many exported rows are written between flushes
+const csvFlushEvery = 100
+
+// ExportBalancesCSV streams every user's balance as CSV with a
+// user_id,balance,currency header, writing rows as the users are read
+func (c *Controller) ExportBalancesCSV(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	writer := csv.NewWriter(w)
+
+	// The header goes out with the first row, so a failure before any user
+	// was read can still be reported with a proper status
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		return writer.Write([]string{"user_id", "balance", "currency"})
+	}
+
+	written := 0
+	err := c.transactionmanager.StreamUserBalances(r.Context(), func(user transactionmanager.User) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := writer.Write([]string{user.ID.String(), user.Balance.String(), user.Currency}); err != nil {
+			return err
+		}
+
+		written++
+		if written%csvFlushEvery == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	})
+
+	if err != nil && !started {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The status line is already sent, all we can do is cut the export short
+		log.Printf("exporting balances: %v", err)
+		return
+	}
+	if !started {
+		start()
+	}
+	writer.Flush()
+}
+
+const (
+	defaultWebhookDeliveries = 50
+	maxWebhookDeliveries     = 500
+)
+
+// GetWebhookDeliveries lists webhook deliveries, newest first. ?status= is
+// pending, delivered or failed and lists every delivery when left out.
+// ?limit= is clamped to between 1 and 500 and defaults to 50.
+func (c *Controller) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	status := transactionmanager.WebhookDeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", transactionmanager.WebhookDeliveryPending, transactionmanager.WebhookDeliveryDelivered, transactionmanager.WebhookDeliveryFailed:
+	default:
+		httpError(w, fmt.Sprintf("Invalid status %q, expected pending, delivered or failed", status), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultWebhookDeliveries
+	}
+	if limit > maxWebhookDeliveries {
+		limit = maxWebhookDeliveries
+	}
+
+	deliveries, err := c.transactionmanager.GetWebhookDeliveries(ctx, status, limit)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// WebhookRetryResponse reports a retry of the failed webhook deliveries.
+// Affected is the number of failed deliveries that were retried.
+type WebhookRetryResponse struct {
+	MutationResult
+	// Delivered is the number of deliveries that got through, including
+	// pending ones that happened to be due
+	Delivered int `json:"delivered"`
+}
+
+// RetryWebhookDeliveries posts every failed webhook delivery again right away
+func (c *Controller) RetryWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	result, err := c.transactionmanager.RetryWebhookDeliveries(ctx)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, WebhookRetryResponse{
+		MutationResult: MutationResult{Affected: int(result.Retried)},
+		Delivered:      result.Delivered,
+	})
+}
@@ -0,0 +1,656 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	adminToken          = "test-admin-token"
+	UserLimitsTemplate  = "/admin/users/%s/limits"
+	ReconciliationPath  = "/admin/reconciliation-report"
+	RecomputePath       = "/admin/recompute-balances%s"
+	BalancesCSVPath     = "/admin/balances.csv"
+	RecentUsersPath     = "/admin/users/recent%s"
+	OrphansPath         = "/admin/orphaned-transactions%s"
+	AdjustmentsTemplate = "/admin/users/%s/adjustments"
+	AuditTemplate       = "/admin/users/%s/audit"
+	WebhooksPath        = "/admin/webhooks%s"
+	WebhookRetryPath    = "/admin/webhooks/retry"
+)
+
+func TestUserLimitsEndpoints(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	// Without the admin token the request is rejected
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf(UserLimitsTemplate, user.ID), bytes.NewBufferString(`{"max_amount":500}`))
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// With the admin token the limits are stored
+	req, _ = http.NewRequest(http.MethodPut, fmt.Sprintf(UserLimitsTemplate, user.ID), bytes.NewBufferString(`{"max_amount":500}`))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(UserLimitsTemplate, user.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var limits transactionmanager.UserLimits
+	err = json.Unmarshal(rr.Body.Bytes(), &limits)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.NotNil(t, limits.MaxAmount) {
+		assert.True(t, limits.MaxAmount.Equal(decimal.NewFromFloat(500)))
+	}
+	assert.Nil(t, limits.DailyLimit)
+	assert.Nil(t, limits.AllowNegative)
+}
+
+func TestReconciliationReportEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	consistentUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	corruptedUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{consistentUser, corruptedUser} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(100),
+			CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	// Corrupt one balance behind the ledger's back
+	_, err = testEnv.DB.ExecContext(testEnv.Context, "UPDATE users SET balance = 130 WHERE id = $1", corruptedUser.ID)
+	if err != nil {
+		t.Fatalf("failed to corrupt balance: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	req, _ := http.NewRequest(http.MethodGet, ReconciliationPath, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var report transactionmanager.ReconciliationReport
+	err = json.Unmarshal(rr.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	if assert.Equal(t, 1, len(report.Mismatches)) {
+		mismatch := report.Mismatches[0]
+		assert.Equal(t, corruptedUser.ID, mismatch.UserID)
+		assert.True(t, mismatch.StoredBalance.Equal(decimal.NewFromFloat(130)))
+		assert.True(t, mismatch.ComputedBalance.Equal(decimal.NewFromFloat(100)))
+		assert.True(t, mismatch.Discrepancy.Equal(decimal.NewFromFloat(30)))
+	}
+	assert.Nil(t, report.NextCursor)
+}
+
+func TestRecomputeBalancesEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	var users []storage.User
+	for i := 0; i < 3; i++ {
+		user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(100),
+			CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	// Corrupt the balances of the first two users
+	for _, user := range users[:2] {
+		_, err = testEnv.DB.ExecContext(testEnv.Context, "UPDATE users SET balance = 42 WHERE id = $1", user.ID)
+		if err != nil {
+			t.Fatalf("failed to corrupt balance: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	recomputeBalances := func(query string) (int, api.RecomputeResponse) {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(RecomputePath, query), nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var result api.RecomputeResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+		}
+		return rr.Code, result
+	}
+
+	// A single user
+	code, result := recomputeBalances("?user_id=" + users[0].ID.String())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, transactionmanager.RecomputeProgress{Processed: 1, Corrected: 1}, result.RecomputeProgress)
+	assert.Equal(t, 1, result.Affected)
+
+	// Everyone, in batches smaller than the number of users
+	code, result = recomputeBalances("?batch_size=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, transactionmanager.RecomputeProgress{Processed: 3, Corrected: 1}, result.RecomputeProgress)
+	assert.Equal(t, 1, result.Affected)
+
+	for _, user := range users {
+		balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+		assert.Nil(t, err)
+		assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+	}
+
+	code, _ = recomputeBalances("?user_id=" + uuid.New().String())
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestExportBalancesCSVEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	users := []storage.User{
+		{ID: uuid.MustParse("00000000-0000-0000-0000-000000000001"), Balance: decimal.NewFromFloat(10)},
+		{ID: uuid.MustParse("00000000-0000-0000-0000-000000000002"), Balance: decimal.NewFromFloat(25.5), Currency: "EUR"},
+	}
+	for _, user := range users {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	req, _ := http.NewRequest(http.MethodGet, BalancesCSVPath, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read CSV: %v", err)
+	}
+	assert.Equal(t, [][]string{
+		{"user_id", "balance", "currency"},
+		{users[0].ID.String(), "10", ""},
+		{users[1].ID.String(), "25.5", "EUR"},
+	}, records)
+
+	// The export is admin only
+	req, _ = http.NewRequest(http.MethodGet, BalancesCSVPath, nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestGetRecentUsersEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	// Added out of creation order, so the listing can't just follow inserts
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := make([]storage.User, 4)
+	for _, i := range []int{2, 0, 3, 1} {
+		users[i] = storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0), CreatedAt: start.Add(time.Duration(i) * time.Hour)}
+		err = storageClient.UserRepository.Add(testEnv.Context, users[i])
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	list := func(query string) []transactionmanager.User {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(RecentUsersPath, query), nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var recent []transactionmanager.User
+		if err := json.Unmarshal(rr.Body.Bytes(), &recent); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return recent
+	}
+
+	recent := list("")
+	if assert.Len(t, recent, 4) {
+		for i, user := range recent {
+			assert.Equal(t, users[3-i].ID, user.ID)
+			assert.True(t, users[3-i].CreatedAt.Equal(user.CreatedAt), "got %s", user.CreatedAt)
+		}
+	}
+
+	recent = list("?limit=2")
+	if assert.Len(t, recent, 2) {
+		assert.Equal(t, users[3].ID, recent[0].ID)
+		assert.Equal(t, users[2].ID, recent[1].ID)
+	}
+
+	// Out of range limits are clamped rather than rejected
+	assert.Len(t, list("?limit=0"), 4)
+	assert.Len(t, list("?limit=1000"), 4)
+}
+
+func TestGetOrphanedTransactionsEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(10),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// Insert orphans with the foreign key checks switched off for the
+	// database transaction
+	orphanIDs := []uuid.UUID{
+		uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+	}
+	tx, err := testEnv.DB.BeginTx(testEnv.Context, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	_, err = tx.ExecContext(testEnv.Context, "SET LOCAL session_replication_role = replica")
+	if err != nil {
+		t.Fatalf("failed to disable foreign keys: %v", err)
+	}
+	for i, id := range orphanIDs {
+		_, err = tx.ExecContext(testEnv.Context, "INSERT INTO transactions (id, user_id, amount, created_at, idempotency_key, sequence) VALUES ($1, $2, $3, $4, $5, 1)",
+			id, uuid.New(), 5*(i+1), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), uuid.New())
+		if err != nil {
+			t.Fatalf("failed to insert orphan: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	list := func(query string) transactionmanager.OrphanedTransactionsReport {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(OrphansPath, query), nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var report transactionmanager.OrphanedTransactionsReport
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return report
+	}
+
+	// The user's own transaction isn't listed
+	report := list("")
+	if assert.Len(t, report.Transactions, 2) {
+		assert.Equal(t, orphanIDs[0], report.Transactions[0].ID)
+		assert.Equal(t, orphanIDs[1], report.Transactions[1].ID)
+	}
+	assert.Nil(t, report.NextCursor)
+
+	// One per page
+	report = list("?limit=1")
+	if assert.Len(t, report.Transactions, 1) && assert.NotNil(t, report.NextCursor) {
+		assert.Equal(t, orphanIDs[0], report.Transactions[0].ID)
+		report = list("?limit=1&after=" + report.NextCursor.String())
+		if assert.Len(t, report.Transactions, 1) {
+			assert.Equal(t, orphanIDs[1], report.Transactions[0].ID)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(OrphansPath, "?after=nope"), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAdjustBalanceEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(50),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	adjust := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AdjustmentsTemplate, user.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := adjust(`{"amount":-20, "operator":"alice", "reason":"chargeback correction", "idempotency_key":"ticket-1"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var adjustment transactionmanager.Adjustment
+	err = json.Unmarshal(rr.Body.Bytes(), &adjustment)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.True(t, adjustment.Transaction.Amount.Equal(decimal.NewFromFloat(-20)))
+	assert.Equal(t, "ADJUSTMENT", adjustment.Transaction.ReasonCode)
+	assert.Equal(t, adjustment.Transaction.ID, adjustment.Audit.TransactionID)
+	assert.Equal(t, user.ID, adjustment.Audit.UserID)
+	assert.Equal(t, "alice", adjustment.Audit.Operator)
+	assert.Equal(t, "chargeback correction", adjustment.Audit.Reason)
+	assert.True(t, adjustment.Audit.BalanceBefore.Equal(decimal.NewFromFloat(50)))
+	assert.True(t, adjustment.Audit.BalanceAfter.Equal(decimal.NewFromFloat(30)))
+
+	// The audit entry links to the transaction that booked the adjustment
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(AuditTemplate, user.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var entries []transactionmanager.AuditEntry
+	err = json.Unmarshal(rr.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, adjustment.Audit.ID, entries[0].ID)
+		linked, err := transactionManager.GetTransaction(testEnv.Context, entries[0].TransactionID)
+		assert.Nil(t, err)
+		assert.True(t, linked.Amount.Equal(decimal.NewFromFloat(-20)))
+	}
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(30)))
+
+	// A retry with the same key doesn't adjust or audit twice
+	rr = adjust(`{"amount":-20, "operator":"alice", "reason":"chargeback correction", "idempotency_key":"ticket-1"}`)
+	assert.NotEqual(t, http.StatusCreated, rr.Code)
+
+	entries, err = transactionManager.GetAuditEntries(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// Adjustments must say who made them and why
+	rr = adjust(`{"amount":5, "reason":"goodwill"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = adjust(`{"amount":5, "operator":"alice"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestWebhookDeliveriesEndpoints(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	// The endpoint fails the first two posts
+	var mu sync.Mutex
+	var receivedIDs []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		receivedIDs = append(receivedIDs, r.Header.Get("Webhook-ID"))
+		if len(receivedIDs) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithWebhooks(endpoint.URL, time.Hour))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(10),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	getDeliveries := func(query string) []transactionmanager.WebhookDelivery {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(WebhooksPath, query), nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var deliveries []transactionmanager.WebhookDelivery
+		if err := json.Unmarshal(rr.Body.Bytes(), &deliveries); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return deliveries
+	}
+	retry := func() api.WebhookRetryResponse {
+		req, _ := http.NewRequest(http.MethodPost, WebhookRetryPath, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var result api.WebhookRetryResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return result
+	}
+
+	// The first attempt fails and is put off by the backoff
+	delivered, err := transactionManager.DeliverWebhooks(testEnv.Context)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+
+	failed := getDeliveries("?status=failed")
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, transactionmanager.EventTransactionCreated, failed[0].Event)
+		assert.Equal(t, 1, failed[0].Attempts)
+		assert.NotEmpty(t, failed[0].LastError)
+
+		var payload transactionmanager.Transaction
+		assert.NoError(t, json.Unmarshal(failed[0].Payload, &payload))
+		assert.Equal(t, transaction.ID, payload.ID)
+		// Written with the transaction, so it carries what the insert set
+		assert.Equal(t, transaction.Sequence, payload.Sequence)
+		assert.True(t, transaction.BalanceAfter.Equal(payload.BalanceAfter), "got %s", payload.BalanceAfter)
+	}
+
+	delivered, err = transactionManager.DeliverWebhooks(testEnv.Context)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered, "a failed delivery should wait out its backoff")
+
+	// Retrying skips the backoff, failing once more and then getting through
+	assert.Equal(t, api.WebhookRetryResponse{MutationResult: api.MutationResult{Affected: 1}, Delivered: 0}, retry())
+	assert.Equal(t, api.WebhookRetryResponse{MutationResult: api.MutationResult{Affected: 1}, Delivered: 1}, retry())
+	assert.Equal(t, api.WebhookRetryResponse{MutationResult: api.MutationResult{Affected: 0}, Delivered: 0}, retry())
+
+	assert.Empty(t, getDeliveries("?status=failed"))
+	deliveredDeliveries := getDeliveries("?status=delivered")
+	if assert.Len(t, deliveredDeliveries, 1) {
+		assert.Equal(t, 3, deliveredDeliveries[0].Attempts)
+		assert.NotNil(t, deliveredDeliveries[0].DeliveredAt)
+		assert.Empty(t, deliveredDeliveries[0].LastError)
+
+		// Every attempt carries the same ID for the endpoint to dedupe on
+		mu.Lock()
+		assert.Equal(t, []string{
+			deliveredDeliveries[0].ID.String(),
+			deliveredDeliveries[0].ID.String(),
+			deliveredDeliveries[0].ID.String(),
+		}, receivedIDs)
+		mu.Unlock()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(WebhooksPath, "?status=lost"), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// AmountConvention selects how request amounts express credits and debits
+type AmountConvention int
+
+const (
+	// SignedAmounts takes positive amounts as credits and negative amounts
+	// as debits
+	SignedAmounts AmountConvention = iota
+	// DirectionAmounts takes amounts as always positive, with a separate
+	// direction of either credit or debit
+	DirectionAmounts
+)
+
+var (
+	errCurrencyRequired = errors.New("currency is required with amount_minor")
+	errAmountMismatch   = errors.New("amount and amount_minor disagree")
+	errAmountNegative   = errors.New("amount must not be negative when a direction is given")
+	errInvalidDirection = errors.New("direction must be credit or debit")
+)
+
+// requestAmount returns the amount of a request, which is either given as a
+// decimal amount or as amount_minor in the minor units of currency. When both
+// are given they must agree.
+func requestAmount(amount *float64, amountMinor *int64, currency string) (decimal.Decimal, error) {
+	if amountMinor == nil {
+		if amount == nil {
+			return decimal.Zero, nil
+		}
+		return decimal.NewFromFloat(*amount), nil
+	}
+
+	if currency == "" {
+		return decimal.Decimal{}, errCurrencyRequired
+	}
+
+	derived, err := transactionmanager.AmountFromMinor(*amountMinor, currency)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	if amount != nil && !decimal.NewFromFloat(*amount).Equal(derived) {
+		return decimal.Decimal{}, errAmountMismatch
+	}
+
+	return derived, nil
+}
+
+// signedAmount converts a request amount to the signed amount the ledger
+// stores, following the controller's amount convention. The direction is
+// ignored for signed amounts.
+func (c *Controller) signedAmount(amount decimal.Decimal, direction string) (decimal.Decimal, error) {
+	if c.amountConvention != DirectionAmounts {
+		return amount, nil
+	}
+
+	if amount.IsNegative() {
+		return decimal.Decimal{}, errAmountNegative
+	}
+
+	switch transactionmanager.TransactionType(direction) {
+	case transactionmanager.TransactionTypeCredit:
+		return amount, nil
+	case transactionmanager.TransactionTypeDebit:
+		return amount.Neg(), nil
+	default:
+		return decimal.Decimal{}, errInvalidDirection
+	}
+}
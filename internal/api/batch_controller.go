@@ -0,0 +1,236 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// maxBatchTransactions caps how many transactions one batch may create
+const maxBatchTransactions = 100
+
+// maxImportTransactions caps how many transactions of one user a single
+// import may insert
+const maxImportTransactions = 1000
+
+// CreateBatchRequest is the request body for adding several transactions
+// under one batch ID
+type CreateBatchRequest struct {
+	Transactions []BatchTransactionRequest `json:"transactions"`
+}
+
+// BatchTransactionRequest is one transaction of a batch, taking the same
+// fields as AddTransactionRequest plus the user it is for
+type BatchTransactionRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+	AddTransactionRequest
+}
+
+// CreateBatch adds all the transactions of the request, or none of them,
+// under a new batch ID
+func (c *Controller) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var createBatchRequest CreateBatchRequest
+	if err := decodeJSON(r, &createBatchRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(createBatchRequest.Transactions) > maxBatchTransactions {
+		httpError(w, fmt.Sprintf("At most %d transactions can be added in one batch", maxBatchTransactions), http.StatusBadRequest)
+		return
+	}
+
+	transactions := make([]transactionmanager.Transaction, 0, len(createBatchRequest.Transactions))
+	for i, request := range createBatchRequest.Transactions {
+		idempotencyKey, err := c.writeIdempotencyKey(request.IdempotencyKey)
+		if err != nil {
+			httpError(w, fmt.Sprintf("transaction %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+
+		amount, err := requestAmount(request.Amount, request.AmountMinor, request.Currency)
+		if err != nil {
+			httpError(w, fmt.Sprintf("transaction %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+
+		amount, err = c.signedAmount(amount, request.Direction)
+		if err != nil {
+			httpError(w, fmt.Sprintf("transaction %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+
+		transactions = append(transactions, transactionmanager.Transaction{
+			UserID:         request.UserID,
+			Amount:         amount,
+			ID:             uuid.New(),
+			IdempotencyKey: idempotencyKey,
+			ReasonCode:     request.ReasonCode,
+			Currency:       request.Currency,
+			CreatedAt:      requestCreatedAt(request.CreatedAt),
+		})
+	}
+
+	batch, err := c.transactionmanager.AddTransactionBatch(ctx, transactions)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, batch)
+}
+
+// AddUserTransactions imports a JSON array of the user's transactions, taking
+// the same fields as AddTransactionRequest, in one insert. Either all of them
+// are added, answered with 201 Created and the stored transactions, or none.
+// Errors name the index of the transaction that failed, and one repeating an
+// idempotency key gets 409 Conflict.
+//
+// With a mode query parameter, atomic or partial, the response is instead a
+// report with the outcome of every transaction: 201 Created when none was
+// invalid, 207 Multi-Status when the valid ones were added without the
+// invalid ones, or 422 Unprocessable Entity when nothing was added because
+// of them. Transactions repeating an idempotency key are reported as
+// duplicates rather than failing the import.
+func (c *Controller) AddUserTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %s", err), http.StatusBadRequest)
+		return
+	}
+
+	mode := transactionmanager.ImportMode(r.URL.Query().Get("mode"))
+	if mode != "" && mode != transactionmanager.ImportAtomic && mode != transactionmanager.ImportPartial {
+		httpError(w, fmt.Sprintf("Invalid mode %q, expected atomic or partial", mode), http.StatusBadRequest)
+		return
+	}
+
+	var requests []AddTransactionRequest
+	if err := decodeJSON(r, &requests); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requests) > maxImportTransactions {
+		httpError(w, fmt.Sprintf("At most %d transactions can be imported at once", maxImportTransactions), http.StatusBadRequest)
+		return
+	}
+
+	if mode != "" {
+		c.importUserTransactions(w, r, userID, requests, mode)
+		return
+	}
+
+	transactions := make([]transactionmanager.Transaction, 0, len(requests))
+	for i, request := range requests {
+		transaction, err := c.importTransaction(userID, request)
+		if err != nil {
+			httpError(w, fmt.Sprintf("transaction %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	added, err := c.transactionmanager.AddUserTransactions(ctx, userID, transactions)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, added)
+}
+
+// BackfillUserTransactions imports the user's transactions like
+// AddUserTransactions, but they may be dated before the manager's
+// backdating window, for loading history. It is only served under /admin.
+func (c *Controller) BackfillUserTransactions(w http.ResponseWriter, r *http.Request) {
+	c.AddUserTransactions(w, r.WithContext(transactionmanager.WithBackfill(r.Context())))
+}
+
+func (c *Controller) importUserTransactions(w http.ResponseWriter, r *http.Request, userID uuid.UUID, requests []AddTransactionRequest, mode transactionmanager.ImportMode) {
+	// Transactions that can't be parsed are reported with the invalid ones
+	rows := make([]transactionmanager.ImportRow, 0, len(requests))
+	for _, request := range requests {
+		transaction, err := c.importTransaction(userID, request)
+		rows = append(rows, transactionmanager.ImportRow{Transaction: transaction, Err: err})
+	}
+
+	report, err := c.transactionmanager.ImportUserTransactions(r.Context(), userID, rows, mode)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	switch {
+	case report.Invalid > 0 && report.Committed:
+		status = http.StatusMultiStatus
+	case report.Invalid > 0:
+		status = http.StatusUnprocessableEntity
+	}
+	c.respondWithJSON(w, status, report)
+}
+
+// importTransaction parses one transaction of an import for the user
+func (c *Controller) importTransaction(userID uuid.UUID, request AddTransactionRequest) (transactionmanager.Transaction, error) {
+	idempotencyKey, err := c.writeIdempotencyKey(request.IdempotencyKey)
+	if err != nil {
+		return transactionmanager.Transaction{}, err
+	}
+
+	amount, err := requestAmount(request.Amount, request.AmountMinor, request.Currency)
+	if err != nil {
+		return transactionmanager.Transaction{}, err
+	}
+
+	amount, err = c.signedAmount(amount, request.Direction)
+	if err != nil {
+		return transactionmanager.Transaction{}, err
+	}
+
+	return transactionmanager.Transaction{
+		UserID:         userID,
+		Amount:         amount,
+		ID:             uuid.New(),
+		IdempotencyKey: idempotencyKey,
+		ReasonCode:     request.ReasonCode,
+		Currency:       request.Currency,
+		CreatedAt:      requestCreatedAt(request.CreatedAt),
+	}, nil
+}
+
+// requestCreatedAt returns the created_at a transaction was sent with, or
+// the zero time for the manager to stamp it
+func requestCreatedAt(createdAt *time.Time) time.Time {
+	if createdAt == nil {
+		return time.Time{}
+	}
+	return createdAt.UTC()
+}
+
+// GetBatch returns the transactions of a batch with their total
+func (c *Controller) GetBatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	batchID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid batch ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	batch, err := c.transactionmanager.GetBatch(r.Context(), batchID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, batch)
+}
@@ -0,0 +1,369 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	BatchesPath        = "/batches"
+	BatchTemplate      = "/batches/%s"
+	UserImportTemplate = "/users/%s/transactions/batch"
+	BackfillTemplate   = "/admin/users/%s/transactions/backfill"
+)
+
+func TestBatchEndpoints(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}))
+
+	alice := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	bob := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{alice, bob} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	amount := func(value float64) *float64 { return &value }
+	post := func(request api.CreateBatchRequest) (int, transactionmanager.Batch) {
+		encoded, _ := json.Marshal(request)
+		req, _ := http.NewRequest(http.MethodPost, BatchesPath, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var batch transactionmanager.Batch
+		json.Unmarshal(rr.Body.Bytes(), &batch)
+		return rr.Code, batch
+	}
+
+	code, created := post(api.CreateBatchRequest{Transactions: []api.BatchTransactionRequest{
+		{UserID: alice.ID, AddTransactionRequest: api.AddTransactionRequest{Amount: amount(100)}},
+		{UserID: bob.ID, AddTransactionRequest: api.AddTransactionRequest{Amount: amount(250)}},
+		{UserID: alice.ID, AddTransactionRequest: api.AddTransactionRequest{Amount: amount(-20)}},
+	}})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, created.Total.Equal(decimal.NewFromFloat(330)))
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(BatchTemplate, created.ID), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var batch transactionmanager.Batch
+	err = json.Unmarshal(rr.Body.Bytes(), &batch)
+	assert.Nil(t, err)
+	assert.Equal(t, created.ID, batch.ID)
+	assert.Len(t, batch.Transactions, 3)
+	assert.True(t, batch.Total.Equal(decimal.NewFromFloat(330)))
+	for _, transaction := range batch.Transactions {
+		if assert.NotNil(t, transaction.BatchID) {
+			assert.Equal(t, created.ID, *transaction.BatchID)
+		}
+	}
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, alice.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(80)))
+
+	// One invalid transaction rejects the whole batch
+	code, _ = post(api.CreateBatchRequest{Transactions: []api.BatchTransactionRequest{
+		{UserID: bob.ID, AddTransactionRequest: api.AddTransactionRequest{Amount: amount(10)}},
+		{UserID: uuid.New(), AddTransactionRequest: api.AddTransactionRequest{Amount: amount(10)}},
+	}})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	balance, err = transactionManager.GetUserBalance(testEnv.Context, bob.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(250)))
+
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(BatchTemplate, uuid.New()), nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAddUserTransactionsEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	post := func(requests []api.AddTransactionRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(requests)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(UserImportTemplate, user.ID), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+	request := func(amount float64, key string) api.AddTransactionRequest {
+		return api.AddTransactionRequest{Amount: &amount, IdempotencyKey: key}
+	}
+
+	repeatedKey := uuid.New().String()
+	rr := post([]api.AddTransactionRequest{
+		request(100, repeatedKey),
+		request(-30, uuid.New().String()),
+		request(20, uuid.New().String()),
+	})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var added []transactionmanager.Transaction
+	if err := json.Unmarshal(rr.Body.Bytes(), &added); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.Len(t, added, 3) {
+		for i, balanceAfter := range []float64{100, 70, 90} {
+			assert.Equal(t, int64(i+1), added[i].Sequence)
+			assert.True(t, added[i].BalanceAfter.Equal(decimal.NewFromFloat(balanceAfter)), "balance after %d: %s", i, added[i].BalanceAfter)
+		}
+	}
+
+	// The second transaction repeats a stored key, so nothing is written
+	rr = post([]api.AddTransactionRequest{
+		request(5, uuid.New().String()),
+		request(100, repeatedKey),
+	})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "transaction 1")
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, balance.Equal(decimal.NewFromFloat(90)), "got %s", balance)
+}
+
+func TestAddUserTransactionsEndpoint_Backfill(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithMaxBackdate(30*24*time.Hour), transactionmanager.WithMaxForwardSkew(5*time.Minute))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithAdminToken(adminToken))
+
+	send := func(template, token, query string, createdAt time.Time) *httptest.ResponseRecorder {
+		amount := 10.0
+		body, _ := json.Marshal([]api.AddTransactionRequest{{Amount: &amount, IdempotencyKey: uuid.New().String(), CreatedAt: &createdAt}})
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(template, user.ID)+query, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+	post := func(query string, createdAt time.Time) *httptest.ResponseRecorder {
+		return send(UserImportTemplate, "", query, createdAt)
+	}
+
+	// Within the window the client's timestamp is kept
+	lastWeek := time.Now().UTC().Add(-7 * 24 * time.Hour).Truncate(time.Microsecond)
+	rr := post("", lastWeek)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var added []transactionmanager.Transaction
+	if err := json.Unmarshal(rr.Body.Bytes(), &added); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.Len(t, added, 1) {
+		assert.True(t, added[0].CreatedAt.Equal(lastWeek), "got %s", added[0].CreatedAt)
+	}
+
+	// Years ago is refused unless the import is a backfill
+	yearsAgo := time.Now().UTC().AddDate(-3, 0, 0)
+	rr = post("", yearsAgo)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "backdating window")
+
+	rr = post("?mode=atomic", yearsAgo)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// Backfills need the admin token
+	rr = post("?allow_backfill=true", yearsAgo)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = send(BackfillTemplate, "", "", yearsAgo)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = send(BackfillTemplate, adminToken, "", yearsAgo)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// Nothing can be dated beyond the forward skew, backfill or not
+	nextWeek := time.Now().UTC().Add(7 * 24 * time.Hour)
+	rr = post("", nextWeek)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "future")
+
+	rr = send(BackfillTemplate, adminToken, "", nextWeek)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, balance.Equal(decimal.NewFromFloat(20)), "got %s", balance)
+}
+
+func TestAddUserTransactionsEndpoint_Modes(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	request := func(amount float64, key string) api.AddTransactionRequest {
+		return api.AddTransactionRequest{Amount: &amount, IdempotencyKey: key}
+	}
+
+	testCases := []struct {
+		name             string
+		mode             string
+		expectedCode     int
+		expectedStatuses []transactionmanager.ImportStatus
+		expectedBalance  float64
+	}{
+		{
+			name:         "Partial",
+			mode:         "partial",
+			expectedCode: http.StatusMultiStatus,
+			expectedStatuses: []transactionmanager.ImportStatus{
+				transactionmanager.ImportCreated,
+				transactionmanager.ImportInvalid,
+				transactionmanager.ImportDuplicate,
+				transactionmanager.ImportInvalid,
+				transactionmanager.ImportCreated,
+			},
+			expectedBalance: 120,
+		},
+		{
+			name:         "Atomic",
+			mode:         "atomic",
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedStatuses: []transactionmanager.ImportStatus{
+				transactionmanager.ImportRolledBack,
+				transactionmanager.ImportInvalid,
+				transactionmanager.ImportRolledBack,
+				transactionmanager.ImportInvalid,
+				transactionmanager.ImportRolledBack,
+			},
+			expectedBalance: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			repeatedKey := uuid.New().String()
+			// Minor units can't be read without a currency
+			minor := int64(1000)
+			unparsable := api.AddTransactionRequest{AmountMinor: &minor, IdempotencyKey: uuid.New().String()}
+			body, _ := json.Marshal([]api.AddTransactionRequest{
+				request(100, repeatedKey),
+				request(0, uuid.New().String()),
+				request(100, repeatedKey),
+				unparsable,
+				request(20, uuid.New().String()),
+			})
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(UserImportTemplate, user.ID)+"?mode="+tc.mode, bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+			assert.Equal(t, tc.expectedCode, rr.Code, rr.Body.String())
+
+			var report transactionmanager.ImportReport
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, 2, report.Invalid)
+			if assert.Len(t, report.Results, len(tc.expectedStatuses)) {
+				for i, result := range report.Results {
+					assert.Equal(t, i, result.Index)
+					assert.Equal(t, tc.expectedStatuses[i], result.Status, "status of %d", i)
+					if result.Status == transactionmanager.ImportInvalid {
+						assert.NotEmpty(t, result.Error, "error of %d", i)
+					}
+					if result.Status == transactionmanager.ImportCreated || result.Status == transactionmanager.ImportDuplicate {
+						assert.NotNil(t, result.TransactionID, "transaction ID of %d", i)
+					}
+				}
+				// The duplicate points at the row that took the key
+				if tc.mode == "partial" && assert.NotNil(t, report.Results[2].TransactionID) {
+					assert.Equal(t, report.Results[0].TransactionID, report.Results[2].TransactionID)
+				}
+			}
+
+			balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+			if err != nil {
+				t.Fatalf("failed to get balance: %v", err)
+			}
+			assert.True(t, balance.Equal(decimal.NewFromFloat(tc.expectedBalance)), "got %s", balance)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// cacheKeyHeader carries the client's key for caching the result of an
+// expensive read
+const cacheKeyHeader = "Idempotency-Key"
+
+// DefaultResultCacheTTL is how long a keyed read result is served from the
+// cache unless WithResultCacheTTL says otherwise
+const DefaultResultCacheTTL = 30 * time.Second
+
+// DefaultResultCacheSize is how many keyed read results are cached at most
+// unless WithResultCacheSize says otherwise
+const DefaultResultCacheSize = 1000
+
+// WithResultCacheTTL sets how long results of keyed reads are cached. Zero
+// turns the cache off.
+func WithResultCacheTTL(ttl time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.cache.ttl = ttl
+	}
+}
+
+// WithResultCacheSize sets how many results of keyed reads are cached at
+// most. Once it is reached the oldest result makes room for the next.
+func WithResultCacheSize(size int) ControllerOption {
+	return func(c *Controller) {
+		c.cache.maxResults = size
+	}
+}
+
+// cachedResult is a successful response as it was written to the client
+type cachedResult struct {
+	key         string
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// resultCache holds the responses of keyed reads for a short TTL, so repeated
+// requests with the same key don't recompute them. Every result lives for the
+// same TTL, so the oldest one is always the first to expire.
+type resultCache struct {
+	ttl        time.Duration
+	maxResults int
+
+	mu      sync.Mutex
+	results map[string]*list.Element
+	// order holds the cachedResults oldest first
+	order *list.List
+}
+
+func newResultCache(ttl time.Duration, maxResults int) *resultCache {
+	return &resultCache{
+		ttl:        ttl,
+		maxResults: maxResults,
+		results:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (rc *resultCache) get(key string, now time.Time) (cachedResult, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	element, ok := rc.results[key]
+	if !ok {
+		return cachedResult{}, false
+	}
+	result := element.Value.(cachedResult)
+	if !now.Before(result.expiresAt) {
+		return cachedResult{}, false
+	}
+	return result, true
+}
+
+func (rc *resultCache) put(key string, result cachedResult, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if element, ok := rc.results[key]; ok {
+		rc.order.Remove(element)
+	}
+	result.key = key
+	result.expiresAt = now.Add(rc.ttl)
+	rc.results[key] = rc.order.PushBack(result)
+
+	// Drop the oldest results while they are expired or over the cap, so
+	// keys that are never asked for again don't pile up
+	for oldest := rc.order.Front(); oldest != nil; oldest = rc.order.Front() {
+		expired := !now.Before(oldest.Value.(cachedResult).expiresAt)
+		if !expired && rc.order.Len() <= rc.maxResults {
+			break
+		}
+		rc.order.Remove(oldest)
+		delete(rc.results, oldest.Value.(cachedResult).key)
+	}
+}
+
+// recordingResponseWriter keeps a copy of everything written through it
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// cached serves a GET from the result cache when the client sends a cache
+// key that was used for the same URL within the TTL. Only 200 responses are
+// cached, and streamed responses are never cached.
+func (c *Controller) cached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientKey := r.Header.Get(cacheKeyHeader)
+		if c.cache == nil || c.cache.ttl <= 0 || clientKey == "" || strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+			next(w, r)
+			return
+		}
+
+		// Scope the key to the tenant and the resource, so reusing a key
+		// elsewhere can't return another tenant's or endpoint's result
+		tenantID, _ := transactionmanager.TenantFromContext(r.Context())
+		key := clientKey + " " + tenantID + " " + r.URL.RequestURI()
+		if result, ok := c.cache.get(key, time.Now()); ok {
+			w.Header().Set("Content-Type", result.contentType)
+			w.WriteHeader(http.StatusOK)
+			w.Write(result.body)
+			return
+		}
+
+		recorder := &recordingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+		if recorder.statusCode == http.StatusOK {
+			c.cache.put(key, cachedResult{
+				contentType: recorder.Header().Get("Content-Type"),
+				body:        recorder.body.Bytes(),
+			}, time.Now())
+		}
+	}
+}
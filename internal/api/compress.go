@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultCompressionMinSize is the smallest response body that gets
+	// compressed unless WithCompression says otherwise. Below it the gzip
+	// framing costs more than it saves.
+	DefaultCompressionMinSize = 1024
+	// DefaultCompressionLevel balances CPU against bandwidth
+	DefaultCompressionLevel = gzip.DefaultCompression
+)
+
+// compressedContentTypes are already compressed, so gzipping them again only
+// burns CPU
+var compressedContentTypes = map[string]bool{
+	"application/gzip":   true,
+	"application/zip":    true,
+	"application/x-gzip": true,
+	"application/pdf":    true,
+}
+
+// WithCompression gzips responses of at least minSize bytes for clients
+// accepting gzip, at the given level from 1 (fastest) to 9 (smallest). Other
+// levels fall back to DefaultCompressionLevel. Without it responses are sent
+// uncompressed.
+func WithCompression(minSize, level int) APIOption {
+	return func(config *apiConfig) {
+		config.compress = true
+		config.compressMinSize = minSize
+		config.compressLevel = level
+	}
+}
+
+// ValidCompressionLevel reports whether level can be passed to
+// WithCompression
+func ValidCompressionLevel(level int) bool {
+	return level >= gzip.BestSpeed && level <= gzip.BestCompression
+}
+
+// compressMiddleware gzips responses for clients that accept it once the body
+// reaches minSize bytes. Smaller bodies, already compressed content types and
+// responses that set their own Content-Encoding are passed through.
+func compressMiddleware(minSize, level int) func(http.Handler) http.Handler {
+	if !ValidCompressionLevel(level) {
+		level = DefaultCompressionLevel
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressResponseWriter{ResponseWriter: w, minSize: minSize, level: level, statusCode: http.StatusOK}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponseWriter holds the body back until it knows whether the
+// response is large enough to compress, then either gzips it or writes it
+// as it is
+type compressResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	level   int
+
+	statusCode  int
+	wroteHeader bool
+	decided     bool
+	buffer      bytes.Buffer
+	gzipWriter  *gzip.Writer
+}
+
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if !w.decided {
+		w.buffer.Write(b)
+		if w.buffer.Len() < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide picks between gzip and plain from what has been buffered so far and
+// sends the header along with the buffered body
+func (w *compressResponseWriter) decide() error {
+	w.decided = true
+
+	header := w.Header()
+	if w.buffer.Len() >= w.minSize && w.compressible() {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gzipWriter, _ = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+
+	buffered := w.buffer.Bytes()
+	w.buffer = bytes.Buffer{}
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if w.gzipWriter != nil {
+		_, err = w.gzipWriter.Write(buffered)
+	} else {
+		_, err = w.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+func (w *compressResponseWriter) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if w.statusCode < http.StatusOK || w.statusCode == http.StatusNoContent || w.statusCode == http.StatusNotModified {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buffer.Bytes())
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if compressedContentTypes[mediaType] {
+		return false
+	}
+	return !strings.HasPrefix(mediaType, "image/") &&
+		!strings.HasPrefix(mediaType, "video/") &&
+		!strings.HasPrefix(mediaType, "audio/")
+}
+
+// Flush sends whatever is buffered so streamed responses keep streaming. A
+// stream flushed before reaching the minimum size goes out uncompressed.
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return
+		}
+	}
+	if w.gzipWriter != nil {
+		w.gzipWriter.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes out a response that never reached the minimum size and
+// finishes the gzip stream of one that did
+func (w *compressResponseWriter) Close() error {
+	if !w.decided {
+		if !w.wroteHeader {
+			// Nothing was written, let the server send its default response
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Close()
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -15,28 +20,202 @@ import (
 	"github.com/gorilla/mux"
 )
 
+const (
+	ndjsonContentType = "application/x-ndjson"
+	// ndjsonFlushEvery is how many streamed rows are written between flushes
+	ndjsonFlushEvery = 100
+	// channelHeader names the channel a transaction comes in through, e.g.
+	// web or mobile. Transactions without it are taken to come from the API.
+	channelHeader = "X-Channel"
+)
+
 // TransactionManager is the interface for the transaction manager
 type TransactionManager interface {
+	Now() time.Time
 	AddTransaction(ctx context.Context, transaction transactionmanager.Transaction) (transactionmanager.Transaction, error)
 	GetUserBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error)
-	GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int) ([]transactionmanager.Transaction, error)
+	GetAvailableBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error)
+	GetBalanceAsOf(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error)
+	GetUserBalanceExcluding(ctx context.Context, userID uuid.UUID, reasonCode string) (decimal.Decimal, error)
+	GetDisplayBalance(ctx context.Context, userID uuid.UUID, convertTo string) (transactionmanager.DisplayBalance, error)
+	SetDisplayCurrency(ctx context.Context, userID uuid.UUID, currency string) (transactionmanager.User, error)
+	GetUserByExternalID(ctx context.Context, externalID string) (transactionmanager.User, error)
+	CreateUser(ctx context.Context, initialBalance decimal.Decimal, currency string, idempotencyKey uuid.UUID) (transactionmanager.User, error)
+	GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter transactionmanager.HistoryFilter) ([]transactionmanager.Transaction, error)
+	GetUserTransactionHistoryByDay(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter transactionmanager.HistoryFilter) ([]transactionmanager.DayGroup, error)
+	CountUserTransactions(ctx context.Context, userID uuid.UUID, filter transactionmanager.HistoryFilter) (int64, bool, error)
+	GetUserTransactionHistoryAfter(ctx context.Context, userID uuid.UUID, cursor transactionmanager.HistoryCursor, limit int, filter transactionmanager.HistoryFilter) ([]transactionmanager.Transaction, transactionmanager.HistoryCursor, error)
+	GetUserTransactionHistoryPage(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter transactionmanager.HistoryFilter) (transactionmanager.HistoryPage, error)
+	ValidateTransaction(ctx context.Context, transaction transactionmanager.Transaction) ([]error, error)
+	AddTransactionBatch(ctx context.Context, transactions []transactionmanager.Transaction) (transactionmanager.Batch, error)
+	AddUserTransactions(ctx context.Context, userID uuid.UUID, transactions []transactionmanager.Transaction) ([]transactionmanager.Transaction, error)
+	ImportUserTransactions(ctx context.Context, userID uuid.UUID, rows []transactionmanager.ImportRow, mode transactionmanager.ImportMode) (transactionmanager.ImportReport, error)
+	GetBatch(ctx context.Context, batchID uuid.UUID) (transactionmanager.Batch, error)
+	GetTransaction(ctx context.Context, transactionID uuid.UUID) (transactionmanager.Transaction, error)
+	GetTransactionImpact(ctx context.Context, userID uuid.UUID, transactionID uuid.UUID) (transactionmanager.TransactionImpact, error)
+	GetTransactionsByIDs(ctx context.Context, ids []uuid.UUID) ([]transactionmanager.Transaction, error)
+	StreamUserTransactionHistory(ctx context.Context, userID uuid.UUID, filter transactionmanager.HistoryFilter, fn func(transactionmanager.Transaction) error) error
+	GetLargestTransaction(ctx context.Context, userID uuid.UUID, transactionType transactionmanager.TransactionType) (transactionmanager.Transaction, error)
+	GetUserIdempotencyKeys(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time, page int, pageSize int) ([]transactionmanager.IdempotencyKeyUsage, error)
+	GetBalanceVolatility(ctx context.Context, userID uuid.UUID, days int) (decimal.Decimal, error)
+	GetAverageTransactionAmount(ctx context.Context, userID uuid.UUID, transactionType transactionmanager.TransactionType, from time.Time, to time.Time) (decimal.Decimal, error)
+	GetTransactionCadence(ctx context.Context, userID uuid.UUID) (transactionmanager.Cadence, error)
+	CreateRecurringTransaction(ctx context.Context, recurring transactionmanager.RecurringTransaction) (transactionmanager.RecurringTransaction, error)
+	GetRecurringTransactions(ctx context.Context, userID uuid.UUID) ([]transactionmanager.RecurringTransaction, error)
+	ProjectBalance(ctx context.Context, userID uuid.UUID, until time.Time) (transactionmanager.BalanceProjection, error)
+	ScheduleTransaction(ctx context.Context, scheduled transactionmanager.ScheduledTransaction) (transactionmanager.ScheduledTransaction, error)
+	GetScheduledTransactions(ctx context.Context, userID uuid.UUID) ([]transactionmanager.ScheduledTransaction, error)
+	CancelScheduledTransaction(ctx context.Context, userID uuid.UUID, scheduledID uuid.UUID) (transactionmanager.ScheduledTransaction, error)
+	GetUserLimits(ctx context.Context, userID uuid.UUID) (transactionmanager.UserLimits, error)
+	AdjustBalance(ctx context.Context, userID uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID, operator string, reason string) (transactionmanager.Adjustment, error)
+	GetAuditEntries(ctx context.Context, userID uuid.UUID) ([]transactionmanager.AuditEntry, error)
+	SetUserLimits(ctx context.Context, userID uuid.UUID, limits transactionmanager.UserLimits) (transactionmanager.UserLimits, error)
+	GetReconciliationReport(ctx context.Context, after uuid.UUID, limit int) (transactionmanager.ReconciliationReport, error)
+	GetRecentUsers(ctx context.Context, limit int) ([]transactionmanager.User, error)
+	GetOrphanedTransactions(ctx context.Context, after uuid.UUID, limit int) (transactionmanager.OrphanedTransactionsReport, error)
+	StreamUserBalances(ctx context.Context, fn func(transactionmanager.User) error) error
+	RecomputeBalances(ctx context.Context, userID uuid.UUID, batchSize int, progress func(transactionmanager.RecomputeProgress)) (transactionmanager.RecomputeProgress, error)
+	GetWebhookDeliveries(ctx context.Context, status transactionmanager.WebhookDeliveryStatus, limit int) ([]transactionmanager.WebhookDelivery, error)
+	RetryWebhookDeliveries(ctx context.Context) (transactionmanager.WebhookRetry, error)
+	Transfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (transactionmanager.Transfer, error)
+	ReserveTransfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (transactionmanager.Transfer, error)
+	SettleTransfer(ctx context.Context, transferID uuid.UUID) (transactionmanager.Transfer, error)
+	CancelTransfer(ctx context.Context, transferID uuid.UUID) (transactionmanager.Transfer, error)
+	GetTransfer(ctx context.Context, transferID uuid.UUID) (transactionmanager.Transfer, error)
+	GetNetFlow(ctx context.Context, fromUserID, toUserID uuid.UUID, from time.Time, to time.Time) (decimal.Decimal, error)
+	GetUserTransfers(ctx context.Context, userID uuid.UUID, direction transactionmanager.TransferDirection, page int, pageSize int) ([]transactionmanager.UserTransfer, error)
+	PreviewTransfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, pending bool) (transactionmanager.TransferPreview, error)
+	RefundTransaction(ctx context.Context, transactionID uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (transactionmanager.Transaction, error)
+	ReverseTransaction(ctx context.Context, transactionID uuid.UUID) (transactionmanager.Transaction, error)
+	GetCompensations(ctx context.Context, transactionID uuid.UUID, page int, pageSize int) (transactionmanager.Compensations, error)
+	VoidTransaction(ctx context.Context, transactionID uuid.UUID) (transactionmanager.Transaction, error)
+	DeleteTransaction(ctx context.Context, transactionID uuid.UUID) (transactionmanager.Transaction, error)
+	FindStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal) (transactionmanager.StoredResponse, bool, error)
+	SaveStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal, response transactionmanager.StoredResponse) error
+	PrepareStatement(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time) (transactionmanager.StatementJob, error)
+	GetStatementJob(ctx context.Context, jobID uuid.UUID) (transactionmanager.StatementJob, error)
 }
 
 // Controller is the API controller
 type Controller struct {
 	transactionmanager TransactionManager
+	jsonNaming         JSONNaming
+	amountConvention   AmountConvention
+	cache              *resultCache
+	metrics            *metrics
+	// requireIdempotencyKey rejects writes without an idempotency key
+	requireIdempotencyKey bool
+}
+
+// ControllerOption configures optional Controller behaviour
+type ControllerOption func(*Controller)
+
+// WithJSONNaming sets the field naming used for every JSON response.
+// Responses use snake_case by default.
+func WithJSONNaming(naming JSONNaming) ControllerOption {
+	return func(c *Controller) {
+		c.jsonNaming = naming
+	}
+}
+
+// WithAmountConvention sets how request amounts express credits and debits.
+// Amounts are signed by default.
+func WithAmountConvention(convention AmountConvention) ControllerOption {
+	return func(c *Controller) {
+		c.amountConvention = convention
+	}
 }
 
-func NewController(tm TransactionManager) Controller {
-	return Controller{
+func NewController(tm TransactionManager, opts ...ControllerOption) Controller {
+	controller := Controller{
 		transactionmanager: tm,
+		jsonNaming:         SnakeCase,
+		cache:              newResultCache(DefaultResultCacheTTL, DefaultResultCacheSize),
+		metrics:            newMetrics(),
 	}
+	for _, opt := range opts {
+		opt(&controller)
+	}
+	return controller
 }
 
 // AddTransactionRequest is the request body for adding a transaction
 type AddTransactionRequest struct {
-	Amount         float64   `json:"amount"`
-	IdempotencyKey uuid.UUID `json:"idempotency_key"`
+	Amount *float64 `json:"amount"`
+	// AmountMinor is the amount in the minor units of Currency, e.g. cents.
+	// It can be sent instead of Amount.
+	AmountMinor *int64 `json:"amount_minor"`
+	// Currency is the ISO 4217 code of the amount, defaulting to the user's
+	// account currency, which it must match. It is needed with AmountMinor
+	// and also picks the currency's amount limits.
+	Currency string `json:"currency"`
+	// Direction is credit or debit, and only used when the controller takes
+	// amounts as always positive
+	Direction string `json:"direction"`
+	// ReasonCode optionally classifies the transaction, e.g. DEPOSIT or FEE
+	ReasonCode string `json:"reason_code"`
+	// IdempotencyKey is either a UUID or a printable ASCII string of at most
+	// 255 characters
+	IdempotencyKey string `json:"idempotency_key"`
+	// CreatedAt is when the transaction happened, defaulting to when it is
+	// added. It can't be older than the manager's backdating window unless
+	// the transaction is imported as a backfill, nor further ahead than its
+	// forward skew.
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+// ValidateTransactionRequest is the request body for validating a transaction
+type ValidateTransactionRequest struct {
+	UserID         uuid.UUID `json:"user_id"`
+	Amount         *float64  `json:"amount"`
+	AmountMinor    *int64    `json:"amount_minor"`
+	Currency       string    `json:"currency"`
+	Direction      string    `json:"direction"`
+	ReasonCode     string    `json:"reason_code"`
+	IdempotencyKey string    `json:"idempotency_key"`
+}
+
+// maxBatchGetIDs caps how many transactions one batch get may ask for
+const maxBatchGetIDs = 100
+
+// GetTransactionImpact returns how a transaction moved the balance of the
+// user given by ?user_id=, for receipts. A transaction of another user gets
+// 404 Not Found.
+func (c *Controller) GetTransactionImpact(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	impact, err := c.transactionmanager.GetTransactionImpact(ctx, userID, transactionID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, impact)
+}
+
+// BatchGetTransactionsRequest is the request body for fetching several
+// transactions by ID
+type BatchGetTransactionsRequest struct {
+	IDs []uuid.UUID `json:"ids"`
+}
+
+// ValidateTransactionResponse is the response body for validating a transaction
+type ValidateTransactionResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
 }
 
 // GetUserBalanceResponse is the response body for getting a user's balance
@@ -50,16 +229,172 @@ func (c *Controller) GetUserBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance, err := c.transactionmanager.GetUserBalance(ctx, userID)
+	// ?asOf= returns the balance as it stood at that time
+	if value := r.URL.Query().Get("asOf"); value != "" {
+		if r.URL.Query().Get("exclude_category") != "" {
+			httpError(w, "asOf can't be combined with exclude_category", http.StatusBadRequest)
+			return
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid asOf %v", err), http.StatusBadRequest)
+			return
+		}
+
+		balance, err := c.transactionmanager.GetBalanceAsOf(ctx, userID, at)
+		if err != nil {
+			c.managerError(w, err)
+			return
+		}
+		c.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"balance": balance,
+			"as_of":   at.UTC(),
+		})
+		return
+	}
+
+	// ?exclude_category=fee returns the balance without the transactions of
+	// that reason code
+	if excluded := r.URL.Query().Get("exclude_category"); excluded != "" {
+		balance, err := c.transactionmanager.GetUserBalanceExcluding(ctx, userID, excluded)
+		if err != nil {
+			c.managerError(w, err)
+			return
+		}
+		c.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"balance":           balance,
+			"excluded_category": strings.ToUpper(excluded),
+		})
+		return
+	}
+
+	// ?convert_to=EUR, or ?currency=EUR, converts the balance; without it
+	// the user's display currency is used, if they have one
+	convertTo := r.URL.Query().Get("convert_to")
+	if convertTo == "" {
+		convertTo = r.URL.Query().Get("currency")
+	}
+
+	balance, err := c.transactionmanager.GetDisplayBalance(ctx, userID, convertTo)
 	if err != nil {
-		httpError(w, fmt.Sprintf("Error retrieving user balance %v", err), http.StatusInternalServerError)
+		httpError(w, fmt.Sprintf("Error retrieving user balance %v", err), errorStatusCode(err))
 		return
 	}
 
-	response := map[string]decimal.Decimal{
-		"balance": balance,
+	c.respondWithJSON(w, http.StatusOK, balance)
+}
+
+// SetDisplayCurrencyRequest is the request body for setting the currency a
+// user's balance is shown in
+type SetDisplayCurrencyRequest struct {
+	// DisplayCurrency is an ISO 4217 code, empty to show the balance in the
+	// account currency
+	DisplayCurrency string `json:"display_currency"`
+}
+
+// SetDisplayCurrency sets the currency GetUserBalance converts the user's
+// balance to when the request doesn't name one, and returns the user
+func (c *Controller) SetDisplayCurrency(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var request SetDisplayCurrencyRequest
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := c.transactionmanager.SetDisplayCurrency(ctx, userID, request.DisplayCurrency)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, user)
+}
+
+// GetServerTime returns the server's current time, so clients sending
+// created_at can check their clock against it
+func (c *Controller) GetServerTime(w http.ResponseWriter, r *http.Request) {
+	response := map[string]string{
+		"server_time": c.transactionmanager.Now().UTC().Format(time.RFC3339),
+	}
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// CreateUserRequest is the request body for creating a user
+type CreateUserRequest struct {
+	// InitialBalance is the user's opening balance, zero when left out. It
+	// must not be negative.
+	InitialBalance float64 `json:"initial_balance"`
+	// Currency is the ISO 4217 code of the user's account, e.g. USD. Left
+	// out, the account is in the ledger's implicit currency.
+	Currency string `json:"currency"`
+}
+
+// CreateUser adds a user with a generated ID and returns it with 201 Created.
+// A retry sending the same Idempotency-Key header gets the same user back,
+// or 409 Conflict if it asked for another initial balance or currency.
+func (c *Controller) CreateUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var createUserRequest CreateUserRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &createUserRequest); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	idempotencyKey, err := c.writeIdempotencyKey(r.Header.Get(idempotencyKeyHeader))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := c.transactionmanager.CreateUser(ctx, decimal.NewFromFloat(createUserRequest.InitialBalance), createUserRequest.Currency, idempotencyKey)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	if user.Replayed {
+		w.Header().Set(replayedHeader, "true")
+	}
+	c.respondWithJSON(w, http.StatusCreated, user)
+}
+
+// GetUserByExternalID returns the user with the given external ID
+func (c *Controller) GetUserByExternalID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	user, err := c.transactionmanager.GetUserByExternalID(ctx, vars["externalID"])
+	if err != nil {
+		c.managerError(w, err)
+		return
 	}
-	respondWithJSON(w, http.StatusOK, response)
+
+	c.respondWithJSON(w, http.StatusOK, user)
+}
+
+// AddTransactionResponse is the response body for adding a transaction
+type AddTransactionResponse struct {
+	Message string `json:"message"`
+	// Version is the user's version after the transaction. Replays don't
+	// know it.
+	Version int64 `json:"version,omitempty"`
+	// Warning flags a keyless transaction that looks like a double submit
+	Warning string `json:"warning,omitempty"`
+	// Entries lists the transaction and the fees or taxes booked along with
+	// it, when there are any
+	Entries []transactionmanager.Transaction `json:"entries,omitempty"`
 }
 
 // AddTransaction adds a transaction to the ledger
@@ -79,25 +414,112 @@ func (c *Controller) AddTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	idempotencyKey, err := c.writeIdempotencyKey(addTransactionRequest.IdempotencyKey)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	amount, err := requestAmount(addTransactionRequest.Amount, addTransactionRequest.AmountMinor, addTransactionRequest.Currency)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	amount, err = c.signedAmount(amount, addTransactionRequest.Direction)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Without created_at the manager stamps the transaction
 	transaction := transactionmanager.Transaction{
 		UserID:         userID,
-		Amount:         decimal.NewFromFloat(addTransactionRequest.Amount),
+		Amount:         amount,
 		ID:             uuid.New(),
-		CreatedAt:      time.Now(),
-		IdempotencyKey: addTransactionRequest.IdempotencyKey,
+		IdempotencyKey: idempotencyKey,
+		ReasonCode:     addTransactionRequest.ReasonCode,
+		Currency:       addTransactionRequest.Currency,
+		Channel:        r.Header.Get(channelHeader),
+		CreatedAt:      requestCreatedAt(addTransactionRequest.CreatedAt),
 	}
 
-	if _, err := c.transactionmanager.AddTransaction(ctx, transaction); err != nil {
-		httpError(w, err.Error(), http.StatusInternalServerError)
+	// A retry of a transaction added within the replay TTL gets the
+	// original response. One stored by the gRPC API can't be sent as it is,
+	// so that retry is left to AddTransaction.
+	stored, found, err := c.transactionmanager.FindStoredResponse(ctx, userID, idempotencyKey, amount)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Error looking up idempotency key %v", err), http.StatusInternalServerError)
+		return
+	}
+	if found && stored.ContentType == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(replayedHeader, "true")
+		w.WriteHeader(stored.StatusCode)
+		w.Write(stored.Body)
 		return
 	}
 
-	response := struct {
-		Message string `json:"message"`
-	}{
+	added, err := c.transactionmanager.AddTransaction(ctx, transaction)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	response := AddTransactionResponse{
 		Message: "Transaction successfully added",
+		Version: added.UserVersion,
 	}
-	respondWithJSON(w, http.StatusCreated, response)
+	if len(added.Derived) > 0 {
+		principal := added
+		principal.Derived = nil
+		response.Entries = append([]transactionmanager.Transaction{principal}, added.Derived...)
+	}
+	if added.PossibleDuplicateOf != nil {
+		response.Warning = fmt.Sprintf("possible duplicate of transaction %s", added.PossibleDuplicateOf)
+	}
+	if added.Replayed {
+		w.Header().Set(replayedHeader, "true")
+	}
+
+	body, err := encodeJSON(response, c.jsonNaming)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Error encoding response %v", err), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	if !added.Replayed {
+		// The transaction is in, so failing to keep the response only costs
+		// a retry its replay
+		err = c.transactionmanager.SaveStoredResponse(ctx, userID, idempotencyKey, amount, transactionmanager.StoredResponse{
+			StatusCode:  http.StatusCreated,
+			ContentType: "application/json",
+			Body:        body,
+		})
+		if err != nil {
+			log.Printf("storing the response for idempotency key %s: %v", idempotencyKey, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// HistoryResponse is a page of a user's transaction history along with where
+// it sits among all of them
+type HistoryResponse struct {
+	Transactions []transactionmanager.Transaction `json:"transactions"`
+	Page         int                              `json:"page"`
+	PageSize     int                              `json:"page_size"`
+	// TotalCount is the number of transactions across all pages, with the
+	// same filters applied
+	TotalCount int64 `json:"total_count"`
+	TotalPages int64 `json:"total_pages"`
+	// CountIsEstimate marks TotalCount, and so TotalPages, as taken from the
+	// table statistics rather than counted
+	CountIsEstimate bool `json:"count_is_estimate"`
 }
 
 // GetUserTransactionHistory returns a user's transaction history
@@ -111,6 +533,525 @@ func (c *Controller) GetUserTransactionHistory(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		c.streamUserTransactionHistory(w, r, userID, filter)
+		return
+	}
+
+	page, pageSize := parsePage(r)
+
+	// ?cursor= switches to keyset pages, starting at the newest transaction
+	// when it is empty
+	if r.URL.Query().Has("cursor") {
+		c.getUserTransactionHistoryAfter(w, r, userID, pageSize, filter)
+		return
+	}
+
+	includeBalances := false
+	if value := r.URL.Query().Get("include_balances"); value != "" {
+		includeBalances, err = strconv.ParseBool(value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid include_balances %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// With balances the page comes wrapped in an object carrying them
+	if includeBalances {
+		historyPage, err := c.transactionmanager.GetUserTransactionHistoryPage(ctx, userID, page, pageSize, filter)
+		if err != nil {
+			c.managerError(w, err)
+			return
+		}
+
+		c.respondWithJSON(w, http.StatusOK, historyPage)
+		return
+	}
+
+	transactions, err := c.transactionmanager.GetUserTransactionHistory(ctx, userID, page, pageSize, filter)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	totalCount, estimated, err := c.transactionmanager.CountUserTransactions(ctx, userID, filter)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, HistoryResponse{
+		Transactions:    transactions,
+		Page:            page,
+		PageSize:        pageSize,
+		TotalCount:      totalCount,
+		TotalPages:      (totalCount + int64(pageSize) - 1) / int64(pageSize),
+		CountIsEstimate: estimated,
+	})
+}
+
+// ExportUserHistoryCSV streams all of a user's transactions, newest first, as
+// a CSV download with an id,created_at,amount,balance_after,idempotency_key
+// header. Rows are written as they are read, and the history query
+// parameters filter them like for GetUserTransactionHistory.
+func (c *Controller) ExportUserHistoryCSV(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	writer := csv.NewWriter(w)
+
+	// The header goes out with the first row, so an unknown user can still
+	// be reported with a proper status
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="history-%s.csv"`, userID))
+		w.WriteHeader(http.StatusOK)
+		return writer.Write([]string{"id", "created_at", "amount", "balance_after", "idempotency_key"})
+	}
+
+	written := 0
+	err = c.transactionmanager.StreamUserTransactionHistory(r.Context(), userID, filter, func(transaction transactionmanager.Transaction) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		err := writer.Write([]string{
+			transaction.ID.String(),
+			transaction.CreatedAt.UTC().Format(time.RFC3339Nano),
+			transaction.Amount.String(),
+			transaction.BalanceAfter.String(),
+			transaction.IdempotencyKey.String(),
+		})
+		if err != nil {
+			return err
+		}
+
+		written++
+		if written%csvFlushEvery == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	})
+
+	if err != nil && !started {
+		c.managerError(w, err)
+		return
+	}
+	if err != nil {
+		// The status line is already sent, all we can do is cut the export short
+		log.Printf("exporting history for user %s: %v", userID, err)
+		return
+	}
+	if !started {
+		start()
+	}
+	writer.Flush()
+}
+
+// GetGroupedTransactionHistory returns a page of the user's history grouped
+// by day with each day's net amount. ?page= and ?pageSize= count days.
+func (c *Controller) GetGroupedTransactionHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Days are the only grouping so far
+	if by := r.URL.Query().Get("by"); by != "" && by != "day" {
+		httpError(w, fmt.Sprintf("Invalid by %q, only day is supported", by), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, pageSize := parsePage(r)
+	groups, err := c.transactionmanager.GetUserTransactionHistoryByDay(ctx, userID, page, pageSize, filter)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, groups)
+}
+
+// HistoryCursorResponse is a keyset page of a user's transaction history.
+// NextCursor is left out on the last page.
+type HistoryCursorResponse struct {
+	Transactions []transactionmanager.Transaction `json:"transactions"`
+	NextCursor   string                           `json:"next_cursor,omitempty"`
+}
+
+// getUserTransactionHistoryAfter writes the page of the user's history
+// following ?cursor= along with the cursor of the next page, which is left
+// out on the last one
+func (c *Controller) getUserTransactionHistoryAfter(w http.ResponseWriter, r *http.Request, userID uuid.UUID, limit int, filter transactionmanager.HistoryFilter) {
+	if r.URL.Query().Get("include_balances") != "" {
+		httpError(w, "include_balances can't be combined with cursor", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := decodeHistoryCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transactions, next, err := c.transactionmanager.GetUserTransactionHistoryAfter(r.Context(), userID, cursor, limit, filter)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	response := HistoryCursorResponse{
+		Transactions: transactions,
+		NextCursor:   encodeHistoryCursor(next),
+	}
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// encodeHistoryCursor turns a cursor into the opaque token handed to clients,
+// empty for the zero cursor
+func encodeHistoryCursor(cursor transactionmanager.HistoryCursor) string {
+	if cursor == (transactionmanager.HistoryCursor{}) {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatInt(cursor.Sequence, 10)))
+}
+
+// decodeHistoryCursor reads a token made by encodeHistoryCursor. An empty
+// token is the zero cursor.
+func decodeHistoryCursor(token string) (transactionmanager.HistoryCursor, error) {
+	if token == "" {
+		return transactionmanager.HistoryCursor{}, nil
+	}
+
+	errInvalid := fmt.Errorf("Invalid cursor %q", token)
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return transactionmanager.HistoryCursor{}, errInvalid
+	}
+	createdAt, sequence, found := strings.Cut(string(decoded), "|")
+	if !found {
+		return transactionmanager.HistoryCursor{}, errInvalid
+	}
+
+	var cursor transactionmanager.HistoryCursor
+	if cursor.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return transactionmanager.HistoryCursor{}, errInvalid
+	}
+	if cursor.Sequence, err = strconv.ParseInt(sequence, 10, 64); err != nil {
+		return transactionmanager.HistoryCursor{}, errInvalid
+	}
+	return cursor, nil
+}
+
+// ValidateTransaction checks a transaction without storing it, so clients can
+// validate input before submitting it. The limits checked are the user's,
+// overrides included, when user_id is given. The currency is only checked to
+// be a well-formed code, a mismatch with the user's account is only caught
+// when the transaction is added.
+func (c *Controller) ValidateTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var validateTransactionRequest ValidateTransactionRequest
+	if err := decodeJSON(r, &validateTransactionRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := ValidateTransactionResponse{
+		Valid:  true,
+		Errors: []string{},
+	}
+
+	idempotencyKey, err := transactionmanager.ParseIdempotencyKey(validateTransactionRequest.IdempotencyKey)
+	if err != nil {
+		response.Valid = false
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	amount, err := requestAmount(validateTransactionRequest.Amount, validateTransactionRequest.AmountMinor, validateTransactionRequest.Currency)
+	if err == nil {
+		amount, err = c.signedAmount(amount, validateTransactionRequest.Direction)
+	}
+	if err != nil {
+		// Without an amount the remaining checks would only add noise
+		response.Valid = false
+		response.Errors = append(response.Errors, err.Error())
+		c.respondWithJSON(w, http.StatusOK, response)
+		return
+	}
+
+	transaction := transactionmanager.Transaction{
+		UserID:         validateTransactionRequest.UserID,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		ReasonCode:     validateTransactionRequest.ReasonCode,
+		Currency:       validateTransactionRequest.Currency,
+		Channel:        r.Header.Get(channelHeader),
+	}
+	errs, err := c.transactionmanager.ValidateTransaction(ctx, transaction)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+	for _, err := range errs {
+		response.Valid = false
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// GetTransaction returns a single transaction by ID
+func (c *Controller) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	transaction, err := c.transactionmanager.GetTransaction(ctx, transactionID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, transaction)
+}
+
+// BatchGetTransactions returns the transactions with the requested IDs, in
+// the order they were asked for. IDs without a transaction are left out.
+// Asking for more than maxBatchGetIDs gets 400.
+func (c *Controller) BatchGetTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var batchGetRequest BatchGetTransactionsRequest
+	if err := decodeJSON(r, &batchGetRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(batchGetRequest.IDs) > maxBatchGetIDs {
+		httpError(w, fmt.Sprintf("At most %d ids can be requested at once", maxBatchGetIDs), http.StatusBadRequest)
+		return
+	}
+
+	transactions, err := c.transactionmanager.GetTransactionsByIDs(ctx, batchGetRequest.IDs)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, transactions)
+}
+
+// GetLargestTransaction returns the user's single biggest credit, or debit
+// when called with ?type=debit
+func (c *Controller) GetLargestTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	transactionType, err := parseTransactionType(r.URL.Query().Get("type"))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transaction, err := c.transactionmanager.GetLargestTransaction(ctx, userID, transactionType)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, transaction)
+}
+
+// GetAverageTransactionAmount returns the mean amount of a user's
+// transactions, only credits or debits when ?type= is given, created within
+// the optional from and to query parameters
+func (c *Controller) GetAverageTransactionAmount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Without a type every transaction is averaged
+	var transactionType transactionmanager.TransactionType
+	if value := r.URL.Query().Get("type"); value != "" {
+		transactionType, err = parseTransactionType(value)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	average, err := c.transactionmanager.GetAverageTransactionAmount(ctx, userID, transactionType, from, to)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	response := map[string]decimal.Decimal{
+		"average": average,
+	}
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// VolatilityResponse is the response body for a user's balance volatility
+type VolatilityResponse struct {
+	WindowDays int             `json:"window_days"`
+	Volatility decimal.Decimal `json:"volatility"`
+}
+
+// GetBalanceVolatility returns the standard deviation of a user's daily net
+// balance changes over ?window=, a number of days such as 30d
+func (c *Controller) GetBalanceVolatility(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	days := transactionmanager.DefaultVolatilityWindow
+	if value := r.URL.Query().Get("window"); value != "" {
+		days, err = parseWindowDays(value)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	volatility, err := c.transactionmanager.GetBalanceVolatility(ctx, userID, days)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	response := VolatilityResponse{
+		WindowDays: days,
+		Volatility: volatility,
+	}
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// GetTransactionCadence returns the average and longest gap, in seconds,
+// between a user's consecutive transactions. Both are null for users with
+// fewer than two transactions.
+func (c *Controller) GetTransactionCadence(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cadence, err := c.transactionmanager.GetTransactionCadence(ctx, userID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, cadence)
+}
+
+// parseWindowDays reads a window given in days, like 30d
+func parseWindowDays(value string) (int, error) {
+	days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+	if err != nil || !strings.HasSuffix(value, "d") || days < 1 {
+		return 0, fmt.Errorf("Invalid window %q, expected a number of days like 30d", value)
+	}
+	return days, nil
+}
+
+// GetUserIdempotencyKeys returns a page of the idempotency keys a user's
+// transactions were written with, within the optional from and to query
+// parameters
+func (c *Controller) GetUserIdempotencyKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, pageSize := parsePage(r)
+
+	keys, err := c.transactionmanager.GetUserIdempotencyKeys(ctx, userID, from, to, page, pageSize)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, keys)
+}
+
+// parsePage reads the page and pageSize query parameters, defaulting to the
+// first page of 10
+func parsePage(r *http.Request) (int, int) {
 	page, err := strconv.Atoi(r.URL.Query().Get("page"))
 	if err != nil || page < 1 {
 		page = 1
@@ -121,23 +1062,186 @@ func (c *Controller) GetUserTransactionHistory(w http.ResponseWriter, r *http.Re
 		pageSize = 10
 	}
 
-	transactions, err := c.transactionmanager.GetUserTransactionHistory(ctx, userID, page, pageSize)
+	return page, pageSize
+}
+
+// parseTransactionType reads the type query parameter, defaulting to credit
+func parseTransactionType(value string) (transactionmanager.TransactionType, error) {
+	switch transactionmanager.TransactionType(value) {
+	case "", transactionmanager.TransactionTypeCredit:
+		return transactionmanager.TransactionTypeCredit, nil
+	case transactionmanager.TransactionTypeDebit:
+		return transactionmanager.TransactionTypeDebit, nil
+	default:
+		return "", fmt.Errorf("Invalid transaction type %q, expected credit or debit", value)
+	}
+}
+
+// parseHistoryFilter reads the history query parameters. Voided transactions
+// are left out unless ?include_voided=true is given, soft deleted ones unless
+// ?includeDeleted=true is, and ?channel= keeps only the transactions of one
+// channel.
+func parseHistoryFilter(r *http.Request) (transactionmanager.HistoryFilter, error) {
+	var filter transactionmanager.HistoryFilter
+	if value := r.URL.Query().Get("include_voided"); value != "" {
+		includeVoided, err := strconv.ParseBool(value)
+		if err != nil {
+			return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid include_voided %q", value)
+		}
+		filter.IncludeVoided = includeVoided
+	}
+	if value := r.URL.Query().Get("includeDeleted"); value != "" {
+		includeDeleted, err := strconv.ParseBool(value)
+		if err != nil {
+			return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid includeDeleted %q", value)
+		}
+		filter.IncludeDeleted = includeDeleted
+	}
+	if value := r.URL.Query().Get("channel"); value != "" {
+		if !transactionmanager.ValidChannel(value) {
+			return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid channel %q, expected one of %s", value, strings.Join(transactionmanager.Channels, ", "))
+		}
+		filter.Channel = value
+	}
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid from %q, expected an RFC3339 timestamp", value)
+		}
+		filter.From = from
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid to %q, expected an RFC3339 timestamp", value)
+		}
+		filter.To = to
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return transactionmanager.HistoryFilter{}, fmt.Errorf("Invalid time range, to is before from")
+	}
+	return filter, nil
+}
+
+// errorStatusCode maps errors returned by the transaction manager to the
+// HTTP status code reported to the client
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, transactionmanager.ErrUserNotFound),
+		errors.Is(err, transactionmanager.ErrTransactionNotFound),
+		errors.Is(err, transactionmanager.ErrStatementJobNotFound),
+		errors.Is(err, transactionmanager.ErrTransferNotFound),
+		errors.Is(err, transactionmanager.ErrBatchNotFound),
+		errors.Is(err, transactionmanager.ErrScheduledNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, transactionmanager.ErrTransferNotPending),
+		errors.Is(err, transactionmanager.ErrAlreadyVoided),
+		errors.Is(err, transactionmanager.ErrAlreadyDeleted),
+		errors.Is(err, transactionmanager.ErrAlreadyReversed),
+		errors.Is(err, transactionmanager.ErrHasCompensations),
+		errors.Is(err, transactionmanager.ErrTransferLeg),
+		errors.Is(err, transactionmanager.ErrScheduledNotPending):
+		return http.StatusConflict
+	case isIdempotencyConflict(err):
+		return http.StatusConflict
+	case errors.Is(err, transactionmanager.ErrInsufficientFunds),
+		errors.Is(err, transactionmanager.ErrRefundExceedsOriginal):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, transactionmanager.ErrTooManyConcurrentTransactions):
+		return http.StatusTooManyRequests
+	case errors.Is(err, transactionmanager.ErrStatementQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, transactionmanager.ErrAddTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, transactionmanager.ErrNoExchangeRates):
+		return http.StatusNotImplemented
+	case errors.Is(err, transactionmanager.ErrInvalidTransaction):
+		return http.StatusBadRequest
+	case errors.Is(err, transactionmanager.ErrDailyLimitExceeded),
+		errors.Is(err, transactionmanager.ErrCreditCapExceeded),
+		errors.Is(err, transactionmanager.ErrTenantMismatch):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isIdempotencyConflict reports whether err turns a request away because its
+// idempotency key was already used or it looked like a duplicate
+func isIdempotencyConflict(err error) bool {
+	return errors.Is(err, transactionmanager.ErrIdempotencyKeyTaken) ||
+		errors.Is(err, transactionmanager.ErrTransactionAlreadyExist) ||
+		errors.Is(err, transactionmanager.ErrPossibleDuplicate)
+}
+
+// managerError writes an error returned by the transaction manager with its
+// status code, counting idempotency conflicts
+func (c *Controller) managerError(w http.ResponseWriter, err error) {
+	if isIdempotencyConflict(err) {
+		c.metrics.idempotencyConflict()
+	}
+	httpError(w, err.Error(), errorStatusCode(err))
+}
+
+// streamUserTransactionHistory writes the whole history as newline delimited
+// JSON, one transaction per line, flushing every ndjsonFlushEvery rows
+func (c *Controller) streamUserTransactionHistory(w http.ResponseWriter, r *http.Request, userID uuid.UUID, filter transactionmanager.HistoryFilter) {
+	flusher, _ := w.(http.Flusher)
+
+	written := 0
+	err := c.transactionmanager.StreamUserTransactionHistory(r.Context(), userID, filter, func(transaction transactionmanager.Transaction) error {
+		line, err := encodeJSON(transaction, c.jsonNaming)
+		if err != nil {
+			return err
+		}
+
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil && written == 0 {
+		c.managerError(w, err)
+		return
+	}
 	if err != nil {
-		httpError(w, err.Error(), http.StatusInternalServerError)
+		// The status line is already sent, all we can do is cut the stream short
+		log.Printf("streaming history for user %s: %v", userID, err)
 		return
 	}
-
-	respondWithJSON(w, http.StatusOK, transactions)
+	if written == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
 }
 
 func decodeJSON(r *http.Request, v interface{}) error {
 	return json.NewDecoder(r.Body).Decode(v)
 }
 
-func respondWithJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+func (c *Controller) respondWithJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	body, err := encodeJSON(data, c.jsonNaming)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Error encoding response %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(data)
+	w.Write(append(body, '\n'))
 }
 
 func httpError(w http.ResponseWriter, message string, statusCode int) {
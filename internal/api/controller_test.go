@@ -1,11 +1,23 @@
 package api_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -22,8 +34,28 @@ import (
 
 var (
 	GetUserBalanceTemplate            = "/users/%s/balance"
+	DisplayCurrencyTemplate           = "/users/%s/display-currency"
 	GetUserTransactionHistoryTemplate = "/users/%s/history%s"
+	HistoryCSVTemplate                = "/users/%s/history.csv"
 	AddTransactionTemplate            = "/users/%s/add"
+	UsersPath                         = "/users"
+	ValidateTransactionPath           = "/transactions/validate"
+	BatchGetTransactionsPath          = "/transactions/batch-get"
+	TransactionTemplate               = "/transactions/%s"
+	TransactionImpactTemplate         = "/transactions/%s/impact?user_id=%s"
+	GetLargestTransactionTemplate     = "/users/%s/history/largest%s"
+	GroupedHistoryTemplate            = "/users/%s/history/grouped%s"
+	AverageAmountTemplate             = "/users/%s/stats/average%s"
+	VolatilityTemplate                = "/users/%s/stats/volatility%s"
+	CadenceTemplate                   = "/users/%s/stats/cadence"
+	IdempotencyKeysTemplate           = "/users/%s/idempotency-keys%s"
+	PrepareStatementTemplate          = "/users/%s/statement/prepare%s"
+	StatementJobTemplate              = "/statements/%s"
+	UserByExternalIDTemplate          = "/users/by-external/%s"
+	ServerTimePath                    = "/time"
+	MetricsPath                       = "/metrics"
+	HealthzPath                       = "/healthz"
+	ReadyzPath                        = "/readyz"
 )
 
 func TestGetUserBalanceEndpoint(t *testing.T) {
@@ -110,6 +142,253 @@ func TestGetUserBalanceEndpoint(t *testing.T) {
 	}
 }
 
+func TestGetUserBalanceEndpoint_AsOf(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	for i, amount := range []float64{100, -30, 50} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	getBalance := func(query string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, user.ID)+query, nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response
+	}
+
+	testCases := []struct {
+		asOf            string
+		expectedBalance string
+	}{
+		{"2019-12-31T00:00:00Z", "0"},
+		{"2020-01-01T12:00:00Z", "100"},
+		// Transactions created right at asOf count
+		{"2020-01-02T00:00:00Z", "70"},
+		{"2020-01-03T01:00:00%2B01:00", "120"},
+		{"2021-01-01T00:00:00Z", "120"},
+	}
+	for _, tc := range testCases {
+		code, response := getBalance("?asOf=" + tc.asOf)
+		assert.Equal(t, http.StatusOK, code, tc.asOf)
+		assert.Equal(t, tc.expectedBalance, response["balance"], tc.asOf)
+	}
+
+	// Without asOf it is the current balance
+	code, response := getBalance("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "120", response["balance"])
+	assert.Equal(t, "120", response["available_balance"])
+
+	code, _ = getBalance("?asOf=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetUserBalanceEndpoint_ExcludeCategory(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	transactions := []struct {
+		amount     float64
+		reasonCode string
+	}{
+		{100, "DEPOSIT"},
+		{-5, "FEE"},
+		{50, ""},
+		{-3, "FEE"},
+		{-20, "WITHDRAWAL"},
+	}
+	for _, transaction := range transactions {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(transaction.amount),
+			IdempotencyKey: uuid.New(),
+			ReasonCode:     transaction.reasonCode,
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, user.ID)+"?exclude_category=fee", nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Balance          decimal.Decimal `json:"balance"`
+		ExcludedCategory string          `json:"excluded_category"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.True(t, response.Balance.Equal(decimal.NewFromFloat(130)), "got %s", response.Balance)
+	assert.Equal(t, "FEE", response.ExcludedCategory)
+
+	// The full balance still includes the fees
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(122)))
+
+	// Unknown categories are rejected
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, user.ID)+"?exclude_category=tips", nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetUserBalanceEndpoint_DisplayCurrency(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	rates := transactionmanager.StaticRates{"USD/EUR": decimal.RequireFromString("0.9")}
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithExchangeRates(rates))
+
+	user := storage.User{
+		ID:       uuid.New(),
+		Balance:  decimal.NewFromFloat(0),
+		Currency: "USD",
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100.55),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	getBalance := func(newAPI *api.API, query string) (int, transactionmanager.DisplayBalance) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, user.ID)+query, nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var response transactionmanager.DisplayBalance
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+		}
+		return rr.Code, response
+	}
+	setDisplayCurrency := func(newAPI *api.API, currency string) int {
+		requestBody := []byte(fmt.Sprintf(`{"display_currency":"%s"}`, currency))
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf(DisplayCurrencyTemplate, user.ID), bytes.NewBuffer(requestBody))
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	newAPI := api.NewAPI(api.NewController(transactionManager))
+
+	// Without a preference the balance is in the account currency
+	code, response := getBalance(newAPI, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "USD", response.Currency)
+	assert.True(t, response.Balance.Equal(decimal.NewFromFloat(100.55)))
+	assert.Nil(t, response.Converted)
+
+	assert.Equal(t, http.StatusBadRequest, setDisplayCurrency(newAPI, "XYZ"))
+	assert.Equal(t, http.StatusOK, setDisplayCurrency(newAPI, "eur"))
+
+	// The preference converts it, rounded to the target currency
+	code, response = getBalance(newAPI, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, response.Balance.Equal(decimal.NewFromFloat(100.55)))
+	if assert.NotNil(t, response.Converted) {
+		assert.Equal(t, "EUR", response.Converted.Currency)
+		assert.True(t, response.Converted.Balance.Equal(decimal.NewFromFloat(90.5)), "got %s", response.Converted.Balance)
+		assert.True(t, response.Converted.AvailableBalance.Equal(decimal.NewFromFloat(90.5)))
+		assert.True(t, response.Converted.Rate.Equal(decimal.NewFromFloat(0.9)))
+	}
+
+	// An explicit currency wins over the preference
+	code, response = getBalance(newAPI, "?convert_to=USD")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, response.Converted)
+
+	code, _ = getBalance(newAPI, "?convert_to=JPY")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Without exchange rates the preference is ignored, but explicit
+	// conversions are refused
+	withoutRates := api.NewAPI(api.NewController(transactionmanager.NewTransactionManagerClient(storageClient)))
+	code, response = getBalance(withoutRates, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, response.Balance.Equal(decimal.NewFromFloat(100.55)))
+	assert.Nil(t, response.Converted)
+
+	code, _ = getBalance(withoutRates, "?currency=EUR")
+	assert.Equal(t, http.StatusNotImplemented, code)
+
+	// Clearing the preference shows the account currency again
+	assert.Equal(t, http.StatusOK, setDisplayCurrency(newAPI, ""))
+	_, response = getBalance(newAPI, "")
+	assert.Nil(t, response.Converted)
+}
+
 func TestGetUserTransactionHistoryEndpoint(t *testing.T) {
 	user := transactionmanager.User{
 		ID:      uuid.New(),
@@ -245,11 +524,12 @@ func TestGetUserTransactionHistoryEndpoint(t *testing.T) {
 
 		// If the status is OK, check the transactions in the response
 		if rr.Code == http.StatusOK {
-			var transactions []transactionmanager.Transaction
-			err = json.Unmarshal(rr.Body.Bytes(), &transactions)
+			var history api.HistoryResponse
+			err = json.Unmarshal(rr.Body.Bytes(), &history)
 			if err != nil {
 				t.Fatalf("failed to unmarshal response: %v", err)
 			}
+			transactions := history.Transactions
 
 			for i := range tc.expectedTransactions {
 				found := false
@@ -265,6 +545,201 @@ func TestGetUserTransactionHistoryEndpoint(t *testing.T) {
 	}
 }
 
+func TestCreateUserEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name                 string
+		requestBody          string
+		expectedStatusCode   int
+		expectedBalance      float64
+		expectedTransactions int
+		expectedCurrency     string
+	}{
+		{name: "Initial balance", requestBody: `{"initial_balance": 100.5}`, expectedStatusCode: http.StatusCreated, expectedBalance: 100.5, expectedTransactions: 1},
+		{name: "Zero balance", requestBody: `{}`, expectedStatusCode: http.StatusCreated, expectedBalance: 0, expectedTransactions: 0},
+		{name: "No body", requestBody: "", expectedStatusCode: http.StatusCreated, expectedBalance: 0, expectedTransactions: 0},
+		{name: "Negative balance", requestBody: `{"initial_balance": -1}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Account currency", requestBody: `{"initial_balance": 10, "currency": "usd"}`, expectedStatusCode: http.StatusCreated, expectedBalance: 10, expectedTransactions: 1, expectedCurrency: "USD"},
+		{name: "Unknown currency", requestBody: `{"currency": "XXX"}`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, UsersPath, bytes.NewBufferString(tc.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusCreated {
+				return
+			}
+
+			var user transactionmanager.User
+			err := json.Unmarshal(rr.Body.Bytes(), &user)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.NotEqual(t, uuid.Nil, user.ID)
+			assert.True(t, user.Balance.Equal(decimal.NewFromFloat(tc.expectedBalance)), "got %s", user.Balance)
+			assert.False(t, user.CreatedAt.IsZero())
+			assert.Equal(t, tc.expectedCurrency, user.Currency)
+
+			// The initial balance is on the ledger, not just on the user row
+			transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, transactionmanager.HistoryFilter{})
+			assert.Nil(t, err)
+			assert.Len(t, transactions, tc.expectedTransactions)
+			for _, transaction := range transactions {
+				assert.Equal(t, tc.expectedCurrency, transaction.Currency)
+			}
+
+			report, err := transactionManager.GetReconciliationReport(testEnv.Context, uuid.Nil, 100)
+			assert.Nil(t, err)
+			assert.Empty(t, report.Mismatches)
+		})
+	}
+}
+
+func TestCreateUserEndpoint_IdempotencyKey(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	createUser := func(requestBody string, idempotencyKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, UsersPath, bytes.NewBufferString(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := createUser(`{"initial_balance": 50}`, "signup-42")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotency-Replayed"))
+
+	retry := createUser(`{"initial_balance": 50}`, "signup-42")
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotency-Replayed"))
+	assert.JSONEq(t, first.Body.String(), retry.Body.String())
+
+	// Reusing the key for another user is a conflict
+	conflict := createUser(`{"initial_balance": 60}`, "signup-42")
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+
+	// Only one user was created, with its initial balance booked once
+	users, err := transactionManager.GetRecentUsers(testEnv.Context, 10)
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+
+	var user transactionmanager.User
+	err = json.Unmarshal(first.Body.Bytes(), &user)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, transactionmanager.HistoryFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 1)
+
+	// Another key creates another user
+	other := createUser(`{"initial_balance": 50}`, "signup-43")
+	assert.Equal(t, http.StatusCreated, other.Code)
+	assert.NotEqual(t, first.Body.String(), other.Body.String())
+}
+
+func TestGetUserByExternalIDEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:         uuid.New(),
+		Balance:    decimal.NewFromFloat(10),
+		ExternalID: sql.NullString{String: "customer-42", Valid: true},
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Another tenant knows a user of its own by the same external ID
+	tenantUser := storage.User{
+		ID:         uuid.New(),
+		Balance:    decimal.NewFromFloat(20),
+		ExternalID: sql.NullString{String: "customer-42", Valid: true},
+		TenantID:   "acme",
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, tenantUser)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	found, err := transactionManager.GetUserByExternalID(transactionmanager.WithTenant(testEnv.Context, "acme"), "customer-42")
+	assert.NoError(t, err)
+	assert.Equal(t, tenantUser.ID, found.ID)
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		externalID         string
+		expectedStatusCode int
+	}{
+		{name: "Found", externalID: "customer-42", expectedStatusCode: http.StatusOK},
+		{name: "Not found", externalID: "customer-43", expectedStatusCode: http.StatusNotFound},
+		// Must not be routed to the history of a user called by-external
+		{name: "Not found named like a route", externalID: "history", expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(UserByExternalIDTemplate, tc.externalID), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var found transactionmanager.User
+			err = json.Unmarshal(rr.Body.Bytes(), &found)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, user.ID, found.ID)
+			assert.Equal(t, "customer-42", found.ExternalID)
+			assert.True(t, found.Balance.Equal(user.Balance))
+		})
+	}
+}
+
 func TestAddTransaction(t *testing.T) {
 	testUserID := uuid.New()
 	idempotency_key := uuid.New().String()
@@ -314,6 +789,7 @@ func TestAddTransaction(t *testing.T) {
 			newAPI := api.NewAPI(controller)
 
 			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, testUserID.String()), bytes.NewBuffer(tc.requestBody))
+			req.Header.Set("Content-Type", "application/json")
 			rr := httptest.NewRecorder()
 			newAPI.ServeHTTP(rr, req)
 
@@ -331,7 +807,7 @@ func TestAddTransaction(t *testing.T) {
 				}
 				assert.Equal(t, "Transaction successfully added", response.Message)
 
-				transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, testUserID, 1, 10)
+				transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, testUserID, 1, 10, transactionmanager.HistoryFilter{})
 				if err != nil {
 					t.Fatalf("failed to get transactions: %v", err)
 				}
@@ -344,43 +820,339 @@ func TestAddTransaction(t *testing.T) {
 	}
 }
 
-func TestAddTransaction_MultipleRequestWithSameAmount(t *testing.T) {
-	testUserID := uuid.New()
-	idempotencyKey := uuid.New().String()
+func TestAddTransaction_InvalidIdempotencyKey(t *testing.T) {
 	testCases := []struct {
-		name               string
-		requestBody        []byte
-		expectedStatusCode int
-		mockError          error
+		name           string
+		idempotencyKey string
 	}{
 		{
-			name:               "Valid transaction",
-			requestBody:        []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s"}`, testUserID.String(), idempotencyKey)),
-			expectedStatusCode: http.StatusCreated,
-			mockError:          nil,
+			name:           "Key longer than 255 characters",
+			idempotencyKey: strings.Repeat("k", 256),
+		},
+		{
+			name:           "Key with control characters",
+			idempotencyKey: "order-42\\u0000\\n",
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Create a test environment
-			testEnv, err := utils.CreateTestEnv()
-			if err != nil {
-				t.Fatalf("failed to create test env: %v", err)
-			}
-			defer testEnv.Cleanup()
-
-			storageClient := storage.NewStorageClient(testEnv.DB)
+			// The key is rejected before the ledger is touched, so no test env is needed
+			storageClient := storage.NewStorageClient(nil)
 			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
 
-			user := storage.User{
-				ID:      testUserID,
-				Balance: decimal.NewFromFloat(0),
-			}
+			controller := api.NewController(transactionManager)
+			newAPI := api.NewAPI(controller)
 
-			err = storageClient.UserRepository.Add(testEnv.Context, user)
-			if err != nil {
-				t.Fatalf("failed to add user: %v", err)
+			requestBody := []byte(fmt.Sprintf(`{"amount":100, "idempotency_key":"%s"}`, tc.idempotencyKey))
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, uuid.New()), bytes.NewBuffer(requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+	}
+}
+
+func TestAddTransaction_StringIdempotencyKey(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	// The same string key must be recognised as a duplicate on retry
+	statusCodes := []int{}
+	for i := 0; i < 2; i++ {
+		requestBody := []byte(`{"amount":100, "idempotency_key":"order-42"}`)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		statusCodes = append(statusCodes, rr.Code)
+	}
+
+	assert.Equal(t, http.StatusCreated, statusCodes[0])
+	assert.NotEqual(t, http.StatusCreated, statusCodes[1])
+}
+
+func TestAddTransaction_ReplayedHeader(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithReturnExisting(true))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	responses := []*httptest.ResponseRecorder{}
+	for i := 0; i < 2; i++ {
+		requestBody := []byte(`{"amount":100, "idempotency_key":"order-42"}`)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		responses = append(responses, rr)
+	}
+
+	// The first request creates the transaction, the retry gets it back
+	assert.Equal(t, http.StatusCreated, responses[0].Code)
+	assert.Empty(t, responses[0].Header().Get("Idempotency-Replayed"))
+	assert.Equal(t, http.StatusCreated, responses[1].Code)
+	assert.Equal(t, "true", responses[1].Header().Get("Idempotency-Replayed"))
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+}
+
+func TestAddTransaction_SameKeyDifferentUsers(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	users := []storage.User{
+		{ID: uuid.New(), Balance: decimal.NewFromFloat(0)},
+		{ID: uuid.New(), Balance: decimal.NewFromFloat(0)},
+	}
+	for _, user := range users {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	addTransaction := func(userID uuid.UUID, amount float64) *httptest.ResponseRecorder {
+		requestBody := []byte(fmt.Sprintf(`{"amount":%v, "idempotency_key":"order-42"}`, amount))
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, userID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Keys are scoped per user, so both users get their transaction
+	for _, user := range users {
+		rr := addTransaction(user.ID, 100)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+
+		balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+		assert.Nil(t, err)
+		assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+	}
+
+	// A retry by the same user is still a duplicate
+	rr := addTransaction(users[0].ID, 100)
+	assert.NotEqual(t, http.StatusCreated, rr.Code)
+
+	// and so is the key reused for another amount
+	rr = addTransaction(users[0].ID, 50)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, users[0].ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+}
+
+func TestAddTransaction_ResponseReplay(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithClock(func() time.Time { return now }),
+		transactionmanager.WithResponseReplay(time.Hour))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	addTransaction := func() *httptest.ResponseRecorder {
+		requestBody := []byte(`{"amount":100, "idempotency_key":"order-42"}`)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := addTransaction()
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotency-Replayed"))
+
+	// A retry within the TTL gets the very same response without adding
+	// anything
+	now = now.Add(30 * time.Minute)
+	retry := addTransaction()
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotency-Replayed"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+
+	// Once the TTL has passed the key is fresh again
+	now = now.Add(time.Hour)
+	fresh := addTransaction()
+	assert.Equal(t, http.StatusCreated, fresh.Code)
+	assert.Empty(t, fresh.Header().Get("Idempotency-Replayed"))
+
+	balance, err = transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(200)))
+}
+
+func TestAddTransaction_Timeout(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithAddTimeout(300*time.Millisecond))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Make the balance update outlast the timeout
+	_, err = testEnv.DB.ExecContext(testEnv.Context, `
+		CREATE FUNCTION slow_balance_update() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_sleep(2);
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql;
+
+		CREATE TRIGGER slow_balance_update BEFORE UPDATE ON users
+			FOR EACH ROW EXECUTE FUNCTION slow_balance_update();`)
+	if err != nil {
+		t.Fatalf("failed to slow down balance updates: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	requestBody := []byte(`{"amount": 100}`)
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "took too long")
+
+	// The transaction row went with the rollback
+	var count int
+	err = testEnv.DB.QueryRowContext(testEnv.Context, "SELECT COUNT(*) FROM transactions WHERE user_id = $1", user.ID).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.IsZero())
+}
+
+func TestAddTransaction_MultipleRequestWithSameAmount(t *testing.T) {
+	testUserID := uuid.New()
+	idempotencyKey := uuid.New().String()
+	testCases := []struct {
+		name               string
+		requestBody        []byte
+		expectedStatusCode int
+		mockError          error
+	}{
+		{
+			name:               "Valid transaction",
+			requestBody:        []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s"}`, testUserID.String(), idempotencyKey)),
+			expectedStatusCode: http.StatusCreated,
+			mockError:          nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+			user := storage.User{
+				ID:      testUserID,
+				Balance: decimal.NewFromFloat(0),
+			}
+
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
 			}
 
 			// Create the controller and the test request
@@ -397,6 +1169,7 @@ func TestAddTransaction_MultipleRequestWithSameAmount(t *testing.T) {
 
 			for i := 0; i < concurrentRequests; i++ {
 				req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, testUserID.String()), bytes.NewBuffer(tc.requestBody))
+				req.Header.Set("Content-Type", "application/json")
 				rr := httptest.NewRecorder()
 
 				go func() {
@@ -450,7 +1223,7 @@ func TestAddTransaction_MultipleRequestWithDifferentAmount(t *testing.T) {
 	controller := api.NewController(transactionManager)
 	newAPI := api.NewAPI(controller)
 
-	//Dont make  it greater.There can be issues beacause of rate limiter.
+	// The requests are all for one user and share its rate limit
 	concurrentRequests := 5
 	startCh := make(chan struct{})
 	var wg sync.WaitGroup
@@ -463,6 +1236,7 @@ func TestAddTransaction_MultipleRequestWithDifferentAmount(t *testing.T) {
 
 			requestBody := []byte(fmt.Sprintf(`{"user_id":"%s", "amount":%f, "idempotency_key":"%s"}`, user.ID.String(), i, idempotencyKey))
 			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID.String()), bytes.NewBuffer(requestBody))
+			req.Header.Set("Content-Type", "application/json")
 			rr := httptest.NewRecorder()
 			<-startCh
 			newAPI.ServeHTTP(rr, req)
@@ -480,12 +1254,2662 @@ func TestAddTransaction_MultipleRequestWithDifferentAmount(t *testing.T) {
 	// Check the response status code
 	assert.Equal(t, int32(concurrentRequests), successCount)
 
+	// Every transaction saw the balance left by the one before it, whatever
+	// order the requests were served in
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var history struct {
+		Transactions []transactionmanager.Transaction `json:"transactions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.Len(t, history.Transactions, concurrentRequests)
+
+	sort.Slice(history.Transactions, func(i, j int) bool {
+		return history.Transactions[i].Sequence < history.Transactions[j].Sequence
+	})
+	running := decimal.Zero
+	for _, transaction := range history.Transactions {
+		running = running.Add(transaction.Amount)
+		assert.True(t, transaction.BalanceAfter.Equal(running), "balance after %d: got %s, want %s", transaction.Sequence, transaction.BalanceAfter, running)
+	}
+	assert.True(t, running.Equal(decimal.NewFromFloat(15)))
+}
+
+func TestGetUserTransactionHistoryEndpoint_JSONNaming(t *testing.T) {
+	testCases := []struct {
+		name         string
+		naming       api.JSONNaming
+		expectedKeys []string
+		missingKeys  []string
+	}{
+		{
+			name:         "Snake case",
+			naming:       api.SnakeCase,
+			expectedKeys: []string{"id", "user_id", "created_at", "idempotency_key"},
+			missingKeys:  []string{"userId", "createdAt", "idempotencyKey"},
+		},
+		{
+			name:         "Camel case",
+			naming:       api.CamelCase,
+			expectedKeys: []string{"id", "userId", "createdAt", "idempotencyKey"},
+			missingKeys:  []string{"user_id", "created_at", "idempotency_key"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+			user := storage.User{
+				ID:      uuid.New(),
+				Balance: decimal.NewFromFloat(0),
+			}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+				ID:             uuid.New(),
+				UserID:         user.ID,
+				Amount:         decimal.NewFromFloat(100),
+				CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				IdempotencyKey: uuid.New(),
+			})
+			if err != nil {
+				t.Fatalf("failed to add transaction: %v", err)
+			}
+
+			controller := api.NewController(transactionManager, api.WithJSONNaming(tc.naming))
+			newAPI := api.NewAPI(controller)
+
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			var history struct {
+				Transactions []map[string]interface{} `json:"transactions"`
+			}
+			err = json.Unmarshal(rr.Body.Bytes(), &history)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			transactions := history.Transactions
+			assert.Equal(t, 1, len(transactions))
+
+			for _, key := range tc.expectedKeys {
+				assert.Contains(t, transactions[0], key)
+			}
+			for _, key := range tc.missingKeys {
+				assert.NotContains(t, transactions[0], key)
+			}
+		})
+	}
 }
 
-func transactionsEqual(a, b transactionmanager.Transaction) bool {
-	return a.ID == b.ID &&
-		a.Amount.Equal(b.Amount) &&
-		a.UserID == b.UserID &&
-		a.CreatedAt.Equal(b.CreatedAt) &&
-		a.IdempotencyKey == b.IdempotencyKey
+func TestGetUserTransactionHistoryEndpoint_NDJSON(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	numTransactions := 3
+	for i := 0; i < numTransactions; i++ {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+
+	// Consume the stream line by line, each line is one transaction
+	scanner := bufio.NewScanner(rr.Body)
+	lines := 0
+	for scanner.Scan() {
+		var transaction transactionmanager.Transaction
+		err = json.Unmarshal(scanner.Bytes(), &transaction)
+		if err != nil {
+			t.Fatalf("failed to unmarshal line %d: %v", lines, err)
+		}
+		assert.Equal(t, user.ID, transaction.UserID)
+		lines++
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, numTransactions, lines)
+}
+
+func TestCompression(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithCompression(1024, 9))
+
+	// The balance is well below the threshold and is sent as it is
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, user.ID), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Less(t, rr.Body.Len(), 1024)
+	assert.True(t, json.Valid(rr.Body.Bytes()))
+
+	// A page of 20 transactions is over it and gets gzipped
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, "?pageSize=20"), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to read gzipped response: %v", err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read gzipped response: %v", err)
+	}
+	assert.Greater(t, len(body), 1024)
+
+	var history api.HistoryResponse
+	err = json.Unmarshal(body, &history)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.Len(t, history.Transactions, 20)
+
+	// Clients that don't accept gzip get the page uncompressed
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, "?pageSize=20"), nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.True(t, json.Valid(rr.Body.Bytes()))
+}
+
+func TestGetGroupedTransactionHistoryEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	transactions := []struct {
+		amount    float64
+		createdAt time.Time
+	}{
+		{100, time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)},
+		{-20, time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)},
+		{50, time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, transaction := range transactions {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(transaction.amount),
+			CreatedAt:      transaction.createdAt,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	getGroups := func(query string) []transactionmanager.DayGroup {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GroupedHistoryTemplate, user.ID, query), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var groups []transactionmanager.DayGroup
+		if err := json.Unmarshal(rr.Body.Bytes(), &groups); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return groups
+	}
+
+	// Newest day first, each with its own net
+	groups := getGroups("?by=day")
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "2020-01-02", groups[0].Date)
+		assert.Len(t, groups[0].Transactions, 1)
+		assert.True(t, groups[0].Net.Equal(decimal.NewFromFloat(50)))
+
+		assert.Equal(t, "2020-01-01", groups[1].Date)
+		if assert.Len(t, groups[1].Transactions, 2) {
+			assert.True(t, groups[1].Transactions[0].Amount.Equal(decimal.NewFromFloat(-20)))
+			assert.True(t, groups[1].Transactions[1].Amount.Equal(decimal.NewFromFloat(100)))
+		}
+		assert.True(t, groups[1].Net.Equal(decimal.NewFromFloat(80)))
+	}
+
+	// Pages count days, so the second page holds the whole first day
+	groups = getGroups("?by=day&page=2&pageSize=1")
+	if assert.Len(t, groups, 1) {
+		assert.Equal(t, "2020-01-01", groups[0].Date)
+		assert.Len(t, groups[0].Transactions, 2)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GroupedHistoryTemplate, user.ID, "?by=week"), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetLargestTransactionEndpoint(t *testing.T) {
+	testCases := []struct {
+		name               string
+		amounts            []float64
+		voided             []int
+		deleted            []int
+		queryParams        string
+		expectedStatusCode int
+		expectedAmount     float64
+	}{
+		{
+			name:               "Clear maximum",
+			amounts:            []float64{10, 250, 40},
+			queryParams:        "?type=credit",
+			expectedStatusCode: http.StatusOK,
+			expectedAmount:     250,
+		},
+		{
+			name:               "Largest voided",
+			amounts:            []float64{10, 250, 40},
+			voided:             []int{1},
+			queryParams:        "?type=credit",
+			expectedStatusCode: http.StatusOK,
+			expectedAmount:     40,
+		},
+		{
+			name:               "Largest deleted",
+			amounts:            []float64{10, 250, 40},
+			deleted:            []int{1},
+			queryParams:        "?type=credit",
+			expectedStatusCode: http.StatusOK,
+			expectedAmount:     40,
+		},
+		{
+			name:               "No transactions",
+			amounts:            nil,
+			queryParams:        "",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Invalid type",
+			amounts:            nil,
+			queryParams:        "?type=refund",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+			user := storage.User{
+				ID:      uuid.New(),
+				Balance: decimal.NewFromFloat(0),
+			}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			var ids []uuid.UUID
+			for _, amount := range tc.amounts {
+				transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+					ID:             uuid.New(),
+					UserID:         user.ID,
+					Amount:         decimal.NewFromFloat(amount),
+					CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+					IdempotencyKey: uuid.New(),
+				})
+				if err != nil {
+					t.Fatalf("failed to add transaction: %v", err)
+				}
+				ids = append(ids, transaction.ID)
+			}
+			for _, i := range tc.voided {
+				if _, err := transactionManager.VoidTransaction(testEnv.Context, ids[i]); err != nil {
+					t.Fatalf("failed to void transaction: %v", err)
+				}
+			}
+			for _, i := range tc.deleted {
+				if _, err := transactionManager.DeleteTransaction(testEnv.Context, ids[i]); err != nil {
+					t.Fatalf("failed to delete transaction: %v", err)
+				}
+			}
+
+			controller := api.NewController(transactionManager)
+			newAPI := api.NewAPI(controller)
+
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetLargestTransactionTemplate, user.ID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+
+			if rr.Code == http.StatusOK {
+				var transaction transactionmanager.Transaction
+				err = json.Unmarshal(rr.Body.Bytes(), &transaction)
+				if err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+				assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(tc.expectedAmount)), "expected amount %f, got %s", tc.expectedAmount, transaction.Amount)
+			}
+		})
+	}
+}
+
+func TestValidateTransactionEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	// A user whose override caps amounts at 50
+	limitedUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, limitedUser)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	maxAmount := decimal.NewFromFloat(50)
+	_, err = transactionManager.SetUserLimits(testEnv.Context, limitedUser.ID, transactionmanager.UserLimits{MaxAmount: &maxAmount})
+	if err != nil {
+		t.Fatalf("failed to set user limits: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		requestBody    []byte
+		expectedValid  bool
+		expectedErrors int
+	}{
+		{
+			name:           "Valid transaction",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s"}`, uuid.New(), uuid.New())),
+			expectedValid:  true,
+			expectedErrors: 0,
+		},
+		{
+			name:           "Negative amount",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":-100, "idempotency_key":"%s"}`, uuid.New(), uuid.New())),
+			expectedValid:  false,
+			expectedErrors: 1,
+		},
+		{
+			name:           "Known reason code",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s", "reason_code":"DEPOSIT"}`, uuid.New(), uuid.New())),
+			expectedValid:  true,
+			expectedErrors: 0,
+		},
+		{
+			name:           "Unknown reason code",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s", "reason_code":"BRIBE"}`, uuid.New(), uuid.New())),
+			expectedValid:  false,
+			expectedErrors: 1,
+		},
+		{
+			name:           "Currency code",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s", "currency":"EUR"}`, uuid.New(), uuid.New())),
+			expectedValid:  true,
+			expectedErrors: 0,
+		},
+		{
+			name:           "Malformed currency",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s", "currency":"EURO"}`, uuid.New(), uuid.New())),
+			expectedValid:  false,
+			expectedErrors: 1,
+		},
+		{
+			name:           "Within the user's limit",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":50, "idempotency_key":"%s"}`, limitedUser.ID, uuid.New())),
+			expectedValid:  true,
+			expectedErrors: 0,
+		},
+		{
+			name:           "Over the user's limit",
+			requestBody:    []byte(fmt.Sprintf(`{"user_id":"%s", "amount":100, "idempotency_key":"%s"}`, limitedUser.ID, uuid.New())),
+			expectedValid:  false,
+			expectedErrors: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, ValidateTransactionPath, bytes.NewBuffer(tc.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			var response api.ValidateTransactionResponse
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, tc.expectedValid, response.Valid)
+			assert.Equal(t, tc.expectedErrors, len(response.Errors))
+		})
+	}
+}
+
+func TestGetAverageTransactionAmountEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	emptyUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, u := range []storage.User{user, emptyUser} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	for i, amount := range []float64{10, 20, 60, -30} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		userID             uuid.UUID
+		queryParams        string
+		expectedStatusCode int
+		expectedAverage    float64
+	}{
+		{name: "All transactions", userID: user.ID, queryParams: "", expectedStatusCode: http.StatusOK, expectedAverage: 15},
+		{name: "Credits", userID: user.ID, queryParams: "?type=credit", expectedStatusCode: http.StatusOK, expectedAverage: 30},
+		{name: "Debits", userID: user.ID, queryParams: "?type=debit", expectedStatusCode: http.StatusOK, expectedAverage: -30},
+		{name: "Date range", userID: user.ID, queryParams: "?type=credit&from=2020-01-02T00:00:00Z&to=2020-01-04T00:00:00Z", expectedStatusCode: http.StatusOK, expectedAverage: 40},
+		{name: "No transactions", userID: emptyUser.ID, queryParams: "", expectedStatusCode: http.StatusOK, expectedAverage: 0},
+		{name: "Invalid type", userID: user.ID, queryParams: "?type=refund", expectedStatusCode: http.StatusBadRequest},
+		{name: "Unknown user", userID: uuid.New(), queryParams: "", expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(AverageAmountTemplate, tc.userID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var response map[string]decimal.Decimal
+			err = json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.True(t, response["average"].Equal(decimal.NewFromFloat(tc.expectedAverage)), "expected average %f, got %s", tc.expectedAverage, response["average"])
+		})
+	}
+}
+
+func TestGetBalanceVolatilityEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	now := time.Date(2020, 1, 4, 12, 0, 0, 0, time.UTC)
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}),
+		transactionmanager.WithClock(func() time.Time { return now }))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	emptyUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, u := range []storage.User{user, emptyUser} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	// Daily net changes of +10, -10, +10 and -10 from January 1st to 4th:
+	// a mean of zero and a standard deviation of 10
+	transactions := []struct {
+		day    int
+		amount float64
+	}{
+		{1, 10},
+		{2, 5}, {2, -15},
+		{3, 10},
+		{4, -10},
+	}
+	for i, transaction := range transactions {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(transaction.amount),
+			CreatedAt:      time.Date(2020, 1, transaction.day, i, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		userID             uuid.UUID
+		queryParams        string
+		expectedStatusCode int
+		expectedVolatility float64
+	}{
+		{name: "Known daily changes", userID: user.ID, queryParams: "?window=4d", expectedStatusCode: http.StatusOK, expectedVolatility: 10},
+		{name: "Last two days", userID: user.ID, queryParams: "?window=2d", expectedStatusCode: http.StatusOK, expectedVolatility: 10},
+		{name: "Single day", userID: user.ID, queryParams: "?window=1d", expectedStatusCode: http.StatusOK, expectedVolatility: 0},
+		{name: "No transactions", userID: emptyUser.ID, queryParams: "", expectedStatusCode: http.StatusOK, expectedVolatility: 0},
+		{name: "Invalid window", userID: user.ID, queryParams: "?window=30", expectedStatusCode: http.StatusBadRequest},
+		{name: "Unknown user", userID: uuid.New(), queryParams: "", expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(VolatilityTemplate, tc.userID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Volatility decimal.Decimal `json:"volatility"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.True(t, response.Volatility.Equal(decimal.NewFromFloat(tc.expectedVolatility)), "expected %v, got %s", tc.expectedVolatility, response.Volatility)
+		})
+	}
+}
+
+func TestGetTransactionCadenceEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	singleUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	emptyUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, u := range []storage.User{user, singleUser, emptyUser} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	// Gaps of one and three hours, added out of order: an average of two
+	// hours and a longest gap of three
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	transactions := []struct {
+		userID    uuid.UUID
+		createdAt time.Time
+	}{
+		{user.ID, start.Add(4 * time.Hour)},
+		{user.ID, start},
+		{user.ID, start.Add(time.Hour)},
+		{singleUser.ID, start},
+	}
+	for _, transaction := range transactions {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         transaction.userID,
+			Amount:         decimal.NewFromFloat(10),
+			CreatedAt:      transaction.createdAt,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	hours := func(h float64) *float64 {
+		seconds := h * 3600
+		return &seconds
+	}
+
+	testCases := []struct {
+		name               string
+		userID             uuid.UUID
+		expectedStatusCode int
+		expectedCadence    transactionmanager.Cadence
+	}{
+		{name: "Known gaps", userID: user.ID, expectedStatusCode: http.StatusOK,
+			expectedCadence: transactionmanager.Cadence{Transactions: 3, AverageGapSeconds: hours(2), MaxGapSeconds: hours(3)}},
+		{name: "Single transaction", userID: singleUser.ID, expectedStatusCode: http.StatusOK,
+			expectedCadence: transactionmanager.Cadence{Transactions: 1}},
+		{name: "No transactions", userID: emptyUser.ID, expectedStatusCode: http.StatusOK,
+			expectedCadence: transactionmanager.Cadence{Transactions: 0}},
+		{name: "Unknown user", userID: uuid.New(), expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(CadenceTemplate, tc.userID), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var response transactionmanager.Cadence
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, tc.expectedCadence, response)
+		})
+	}
+}
+
+func TestGetUserIdempotencyKeysEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithKeyReuseAfterSettlement(true))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Key A is used again for another amount once its first transaction
+	// settled, the last key falls outside the window
+	keyA, keyB, keyC := uuid.New(), uuid.New(), uuid.New()
+	entries := []struct {
+		key    uuid.UUID
+		amount float64
+		day    int
+	}{
+		{key: keyA, amount: 10, day: 1},
+		{key: keyB, amount: 20, day: 2},
+		{key: keyA, amount: 30, day: 3},
+		{key: keyC, amount: 40, day: 10},
+	}
+	var ids []uuid.UUID
+	for _, entry := range entries {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(entry.amount),
+			CreatedAt:      time.Date(2020, 1, entry.day, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: entry.key,
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		ids = append(ids, transaction.ID)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	get := func(queryParams string) []transactionmanager.IdempotencyKeyUsage {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(IdempotencyKeysTemplate, user.ID, queryParams), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var keys []transactionmanager.IdempotencyKeyUsage
+		err := json.Unmarshal(rr.Body.Bytes(), &keys)
+		if err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return keys
+	}
+
+	window := "?from=2020-01-01T00:00:00Z&to=2020-01-05T00:00:00Z"
+	keys := get(window)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, keyA, keys[0].IdempotencyKey)
+		assert.Equal(t, []uuid.UUID{ids[0], ids[2]}, keys[0].TransactionIDs)
+		assert.Equal(t, keyB, keys[1].IdempotencyKey)
+		assert.Equal(t, []uuid.UUID{ids[1]}, keys[1].TransactionIDs)
+	}
+
+	// Second page of one
+	keys = get(window + "&page=2&pageSize=1")
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, keyB, keys[0].IdempotencyKey)
+	}
+}
+
+func TestGetTransactionEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	added, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(42),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		id                 string
+		expectedStatusCode int
+	}{
+		{name: "Existing transaction", id: added.ID.String(), expectedStatusCode: http.StatusOK},
+		{name: "Unknown transaction", id: uuid.New().String(), expectedStatusCode: http.StatusNotFound},
+		{name: "Invalid ID", id: "not-a-uuid", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(TransactionTemplate, tc.id), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if rr.Code != http.StatusOK {
+				var response map[string]string
+				err := json.Unmarshal(rr.Body.Bytes(), &response)
+				assert.Nil(t, err)
+				assert.NotEmpty(t, response["message"])
+				return
+			}
+
+			var transaction transactionmanager.Transaction
+			err := json.Unmarshal(rr.Body.Bytes(), &transaction)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, added.ID, transaction.ID)
+			assert.Equal(t, user.ID, transaction.UserID)
+			assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(42)))
+			assert.Equal(t, added.Sequence, transaction.Sequence)
+		})
+	}
+}
+
+func TestExportUserHistoryCSVEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	var added []transactionmanager.Transaction
+	for _, amount := range []float64{100, -30.25} {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		added = append(added, transaction)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(HistoryCSVTemplate, user.ID), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf(`attachment; filename="history-%s.csv"`, user.ID), rr.Header().Get("Content-Disposition"))
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read CSV: %v", err)
+	}
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, []string{"id", "created_at", "amount", "balance_after", "idempotency_key"}, records[0])
+		// Newest first
+		assert.Equal(t, []string{added[1].ID.String(), added[1].CreatedAt.UTC().Format(time.RFC3339Nano), "-30.25", "69.75", added[1].IdempotencyKey.String()}, records[1])
+		assert.Equal(t, []string{added[0].ID.String(), added[0].CreatedAt.UTC().Format(time.RFC3339Nano), "100", "100", added[0].IdempotencyKey.String()}, records[2])
+	}
+
+	// An unknown user is reported before anything is streamed
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(HistoryCSVTemplate, uuid.New()), nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Disposition"))
+}
+
+func TestGetTransactionImpactEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	other := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, u := range []storage.User{user, other} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	var added []transactionmanager.Transaction
+	for _, amount := range []float64{100, -30, 45.5} {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		added = append(added, transaction)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name                  string
+		id                    string
+		userID                string
+		expectedStatusCode    int
+		expectedBalanceBefore float64
+		expectedBalanceAfter  float64
+	}{
+		{name: "First transaction", id: added[0].ID.String(), userID: user.ID.String(), expectedStatusCode: http.StatusOK, expectedBalanceBefore: 0, expectedBalanceAfter: 100},
+		{name: "Debit", id: added[1].ID.String(), userID: user.ID.String(), expectedStatusCode: http.StatusOK, expectedBalanceBefore: 100, expectedBalanceAfter: 70},
+		{name: "Latest transaction", id: added[2].ID.String(), userID: user.ID.String(), expectedStatusCode: http.StatusOK, expectedBalanceBefore: 70, expectedBalanceAfter: 115.5},
+		{name: "Another user's transaction", id: added[1].ID.String(), userID: other.ID.String(), expectedStatusCode: http.StatusNotFound},
+		{name: "Unknown transaction", id: uuid.New().String(), userID: user.ID.String(), expectedStatusCode: http.StatusNotFound},
+		{name: "Missing user ID", id: added[0].ID.String(), userID: "", expectedStatusCode: http.StatusBadRequest},
+		{name: "Invalid ID", id: "not-a-uuid", userID: user.ID.String(), expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(TransactionImpactTemplate, tc.id, tc.userID), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var impact transactionmanager.TransactionImpact
+			err := json.Unmarshal(rr.Body.Bytes(), &impact)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, tc.id, impact.TransactionID.String())
+			assert.True(t, impact.BalanceBefore.Equal(decimal.NewFromFloat(tc.expectedBalanceBefore)), "balance before %s", impact.BalanceBefore)
+			assert.True(t, impact.BalanceAfter.Equal(decimal.NewFromFloat(tc.expectedBalanceAfter)), "balance after %s", impact.BalanceAfter)
+			// The balances bracket the amount
+			assert.True(t, impact.BalanceAfter.Sub(impact.BalanceBefore).Equal(impact.Amount), "amount %s", impact.Amount)
+		})
+	}
+}
+
+func TestBatchGetTransactionsEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		ids = append(ids, transaction.ID)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	post := func(requested []uuid.UUID) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.BatchGetTransactionsRequest{IDs: requested})
+		req, _ := http.NewRequest(http.MethodPost, BatchGetTransactionsPath, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Missing IDs are skipped and the rest come back in the requested order
+	missing := uuid.New()
+	rr := post([]uuid.UUID{ids[2], missing, ids[0]})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var transactions []transactionmanager.Transaction
+	err = json.Unmarshal(rr.Body.Bytes(), &transactions)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.Len(t, transactions, 2) {
+		assert.Equal(t, ids[2], transactions[0].ID)
+		assert.Equal(t, ids[0], transactions[1].ID)
+	}
+
+	// Too many IDs
+	tooMany := make([]uuid.UUID, 101)
+	for i := range tooMany {
+		tooMany[i] = uuid.New()
+	}
+	rr = post(tooMany)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetLargestTransactionEndpoint_CacheKey(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	addTransaction := func(amount float64) {
+		_, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	addTransaction(10)
+
+	controller := api.NewController(transactionManager, api.WithResultCacheTTL(time.Minute), api.WithResultCacheSize(1))
+	newAPI := api.NewAPI(controller)
+
+	get := func(cacheKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetLargestTransactionTemplate, user.ID, "?type=credit"), nil)
+		req.Header.Set("Idempotency-Key", cacheKey)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := get("report-1")
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	// A larger transaction arrives, but the same key still gets the result
+	// computed for the first request
+	addTransaction(500)
+
+	second := get("report-1")
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "application/json", second.Header().Get("Content-Type"))
+
+	// A new key recomputes
+	fresh := get("report-2")
+	var transaction transactionmanager.Transaction
+	err = json.Unmarshal(fresh.Body.Bytes(), &transaction)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(500)))
+
+	// The cache holds a single result, so the new key pushed out the first
+	evicted := get("report-1")
+	err = json.Unmarshal(evicted.Body.Bytes(), &transaction)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(500)))
+}
+
+func TestGetUserTransactionHistoryEndpoint_IncludeVoided(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	var added []transactionmanager.Transaction
+	for i := 0; i < 2; i++ {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		added = append(added, transaction)
+	}
+
+	voided, err := transactionManager.VoidTransaction(testEnv.Context, added[0].ID)
+	if err != nil {
+		t.Fatalf("failed to void transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		queryParams        string
+		expectedStatusCode int
+		expectedIDs        []uuid.UUID
+	}{
+		{name: "Voided left out by default", queryParams: "", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID}},
+		{name: "Voided left out explicitly", queryParams: "?include_voided=false", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID}},
+		{name: "Voided included", queryParams: "?include_voided=true", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID, voided.ID}},
+		{name: "Invalid value", queryParams: "?include_voided=maybe", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var history api.HistoryResponse
+			err = json.Unmarshal(rr.Body.Bytes(), &history)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			transactions := history.Transactions
+
+			var ids []uuid.UUID
+			for _, transaction := range transactions {
+				ids = append(ids, transaction.ID)
+				if transaction.ID == voided.ID {
+					assert.Equal(t, transactionmanager.TransactionStatusVoided, transaction.Status)
+				}
+			}
+			assert.Equal(t, tc.expectedIDs, ids)
+		})
+	}
+}
+
+func TestGetUserTransactionHistoryEndpoint_DateRange(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// One transaction on each of January 1st to 3rd
+	var added []transactionmanager.Transaction
+	for i := 0; i < 3; i++ {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		added = append(added, transaction)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		queryParams        string
+		expectedStatusCode int
+		expectedIDs        []uuid.UUID
+	}{
+		{name: "No range", queryParams: "", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[2].ID, added[1].ID, added[0].ID}},
+		{name: "From only", queryParams: "?from=2020-01-02T00:00:00Z", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[2].ID, added[1].ID}},
+		{name: "To only", queryParams: "?to=2020-01-02T00:00:00Z", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID, added[0].ID}},
+		{name: "Both", queryParams: "?from=2020-01-02T00:00:00Z&to=2020-01-02T12:00:00Z", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID}},
+		{name: "Other time zone", queryParams: "?from=2020-01-02T01:00:00%2B01:00&to=2020-01-02T01:00:00%2B01:00", expectedStatusCode: http.StatusOK, expectedIDs: []uuid.UUID{added[1].ID}},
+		{name: "Invalid from", queryParams: "?from=yesterday", expectedStatusCode: http.StatusBadRequest},
+		{name: "Invalid to", queryParams: "?to=2020-01-02", expectedStatusCode: http.StatusBadRequest},
+		{name: "To before from", queryParams: "?from=2020-01-03T00:00:00Z&to=2020-01-01T00:00:00Z", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var history api.HistoryResponse
+			err = json.Unmarshal(rr.Body.Bytes(), &history)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			transactions := history.Transactions
+
+			var ids []uuid.UUID
+			for _, transaction := range transactions {
+				ids = append(ids, transaction.ID)
+			}
+			assert.Equal(t, tc.expectedIDs, ids)
+		})
+	}
+}
+
+func TestGetUserTransactionHistoryEndpoint_Cursor(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	add := func(day int) transactionmanager.Transaction {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(day)),
+			CreatedAt:      time.Date(2020, 1, day, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		return transaction
+	}
+
+	var added []transactionmanager.Transaction
+	for day := 1; day <= 3; day++ {
+		added = append(added, add(day))
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	type cursorPage struct {
+		Transactions []transactionmanager.Transaction `json:"transactions"`
+		NextCursor   string                           `json:"next_cursor"`
+	}
+	get := func(queryParams string) (int, cursorPage) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, queryParams), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var page cursorPage
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		return rr.Code, page
+	}
+	ids := func(transactions []transactionmanager.Transaction) []uuid.UUID {
+		var ids []uuid.UUID
+		for _, transaction := range transactions {
+			ids = append(ids, transaction.ID)
+		}
+		return ids
+	}
+
+	code, first := get("?cursor=&pageSize=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uuid.UUID{added[2].ID, added[1].ID}, ids(first.Transactions))
+	assert.NotEmpty(t, first.NextCursor)
+
+	// A transaction arriving between pages would shift an offset page, the
+	// cursor page still picks up right after the last one seen
+	add(4)
+
+	code, second := get("?pageSize=2&cursor=" + first.NextCursor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uuid.UUID{added[0].ID}, ids(second.Transactions))
+	assert.Empty(t, second.NextCursor)
+
+	// Offset pages keep working
+	code, _ = get("?page=2&pageSize=2")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get("?cursor=not-a-cursor")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = get("?cursor=&include_balances=true")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Transactions created at the same time come newest sequence first,
+	// whether paged by offset, by cursor or streamed
+	tied := []transactionmanager.Transaction{add(10), add(10)}
+	expected := []uuid.UUID{tied[1].ID, tied[0].ID}
+
+	var offsetIDs []uuid.UUID
+	for page := 1; page <= 2; page++ {
+		_, offsetPage := get(fmt.Sprintf("?page=%d&pageSize=1", page))
+		offsetIDs = append(offsetIDs, ids(offsetPage.Transactions)...)
+	}
+	assert.Equal(t, expected, offsetIDs)
+
+	_, first = get("?cursor=&pageSize=1")
+	_, second = get("?pageSize=1&cursor=" + first.NextCursor)
+	assert.Equal(t, expected, append(ids(first.Transactions), ids(second.Transactions)...))
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	var streamed []transactionmanager.Transaction
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() && len(streamed) < len(expected) {
+		var transaction transactionmanager.Transaction
+		if err := json.Unmarshal(scanner.Bytes(), &transaction); err != nil {
+			t.Fatalf("failed to unmarshal line: %v", err)
+		}
+		streamed = append(streamed, transaction)
+	}
+	assert.Equal(t, expected, ids(streamed))
+}
+
+func TestGetUserTransactionHistoryEndpoint_Channel(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	add := func(amount int, channel string) int {
+		requestBody := []byte(fmt.Sprintf(`{"amount": %d}`, amount))
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		if channel != "" {
+			req.Header.Set("X-Channel", channel)
+		}
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, add(1, "mobile"))
+	assert.Equal(t, http.StatusCreated, add(2, "web"))
+	assert.Equal(t, http.StatusCreated, add(3, "mobile"))
+	assert.Equal(t, http.StatusCreated, add(4, ""))
+	assert.Equal(t, http.StatusBadRequest, add(5, "fax"))
+
+	testCases := []struct {
+		name            string
+		query           string
+		expectedStatus  int
+		expectedAmounts []float64
+	}{
+		{name: "mobile", query: "?channel=mobile", expectedStatus: http.StatusOK, expectedAmounts: []float64{3, 1}},
+		{name: "web", query: "?channel=web", expectedStatus: http.StatusOK, expectedAmounts: []float64{2}},
+		{name: "defaulted to api", query: "?channel=api", expectedStatus: http.StatusOK, expectedAmounts: []float64{4}},
+		{name: "unfiltered", query: "", expectedStatus: http.StatusOK, expectedAmounts: []float64{4, 3, 2, 1}},
+		{name: "unknown channel", query: "?channel=fax", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, tc.query), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var history api.HistoryResponse
+			err := json.Unmarshal(rr.Body.Bytes(), &history)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			transactions := history.Transactions
+
+			if assert.Len(t, transactions, len(tc.expectedAmounts)) {
+				for i, amount := range tc.expectedAmounts {
+					assert.True(t, transactions[i].Amount.Equal(decimal.NewFromFloat(amount)))
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserTransactionHistoryEndpoint_PageBalances(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Amounts 1 to 5 on consecutive days
+	for i := 0; i < 5; i++ {
+		_, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	// The middle page holds the amounts 3 and 2, newest first
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, "?page=2&pageSize=2&include_balances=true"), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var historyPage transactionmanager.HistoryPage
+	err = json.Unmarshal(rr.Body.Bytes(), &historyPage)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	if assert.Len(t, historyPage.Transactions, 2) {
+		assert.True(t, historyPage.Transactions[0].Amount.Equal(decimal.NewFromInt(3)))
+		assert.True(t, historyPage.Transactions[1].Amount.Equal(decimal.NewFromInt(2)))
+	}
+	assert.True(t, historyPage.PageOpeningBalance.Equal(decimal.NewFromInt(1)), "opening balance is the sum before the page")
+	assert.True(t, historyPage.PageClosingBalance.Equal(decimal.NewFromInt(6)), "closing balance adds the page's transactions")
+
+	// Without the option the page comes with the usual pagination metadata
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, "?page=2&pageSize=2"), nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	var history api.HistoryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &history)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.Len(t, history.Transactions, 2)
+}
+
+func TestGetUserTransactionHistoryEndpoint_PaginationMetadata(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	var added []transactionmanager.Transaction
+	for i := 0; i < 5; i++ {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(10.25 + float64(i)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		added = append(added, transaction)
+	}
+
+	// Voided transactions are left out of the count like they are left out
+	// of the pages
+	_, err = transactionManager.VoidTransaction(testEnv.Context, added[4].ID)
+	if err != nil {
+		t.Fatalf("failed to void transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name                 string
+		queryParams          string
+		expectedPage         int
+		expectedPageSize     int
+		expectedTotalCount   int64
+		expectedTotalPages   int64
+		expectedTransactions int
+	}{
+		{name: "Defaults", queryParams: "", expectedPage: 1, expectedPageSize: 10, expectedTotalCount: 4, expectedTotalPages: 1, expectedTransactions: 4},
+		{name: "Last partial page", queryParams: "?page=2&pageSize=3", expectedPage: 2, expectedPageSize: 3, expectedTotalCount: 4, expectedTotalPages: 2, expectedTransactions: 1},
+		{name: "Past the end", queryParams: "?page=5&pageSize=2", expectedPage: 5, expectedPageSize: 2, expectedTotalCount: 4, expectedTotalPages: 2, expectedTransactions: 0},
+		{name: "Including voided", queryParams: "?pageSize=2&include_voided=true", expectedPage: 1, expectedPageSize: 2, expectedTotalCount: 5, expectedTotalPages: 3, expectedTransactions: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			var history api.HistoryResponse
+			err := json.Unmarshal(rr.Body.Bytes(), &history)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, tc.expectedPage, history.Page)
+			assert.Equal(t, tc.expectedPageSize, history.PageSize)
+			assert.Equal(t, tc.expectedTotalCount, history.TotalCount)
+			assert.Equal(t, tc.expectedTotalPages, history.TotalPages)
+			assert.Len(t, history.Transactions, tc.expectedTransactions)
+		})
+	}
+
+	// Amounts keep their exact decimal value inside the envelope
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, "?pageSize=1"), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	var history api.HistoryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &history)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if assert.Len(t, history.Transactions, 1) {
+		assert.Equal(t, "13.25", history.Transactions[0].Amount.String())
+	}
+}
+
+func TestAddTransaction_DuplicateWindow(t *testing.T) {
+	testCases := []struct {
+		name                     string
+		reject                   bool
+		expectedSecondStatusCode int
+	}{
+		{name: "Flagged", reject: false, expectedSecondStatusCode: http.StatusCreated},
+		{name: "Rejected", reject: true, expectedSecondStatusCode: http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithDuplicateWindow(time.Minute, tc.reject))
+
+			user := storage.User{
+				ID:      uuid.New(),
+				Balance: decimal.NewFromFloat(0),
+			}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			controller := api.NewController(transactionManager)
+			newAPI := api.NewAPI(controller)
+
+			// The same keyless transaction twice in a row
+			var responses []*httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBufferString(`{"amount": 100}`))
+				req.Header.Set("Content-Type", "application/json")
+				rr := httptest.NewRecorder()
+				newAPI.ServeHTTP(rr, req)
+				responses = append(responses, rr)
+			}
+
+			assert.Equal(t, http.StatusCreated, responses[0].Code)
+			assert.NotContains(t, responses[0].Body.String(), "warning")
+			assert.Equal(t, tc.expectedSecondStatusCode, responses[1].Code)
+			if !tc.reject {
+				assert.Contains(t, responses[1].Body.String(), "possible duplicate")
+			}
+		})
+	}
+}
+
+func TestAddTransaction_AmountMinor(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{name: "Minor units", requestBody: `{"amount_minor": 10050, "currency": "USD"}`, expectedStatusCode: http.StatusCreated},
+		{name: "Both agreeing", requestBody: `{"amount": 100.5, "amount_minor": 10050, "currency": "USD"}`, expectedStatusCode: http.StatusCreated},
+		{name: "Both disagreeing", requestBody: `{"amount": 100, "amount_minor": 10050, "currency": "USD"}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Missing currency", requestBody: `{"amount_minor": 10050}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Unknown currency", requestBody: `{"amount_minor": 10050, "currency": "XXX"}`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.requestBody), &body); err != nil {
+				t.Fatalf("failed to unmarshal request body: %v", err)
+			}
+			body["idempotency_key"] = uuid.New()
+			requestBody, _ := json.Marshal(body)
+
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+		})
+	}
+
+	// Both accepted requests added 100.50
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.RequireFromString("201")))
+}
+
+func TestAddTransaction_RequireIdempotencyKey(t *testing.T) {
+	testCases := []struct {
+		name               string
+		required           bool
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{name: "Required and missing", required: true, requestBody: `{"amount": 10}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Required and given", required: true, requestBody: fmt.Sprintf(`{"amount": 10, "idempotency_key": "%s"}`, uuid.New()), expectedStatusCode: http.StatusCreated},
+		{name: "Optional and missing", required: false, requestBody: `{"amount": 10}`, expectedStatusCode: http.StatusCreated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+			user := storage.User{
+				ID:      uuid.New(),
+				Balance: decimal.NewFromFloat(0),
+			}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			controller := api.NewController(transactionManager, api.WithRequireIdempotencyKey(tc.required))
+			newAPI := api.NewAPI(controller)
+
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBufferString(tc.requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode == http.StatusBadRequest {
+				assert.Contains(t, rr.Body.String(), "idempotency key required")
+			}
+		})
+	}
+}
+
+func TestAddTransaction_AmountConvention(t *testing.T) {
+	testCases := []struct {
+		name               string
+		convention         api.AmountConvention
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{name: "Signed debit", convention: api.SignedAmounts, requestBody: `{"amount": -25}`, expectedStatusCode: http.StatusCreated},
+		{name: "Direction debit", convention: api.DirectionAmounts, requestBody: `{"amount": 25, "direction": "debit"}`, expectedStatusCode: http.StatusCreated},
+		{name: "Direction negative amount", convention: api.DirectionAmounts, requestBody: `{"amount": -25, "direction": "debit"}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Direction missing", convention: api.DirectionAmounts, requestBody: `{"amount": 25}`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a test environment
+			testEnv, err := utils.CreateTestEnv()
+			if err != nil {
+				t.Fatalf("failed to create test env: %v", err)
+			}
+			defer testEnv.Cleanup()
+
+			storageClient := storage.NewStorageClient(testEnv.DB)
+			transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+				transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}))
+
+			user := storage.User{
+				ID:      uuid.New(),
+				Balance: decimal.NewFromFloat(100),
+			}
+			err = storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+
+			controller := api.NewController(transactionManager, api.WithAmountConvention(tc.convention))
+			newAPI := api.NewAPI(controller)
+
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.requestBody), &body); err != nil {
+				t.Fatalf("failed to unmarshal request body: %v", err)
+			}
+			body["idempotency_key"] = uuid.New()
+			requestBody, _ := json.Marshal(body)
+
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusCreated {
+				return
+			}
+
+			// Both conventions store the same signed amount
+			transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, transactionmanager.HistoryFilter{})
+			assert.Nil(t, err)
+			if assert.Equal(t, 1, len(transactions)) {
+				assert.True(t, transactions[0].Amount.Equal(decimal.NewFromFloat(-25)))
+			}
+		})
+	}
+}
+
+func TestAddTransaction_Debits(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(50)}
+	overdraftUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(50)}
+	for _, u := range []storage.User{user, overdraftUser} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithLimits(transactionmanager.Limits{AllowNegative: true}),
+		transactionmanager.WithOverdraftAccounts(overdraftUser.ID))
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	add := func(userID uuid.UUID, amount float64) int {
+		requestBody := []byte(fmt.Sprintf(`{"amount":%f, "idempotency_key":"%s"}`, amount, uuid.New()))
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, userID), bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Two debits racing for a balance that only covers one of them
+	concurrentRequests := 2
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(concurrentRequests)
+
+	successCount := int32(0)
+	insufficientCount := int32(0)
+	for i := 0; i < concurrentRequests; i++ {
+		go func() {
+			defer wg.Done()
+			<-startCh
+			switch add(user.ID, -30) {
+			case http.StatusCreated:
+				atomic.AddInt32(&successCount, 1)
+			case http.StatusUnprocessableEntity:
+				atomic.AddInt32(&insufficientCount, 1)
+			}
+		}()
+	}
+	close(startCh)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), successCount)
+	assert.Equal(t, int32(1), insufficientCount)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(20)), "got %s", balance)
+
+	// Debiting the balance down to exactly zero is fine
+	assert.Equal(t, http.StatusCreated, add(user.ID, -20))
+	assert.Equal(t, http.StatusUnprocessableEntity, add(user.ID, -0.01))
+
+	// Overdraft accounts may go below zero
+	assert.Equal(t, http.StatusCreated, add(overdraftUser.ID, -80))
+	balance, err = transactionManager.GetUserBalance(testEnv.Context, overdraftUser.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(-30)), "got %s", balance)
+}
+
+func TestAddTransaction_ReasonCode(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	testCases := []struct {
+		name               string
+		reasonCode         string
+		expectedStatusCode int
+	}{
+		{name: "Valid code", reasonCode: "DEPOSIT", expectedStatusCode: http.StatusCreated},
+		{name: "Invalid code", reasonCode: "BRIBE", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requestBody := []byte(fmt.Sprintf(`{"amount": 10, "idempotency_key": "%s", "reason_code": "%s"}`, uuid.New(), tc.reasonCode))
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBuffer(requestBody))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+		})
+	}
+
+	// Only the valid transaction was stored, with its code
+	transactions, err := transactionManager.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, transactionmanager.HistoryFilter{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(transactions)) {
+		assert.Equal(t, "DEPOSIT", transactions[0].ReasonCode)
+	}
+}
+
+func TestGetServerTimeEndpoint(t *testing.T) {
+	fakeNow := time.Date(2021, 6, 15, 12, 30, 0, 0, time.UTC)
+
+	// The clock is all the endpoint reads, so no database is needed
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithClock(func() time.Time { return fakeNow }))
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	req, _ := http.NewRequest(http.MethodGet, ServerTimePath, nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response map[string]string
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	assert.Equal(t, "2021-06-15T12:30:00Z", response["server_time"])
+}
+
+func TestContentTypeMiddleware(t *testing.T) {
+	testCases := []struct {
+		name               string
+		contentType        string
+		expectedStatusCode int
+	}{
+		{name: "JSON", contentType: "application/json", expectedStatusCode: http.StatusOK},
+		{name: "JSON with charset", contentType: "application/json; charset=utf-8", expectedStatusCode: http.StatusOK},
+		{name: "Missing", contentType: "", expectedStatusCode: http.StatusUnsupportedMediaType},
+		{name: "Wrong", contentType: "text/plain", expectedStatusCode: http.StatusUnsupportedMediaType},
+	}
+
+	// Validating a transaction without a user doesn't touch the database
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requestBody := []byte(fmt.Sprintf(`{"amount": 10, "idempotency_key": "%s"}`, uuid.New()))
+			req, _ := http.NewRequest(http.MethodPost, ValidateTransactionPath, bytes.NewBuffer(requestBody))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	scrape := func() string {
+		req, _ := http.NewRequest(http.MethodGet, MetricsPath, nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain"))
+		return rr.Body.String()
+	}
+	sample := func(metrics, series string) float64 {
+		for _, line := range strings.Split(metrics, "\n") {
+			if value, ok := strings.CutPrefix(line, series+" "); ok {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					t.Fatalf("failed to parse %q: %v", line, err)
+				}
+				return parsed
+			}
+		}
+		return 0
+	}
+
+	okSeries := `ledger_http_requests_total{method="GET",route="/time",status="200"}`
+	rejectedSeries := `ledger_http_requests_total{method="POST",route="/transactions/validate",status="415"}`
+	latencySeries := `ledger_http_request_duration_seconds_count{method="GET",route="/time"}`
+	infBucketSeries := `ledger_http_request_duration_seconds_bucket{method="GET",route="/time",le="+Inf"}`
+	conflictSeries := "ledger_idempotency_conflicts_total"
+
+	before := scrape()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ServerTimePath, nil)
+		newAPI.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req, _ := http.NewRequest(http.MethodPost, ValidateTransactionPath, bytes.NewBufferString(`{}`))
+	req.Header.Set("Content-Type", "text/plain")
+	newAPI.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The same transaction sent twice, the second one is a conflict
+	body := fmt.Sprintf(`{"amount": 10, "idempotency_key": "%s"}`, uuid.New())
+	for _, expected := range []int{http.StatusCreated, http.StatusConflict} {
+		req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, expected, rr.Code)
+	}
+
+	after := scrape()
+
+	assert.Equal(t, float64(2), sample(after, okSeries)-sample(before, okSeries))
+	assert.Equal(t, float64(1), sample(after, rejectedSeries)-sample(before, rejectedSeries))
+	assert.Equal(t, float64(2), sample(after, latencySeries)-sample(before, latencySeries))
+	assert.Equal(t, sample(after, latencySeries), sample(after, infBucketSeries))
+	assert.Contains(t, after, "# TYPE ledger_idempotency_conflicts_total counter\nledger_idempotency_conflicts_total ")
+	assert.Equal(t, float64(1), sample(after, conflictSeries)-sample(before, conflictSeries))
+}
+
+func TestRequestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	// The clock is all the endpoint reads, so no database is needed
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithLogger(logger))
+
+	testCases := []struct {
+		name      string
+		requestID string
+		echoed    bool
+	}{
+		{name: "Client request ID", requestID: "retry-42", echoed: true},
+		{name: "Generated request ID", requestID: ""},
+		{name: "Request ID with spaces", requestID: "a b"},
+		{name: "Too long request ID", requestID: strings.Repeat("a", 129)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			req, _ := http.NewRequest(http.MethodGet, ServerTimePath, nil)
+			if tc.requestID != "" {
+				req.Header.Set("X-Request-ID", tc.requestID)
+			}
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			requestID := rr.Header().Get("X-Request-ID")
+			if tc.echoed {
+				assert.Equal(t, tc.requestID, requestID)
+			} else {
+				_, err := uuid.Parse(requestID)
+				assert.NoError(t, err, "expected a generated request ID, got %q", requestID)
+			}
+
+			var entry map[string]interface{}
+			err := json.Unmarshal(logs.Bytes(), &entry)
+			if err != nil {
+				t.Fatalf("failed to unmarshal log entry %q: %v", logs.String(), err)
+			}
+			assert.Equal(t, "request", entry["msg"])
+			assert.Equal(t, requestID, entry["request_id"])
+			assert.Equal(t, http.MethodGet, entry["method"])
+			assert.Equal(t, ServerTimePath, entry["path"])
+			assert.Equal(t, float64(http.StatusOK), entry["status"])
+			assert.Contains(t, entry, "duration")
+		})
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	// The probes never reach the transaction manager
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+
+	databaseDown := errors.New("connection refused")
+	testCases := []struct {
+		name               string
+		path               string
+		checks             map[string]error
+		expectedStatusCode int
+		expectedFailing    map[string]string
+	}{
+		{name: "Liveness", path: HealthzPath, checks: map[string]error{"database": databaseDown}, expectedStatusCode: http.StatusOK},
+		{name: "Ready without checks", path: ReadyzPath, expectedStatusCode: http.StatusOK},
+		{name: "Ready", path: ReadyzPath, checks: map[string]error{"database": nil}, expectedStatusCode: http.StatusOK},
+		{name: "Database down", path: ReadyzPath, checks: map[string]error{"database": databaseDown, "cache": nil},
+			expectedStatusCode: http.StatusServiceUnavailable, expectedFailing: map[string]string{"database": "connection refused"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Tenants are enabled, probes don't send a tenant either way
+			opts := []api.APIOption{api.WithTenantHeader()}
+			for name, err := range tc.checks {
+				err := err
+				opts = append(opts, api.WithReadinessCheck(name, func(context.Context) error { return err }))
+			}
+			newAPI := api.NewAPI(controller, opts...)
+
+			req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+
+			var response struct {
+				Status  string            `json:"status"`
+				Failing map[string]string `json:"failing"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.Equal(t, tc.expectedFailing, response.Failing)
+		})
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	// Malformed user IDs are turned away before the database is reached
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithRateLimit(1, 2))
+
+	get := func(userID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, userID), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The burst goes through, the next request has to wait for a token
+	assert.Equal(t, http.StatusBadRequest, get("noisy").Code)
+	assert.Equal(t, http.StatusBadRequest, get("noisy").Code)
+	limited := get("noisy")
+	assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.Equal(t, "1", limited.Header().Get("Retry-After"))
+
+	// Other users have buckets of their own
+	assert.Equal(t, http.StatusBadRequest, get("quiet").Code)
+
+	// Rate limiting can be turned off
+	unlimited := api.NewAPI(controller, api.WithRateLimit(0, 0))
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(GetUserBalanceTemplate, "noisy"), nil)
+		rr := httptest.NewRecorder()
+		unlimited.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestAPIRun_Shutdown(t *testing.T) {
+	// Readiness checks stand in for slow requests, no database is needed
+	storageClient := storage.NewStorageClient(nil)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+	controller := api.NewController(transactionManager)
+
+	testCases := []struct {
+		name               string
+		shutdownTimeout    time.Duration
+		expectedStatusCode int
+		expectedAborted    bool
+	}{
+		{name: "Drained", shutdownTimeout: 5 * time.Second, expectedStatusCode: http.StatusOK},
+		{name: "Aborted after timeout", shutdownTimeout: 50 * time.Millisecond, expectedStatusCode: http.StatusServiceUnavailable, expectedAborted: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to find a free port: %v", err)
+			}
+			addr := listener.Addr().String()
+			listener.Close()
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			slowCheck := func(ctx context.Context) error {
+				close(started)
+				select {
+				case <-release:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			newAPI := api.NewAPI(controller,
+				api.WithReadinessCheck("slow", slowCheck),
+				api.WithShutdownTimeout(tc.shutdownTimeout))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runErr := make(chan error, 1)
+			go func() { runErr <- newAPI.Run(ctx, addr) }()
+
+			// Wait for the server to listen
+			for i := 0; ; i++ {
+				resp, err := http.Get("http://" + addr + HealthzPath)
+				if err == nil {
+					resp.Body.Close()
+					break
+				}
+				if i == 100 {
+					t.Fatalf("server did not start: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			statusCodes := make(chan int, 1)
+			go func() {
+				resp, err := http.Get("http://" + addr + ReadyzPath)
+				if err != nil {
+					statusCodes <- 0
+					return
+				}
+				resp.Body.Close()
+				statusCodes <- resp.StatusCode
+			}()
+
+			// Shut down while the request is in flight
+			<-started
+			cancel()
+			if !tc.expectedAborted {
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+			}
+
+			assert.Equal(t, tc.expectedStatusCode, <-statusCodes)
+			err = <-runErr
+			if tc.expectedAborted {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// No new connections are taken once it has stopped
+			_, err = http.Get("http://" + addr + HealthzPath)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPrepareStatementEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	workerCtx, stopWorkers := context.WithCancel(testEnv.Context)
+	defer stopWorkers()
+	go transactionManager.RunStatementWorkers(workerCtx, 1)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// One transaction on each of the first three days of January
+	for i := 0; i < 3; i++ {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(float64(i + 1)),
+			CreatedAt:      time.Date(2020, 1, i+1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	query := "?from=2020-01-02T00:00:00Z&to=2020-01-04T00:00:00Z"
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(PrepareStatementTemplate, user.ID, query), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var job transactionmanager.StatementJob
+	err = json.Unmarshal(rr.Body.Bytes(), &job)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	// Poll until the job finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status != transactionmanager.StatementJobDone && job.Status != transactionmanager.StatementJobFailed {
+		if time.Now().After(deadline) {
+			t.Fatalf("statement job did not finish, last status %s", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(StatementJobTemplate, job.ID), nil)
+		rr = httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		err = json.Unmarshal(rr.Body.Bytes(), &job)
+		if err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+	}
+
+	assert.Equal(t, transactionmanager.StatementJobDone, job.Status)
+	if assert.NotNil(t, job.Statement) {
+		assert.Equal(t, 2, len(job.Statement.Transactions))
+		assert.True(t, job.Statement.OpeningBalance.Equal(decimal.NewFromFloat(1)))
+		assert.True(t, job.Statement.ClosingBalance.Equal(decimal.NewFromFloat(6)))
+	}
+
+	// Unknown jobs are reported as not found
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf(StatementJobTemplate, uuid.New()), nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func transactionsEqual(a, b transactionmanager.Transaction) bool {
+	return a.ID == b.ID &&
+		a.Amount.Equal(b.Amount) &&
+		a.UserID == b.UserID &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.IdempotencyKey == b.IdempotencyKey
+}
+
+func TestTenantIsolation(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:       uuid.New(),
+		Balance:  decimal.NewFromFloat(0),
+		TenantID: "acme",
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	transaction, err := transactionManager.AddTransaction(transactionmanager.WithTenant(testEnv.Context, "acme"), transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller, api.WithTenantHeader())
+
+	serve := func(method, path, tenantID string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if tenantID != "" {
+			req.Header.Set("X-Tenant-ID", tenantID)
+		}
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Own tenant reads", func(t *testing.T) {
+		rr := serve(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), "acme", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		rr = serve(http.MethodGet, fmt.Sprintf(TransactionTemplate, transaction.ID), "acme", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("Cross tenant reads are not found", func(t *testing.T) {
+		for _, path := range []string{
+			fmt.Sprintf(GetUserBalanceTemplate, user.ID),
+			fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""),
+			fmt.Sprintf(TransactionTemplate, transaction.ID),
+		} {
+			rr := serve(http.MethodGet, path, "globex", nil)
+			assert.Equal(t, http.StatusNotFound, rr.Code, path)
+		}
+	})
+
+	t.Run("Cross tenant writes are rejected", func(t *testing.T) {
+		requestBody := []byte(fmt.Sprintf(`{"user_id":"%s", "amount":50, "idempotency_key":"%s"}`, user.ID, uuid.New()))
+		rr := serve(http.MethodPost, fmt.Sprintf(AddTransactionTemplate, user.ID), "globex", requestBody)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+
+		balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+		if err != nil {
+			t.Fatalf("failed to get balance: %v", err)
+		}
+		assert.True(t, balance.Equal(decimal.NewFromFloat(100)))
+	})
+
+	t.Run("Missing tenant", func(t *testing.T) {
+		rr := serve(http.MethodGet, fmt.Sprintf(GetUserTransactionHistoryTemplate, user.ID, ""), "", nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
 }
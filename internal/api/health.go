@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds how long /readyz waits on its checks, so a hanging
+// dependency fails the probe rather than timing it out
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck is a dependency /readyz checks before reporting ready
+type readinessCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// WithReadinessCheck makes /readyz check a dependency, e.g. the database's
+// PingContext, reporting it by name when it fails. Without checks the
+// service is ready as soon as it is up.
+func WithReadinessCheck(name string, check func(context.Context) error) APIOption {
+	return func(config *apiConfig) {
+		config.readinessChecks = append(config.readinessChecks, readinessCheck{name: name, check: check})
+	}
+}
+
+// healthz answers liveness probes: the process is up as long as it answers
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeProbeResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz answers readiness probes with 200 once every check passes, and with
+// 503 naming each failing dependency and its error otherwise
+func readyz(checks []readinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		failing := map[string]string{}
+		for _, check := range checks {
+			if err := check.check(ctx); err != nil {
+				failing[check.name] = err.Error()
+			}
+		}
+
+		if len(failing) > 0 {
+			writeProbeResponse(w, http.StatusServiceUnavailable, struct {
+				Status  string            `json:"status"`
+				Failing map[string]string `json:"failing"`
+			}{
+				Status:  "unavailable",
+				Failing: failing,
+			})
+			return
+		}
+		writeProbeResponse(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
+
+// writeProbeResponse writes body as JSON. Probes aren't part of the API, so
+// the controller's naming convention doesn't apply.
+func writeProbeResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// idempotencyKeyHeader carries the idempotency key of writes whose body has
+// no field for it, like creating a user
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// replayedHeader tells a client its request was answered with the result of
+// an earlier one carrying the same idempotency key
+const replayedHeader = "Idempotency-Replayed"
+
+var errIdempotencyKeyRequired = errors.New("idempotency key required")
+
+// WithRequireIdempotencyKey rejects writes sent without an idempotency key
+// with 400 Bad Request. Keys are optional by default.
+func WithRequireIdempotencyKey(required bool) ControllerOption {
+	return func(c *Controller) {
+		c.requireIdempotencyKey = required
+	}
+}
+
+// writeIdempotencyKey parses the idempotency key of a write, rejecting an
+// empty one when keys are required
+func (c *Controller) writeIdempotencyKey(key string) (uuid.UUID, error) {
+	if key == "" && c.requireIdempotencyKey {
+		return uuid.Nil, errIdempotencyKeyRequired
+	}
+	return transactionmanager.ParseIdempotencyKey(key)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// requestIDHeader carries the ID a request is logged under. A client may
+// send its own, otherwise one is generated; either way it is echoed back.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps client request IDs so they can't bloat the logs
+const maxRequestIDLength = 128
+
+// WithLogger sets the logger requests are logged to, slog.Default() by
+// default
+func WithLogger(logger *slog.Logger) APIOption {
+	return func(config *apiConfig) {
+		config.logger = logger
+	}
+}
+
+// requestLogMiddleware tags every request with a request ID, passes it on to
+// the transaction manager through the request context and logs the request
+// once it is answered
+func requestLogMiddleware(logger *slog.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(requestIDHeader)
+			if !validRequestID(requestID) {
+				requestID = uuid.New().String()
+			}
+			w.Header().Set(requestIDHeader, requestID)
+
+			start := time.Now()
+			sw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(sw, r.WithContext(transactionmanager.WithRequestID(r.Context(), requestID)))
+
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("request_id", requestID),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", sw.statusCode),
+				slog.Duration("duration", time.Since(start)))
+		})
+	}
+}
+
+// validRequestID accepts non-empty IDs of printable ASCII characters up to
+// maxRequestIDLength, so a client can't inject anything into the logs
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram. They match the Prometheus client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+type routeLabels struct {
+	method string
+	route  string
+}
+
+type histogram struct {
+	// counts holds one count per bucket, not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics counts requests and their latencies per route, and exposes them in
+// the Prometheus text format
+type metrics struct {
+	idempotencyConflicts uint64
+
+	mu        sync.Mutex
+	requests  map[requestLabels]uint64
+	latencies map[routeLabels]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[requestLabels]uint64),
+		latencies: make(map[routeLabels]*histogram),
+	}
+}
+
+func (m *metrics) observe(method, route string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestLabels{method: method, route: route, status: status}]++
+
+	labels := routeLabels{method: method, route: route}
+	h, ok := m.latencies[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[labels] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// idempotencyConflict counts a request turned away because its idempotency
+// key was already used or it looked like a duplicate. A burst of these means
+// clients are retrying in a loop.
+func (m *metrics) idempotencyConflict() {
+	atomic.AddUint64(&m.idempotencyConflicts, 1)
+}
+
+// write renders every metric, sorted by labels so scrapes are stable
+func (m *metrics) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf.WriteString("# HELP ledger_http_requests_total Requests handled, by route and status code.\n")
+	buf.WriteString("# TYPE ledger_http_requests_total counter\n")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, labels := range requests {
+		fmt.Fprintf(buf, "ledger_http_requests_total{method=%s,route=%s,status=\"%d\"} %d\n",
+			labelValue(labels.method), labelValue(labels.route), labels.status, m.requests[labels])
+	}
+
+	buf.WriteString("# HELP ledger_http_request_duration_seconds Time taken to handle requests, by route.\n")
+	buf.WriteString("# TYPE ledger_http_request_duration_seconds histogram\n")
+	routes := make([]routeLabels, 0, len(m.latencies))
+	for labels := range m.latencies {
+		routes = append(routes, labels)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	for _, labels := range routes {
+		h := m.latencies[labels]
+		prefix := fmt.Sprintf("method=%s,route=%s", labelValue(labels.method), labelValue(labels.route))
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "ledger_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "ledger_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", prefix, h.count)
+		fmt.Fprintf(buf, "ledger_http_request_duration_seconds_sum{%s} %s\n", prefix, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "ledger_http_request_duration_seconds_count{%s} %d\n", prefix, h.count)
+	}
+
+	buf.WriteString("# HELP ledger_idempotency_conflicts_total Requests rejected as a reused idempotency key or a likely duplicate.\n")
+	buf.WriteString("# TYPE ledger_idempotency_conflicts_total counter\n")
+	fmt.Fprintf(buf, "ledger_idempotency_conflicts_total %d\n", atomic.LoadUint64(&m.idempotencyConflicts))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// handler serves the metrics for Prometheus to scrape
+func (m *metrics) handler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// metricsMiddleware records the status code and latency of every request
+// under its route template, so /users/{uid}/balance is one series no matter
+// how many users there are
+func metricsMiddleware(m *metrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			start := time.Now()
+			sw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			m.observe(r.Method, route, sw.statusCode, time.Since(start))
+		})
+	}
+}
+
+// statusResponseWriter remembers the status code sent to the client
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses streaming
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
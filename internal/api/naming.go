@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// JSONNaming selects how response field names are serialized
+type JSONNaming int
+
+const (
+	// SnakeCase keeps the field names as declared, e.g. user_id
+	SnakeCase JSONNaming = iota
+	// CamelCase rewrites field names to lower camel case, e.g. userId
+	CamelCase
+)
+
+// encodeJSON marshals data, rewriting every object key according to naming
+func encodeJSON(data interface{}, naming JSONNaming) ([]byte, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil || naming == SnakeCase {
+		return encoded, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	// Keep numbers as they were written so amounts don't lose precision
+	decoder.UseNumber()
+
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(renameKeys(generic, snakeToCamel))
+}
+
+func renameKeys(value interface{}, rename func(string) string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			renamed[rename(key)] = renameKeys(item, rename)
+		}
+		return renamed
+	case []interface{}:
+		for i, item := range v {
+			v[i] = renameKeys(item, rename)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		runes := []rune(parts[i])
+		runes[0] = unicode.ToUpper(runes[0])
+		parts[i] = string(runes)
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,607 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// operation documents an endpoint beyond what its route registration tells.
+// The path, method and path parameters of every endpoint are read from the
+// router, so an endpoint is never missing from the document, only its
+// details are.
+type operation struct {
+	id      string
+	summary string
+	params  []parameter
+	// request is a value of the type of the JSON request body, nil for
+	// endpoints without one
+	request interface{}
+	// status is the status of a successful response, 200 when zero
+	status int
+	// response is a value of the type of the successful JSON response body,
+	// nil for endpoints answering in another contentType or without a body
+	response    interface{}
+	contentType string
+	// otherResponses are further JSON responses by status, on top of the
+	// error ones
+	otherResponses map[int]interface{}
+}
+
+// parameter is a query or header parameter of an endpoint. Its schema is
+// that of a value of the parameter's type.
+type parameter struct {
+	in          string
+	name        string
+	description string
+	value       interface{}
+}
+
+func queryParam(name string, value interface{}, description string) parameter {
+	return parameter{in: "query", name: name, description: description, value: value}
+}
+
+func headerParam(name string, description string) parameter {
+	return parameter{in: "header", name: name, description: description, value: ""}
+}
+
+var (
+	pageParams = []parameter{
+		queryParam("page", 0, "Page number, starting at 1"),
+		queryParam("pageSize", 0, "Page size, 10 by default"),
+	}
+	timeRangeParams = []parameter{
+		queryParam("from", time.Time{}, "Start of the period, RFC 3339"),
+		queryParam("to", time.Time{}, "End of the period, RFC 3339, now by default"),
+	}
+	historyFilterParams = append([]parameter{
+		queryParam("include_voided", false, "Include voided transactions"),
+		queryParam("includeDeleted", false, "Include soft deleted transactions"),
+		queryParam("channel", "", "Only transactions that came in through this channel"),
+	}, timeRangeParams...)
+	adminLimitParams = []parameter{
+		queryParam("after", uuid.UUID{}, "Resume after this ID"),
+		queryParam("limit", 0, "Maximum number of rows"),
+	}
+	importParams = []parameter{
+		queryParam("mode", transactionmanager.ImportMode(""), "atomic or partial, to report the outcome of every transaction"),
+	}
+	channelParam = headerParam(channelHeader, "Channel the transaction came in through: web, mobile, api, batch or scheduled")
+)
+
+func params(groups ...[]parameter) []parameter {
+	var all []parameter
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// operations documents the endpoints registered in NewAPI, keyed by method
+// and path template
+var operations = map[string]operation{
+	"GET " + userByExternal: {id: "GetUserByExternalID", summary: "Get a user by external ID", response: transactionmanager.User{}},
+	"POST " + users: {
+		id: "CreateUser", summary: "Create a user", status: http.StatusCreated,
+		params:  []parameter{headerParam(idempotencyKeyHeader, "Replays the user created with the same key")},
+		request: CreateUserRequest{}, response: transactionmanager.User{},
+	},
+	"POST " + addTransaction: {
+		id: "AddTransaction", summary: "Add a transaction to a user", status: http.StatusCreated,
+		params:  []parameter{channelParam},
+		request: AddTransactionRequest{}, response: AddTransactionResponse{},
+	},
+	"POST " + userImport: {
+		id: "AddUserTransactions", summary: "Import a user's transactions in one insert. With mode, answers with an import report instead.",
+		status:  http.StatusCreated,
+		params:  importParams,
+		request: []AddTransactionRequest{}, response: []transactionmanager.Transaction{},
+		otherResponses: map[int]interface{}{
+			http.StatusMultiStatus:         transactionmanager.ImportReport{},
+			http.StatusUnprocessableEntity: transactionmanager.ImportReport{},
+		},
+	},
+	"GET " + getUserBalance: {
+		id: "GetUserBalance", summary: "Get a user's balance. With asOf or exclude_category, answers with the balance alone.",
+		params: []parameter{
+			queryParam("convert_to", "", "Currency to convert the balance to, the user's display currency by default"),
+			queryParam("currency", "", "Alias of convert_to"),
+			queryParam("asOf", time.Time{}, "Balance as it stood at this time, RFC 3339"),
+			queryParam("exclude_category", "", "Leave out the transactions of this reason code"),
+		},
+		response: transactionmanager.DisplayBalance{},
+	},
+	"GET " + projected: {
+		id: "GetProjectedBalance", summary: "Project a user's balance with their recurring transactions",
+		params:   []parameter{queryParam("until", time.Time{}, "End of the projection")},
+		response: transactionmanager.BalanceProjection{},
+	},
+	"PUT " + userDisplay: {
+		id: "SetDisplayCurrency", summary: "Set the currency a user's balance is shown in",
+		request: SetDisplayCurrencyRequest{}, response: transactionmanager.User{},
+	},
+	"POST " + recurring: {
+		id: "CreateRecurringTransaction", summary: "Schedule a recurring transaction", status: http.StatusCreated,
+		request: RecurringTransactionRequest{}, response: transactionmanager.RecurringTransaction{},
+	},
+	"GET " + recurring: {id: "GetRecurringTransactions", summary: "List a user's recurring transactions", response: []transactionmanager.RecurringTransaction{}},
+	"POST " + schedule: {
+		id: "ScheduleTransaction", summary: "Schedule a future-dated transaction", status: http.StatusCreated,
+		request: ScheduleTransactionRequest{}, response: transactionmanager.ScheduledTransaction{},
+	},
+	"GET " + scheduled:       {id: "GetScheduledTransactions", summary: "List a user's scheduled transactions", response: []transactionmanager.ScheduledTransaction{}},
+	"POST " + cancelSchedule: {id: "CancelScheduledTransaction", summary: "Cancel a scheduled transaction", response: transactionmanager.ScheduledTransaction{}},
+	"GET " + userHistory: {
+		id: "GetUserTransactionHistory", summary: "Page through a user's transactions, newest first. With cursor the page is a HistoryCursorResponse, with include_balances a HistoryPage, and with Accept: application/x-ndjson every transaction is streamed.",
+		params: params(historyFilterParams, pageParams, []parameter{
+			queryParam("cursor", "", "Keyset page token, empty for the first page"),
+			queryParam("include_balances", false, "Include the balances before and after the page"),
+		}),
+		response: HistoryResponse{},
+	},
+	"GET " + historyCSV: {
+		id: "ExportUserHistoryCSV", summary: "Download all of a user's transactions, newest first, as CSV",
+		params: historyFilterParams, contentType: "text/csv",
+	},
+	"GET " + groupedHistory: {
+		id: "GetGroupedTransactionHistory", summary: "Page through a user's transactions grouped by day",
+		params:   params([]parameter{queryParam("by", "", "Grouping, only day")}, historyFilterParams, pageParams),
+		response: []transactionmanager.DayGroup{},
+	},
+	"GET " + largest: {
+		id: "GetLargestTransaction", summary: "Get a user's largest credit or debit",
+		params:   []parameter{queryParam("type", transactionmanager.TransactionType(""), "credit or debit, credit by default")},
+		response: transactionmanager.Transaction{},
+	},
+	"GET " + userKeys: {
+		id: "GetUserIdempotencyKeys", summary: "List the idempotency keys of a user's transactions",
+		params:   params(timeRangeParams, pageParams),
+		response: []transactionmanager.IdempotencyKeyUsage{},
+	},
+	"GET " + averageAmount: {
+		id: "GetAverageTransactionAmount", summary: "Get the mean amount of a user's transactions",
+		params: params([]parameter{queryParam("type", transactionmanager.TransactionType(""), "credit or debit, every transaction by default")}, timeRangeParams),
+		response: struct {
+			Average decimal.Decimal `json:"average"`
+		}{},
+	},
+	"GET " + volatility: {
+		id: "GetBalanceVolatility", summary: "Get the standard deviation of a user's daily balance changes",
+		params:   []parameter{queryParam("window", "", "Number of days, like 30d")},
+		response: VolatilityResponse{},
+	},
+	"GET " + cadence: {id: "GetTransactionCadence", summary: "Get the gaps between a user's transactions", response: transactionmanager.Cadence{}},
+	"POST " + validateTransaction: {
+		id: "ValidateTransaction", summary: "Check a transaction without storing it",
+		params:  []parameter{channelParam},
+		request: ValidateTransactionRequest{}, response: ValidateTransactionResponse{},
+	},
+	"POST " + voidTransaction:    {id: "VoidTransaction", summary: "Void a pending transaction", response: transactionmanager.Transaction{}},
+	"POST " + batchGet:           {id: "BatchGetTransactions", summary: "Get several transactions by ID", request: BatchGetTransactionsRequest{}, response: []transactionmanager.Transaction{}},
+	"GET " + transactionByID:     {id: "GetTransaction", summary: "Get a transaction", response: transactionmanager.Transaction{}},
+	"GET " + transactionImpact:   {id: "GetTransactionImpact", summary: "Get the user's balance just before and after a transaction", params: []parameter{queryParam("user_id", uuid.UUID{}, "User the transaction belongs to")}, response: transactionmanager.TransactionImpact{}},
+	"POST " + refundTransaction:  {id: "RefundTransaction", summary: "Refund part or all of a transaction", status: http.StatusCreated, request: RefundRequest{}, response: transactionmanager.Transaction{}},
+	"POST " + reverseTransaction: {id: "ReverseTransaction", summary: "Reverse a transaction", status: http.StatusCreated, response: transactionmanager.Transaction{}},
+	"GET " + compensations:       {id: "GetCompensations", summary: "List the refunds and reversals of a transaction", params: pageParams, response: transactionmanager.Compensations{}},
+	"POST " + batches:            {id: "CreateBatch", summary: "Add transactions of several users under one batch ID", status: http.StatusCreated, request: CreateBatchRequest{}, response: transactionmanager.Batch{}},
+	"GET " + batch:               {id: "GetBatch", summary: "Get the transactions of a batch", response: transactionmanager.Batch{}},
+	"GET " + serverTime: {
+		id: "GetServerTime", summary: "Get the server's clock",
+		response: struct {
+			ServerTime time.Time `json:"server_time"`
+		}{},
+	},
+	"GET " + metricsPath: {id: "GetMetrics", summary: "Prometheus metrics", contentType: metricsContentType},
+	"POST " + transfers: {
+		id: "CreateTransfer", summary: "Move money between two users. With dry_run, answers with a TransferPreview instead.",
+		status:  http.StatusCreated,
+		params:  []parameter{queryParam("dry_run", false, "Only check the transfer")},
+		request: TransferRequest{}, response: transactionmanager.Transfer{},
+		otherResponses: map[int]interface{}{http.StatusOK: transactionmanager.TransferPreview{}},
+	},
+	"GET " + userTransfers: {
+		id: "GetUserTransfers", summary: "List the transfers a user sent or received",
+		params:   params([]parameter{queryParam("direction", transactionmanager.TransferDirection(""), "sent or received, both by default")}, pageParams),
+		response: []transactionmanager.UserTransfer{},
+	},
+	"GET " + netFlow:           {id: "GetNetFlow", summary: "Get the net amount one user transferred to another", params: timeRangeParams, response: NetFlowResponse{}},
+	"GET " + transfer:          {id: "GetTransfer", summary: "Get a transfer", response: transactionmanager.Transfer{}},
+	"POST " + settleTransfer:   {id: "SettleTransfer", summary: "Settle a pending transfer", response: transactionmanager.Transfer{}},
+	"POST " + cancelTransfer:   {id: "CancelTransfer", summary: "Cancel a pending transfer", response: transactionmanager.Transfer{}},
+	"POST " + prepareStatement: {id: "PrepareStatement", summary: "Start generating a user's statement", status: http.StatusAccepted, params: timeRangeParams, response: transactionmanager.StatementJob{}},
+	"GET " + statementJob:      {id: "GetStatementJob", summary: "Get a statement job", response: transactionmanager.StatementJob{}},
+
+	"GET " + adminPrefix + userLimits:           {id: "GetUserLimits", summary: "Get a user's limits", response: transactionmanager.UserLimits{}},
+	"PUT " + adminPrefix + userLimits:           {id: "SetUserLimits", summary: "Set a user's limits", request: transactionmanager.UserLimits{}, response: transactionmanager.UserLimits{}},
+	"POST " + adminPrefix + adjustments:         {id: "AdjustBalance", summary: "Adjust a user's balance by hand", status: http.StatusCreated, request: AdjustBalanceRequest{}, response: transactionmanager.Adjustment{}},
+	"DELETE " + adminPrefix + deleteTransaction: {id: "DeleteTransaction", summary: "Soft delete a transaction", response: transactionmanager.Transaction{}},
+	"GET " + adminPrefix + auditLog:             {id: "GetAuditEntries", summary: "List a user's audit entries", response: []transactionmanager.AuditEntry{}},
+	"GET " + adminPrefix + recentUsers:          {id: "GetRecentUsers", summary: "List the most recently created users", params: adminLimitParams[1:], response: []transactionmanager.User{}},
+	"GET " + adminPrefix + reconcile:            {id: "GetReconciliationReport", summary: "Compare stored balances with their transactions", params: adminLimitParams, response: transactionmanager.ReconciliationReport{}},
+	"GET " + adminPrefix + orphans:              {id: "GetOrphanedTransactions", summary: "List transactions without a user", params: adminLimitParams, response: transactionmanager.OrphanedTransactionsReport{}},
+	"POST " + adminPrefix + recompute: {
+		id: "RecomputeBalances", summary: "Rebuild stored balances from the transactions",
+		params: []parameter{
+			queryParam("user_id", uuid.UUID{}, "Only this user, every user by default"),
+			queryParam("batch_size", 0, "Users per batch"),
+		},
+		response: RecomputeResponse{},
+	},
+	"GET " + adminPrefix + balancesCSV: {id: "ExportBalancesCSV", summary: "Export every user's balance as CSV", contentType: "text/csv"},
+	"GET " + adminPrefix + webhooks: {
+		id: "GetWebhookDeliveries", summary: "List webhook deliveries, newest first",
+		params: []parameter{
+			queryParam("status", transactionmanager.WebhookDeliveryStatus(""), "pending, delivered or failed"),
+			queryParam("limit", 0, "Maximum number of deliveries, 50 by default"),
+		},
+		response: []transactionmanager.WebhookDelivery{},
+	},
+	"POST " + adminPrefix + webhookRetry: {id: "RetryWebhookDeliveries", summary: "Post every failed webhook delivery again", response: WebhookRetryResponse{}},
+	"POST " + adminPrefix + backfill: {
+		id: "BackfillUserTransactions", summary: "Import a user's transactions dated before the backdating window",
+		status:  http.StatusCreated,
+		params:  importParams,
+		request: []AddTransactionRequest{}, response: []transactionmanager.Transaction{},
+		otherResponses: map[int]interface{}{
+			http.StatusMultiStatus:         transactionmanager.ImportReport{},
+			http.StatusUnprocessableEntity: transactionmanager.ImportReport{},
+		},
+	},
+
+	"GET " + healthzPath: {
+		id: "Healthz", summary: "Liveness probe",
+		response: struct {
+			Status string `json:"status"`
+		}{},
+	},
+	"GET " + readyzPath: {
+		id: "Readyz", summary: "Readiness probe",
+		response: struct {
+			Status string `json:"status"`
+		}{},
+		otherResponses: map[int]interface{}{
+			http.StatusServiceUnavailable: struct {
+				Status  string            `json:"status"`
+				Failing map[string]string `json:"failing"`
+			}{},
+		},
+	},
+}
+
+// stringPathParams are the path variables that aren't UUIDs
+var stringPathParams = map[string]bool{"externalID": true}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// newOpenAPISpec describes the routes registered on api, and the probes
+// registered on probes, as an OpenAPI 3 document. Response field names
+// follow naming; request bodies are always read as declared.
+func newOpenAPISpec(api *mux.Router, probes *mux.Router, naming JSONNaming, tenants bool) ([]byte, error) {
+	requests := newSchemaGenerator(nil, "")
+	responses := requests
+	if naming == CamelCase {
+		// Types sent both ways get a schema for each naming
+		requests.suffix = "Input"
+		responses = newSchemaGenerator(snakeToCamel, "")
+		responses.schemas = requests.schemas
+	}
+
+	errorSchema := responses.schema(reflect.TypeOf(struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}))
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+	}
+
+	paths := map[string]map[string]interface{}{}
+	describe := func(router *mux.Router, probe bool) error {
+		return router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				return nil
+			}
+			// Path prefixes and subrouters have no methods of their own
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+
+			documentedPath := pathVariable.ReplaceAllString(template, "{$1}")
+			for _, method := range methods {
+				op, documented := operations[method+" "+template]
+				if paths[documentedPath] == nil {
+					paths[documentedPath] = map[string]interface{}{}
+				}
+				paths[documentedPath][strings.ToLower(method)] = describeOperation(op, documented, template, probe, tenants, requests, responses, errorResponse)
+			}
+			return nil
+		})
+	}
+	if err := describe(api, false); err != nil {
+		return nil, err
+	}
+	if err := describe(probes, true); err != nil {
+		return nil, err
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Ledger Service API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": requests.schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+func describeOperation(op operation, documented bool, template string, probe bool, tenants bool, requests, responses *schemaGenerator, errorResponse map[string]interface{}) map[string]interface{} {
+	described := map[string]interface{}{}
+	if documented {
+		described["operationId"] = op.id
+		described["summary"] = op.summary
+	}
+	if strings.HasPrefix(template, adminPrefix+"/") {
+		described["tags"] = []string{"admin"}
+		described["security"] = []map[string][]string{{"adminToken": {}}}
+	}
+
+	var parameters []map[string]interface{}
+	for _, match := range pathVariable.FindAllStringSubmatch(template, -1) {
+		schema := map[string]interface{}{"type": "string", "format": "uuid"}
+		if stringPathParams[match[1]] {
+			schema = map[string]interface{}{"type": "string"}
+		}
+		parameters = append(parameters, map[string]interface{}{"in": "path", "name": match[1], "required": true, "schema": schema})
+	}
+	// Probes bypass the tenant middleware
+	if tenants && !probe {
+		parameters = append(parameters, map[string]interface{}{"in": "header", "name": tenantHeader, "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, param := range op.params {
+		parameters = append(parameters, map[string]interface{}{
+			"in":          param.in,
+			"name":        param.name,
+			"description": param.description,
+			"schema":      requests.schema(reflect.TypeOf(param.value)),
+		})
+	}
+	if len(parameters) > 0 {
+		described["parameters"] = parameters
+	}
+
+	if op.request != nil {
+		described["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": requests.schema(reflect.TypeOf(op.request))}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case op.response != nil:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": responses.schema(reflect.TypeOf(op.response))}}
+	case op.contentType != "":
+		success["content"] = map[string]interface{}{op.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	described["responses"] = map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default":          errorResponse,
+	}
+	for other, response := range op.otherResponses {
+		described["responses"].(map[string]interface{})[fmt.Sprint(other)] = map[string]interface{}{
+			"description": http.StatusText(other),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": responses.schema(reflect.TypeOf(response))}},
+		}
+	}
+	return described
+}
+
+var (
+	decimalType     = reflect.TypeOf(decimal.Decimal{})
+	nullDecimalType = reflect.TypeOf(decimal.NullDecimal{})
+	uuidType        = reflect.TypeOf(uuid.UUID{})
+	nullUUIDType    = reflect.TypeOf(uuid.NullUUID{})
+	timeType        = reflect.TypeOf(time.Time{})
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGenerator derives JSON schemas from Go types the way encoding/json
+// marshals them. Named structs become components referenced by name.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+	// rename rewrites field names, nil to keep them as declared
+	rename func(string) string
+	// suffix is appended to component names
+	suffix string
+}
+
+func newSchemaGenerator(rename func(string) string, suffix string) *schemaGenerator {
+	return &schemaGenerator{
+		schemas: map[string]interface{}{},
+		names:   map[reflect.Type]string{},
+		rename:  rename,
+		suffix:  suffix,
+	}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	// Decimals are marshalled as strings so they keep every digit
+	case decimalType:
+		return map[string]interface{}{"type": "string", "format": "decimal", "example": "100.25"}
+	case nullDecimalType:
+		return map[string]interface{}{"type": "string", "format": "decimal", "nullable": true}
+	case uuidType:
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	case nullUUIDType:
+		return map[string]interface{}{"type": "string", "format": "uuid", "nullable": true}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schema(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.component(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// component returns a reference to the schema of a named struct, adding it
+// to the components the first time
+func (g *schemaGenerator) component(t reflect.Type) map[string]interface{} {
+	name, ok := g.names[t]
+	if !ok {
+		name = t.Name() + g.suffix
+		if _, taken := g.schemas[name]; taken {
+			// Types of the same name from different packages
+			pkg := path.Base(t.PkgPath())
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		g.names[t] = name
+		// Registered before it is filled in, for types referring to
+		// themselves
+		g.schemas[name] = map[string]interface{}{}
+		g.schemas[name] = g.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	g.fields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// fields adds the properties of the exported fields of t, promoting those
+// of embedded structs like encoding/json does
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.fields(embedded, properties)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		if g.rename != nil {
+			name = g.rename(name)
+		}
+		schema := g.schema(field.Type)
+		if options == "string" {
+			schema = map[string]interface{}{"type": "string"}
+		}
+		properties[name] = schema
+	}
+}
+
+// docsPage renders the OpenAPI document with Swagger UI
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Ledger Service API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "` + openAPIPath + `", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+// serveOpenAPISpec answers with the OpenAPI document, or with 500 when it
+// couldn't be generated
+func serveOpenAPISpec(spec []byte, err error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			httpError(w, fmt.Sprintf("Error describing the API %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(spec)
+	}
+}
+
+// serveDocs answers with the Swagger UI page
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+}
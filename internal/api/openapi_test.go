@@ -0,0 +1,70 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+)
+
+type openAPISchema struct {
+	Ref        string                   `json:"$ref"`
+	Type       string                   `json:"type"`
+	Format     string                   `json:"format"`
+	Properties map[string]openAPISchema `json:"properties"`
+	Items      *openAPISchema           `json:"items"`
+}
+
+type openAPISpec struct {
+	OpenAPI    string                                       `json:"openapi"`
+	Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+func TestOpenAPIEndpoints(t *testing.T) {
+	// The document only reads the routes, the manager is never called
+	controller := api.NewController(nil)
+	newAPI := api.NewAPI(controller, api.WithTenantHeader())
+
+	req, _ := http.NewRequest(http.MethodGet, "/openapi.json", nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var spec openAPISpec
+	if err := json.Unmarshal(rr.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("failed to unmarshal spec: %v", err)
+	}
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+
+	// Every registered route is described
+	for path, methods := range spec.Paths {
+		for method, operation := range methods {
+			assert.NotEmpty(t, operation["operationId"], "%s %s isn't documented", method, path)
+		}
+	}
+	assert.Contains(t, spec.Paths["/users/{uid}/add"], "post")
+	assert.Contains(t, spec.Paths["/admin/users/{uid}/limits"], "put")
+	assert.Contains(t, spec.Paths["/healthz"], "get")
+
+	transaction := spec.Components.Schemas["Transaction"]
+	assert.Equal(t, "string", transaction.Properties["amount"].Type)
+	assert.Equal(t, "decimal", transaction.Properties["amount"].Format)
+	assert.Equal(t, "uuid", transaction.Properties["id"].Format)
+	assert.Equal(t, "date-time", transaction.Properties["created_at"].Format)
+	if items := spec.Components.Schemas["HistoryResponse"].Properties["transactions"].Items; assert.NotNil(t, items) {
+		assert.Equal(t, "#/components/schemas/Transaction", items.Ref)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/docs", nil)
+	rr = httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "/openapi.json")
+}
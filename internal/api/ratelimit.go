@@ -0,0 +1,128 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRateLimit is how many requests per second each user may make
+	DefaultRateLimit = 10
+	// DefaultRateBurst is how many requests a user may make at once
+	DefaultRateBurst = 100
+
+	// limiterIdleTTL is how long a user's limiter is kept after their last
+	// request. A forgotten limiter starts again with a full bucket, which is
+	// where it would be by then anyway.
+	limiterIdleTTL = 10 * time.Minute
+)
+
+// WithRateLimit lets each user make perSecond requests per second, in bursts
+// of up to burst, instead of DefaultRateLimit and DefaultRateBurst. A zero
+// or negative perSecond turns rate limiting off.
+func WithRateLimit(perSecond float64, burst int) APIOption {
+	return func(config *apiConfig) {
+		config.rateLimit = perSecond
+		config.rateBurst = burst
+		config.rateLimitSet = true
+	}
+}
+
+type userLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// userLimiters keeps a token bucket per user, so one noisy account can't use
+// up the requests of the others
+type userLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*userLimiter
+	lastSweep time.Time
+}
+
+func newUserLimiters(perSecond float64, burst int) *userLimiters {
+	limit := rate.Limit(perSecond)
+	if perSecond <= 0 {
+		limit = rate.Inf
+	}
+	return &userLimiters{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[string]*userLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket. When there is none it returns how
+// long until there will be.
+func (l *userLimiters) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > limiterIdleTTL {
+		for k, user := range l.limiters {
+			if now.Sub(user.lastSeen) > limiterIdleTTL {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	user, ok := l.limiters[key]
+	if !ok {
+		user = &userLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = user
+	}
+	user.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := user.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// A zero burst never has a token
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitKey is the user in the request's path, or the client's address
+// for requests that aren't about one user
+func rateLimitKey(r *http.Request) string {
+	if userID := mux.Vars(r)["uid"]; userID != "" {
+		return "user:" + userID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// limitMiddleware turns away requests of users over their rate limit with
+// 429 Too Many Requests and a Retry-After header saying, in seconds, when
+// they may try again
+func limitMiddleware(limiters *userLimiters) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowed, retryAfter := limiters.allow(rateLimitKey(r)); !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// RecurringTransactionRequest is the request body for scheduling a recurring
+// transaction
+type RecurringTransactionRequest struct {
+	// Amount is booked on every run, negative for a recurring debit
+	Amount float64 `json:"amount"`
+	// Interval is daily, weekly or monthly
+	Interval transactionmanager.RecurringInterval `json:"interval"`
+	// NextRunAt is the first run, later runs follow every Interval
+	NextRunAt time.Time `json:"next_run_at"`
+}
+
+// CreateRecurringTransaction schedules a recurring transaction for a user
+func (c *Controller) CreateRecurringTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var request RecurringTransactionRequest
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recurring, err := c.transactionmanager.CreateRecurringTransaction(ctx, transactionmanager.RecurringTransaction{
+		UserID:    userID,
+		Amount:    decimal.NewFromFloat(request.Amount),
+		Interval:  request.Interval,
+		NextRunAt: request.NextRunAt,
+	})
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, recurring)
+}
+
+// GetRecurringTransactions returns a user's recurring transactions
+func (c *Controller) GetRecurringTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	recurring, err := c.transactionmanager.GetRecurringTransactions(ctx, userID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, recurring)
+}
+
+// GetProjectedBalance projects a user's balance forward to the until query
+// parameter by the runs of their recurring transactions due by then. until is
+// either a date, covering the whole day in UTC, or an RFC 3339 time.
+func (c *Controller) GetProjectedBalance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	until, err := parseUntil(r.URL.Query().Get("until"))
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	projection, err := c.transactionmanager.ProjectBalance(ctx, userID, until)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, projection)
+}
+
+// parseUntil reads the end of a projection. A date stands for its last
+// instant in UTC, so runs on that day are included.
+func parseUntil(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("until is required")
+	}
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid until %q, expected a date or an RFC 3339 time", value)
+	}
+	return until, nil
+}
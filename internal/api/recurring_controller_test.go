@@ -0,0 +1,108 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	RecurringTemplate        = "/users/%s/recurring"
+	ProjectedBalanceTemplate = "/users/%s/balance/projected%s"
+)
+
+func TestGetProjectedBalanceEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient,
+		transactionmanager.WithClock(func() time.Time { return now }))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(50)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	schedule := func(userID uuid.UUID, request api.RecurringTransactionRequest) int {
+		body, _ := json.Marshal(request)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(RecurringTemplate, userID), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// A monthly credit of 100 from January 15th
+	code := schedule(user.ID, api.RecurringTransactionRequest{
+		Amount:    100,
+		Interval:  transactionmanager.RecurringMonthly,
+		NextRunAt: time.Date(2020, 1, 15, 9, 0, 0, 0, time.UTC),
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	assert.Equal(t, http.StatusBadRequest, schedule(user.ID, api.RecurringTransactionRequest{Amount: 100, Interval: "yearly", NextRunAt: now}))
+	assert.Equal(t, http.StatusBadRequest, schedule(user.ID, api.RecurringTransactionRequest{Amount: 0, Interval: transactionmanager.RecurringDaily, NextRunAt: now}))
+	assert.Equal(t, http.StatusNotFound, schedule(uuid.New(), api.RecurringTransactionRequest{Amount: 100, Interval: transactionmanager.RecurringDaily, NextRunAt: now}))
+
+	testCases := []struct {
+		name                string
+		userID              uuid.UUID
+		queryParams         string
+		expectedStatusCode  int
+		expectedProjected   float64
+		expectedOccurrences int
+	}{
+		{name: "Three months", userID: user.ID, queryParams: "?until=2020-04-01", expectedStatusCode: http.StatusOK, expectedProjected: 350, expectedOccurrences: 3},
+		{name: "Run on the last day counts", userID: user.ID, queryParams: "?until=2020-03-15", expectedStatusCode: http.StatusOK, expectedProjected: 350, expectedOccurrences: 3},
+		{name: "Day before a run", userID: user.ID, queryParams: "?until=2020-03-14", expectedStatusCode: http.StatusOK, expectedProjected: 250, expectedOccurrences: 2},
+		{name: "Before the first run", userID: user.ID, queryParams: "?until=2020-01-15T08:59:59Z", expectedStatusCode: http.StatusOK, expectedProjected: 50, expectedOccurrences: 0},
+		{name: "Missing until", userID: user.ID, queryParams: "", expectedStatusCode: http.StatusBadRequest},
+		{name: "Invalid until", userID: user.ID, queryParams: "?until=April", expectedStatusCode: http.StatusBadRequest},
+		{name: "Past until", userID: user.ID, queryParams: "?until=2019-12-01", expectedStatusCode: http.StatusBadRequest},
+		{name: "Unknown user", userID: uuid.New(), queryParams: "?until=2020-04-01", expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(ProjectedBalanceTemplate, tc.userID, tc.queryParams), nil)
+			rr := httptest.NewRecorder()
+			newAPI.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rr.Code)
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var projection transactionmanager.BalanceProjection
+			err := json.Unmarshal(rr.Body.Bytes(), &projection)
+			if err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			assert.True(t, projection.Balance.Equal(decimal.NewFromFloat(50)), "got balance %s", projection.Balance)
+			assert.True(t, projection.ProjectedBalance.Equal(decimal.NewFromFloat(tc.expectedProjected)), "expected %v, got %s", tc.expectedProjected, projection.ProjectedBalance)
+			assert.Equal(t, tc.expectedOccurrences, projection.Occurrences)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+)
+
+// RefundRequest is the request body for refunding part or all of a
+// transaction
+type RefundRequest struct {
+	// Amount is the positive amount to refund
+	Amount         float64 `json:"amount"`
+	IdempotencyKey string  `json:"idempotency_key"`
+}
+
+// RefundTransaction refunds part or all of a transaction. Refunds taking the
+// total refunded past the original amount get 422 Unprocessable Entity.
+func (c *Controller) RefundTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var refundRequest RefundRequest
+	if err := decodeJSON(r, &refundRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey, err := c.writeIdempotencyKey(refundRequest.IdempotencyKey)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refund, err := c.transactionmanager.RefundTransaction(ctx, transactionID, decimal.NewFromFloat(refundRequest.Amount), idempotencyKey)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, refund)
+}
+
+// ReverseTransaction undoes a transaction with a compensating transaction of
+// the negated amount, answered with 201 Created and the reversal. Reversing
+// a transaction again, or one that was refunded, gets 409 Conflict.
+func (c *Controller) ReverseTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	reversal, err := c.transactionmanager.ReverseTransaction(ctx, transactionID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, reversal)
+}
+
+// VoidTransaction reverses a transaction by voiding it, taking its amount
+// back out of the user's balance. A transaction can only be voided once,
+// later attempts get 409 Conflict, as do transactions with refunds or
+// reversals that aren't voided and legs of transfers.
+func (c *Controller) VoidTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	voided, err := c.transactionmanager.VoidTransaction(ctx, transactionID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, voided)
+}
+
+// GetCompensations returns a page of the refunds and reversals of a
+// transaction, oldest first, with the amount still refundable
+func (c *Controller) GetCompensations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	page, pageSize := parsePage(r)
+
+	compensations, err := c.transactionmanager.GetCompensations(ctx, transactionID, page, pageSize)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, compensations)
+}
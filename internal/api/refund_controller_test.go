@@ -0,0 +1,392 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	RefundTransactionTemplate  = "/transactions/%s/refund"
+	ReverseTransactionTemplate = "/transactions/%s/reverse"
+	VoidTransactionTemplate    = "/transactions/%s/void"
+	CompensationsTemplate      = "/transactions/%s/reversals"
+)
+
+func TestRefundTransactionEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	original, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	refund := func(amount float64, idempotencyKey string) (int, transactionmanager.Transaction) {
+		body, _ := json.Marshal(api.RefundRequest{Amount: amount, IdempotencyKey: idempotencyKey})
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(RefundTransactionTemplate, original.ID), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transaction transactionmanager.Transaction
+		json.Unmarshal(rr.Body.Bytes(), &transaction)
+		return rr.Code, transaction
+	}
+
+	// Partial refunds that together make up the original
+	code, first := refund(60, uuid.New().String())
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, first.Amount.Equal(decimal.NewFromFloat(-60)), "refund should be booked against the credit")
+	if assert.NotNil(t, first.ReversesID) {
+		assert.Equal(t, original.ID, *first.ReversesID)
+	}
+
+	// Two equal refunds without a key are two refunds, not a retry
+	code, _ = refund(20, "")
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = refund(20, "")
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Nothing is left to refund
+	code, _ = refund(0.01, uuid.New().String())
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, balance.IsZero(), "expected a zero balance, got %s", balance)
+}
+
+func TestReverseTransactionEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	original, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+		ReasonCode:     "DEPOSIT",
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	reverse := func(transactionID uuid.UUID) (int, transactionmanager.Transaction) {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(ReverseTransactionTemplate, transactionID), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transaction transactionmanager.Transaction
+		json.Unmarshal(rr.Body.Bytes(), &transaction)
+		return rr.Code, transaction
+	}
+
+	code, reversal := reverse(original.ID)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, reversal.Amount.Equal(decimal.NewFromFloat(-100)), "got %s", reversal.Amount)
+	assert.Equal(t, "DEPOSIT", reversal.ReasonCode)
+	if assert.NotNil(t, reversal.ReversesID) {
+		assert.Equal(t, original.ID, *reversal.ReversesID)
+	}
+
+	// A transaction is only reversed once
+	code, _ = reverse(original.ID)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = reverse(uuid.New())
+	assert.Equal(t, http.StatusNotFound, code)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, balance.IsZero(), "expected a zero balance, got %s", balance)
+}
+
+func TestGetCompensationsEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	original, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	list := func(query string) (int, transactionmanager.Compensations) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(CompensationsTemplate, original.ID)+query, nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var compensations transactionmanager.Compensations
+		json.Unmarshal(rr.Body.Bytes(), &compensations)
+		return rr.Code, compensations
+	}
+
+	code, compensations := list("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, compensations.Compensations)
+	assert.True(t, compensations.Refundable.Equal(decimal.NewFromFloat(100)), "got %s", compensations.Refundable)
+
+	refund, err := transactionManager.RefundTransaction(testEnv.Context, original.ID, decimal.NewFromFloat(30), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to refund transaction: %v", err)
+	}
+
+	code, compensations = list("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, compensations.Refundable.Equal(decimal.NewFromFloat(70)), "got %s", compensations.Refundable)
+
+	// A refunded transaction can only be reversed once the refund is voided
+	if _, err = transactionManager.VoidTransaction(testEnv.Context, refund.ID); err != nil {
+		t.Fatalf("failed to void refund: %v", err)
+	}
+	reversal, err := transactionManager.ReverseTransaction(testEnv.Context, original.ID)
+	if err != nil {
+		t.Fatalf("failed to reverse transaction: %v", err)
+	}
+
+	code, compensations = list("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, original.ID, compensations.TransactionID)
+	assert.Equal(t, int64(2), compensations.Total)
+	assert.True(t, compensations.Compensated.Equal(decimal.NewFromFloat(100)), "got %s", compensations.Compensated)
+	assert.True(t, compensations.Refundable.IsZero(), "got %s", compensations.Refundable)
+	if assert.Len(t, compensations.Compensations, 2) {
+		assert.Equal(t, refund.ID, compensations.Compensations[0].ID)
+		assert.True(t, compensations.Compensations[0].Amount.Equal(decimal.NewFromFloat(-30)), "got %s", compensations.Compensations[0].Amount)
+		assert.Equal(t, transactionmanager.TransactionStatusVoided, compensations.Compensations[0].Status)
+		assert.Equal(t, reversal.ID, compensations.Compensations[1].ID)
+		assert.True(t, compensations.Compensations[1].Amount.Equal(decimal.NewFromFloat(-100)), "got %s", compensations.Compensations[1].Amount)
+		assert.False(t, compensations.Compensations[1].CreatedAt.IsZero())
+	}
+
+	code, compensations = list("?page=2&pageSize=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(2), compensations.Total)
+	if assert.Len(t, compensations.Compensations, 1) {
+		assert.Equal(t, reversal.ID, compensations.Compensations[0].ID)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(CompensationsTemplate, uuid.New()), nil)
+	rr := httptest.NewRecorder()
+	newAPI.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestReverseTransactionEndpoint_Concurrent(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	original, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         user.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	// Two reversals of the same transaction at once
+	concurrentRequests := 2
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(concurrentRequests)
+
+	successCount := int32(0)
+	conflictCount := int32(0)
+	for i := 0; i < concurrentRequests; i++ {
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(ReverseTransactionTemplate, original.ID), nil)
+			rr := httptest.NewRecorder()
+			<-startCh
+			newAPI.ServeHTTP(rr, req)
+			switch rr.Code {
+			case http.StatusCreated:
+				atomic.AddInt32(&successCount, 1)
+			case http.StatusConflict:
+				atomic.AddInt32(&conflictCount, 1)
+			}
+		}()
+	}
+	close(startCh)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), successCount)
+	assert.Equal(t, int32(1), conflictCount)
+
+	// The amount was reversed exactly once
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.IsZero(), "got %s", balance)
+
+	compensations, err := transactionManager.GetCompensations(testEnv.Context, original.ID, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), compensations.Total)
+}
+
+func TestVoidTransactionEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, u := range []storage.User{user, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	add := func(amount float64) transactionmanager.Transaction {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		return transaction
+	}
+	refunded := add(100)
+	plain := add(10)
+
+	_, err = transactionManager.RefundTransaction(testEnv.Context, refunded.ID, decimal.NewFromFloat(40), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to refund transaction: %v", err)
+	}
+	transfer, err := transactionManager.ReserveTransfer(testEnv.Context, user.ID, receiver.ID, decimal.NewFromFloat(20), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to reserve transfer: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	void := func(transactionID uuid.UUID) int {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf(VoidTransactionTemplate, transactionID), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, void(plain.ID))
+	assert.Equal(t, http.StatusConflict, void(plain.ID))
+	assert.Equal(t, http.StatusNotFound, void(uuid.New()))
+
+	// The refund already took 40 out, voiding the original would take
+	// another 100
+	assert.Equal(t, http.StatusConflict, void(refunded.ID))
+	// The pending transfer's leg is only undone by cancelling the transfer
+	assert.Equal(t, http.StatusConflict, void(transfer.DebitTransactionID))
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(40)), "got %s", balance)
+
+	_, err = transactionManager.CancelTransfer(testEnv.Context, transfer.ID)
+	assert.Nil(t, err)
+	balance, err = transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(60)), "got %s", balance)
+}
@@ -1,45 +1,259 @@
 package api
 
 import (
+	"crypto/subtle"
+	"log/slog"
+	"mime"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/time/rate"
 )
 
 const (
+	users          = "/users"
 	addTransaction = "/users/{uid}/add"
+	userByExternal = "/users/by-external/{externalID}"
 	getUserBalance = "/users/{uid}/balance"
+	projected      = "/users/{uid}/balance/projected"
+	userDisplay    = "/users/{uid}/display-currency"
+	recurring      = "/users/{uid}/recurring"
+	schedule       = "/users/{uid}/schedule"
+	scheduled      = "/users/{uid}/scheduled"
+	cancelSchedule = "/users/{uid}/scheduled/{id}/cancel"
 	userHistory    = "/users/{uid}/history"
-)
+	historyCSV     = "/users/{uid}/history.csv"
+	largest        = "/users/{uid}/history/largest"
+	groupedHistory = "/users/{uid}/history/grouped"
+	averageAmount  = "/users/{uid}/stats/average"
+	volatility     = "/users/{uid}/stats/volatility"
+	cadence        = "/users/{uid}/stats/cadence"
+	userKeys       = "/users/{uid}/idempotency-keys"
+	userTransfers  = "/users/{uid}/transfers"
+	userImport     = "/users/{uid}/transactions/batch"
+	netFlow        = "/users/{uid}/flow/{otherID}"
+
+	prepareStatement = "/users/{uid}/statement/prepare"
+	statementJob     = "/statements/{jobID}"
+
+	validateTransaction = "/transactions/validate"
+	transactionByID     = "/transactions/{id}"
+	transactionImpact   = "/transactions/{id}/impact"
+	refundTransaction   = "/transactions/{id}/refund"
+	reverseTransaction  = "/transactions/{id}/reverse"
+	compensations       = "/transactions/{id}/reversals"
+	voidTransaction     = "/transactions/{id}/void"
+	batchGet            = "/transactions/batch-get"
+	serverTime          = "/time"
+	metricsPath         = "/metrics"
+	healthzPath         = "/healthz"
+	readyzPath          = "/readyz"
+	openAPIPath         = "/openapi.json"
+	docsPath            = "/docs"
+
+	batches = "/batches"
+	batch   = "/batches/{id}"
 
-var limiter = rate.NewLimiter(10, 100)
+	transfers      = "/transfers"
+	transfer       = "/transfers/{id}"
+	settleTransfer = "/transfers/{id}/settle"
+	cancelTransfer = "/transfers/{id}/cancel"
 
-// limitMiddleware is a middleware that limits the number of requests per second
-// to 10 requests per second
-// If the limit is exceeded, a 429 Too Many Requests response is returned
-func limitMiddleware(next http.Handler) http.Handler {
+	adminPrefix       = "/admin"
+	userLimits        = "/users/{uid}/limits"
+	adjustments       = "/users/{uid}/adjustments"
+	deleteTransaction = "/transactions/{id}"
+	auditLog          = "/users/{uid}/audit"
+	recentUsers       = "/users/recent"
+	reconcile         = "/reconciliation-report"
+	orphans           = "/orphaned-transactions"
+	recompute         = "/recompute-balances"
+	balancesCSV       = "/balances.csv"
+	webhooks          = "/webhooks"
+	webhookRetry      = "/webhooks/retry"
+	backfill          = "/users/{uid}/transactions/backfill"
+)
+
+// jsonContentTypeMiddleware rejects POST and PATCH requests whose body isn't
+// declared as application/json with 415 Unsupported Media Type. Requests
+// without a body are let through.
+func jsonContentTypeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-			return
+		if (r.Method == http.MethodPost || r.Method == http.MethodPatch) && r.ContentLength != 0 {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				httpError(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// APIOption configures optional router behaviour
+type APIOption func(*apiConfig)
+
+type apiConfig struct {
+	adminToken string
+
+	compress        bool
+	compressMinSize int
+	compressLevel   int
+
+	tenants bool
+
+	logger *slog.Logger
+
+	readinessChecks []readinessCheck
+
+	shutdownTimeout time.Duration
+
+	rateLimit    float64
+	rateBurst    int
+	rateLimitSet bool
+}
+
+// WithAdminToken sets the bearer token required by the /admin endpoints.
+// Without a token the admin endpoints are disabled.
+func WithAdminToken(token string) APIOption {
+	return func(config *apiConfig) {
+		config.adminToken = token
+	}
+}
+
+// adminMiddleware only lets requests carrying the admin bearer token through
+func adminMiddleware(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				httpError(w, "admin API is disabled", http.StatusForbidden)
+				return
+			}
+			provided := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+token)) != 1 {
+				httpError(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // NewAPI returns a new API router
 // The router is configured with the API controller
 // and the rate limiting middleware
-func NewAPI(apiController Controller) http.Handler {
+func NewAPI(apiController Controller, opts ...APIOption) *API {
+	var config apiConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	logger := config.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	if !config.rateLimitSet {
+		config.rateLimit, config.rateBurst = DefaultRateLimit, DefaultRateBurst
+	}
+
 	router := mux.NewRouter()
 
-	// Add rate limiting middleware to all endpoints
-	router.Use(limitMiddleware)
+	// Tag and log every request, including those turned away by the
+	// middlewares below
+	router.Use(requestLogMiddleware(logger))
+	// Measure every endpoint
+	router.Use(metricsMiddleware(apiController.metrics))
+	// Rate limit every user on their own
+	router.Use(limitMiddleware(newUserLimiters(config.rateLimit, config.rateBurst)))
+	router.Use(jsonContentTypeMiddleware)
+	if config.tenants {
+		router.Use(tenantMiddleware)
+	}
+	if config.compress {
+		router.Use(compressMiddleware(config.compressMinSize, config.compressLevel))
+	}
 
+	// Registered first so external IDs like "history" aren't taken for a
+	// user route
+	router.HandleFunc(userByExternal, apiController.GetUserByExternalID).Methods(http.MethodGet)
+	router.HandleFunc(users, apiController.CreateUser).Methods(http.MethodPost)
 	router.HandleFunc(addTransaction, apiController.AddTransaction).Methods(http.MethodPost)
+	router.HandleFunc(userImport, apiController.AddUserTransactions).Methods(http.MethodPost)
 	router.HandleFunc(getUserBalance, apiController.GetUserBalance).Methods(http.MethodGet)
-	router.HandleFunc(userHistory, apiController.GetUserTransactionHistory).Methods(http.MethodGet)
+	router.HandleFunc(projected, apiController.GetProjectedBalance).Methods(http.MethodGet)
+	router.HandleFunc(userDisplay, apiController.SetDisplayCurrency).Methods(http.MethodPut)
+	router.HandleFunc(recurring, apiController.CreateRecurringTransaction).Methods(http.MethodPost)
+	router.HandleFunc(recurring, apiController.GetRecurringTransactions).Methods(http.MethodGet)
+	router.HandleFunc(schedule, apiController.ScheduleTransaction).Methods(http.MethodPost)
+	router.HandleFunc(scheduled, apiController.GetScheduledTransactions).Methods(http.MethodGet)
+	router.HandleFunc(cancelSchedule, apiController.CancelScheduledTransaction).Methods(http.MethodPost)
+	router.HandleFunc(userHistory, apiController.cached(apiController.GetUserTransactionHistory)).Methods(http.MethodGet)
+	router.HandleFunc(historyCSV, apiController.ExportUserHistoryCSV).Methods(http.MethodGet)
+	router.HandleFunc(groupedHistory, apiController.GetGroupedTransactionHistory).Methods(http.MethodGet)
+	router.HandleFunc(largest, apiController.cached(apiController.GetLargestTransaction)).Methods(http.MethodGet)
+	router.HandleFunc(userKeys, apiController.GetUserIdempotencyKeys).Methods(http.MethodGet)
+	router.HandleFunc(averageAmount, apiController.cached(apiController.GetAverageTransactionAmount)).Methods(http.MethodGet)
+	router.HandleFunc(volatility, apiController.cached(apiController.GetBalanceVolatility)).Methods(http.MethodGet)
+	router.HandleFunc(cadence, apiController.cached(apiController.GetTransactionCadence)).Methods(http.MethodGet)
+	router.HandleFunc(validateTransaction, apiController.ValidateTransaction).Methods(http.MethodPost)
+	router.HandleFunc(voidTransaction, apiController.VoidTransaction).Methods(http.MethodPost)
+	router.HandleFunc(batchGet, apiController.BatchGetTransactions).Methods(http.MethodPost)
+	router.HandleFunc(transactionByID, apiController.GetTransaction).Methods(http.MethodGet)
+	router.HandleFunc(transactionImpact, apiController.GetTransactionImpact).Methods(http.MethodGet)
+	router.HandleFunc(refundTransaction, apiController.RefundTransaction).Methods(http.MethodPost)
+	router.HandleFunc(reverseTransaction, apiController.ReverseTransaction).Methods(http.MethodPost)
+	router.HandleFunc(compensations, apiController.GetCompensations).Methods(http.MethodGet)
+	router.HandleFunc(batches, apiController.CreateBatch).Methods(http.MethodPost)
+	router.HandleFunc(batch, apiController.GetBatch).Methods(http.MethodGet)
+	router.HandleFunc(serverTime, apiController.GetServerTime).Methods(http.MethodGet)
+	router.HandleFunc(metricsPath, apiController.metrics.handler).Methods(http.MethodGet)
+	router.HandleFunc(transfers, apiController.CreateTransfer).Methods(http.MethodPost)
+	router.HandleFunc(userTransfers, apiController.GetUserTransfers).Methods(http.MethodGet)
+	router.HandleFunc(netFlow, apiController.GetNetFlow).Methods(http.MethodGet)
+	router.HandleFunc(transfer, apiController.GetTransfer).Methods(http.MethodGet)
+	router.HandleFunc(settleTransfer, apiController.SettleTransfer).Methods(http.MethodPost)
+	router.HandleFunc(cancelTransfer, apiController.CancelTransfer).Methods(http.MethodPost)
+	router.HandleFunc(prepareStatement, apiController.PrepareStatement).Methods(http.MethodPost)
+	router.HandleFunc(statementJob, apiController.GetStatementJob).Methods(http.MethodGet)
+
+	// Admin endpoints require the admin bearer token
+	admin := router.PathPrefix(adminPrefix).Subrouter()
+	admin.Use(adminMiddleware(config.adminToken))
+	admin.HandleFunc(userLimits, apiController.GetUserLimits).Methods(http.MethodGet)
+	admin.HandleFunc(userLimits, apiController.SetUserLimits).Methods(http.MethodPut)
+	admin.HandleFunc(adjustments, apiController.AdjustBalance).Methods(http.MethodPost)
+	admin.HandleFunc(deleteTransaction, apiController.DeleteTransaction).Methods(http.MethodDelete)
+	admin.HandleFunc(auditLog, apiController.GetAuditEntries).Methods(http.MethodGet)
+	admin.HandleFunc(recentUsers, apiController.GetRecentUsers).Methods(http.MethodGet)
+	admin.HandleFunc(reconcile, apiController.cached(apiController.GetReconciliationReport)).Methods(http.MethodGet)
+	admin.HandleFunc(orphans, apiController.GetOrphanedTransactions).Methods(http.MethodGet)
+	admin.HandleFunc(recompute, apiController.RecomputeBalances).Methods(http.MethodPost)
+	admin.HandleFunc(balancesCSV, apiController.ExportBalancesCSV).Methods(http.MethodGet)
+	admin.HandleFunc(webhooks, apiController.GetWebhookDeliveries).Methods(http.MethodGet)
+	admin.HandleFunc(webhookRetry, apiController.RetryWebhookDeliveries).Methods(http.MethodPost)
+	admin.HandleFunc(backfill, apiController.BackfillUserTransactions).Methods(http.MethodPost)
+
+	// Probes bypass every middleware, so they are neither rate limited nor
+	// asked for a tenant or a token
+	probes := mux.NewRouter()
+	probes.HandleFunc(healthzPath, healthz).Methods(http.MethodGet)
+	probes.HandleFunc(readyzPath, readyz(config.readinessChecks)).Methods(http.MethodGet)
+
+	// The API description is generated from the routes registered above
+	// and, like the probes, served without asking for a tenant or a token
+	spec, err := newOpenAPISpec(router, probes, apiController.jsonNaming, config.tenants)
+	if err != nil {
+		logger.Error("describing the API", "error", err)
+	}
+	probes.HandleFunc(openAPIPath, serveOpenAPISpec(spec, err)).Methods(http.MethodGet)
+	probes.HandleFunc(docsPath, serveDocs).Methods(http.MethodGet)
+
+	probes.PathPrefix("/").Handler(router)
 
-	return router
+	shutdownTimeout := config.shutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	return &API{handler: probes, logger: logger, shutdownTimeout: shutdownTimeout}
 }
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// ScheduleTransactionRequest is the request body for scheduling a
+// future-dated transaction
+type ScheduleTransactionRequest struct {
+	Amount    float64   `json:"amount"`
+	ExecuteAt time.Time `json:"execute_at"`
+	// IdempotencyKey covers the scheduling and is the key the transaction
+	// is posted with. One is generated when it is left out.
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// ScheduleTransaction stores a transaction to be posted for the user at
+// execute_at. A retry with the same idempotency key gets the transaction
+// already scheduled, flagged with the Idempotency-Replayed header.
+func (c *Controller) ScheduleTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var request ScheduleTransactionRequest
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey, err := c.writeIdempotencyKey(request.IdempotencyKey)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := c.transactionmanager.ScheduleTransaction(ctx, transactionmanager.ScheduledTransaction{
+		UserID:         userID,
+		Amount:         decimal.NewFromFloat(request.Amount),
+		ExecuteAt:      request.ExecuteAt,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+	if scheduled.Replayed {
+		w.Header().Set(replayedHeader, "true")
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, scheduled)
+}
+
+// GetScheduledTransactions returns a user's scheduled transactions
+func (c *Controller) GetScheduledTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := c.transactionmanager.GetScheduledTransactions(ctx, userID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, scheduled)
+}
+
+// CancelScheduledTransaction cancels a scheduled transaction that hasn't been
+// picked up by the scheduler yet. Later ones get 409 Conflict.
+func (c *Controller) CancelScheduledTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+	scheduledID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid scheduled transaction ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cancelled, err := c.transactionmanager.CancelScheduledTransaction(ctx, userID, scheduledID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, cancelled)
+}
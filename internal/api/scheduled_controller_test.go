@@ -0,0 +1,135 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	ScheduleTemplate       = "/users/%s/schedule"
+	ScheduledTemplate      = "/users/%s/scheduled"
+	CancelScheduleTemplate = "/users/%s/scheduled/%s/cancel"
+)
+
+func TestScheduledTransactionEndpoints(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	post := func(path string, body interface{}) (*httptest.ResponseRecorder, transactionmanager.ScheduledTransaction) {
+		encoded, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var scheduled transactionmanager.ScheduledTransaction
+		json.Unmarshal(rr.Body.Bytes(), &scheduled)
+		return rr, scheduled
+	}
+	list := func() []transactionmanager.ScheduledTransaction {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(ScheduledTemplate, user.ID), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var scheduled []transactionmanager.ScheduledTransaction
+		json.Unmarshal(rr.Body.Bytes(), &scheduled)
+		return scheduled
+	}
+
+	executeAt := time.Now().Add(300 * time.Millisecond)
+	request := api.ScheduleTransactionRequest{Amount: 25, ExecuteAt: executeAt, IdempotencyKey: uuid.New().String()}
+	rr, due := post(fmt.Sprintf(ScheduleTemplate, user.ID), request)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, transactionmanager.ScheduledStatusScheduled, due.Status)
+
+	// A retry gets the same scheduled transaction
+	rr, replayed := post(fmt.Sprintf(ScheduleTemplate, user.ID), request)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Idempotency-Replayed"))
+	assert.Equal(t, due.ID, replayed.ID)
+
+	// Cancelled before it is due, it is never posted
+	_, cancelled := post(fmt.Sprintf(ScheduleTemplate, user.ID), api.ScheduleTransactionRequest{Amount: 1000, ExecuteAt: executeAt})
+	rr, _ = post(fmt.Sprintf(CancelScheduleTemplate, user.ID, cancelled.ID), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr, _ = post(fmt.Sprintf(ScheduleTemplate, user.ID), api.ScheduleTransactionRequest{Amount: 25, ExecuteAt: time.Now().Add(-time.Minute)})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr, _ = post(fmt.Sprintf(ScheduleTemplate, uuid.New()), api.ScheduleTransactionRequest{Amount: 25, ExecuteAt: executeAt})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	ctx, cancel := context.WithCancel(testEnv.Context)
+	defer cancel()
+	go transactionManager.RunScheduler(ctx, 50*time.Millisecond)
+
+	var executed transactionmanager.ScheduledTransaction
+	assert.Eventually(t, func() bool {
+		for _, scheduled := range list() {
+			if scheduled.ID == due.ID && scheduled.Status == transactionmanager.ScheduledStatusExecuted {
+				executed = scheduled
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+
+	if assert.NotNil(t, executed.TransactionID) {
+		transaction, err := transactionManager.GetTransaction(testEnv.Context, *executed.TransactionID)
+		assert.Nil(t, err)
+		assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(25)))
+		assert.Equal(t, due.IdempotencyKey, transaction.IdempotencyKey)
+		assert.Equal(t, "scheduled", transaction.Channel)
+	}
+
+	// Another pass posts nothing again
+	posted, err := transactionManager.ExecuteDueScheduled(testEnv.Context)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, posted)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(25)), "got %s", balance)
+
+	for _, scheduled := range list() {
+		if scheduled.ID == cancelled.ID {
+			assert.Equal(t, transactionmanager.ScheduledStatusCancelled, scheduled.Status)
+		}
+	}
+
+	// Executed transactions can't be cancelled
+	rr, _ = post(fmt.Sprintf(CancelScheduleTemplate, user.ID, due.ID), nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr, _ = post(fmt.Sprintf(CancelScheduleTemplate, user.ID, uuid.New()), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShutdownTimeout is how long Run waits for in-flight requests
+	// to finish once it is asked to stop
+	DefaultShutdownTimeout = 15 * time.Second
+
+	// abortGrace is how long requests cancelled after the shutdown timeout
+	// get to roll back and return before their connections are closed
+	abortGrace = 5 * time.Second
+)
+
+// WithShutdownTimeout sets how long Run drains in-flight requests before it
+// cancels them, DefaultShutdownTimeout when zero
+func WithShutdownTimeout(timeout time.Duration) APIOption {
+	return func(config *apiConfig) {
+		config.shutdownTimeout = timeout
+	}
+}
+
+// API serves the ledger endpoints. It is an http.Handler, and Run serves it
+// on an address of its own.
+type API struct {
+	handler         http.Handler
+	logger          *slog.Logger
+	shutdownTimeout time.Duration
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
+}
+
+// Run serves the API on addr until ctx is done, then stops taking new
+// connections and waits up to the shutdown timeout for in-flight requests.
+// Requests still running after that have their context cancelled, so their
+// database transactions roll back instead of being cut off mid-write.
+// Run returns nil once every request finished in time.
+func (a *API) Run(ctx context.Context, addr string) error {
+	// Requests outlive ctx, which only starts the shutdown, and are
+	// cancelled once they overrun the shutdown timeout
+	requestsCtx, abortRequests := context.WithCancel(context.WithoutCancel(ctx))
+	defer abortRequests()
+
+	var inflight sync.WaitGroup
+	server := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inflight.Add(1)
+			defer inflight.Done()
+			a.ServeHTTP(w, r)
+		}),
+		MaxHeaderBytes: 1 << 20,
+		BaseContext:    func(net.Listener) context.Context { return requestsCtx },
+	}
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		a.logger.Info("API listening", "addr", addr)
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case <-ctx.Done():
+	}
+
+	a.logger.Info("shutting down, draining in-flight requests", "timeout", a.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		server.Close()
+		return err
+	}
+
+	a.logger.Warn("shutdown timed out, aborting in-flight requests")
+	abortRequests()
+
+	aborted := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(aborted)
+	}()
+	select {
+	case <-aborted:
+	case <-time.After(abortGrace):
+	}
+	server.Close()
+
+	return fmt.Errorf("requests still running after %s were aborted: %w", a.shutdownTimeout, err)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PrepareStatement starts generating a user's statement in the background and
+// responds with the job to poll. The period is given by the optional from and
+// to query parameters in RFC 3339; it defaults to everything up to now.
+func (c *Controller) PrepareStatement(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := c.transactionmanager.PrepareStatement(ctx, userID, from, to)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// GetStatementJob returns the status of a statement job, including the
+// statement once it is done
+func (c *Controller) GetStatementJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	jobID, err := uuid.Parse(vars["jobID"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid job ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	job, err := c.transactionmanager.GetStatementJob(ctx, jobID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, job)
+}
+
+// parseTimeRange reads the from and to query parameters. A missing from means
+// the beginning of time and a missing to means now.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	from := time.Time{}
+	to := time.Now()
+
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid from %v", err)
+		}
+		from = parsed
+	}
+
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid to %v", err)
+		}
+		to = parsed
+	}
+
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid time range, to is before from")
+	}
+
+	return from, to, nil
+}
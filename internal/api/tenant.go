@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// tenantHeader names the tenant a request acts for
+const tenantHeader = "X-Tenant-ID"
+
+// WithTenantHeader scopes every request to the tenant in its X-Tenant-ID
+// header, so it only sees and writes that tenant's users. Requests without
+// the header are rejected, except on the admin endpoints, which see every
+// tenant unless they send one. Without it tenants are ignored.
+func WithTenantHeader() APIOption {
+	return func(config *apiConfig) {
+		config.tenants = true
+	}
+}
+
+// tenantMiddleware puts the tenant of the request into its context
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID := strings.TrimSpace(r.Header.Get(tenantHeader))
+		if tenantID == "" {
+			if strings.HasPrefix(r.URL.Path, adminPrefix+"/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			httpError(w, tenantHeader+" header is required", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(transactionmanager.WithTenant(r.Context(), tenantID)))
+	})
+}
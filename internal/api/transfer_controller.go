@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+// TransferRequest is the request body for moving money between two users
+type TransferRequest struct {
+	FromUserID uuid.UUID `json:"from_user_id"`
+	ToUserID   uuid.UUID `json:"to_user_id"`
+	Amount     float64   `json:"amount"`
+	// IdempotencyKey covers the whole transfer, both of its legs
+	IdempotencyKey string `json:"idempotency_key"`
+	// Pending only reserves the amount on the sender until the transfer is
+	// settled or cancelled
+	Pending bool `json:"pending"`
+}
+
+// CreateTransfer moves money from one user to another. A retry with the same
+// idempotency key gets the transfer already made, flagged with the
+// Idempotency-Replayed header. With ?dry_run=true the transfer is only checked
+// and the balances it would leave both users with are returned.
+func (c *Controller) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid dry_run %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var transferRequest TransferRequest
+	if err := decodeJSON(r, &transferRequest); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		preview, err := c.transactionmanager.PreviewTransfer(ctx, transferRequest.FromUserID, transferRequest.ToUserID, decimal.NewFromFloat(transferRequest.Amount), transferRequest.Pending)
+		if err != nil {
+			c.managerError(w, err)
+			return
+		}
+		c.respondWithJSON(w, http.StatusOK, preview)
+		return
+	}
+
+	idempotencyKey, err := c.writeIdempotencyKey(transferRequest.IdempotencyKey)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transfer := c.transactionmanager.Transfer
+	if transferRequest.Pending {
+		transfer = c.transactionmanager.ReserveTransfer
+	}
+
+	result, err := transfer(ctx, transferRequest.FromUserID, transferRequest.ToUserID, decimal.NewFromFloat(transferRequest.Amount), idempotencyKey)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+	if result.Replayed {
+		w.Header().Set(replayedHeader, "true")
+	}
+
+	c.respondWithJSON(w, http.StatusCreated, result)
+}
+
+// GetTransfer returns a transfer
+func (c *Controller) GetTransfer(w http.ResponseWriter, r *http.Request) {
+	c.handleTransfer(w, r, c.transactionmanager.GetTransfer)
+}
+
+// SettleTransfer credits the receiver of a pending transfer. Transfers that
+// aren't pending get 409 Conflict.
+func (c *Controller) SettleTransfer(w http.ResponseWriter, r *http.Request) {
+	c.handleTransfer(w, r, c.transactionmanager.SettleTransfer)
+}
+
+// CancelTransfer gives the amount reserved by a pending transfer back to the
+// sender. Transfers that aren't pending get 409 Conflict.
+func (c *Controller) CancelTransfer(w http.ResponseWriter, r *http.Request) {
+	c.handleTransfer(w, r, c.transactionmanager.CancelTransfer)
+}
+
+// GetUserTransfers returns a page of the transfers a user sent or received,
+// optionally only those in one direction
+func (c *Controller) GetUserTransfers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	direction := transactionmanager.TransferDirection(r.URL.Query().Get("direction"))
+	switch direction {
+	case "", transactionmanager.TransferDirectionSent, transactionmanager.TransferDirectionReceived:
+	default:
+		httpError(w, fmt.Sprintf("Invalid direction %q, expected sent or received", direction), http.StatusBadRequest)
+		return
+	}
+
+	page, pageSize := parsePage(r)
+
+	transfers, err := c.transactionmanager.GetUserTransfers(ctx, userID, direction, page, pageSize)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, transfers)
+}
+
+// NetFlowResponse is the net amount one user transferred to another
+type NetFlowResponse struct {
+	FromUserID uuid.UUID       `json:"from_user_id"`
+	ToUserID   uuid.UUID       `json:"to_user_id"`
+	NetAmount  decimal.Decimal `json:"net_amount"`
+}
+
+// GetNetFlow returns the net amount the first user transferred to the second
+// within the optional from and to query parameters, for settling up between
+// frequent counterparties
+func (c *Controller) GetNetFlow(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	fromUserID, err := uuid.Parse(vars["uid"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid user ID %v", err), http.StatusBadRequest)
+		return
+	}
+	toUserID, err := uuid.Parse(vars["otherID"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid counterparty ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	net, err := c.transactionmanager.GetNetFlow(ctx, fromUserID, toUserID, from, to)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	response := NetFlowResponse{
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		NetAmount:  net,
+	}
+	c.respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleTransfer runs fn on the transfer named in the path and responds with
+// the result
+func (c *Controller) handleTransfer(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, transferID uuid.UUID) (transactionmanager.Transfer, error)) {
+	vars := mux.Vars(r)
+	transferID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid transfer ID %v", err), http.StatusBadRequest)
+		return
+	}
+
+	transfer, err := fn(r.Context(), transferID)
+	if err != nil {
+		c.managerError(w, err)
+		return
+	}
+
+	c.respondWithJSON(w, http.StatusOK, transfer)
+}
@@ -0,0 +1,639 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/api"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+var (
+	TransfersPath          = "/transfers"
+	SettleTransferTemplate = "/transfers/%s/settle"
+	CancelTransferTemplate = "/transfers/%s/cancel"
+	UserTransfersTemplate  = "/users/%s/transfers"
+	NetFlowTemplate        = "/users/%s/flow/%s"
+)
+
+func TestCreateTransferEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{sender, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	post := func(body api.TransferRequest) (int, transactionmanager.Transfer) {
+		encoded, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, TransfersPath, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transfer transactionmanager.Transfer
+		json.Unmarshal(rr.Body.Bytes(), &transfer)
+		return rr.Code, transfer
+	}
+
+	balances := func() (decimal.Decimal, decimal.Decimal) {
+		senderBalance, err := transactionManager.GetUserBalance(testEnv.Context, sender.ID)
+		assert.Nil(t, err)
+		receiverBalance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+		assert.Nil(t, err)
+		return senderBalance, receiverBalance
+	}
+
+	request := api.TransferRequest{
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         40,
+		IdempotencyKey: uuid.New().String(),
+	}
+
+	// Both legs are written and returned
+	code, transfer := post(request)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, transactionmanager.TransferStatusSettled, transfer.Status)
+	assert.NotEqual(t, uuid.Nil, transfer.DebitTransactionID)
+	if assert.NotNil(t, transfer.CreditTransactionID) {
+		legs, err := transactionManager.GetTransactionsByIDs(testEnv.Context, []uuid.UUID{transfer.DebitTransactionID, *transfer.CreditTransactionID})
+		assert.Nil(t, err)
+		if assert.Len(t, legs, 2) {
+			assert.Equal(t, sender.ID, legs[0].UserID)
+			assert.True(t, legs[0].Amount.Equal(decimal.NewFromFloat(-40)))
+			assert.Equal(t, receiver.ID, legs[1].UserID)
+			assert.True(t, legs[1].Amount.Equal(decimal.NewFromFloat(40)))
+		}
+	}
+
+	senderBalance, receiverBalance := balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(60)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(40)))
+
+	// A retry with the same key gets the same transfer without moving the
+	// money again
+	code, replayed := post(request)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, transfer.ID, replayed.ID)
+	assert.Equal(t, transfer.DebitTransactionID, replayed.DebitTransactionID)
+	assert.Equal(t, transfer.CreditTransactionID, replayed.CreditTransactionID)
+
+	senderBalance, receiverBalance = balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(60)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(40)))
+
+	// More than the sender has leaves both users untouched
+	code, _ = post(api.TransferRequest{
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         61,
+		IdempotencyKey: uuid.New().String(),
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	senderBalance, receiverBalance = balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(60)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(40)))
+}
+
+func TestCancelTransferEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{sender, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	post := func(path string, body interface{}) (int, transactionmanager.Transfer) {
+		var requestBody *bytes.Buffer
+		if body != nil {
+			encoded, _ := json.Marshal(body)
+			requestBody = bytes.NewBuffer(encoded)
+		} else {
+			requestBody = bytes.NewBuffer(nil)
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, path, requestBody)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transfer transactionmanager.Transfer
+		json.Unmarshal(rr.Body.Bytes(), &transfer)
+		return rr.Code, transfer
+	}
+
+	balances := func() (decimal.Decimal, decimal.Decimal) {
+		senderBalance, err := transactionManager.GetUserBalance(testEnv.Context, sender.ID)
+		assert.Nil(t, err)
+		receiverBalance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+		assert.Nil(t, err)
+		return senderBalance, receiverBalance
+	}
+
+	// Place a pending transfer, which only reserves the amount on the sender
+	code, transfer := post(TransfersPath, api.TransferRequest{
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         30,
+		IdempotencyKey: uuid.New().String(),
+		Pending:        true,
+	})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, transactionmanager.TransferStatusPending, transfer.Status)
+
+	senderBalance, receiverBalance := balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(70)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(0)))
+
+	// Cancelling restores the sender's balance
+	code, cancelled := post(fmt.Sprintf(CancelTransferTemplate, transfer.ID), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, transactionmanager.TransferStatusCancelled, cancelled.Status)
+
+	senderBalance, receiverBalance = balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(100)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(0)))
+
+	// A cancelled transfer can't be cancelled or settled again
+	code, _ = post(fmt.Sprintf(CancelTransferTemplate, transfer.ID), nil)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = post(fmt.Sprintf(SettleTransferTemplate, transfer.ID), nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// Neither can a settled one be cancelled
+	code, transfer = post(TransfersPath, api.TransferRequest{
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         30,
+		IdempotencyKey: uuid.New().String(),
+		Pending:        true,
+	})
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, settled := post(fmt.Sprintf(SettleTransferTemplate, transfer.ID), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, transactionmanager.TransferStatusSettled, settled.Status)
+	assert.NotNil(t, settled.CreditTransactionID)
+
+	code, _ = post(fmt.Sprintf(CancelTransferTemplate, transfer.ID), nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	senderBalance, receiverBalance = balances()
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(70)))
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(30)))
+
+	code, _ = post(fmt.Sprintf(CancelTransferTemplate, uuid.New()), nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestCreateTransferEndpoint_DryRun(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{sender, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	for userID, amount := range map[uuid.UUID]float64{sender.ID: 100, receiver.ID: 20} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+			ID:             uuid.New(),
+			UserID:         userID,
+			Amount:         decimal.NewFromFloat(amount),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	dryRun := func(amount float64, pending bool) (int, transactionmanager.TransferPreview) {
+		encoded, _ := json.Marshal(api.TransferRequest{
+			FromUserID:     sender.ID,
+			ToUserID:       receiver.ID,
+			Amount:         amount,
+			IdempotencyKey: uuid.New().String(),
+			Pending:        pending,
+		})
+		req, _ := http.NewRequest(http.MethodPost, TransfersPath+"?dry_run=true", bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var preview transactionmanager.TransferPreview
+		json.Unmarshal(rr.Body.Bytes(), &preview)
+		return rr.Code, preview
+	}
+
+	countRows := func(table string) int {
+		var count int
+		err := testEnv.DB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		assert.Nil(t, err)
+		return count
+	}
+	transfers, transactions := countRows("transfers"), countRows("transactions")
+
+	code, preview := dryRun(30, false)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, preview.ProjectedFromBalance.Equal(decimal.NewFromFloat(70)))
+	assert.True(t, preview.ProjectedToBalance.Equal(decimal.NewFromFloat(50)))
+
+	// A pending transfer only reserves the amount on the sender
+	code, preview = dryRun(30, true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, preview.ProjectedFromBalance.Equal(decimal.NewFromFloat(70)))
+	assert.True(t, preview.ProjectedToBalance.Equal(decimal.NewFromFloat(20)))
+
+	// The sender's balance must cover it, as for a real transfer
+	code, _ = dryRun(101, false)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// Nothing was written
+	assert.Equal(t, transfers, countRows("transfers"))
+	assert.Equal(t, transactions, countRows("transactions"))
+
+	senderBalance, err := transactionManager.GetUserBalance(testEnv.Context, sender.ID)
+	assert.Nil(t, err)
+	assert.True(t, senderBalance.Equal(decimal.NewFromFloat(100)))
+	receiverBalance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+	assert.Nil(t, err)
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(20)))
+}
+
+func TestCreateTransferEndpoint_MaxTransferAmount(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithLimits(transactionmanager.Limits{
+		MaxAmount:         decimal.NewFromFloat(10),
+		MaxTransferAmount: decimal.NewFromFloat(50),
+	}))
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(200)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{sender, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	transfer := func(amount float64) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(api.TransferRequest{
+			FromUserID:     sender.ID,
+			ToUserID:       receiver.ID,
+			Amount:         amount,
+			IdempotencyKey: uuid.New().String(),
+		})
+		req, _ := http.NewRequest(http.MethodPost, TransfersPath, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// At the transfer limit, which is above the transaction limit
+	rr := transfer(50)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = transfer(50.01)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "maximum allowed for transfers")
+
+	receiverBalance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+	assert.Nil(t, err)
+	assert.True(t, receiverBalance.Equal(decimal.NewFromFloat(50)))
+}
+
+func TestGetUserTransfersEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(100)}
+	other := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(100)}
+	for _, u := range []storage.User{user, other} {
+		err = storageClient.UserRepository.Add(testEnv.Context, u)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	sent, err := transactionManager.Transfer(testEnv.Context, user.ID, other.ID, decimal.NewFromFloat(30), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	received, err := transactionManager.Transfer(testEnv.Context, other.ID, user.ID, decimal.NewFromFloat(10), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	get := func(query string) (int, []transactionmanager.UserTransfer) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(UserTransfersTemplate, user.ID)+query, nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transfers []transactionmanager.UserTransfer
+		json.Unmarshal(rr.Body.Bytes(), &transfers)
+		return rr.Code, transfers
+	}
+
+	// One entry per transfer, not per ledger row
+	code, transfers := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, transfers, 2)
+
+	code, transfers = get("?direction=sent")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, sent.ID, transfers[0].ID)
+		assert.Equal(t, transactionmanager.TransferDirectionSent, transfers[0].Direction)
+		assert.Equal(t, other.ID, transfers[0].CounterpartyID)
+		assert.True(t, transfers[0].Amount.Equal(decimal.NewFromFloat(30)))
+	}
+
+	code, transfers = get("?direction=received")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, received.ID, transfers[0].ID)
+		assert.Equal(t, transactionmanager.TransferDirectionReceived, transfers[0].Direction)
+		assert.Equal(t, other.ID, transfers[0].CounterpartyID)
+	}
+
+	code, transfers = get("?pageSize=1&page=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, transfers, 1)
+
+	code, _ = get("?direction=sideways")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetNetFlowEndpoint(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient)
+
+	a := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(100)}
+	b := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(100)}
+	for _, user := range []storage.User{a, b} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	transfers := []struct {
+		from, to uuid.UUID
+		amount   float64
+	}{
+		{a.ID, b.ID, 30},
+		{a.ID, b.ID, 25},
+		{b.ID, a.ID, 15},
+	}
+	for _, transfer := range transfers {
+		_, err = transactionManager.Transfer(testEnv.Context, transfer.from, transfer.to, decimal.NewFromFloat(transfer.amount), uuid.New())
+		if err != nil {
+			t.Fatalf("failed to transfer: %v", err)
+		}
+	}
+
+	// Pending transfers haven't moved anything yet
+	_, err = transactionManager.ReserveTransfer(testEnv.Context, a.ID, b.ID, decimal.NewFromFloat(5), uuid.New())
+	if err != nil {
+		t.Fatalf("failed to reserve transfer: %v", err)
+	}
+
+	controller := api.NewController(transactionManager)
+	newAPI := api.NewAPI(controller)
+
+	get := func(from, to uuid.UUID) (int, decimal.Decimal) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf(NetFlowTemplate, from, to), nil)
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var response struct {
+			NetAmount decimal.Decimal `json:"net_amount"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.NetAmount
+	}
+
+	code, net := get(a.ID, b.ID)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, net.Equal(decimal.NewFromFloat(40)), "got %s", net)
+
+	code, net = get(b.ID, a.ID)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, net.Equal(decimal.NewFromFloat(-40)), "got %s", net)
+
+	code, _ = get(a.ID, uuid.New())
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// fakeRates quotes a single pair and remembers what it was asked for
+type fakeRates struct {
+	from, to string
+	rate     decimal.Decimal
+	asked    []string
+}
+
+func (r *fakeRates) Rate(_ context.Context, from string, to string) (decimal.Decimal, error) {
+	r.asked = append(r.asked, from+"/"+to)
+	if from != r.from || to != r.to {
+		return decimal.Decimal{}, transactionmanager.ErrExchangeRateNotFound
+	}
+	return r.rate, nil
+}
+
+func TestCreateTransferEndpoint_CrossCurrency(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	rates := &fakeRates{from: "USD", to: "EUR", rate: decimal.RequireFromString("0.9137")}
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithExchangeRates(rates))
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0), Currency: "USD"}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0), Currency: "EUR"}
+	for _, user := range []storage.User{sender, receiver} {
+		err = storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	_, err = transactionManager.AddTransaction(testEnv.Context, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(100),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	post := func(newAPI *api.API) (int, transactionmanager.Transfer) {
+		encoded, _ := json.Marshal(api.TransferRequest{
+			FromUserID:     sender.ID,
+			ToUserID:       receiver.ID,
+			Amount:         40.25,
+			IdempotencyKey: uuid.New().String(),
+		})
+		req, _ := http.NewRequest(http.MethodPost, TransfersPath, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		newAPI.ServeHTTP(rr, req)
+
+		var transfer transactionmanager.Transfer
+		json.Unmarshal(rr.Body.Bytes(), &transfer)
+		return rr.Code, transfer
+	}
+
+	// 40.25 USD at 0.9137 is 36.776425 EUR, rounded to cents
+	code, transfer := post(api.NewAPI(api.NewController(transactionManager)))
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, []string{"USD/EUR"}, rates.asked)
+	assert.True(t, transfer.Amount.Equal(decimal.RequireFromString("40.25")))
+	assert.True(t, transfer.CreditAmount.Equal(decimal.RequireFromString("36.78")))
+	if assert.NotNil(t, transfer.ExchangeRate) {
+		assert.True(t, transfer.ExchangeRate.Equal(rates.rate))
+	}
+	if assert.NotNil(t, transfer.CreditTransactionID) {
+		legs, err := transactionManager.GetTransactionsByIDs(testEnv.Context, []uuid.UUID{transfer.DebitTransactionID, *transfer.CreditTransactionID})
+		assert.Nil(t, err)
+		if assert.Len(t, legs, 2) {
+			assert.Equal(t, sender.ID, legs[0].UserID)
+			assert.Equal(t, "USD", legs[0].Currency)
+			assert.True(t, legs[0].Amount.Equal(decimal.RequireFromString("-40.25")))
+			assert.Equal(t, receiver.ID, legs[1].UserID)
+			assert.Equal(t, "EUR", legs[1].Currency)
+			assert.True(t, legs[1].Amount.Equal(decimal.RequireFromString("36.78")))
+		}
+	}
+
+	// The rate is kept with the transfer
+	stored, err := transactionManager.GetTransfer(testEnv.Context, transfer.ID)
+	assert.Nil(t, err)
+	assert.True(t, stored.CreditAmount.Equal(decimal.RequireFromString("36.78")))
+	if assert.NotNil(t, stored.ExchangeRate) {
+		assert.True(t, stored.ExchangeRate.Equal(rates.rate))
+	}
+
+	senderBalance, err := transactionManager.GetUserBalance(testEnv.Context, sender.ID)
+	assert.Nil(t, err)
+	assert.True(t, senderBalance.Equal(decimal.RequireFromString("59.75")))
+	receiverBalance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+	assert.Nil(t, err)
+	assert.True(t, receiverBalance.Equal(decimal.RequireFromString("36.78")))
+
+	// Without exchange rates the transfer can't be made
+	code, _ = post(api.NewAPI(api.NewController(transactionmanager.NewTransactionManagerClient(storageClient))))
+	assert.Equal(t, http.StatusNotImplemented, code)
+
+	senderBalance, err = transactionManager.GetUserBalance(testEnv.Context, sender.ID)
+	assert.Nil(t, err)
+	assert.True(t, senderBalance.Equal(decimal.RequireFromString("59.75")))
+}
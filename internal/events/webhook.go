@@ -0,0 +1,310 @@
+// Package events delivers the ledger's events to systems outside it
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the timestamp and the
+	// payload, see Sign
+	SignatureHeader = "Webhook-Signature"
+	// TimestampHeader carries when the post was signed, in Unix seconds
+	TimestampHeader = "Webhook-Timestamp"
+	// IDHeader carries the delivery ID, the same on every attempt, so
+	// receivers can drop events they have already seen
+	IDHeader    = "Webhook-ID"
+	EventHeader = "Webhook-Event"
+
+	// DefaultTimeout bounds a single post
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxRetries is how many times a failed post is retried
+	DefaultMaxRetries = 5
+	// DefaultBackoff is the wait before the first retry, doubling with
+	// every further one
+	DefaultBackoff = time.Second
+	// DefaultWorkers is how many events are delivered at once
+	DefaultWorkers = 4
+	// DefaultQueueSize is how many published events may wait for a worker
+	DefaultQueueSize = 1000
+)
+
+// ErrQueueFull is returned by Publish when as many events as the queue holds
+// are already waiting to be delivered. The event goes to the dead letters.
+var ErrQueueFull = errors.New("event queue is full")
+
+// errStopped is the last error of events given up on because Wait ran out
+var errStopped = errors.New("sink stopped before the event was delivered")
+
+// DeadLetterStore keeps the events a WebhookSink gave up on
+type DeadLetterStore interface {
+	Add(ctx context.Context, letter storage.DeadLetter) error
+}
+
+// WebhookOption configures optional WebhookSink behaviour
+type WebhookOption func(*WebhookSink)
+
+// WithTimeout bounds every post to the endpoint
+func WithTimeout(timeout time.Duration) WebhookOption {
+	return func(s *WebhookSink) {
+		s.client.Timeout = timeout
+	}
+}
+
+// WithRetries retries a failed post up to maxRetries times, waiting backoff
+// before the first retry and twice as long before every further one
+func WithRetries(maxRetries int, backoff time.Duration) WebhookOption {
+	return func(s *WebhookSink) {
+		s.maxRetries = maxRetries
+		s.backoff = backoff
+	}
+}
+
+// WithWorkers delivers up to workers events at once, with up to queueSize
+// more waiting for a worker
+func WithWorkers(workers int, queueSize int) WebhookOption {
+	return func(s *WebhookSink) {
+		s.workers = workers
+		s.queueSize = queueSize
+	}
+}
+
+// WithDeadLetters writes the events that still failed after the last retry
+// to store. Without it they are only logged.
+func WithDeadLetters(store DeadLetterStore) WebhookOption {
+	return func(s *WebhookSink) {
+		s.deadLetters = store
+	}
+}
+
+// WithLogger sets the logger failed deliveries are reported to, instead of
+// slog.Default
+func WithLogger(logger *slog.Logger) WebhookOption {
+	return func(s *WebhookSink) {
+		s.logger = logger
+	}
+}
+
+// WebhookSink posts events as JSON to a URL, signed with a shared secret so
+// the receiver can tell they came from the ledger. Events are queued and
+// posted by a fixed number of workers, so publishing never holds up the
+// write that raised them, and retried with exponential backoff when the
+// endpoint fails or doesn't answer with a 2xx status. Unlike the manager's
+// WithWebhooks, events aren't stored before they are posted: those left
+// when Wait runs out go to the dead letters, and those left when the
+// process stops without Wait are lost.
+type WebhookSink struct {
+	url         string
+	secret      []byte
+	client      *http.Client
+	maxRetries  int
+	backoff     time.Duration
+	workers     int
+	queueSize   int
+	deadLetters DeadLetterStore
+	logger      *slog.Logger
+
+	queue chan delivery
+	// pending counts the events published and not yet delivered or given
+	// up on
+	pending sync.WaitGroup
+	// stopped is done once Wait ran out, cutting posts and retries short
+	stopped context.Context
+	stop    context.CancelFunc
+}
+
+// delivery is a published event waiting for a worker
+type delivery struct {
+	// ctx carries the values of the context the event was published with,
+	// but not its cancellation: the request that raised the event may be
+	// over long before the retries are
+	ctx     context.Context
+	id      uuid.UUID
+	event   string
+	payload []byte
+}
+
+// NewWebhookSink returns a sink posting to url, signing with secret
+func NewWebhookSink(url string, secret string, opts ...WebhookOption) *WebhookSink {
+	s := &WebhookSink{
+		url:        url,
+		secret:     []byte(secret),
+		client:     &http.Client{Timeout: DefaultTimeout},
+		maxRetries: DefaultMaxRetries,
+		backoff:    DefaultBackoff,
+		workers:    DefaultWorkers,
+		queueSize:  DefaultQueueSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+
+	s.queue = make(chan delivery, s.queueSize)
+	s.stopped, s.stop = context.WithCancel(context.Background())
+	for i := 0; i < s.workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Publish queues event for posting and returns right away. It fails when
+// the event can't be encoded, and with ErrQueueFull when the queue has no
+// room for it.
+func (s *WebhookSink) Publish(ctx context.Context, event transactionmanager.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	d := delivery{ctx: context.WithoutCancel(ctx), id: uuid.New(), event: event.EventType(), payload: payload}
+	s.pending.Add(1)
+	select {
+	case s.queue <- d:
+		return nil
+	default:
+		s.pending.Done()
+		s.giveUp(d, 0, ErrQueueFull)
+		return ErrQueueFull
+	}
+}
+
+// Wait blocks until every event published so far was delivered or given up
+// on, for a clean shutdown. Once ctx is done the sink stops: posts in flight
+// are cancelled, no more retries are made, and the events left are given up
+// on before Wait returns ctx's error.
+func (s *WebhookSink) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.stop()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// work delivers queued events one at a time
+func (s *WebhookSink) work() {
+	for d := range s.queue {
+		s.deliver(d)
+		s.pending.Done()
+	}
+}
+
+func (s *WebhookSink) deliver(d delivery) {
+	var err error
+	attempts := 0
+	delay := s.backoff
+	for {
+		if s.stopped.Err() != nil {
+			err = errStopped
+			break
+		}
+		attempts++
+		if err = s.post(d); err == nil {
+			return
+		}
+		if attempts > s.maxRetries {
+			break
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.stopped.Done():
+			timer.Stop()
+		}
+		delay *= 2
+	}
+
+	s.giveUp(d, attempts, err)
+}
+
+// giveUp logs an event that wasn't delivered and writes it to the dead
+// letters
+func (s *WebhookSink) giveUp(d delivery, attempts int, err error) {
+	s.logger.Error("giving up on event webhook", "event", d.event, "webhook_id", d.id, "attempts", attempts, "error", err)
+	if s.deadLetters == nil {
+		return
+	}
+	err = s.deadLetters.Add(d.ctx, storage.DeadLetter{
+		ID:        d.id,
+		Event:     d.event,
+		URL:       s.url,
+		Payload:   d.payload,
+		Attempts:  attempts,
+		LastError: err.Error(),
+	})
+	if err != nil {
+		s.logger.Error("writing dead letter", "event", d.event, "webhook_id", d.id, "error", err)
+	}
+}
+
+func (s *WebhookSink) post(d delivery) error {
+	// Stopping the sink cancels the post
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+	defer context.AfterFunc(s.stopped, cancel)()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, d.id.String())
+	req.Header.Set(EventHeader, d.event)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(s.secret, timestamp, d.payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for a payload posted at
+// timestamp: "sha256=" and the hex HMAC-SHA256, keyed with secret, of the
+// timestamp, a dot and the payload. Receivers compute it the same way,
+// compare with hmac.Equal and reject stale timestamps to stop replays.
+func Sign(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package events_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/events"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+)
+
+type memoryDeadLetters struct {
+	mu      sync.Mutex
+	letters []storage.DeadLetter
+}
+
+func (m *memoryDeadLetters) Add(_ context.Context, letter storage.DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, letter)
+	return nil
+}
+
+func TestWebhookSink_Publish(t *testing.T) {
+	testCases := []struct {
+		name                string
+		failures            int32
+		expectedAttempts    int32
+		expectedDeadLetters int
+	}{
+		{name: "Delivered", failures: 0, expectedAttempts: 1},
+		{name: "Delivered on retry", failures: 2, expectedAttempts: 3},
+		{name: "Given up", failures: 10, expectedAttempts: 4, expectedDeadLetters: 1},
+	}
+
+	secret := "shared-secret"
+	event := transactionmanager.TransactionCreated{
+		TransactionID: uuid.New(),
+		UserID:        uuid.New(),
+		Amount:        decimal.NewFromFloat(25),
+		Balance:       decimal.NewFromFloat(125),
+		CreatedAt:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int32
+			var mu sync.Mutex
+			deliveryIDs := map[string]bool{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				payload, _ := io.ReadAll(r.Body)
+
+				// Every attempt is signed and carries the same delivery ID
+				expected := events.Sign([]byte(secret), r.Header.Get(events.TimestampHeader), payload)
+				assert.True(t, hmac.Equal([]byte(expected), []byte(r.Header.Get(events.SignatureHeader))), "bad signature")
+				assert.Equal(t, transactionmanager.EventTransactionCreated, r.Header.Get(events.EventHeader))
+				mu.Lock()
+				deliveryIDs[r.Header.Get(events.IDHeader)] = true
+				mu.Unlock()
+
+				var received transactionmanager.TransactionCreated
+				assert.Nil(t, json.Unmarshal(payload, &received))
+				assert.Equal(t, event.TransactionID, received.TransactionID)
+				assert.True(t, received.Balance.Equal(event.Balance))
+
+				if atomic.AddInt32(&attempts, 1) <= tc.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			deadLetters := &memoryDeadLetters{}
+			sink := events.NewWebhookSink(server.URL, secret,
+				events.WithRetries(3, time.Millisecond),
+				events.WithTimeout(time.Second),
+				events.WithDeadLetters(deadLetters))
+
+			err := sink.Publish(context.Background(), event)
+			assert.Nil(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			assert.Nil(t, sink.Wait(ctx))
+
+			assert.Equal(t, tc.expectedAttempts, atomic.LoadInt32(&attempts))
+			assert.Len(t, deliveryIDs, 1)
+			if assert.Len(t, deadLetters.letters, tc.expectedDeadLetters) && tc.expectedDeadLetters > 0 {
+				letter := deadLetters.letters[0]
+				assert.True(t, deliveryIDs[letter.ID.String()])
+				assert.Equal(t, transactionmanager.EventTransactionCreated, letter.Event)
+				assert.Equal(t, server.URL, letter.URL)
+				assert.Equal(t, int(tc.expectedAttempts), letter.Attempts)
+				assert.Contains(t, letter.LastError, "503")
+			}
+		})
+	}
+}
+
+func TestWebhookSink_QueueFull(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	deadLetters := &memoryDeadLetters{}
+	sink := events.NewWebhookSink(server.URL, "shared-secret",
+		events.WithWorkers(1, 1),
+		events.WithDeadLetters(deadLetters))
+
+	event := transactionmanager.TransactionCreated{TransactionID: uuid.New(), UserID: uuid.New()}
+
+	// The worker holds the first event, the queue the second
+	assert.Nil(t, sink.Publish(context.Background(), event))
+	<-received
+	assert.Nil(t, sink.Publish(context.Background(), event))
+
+	// and the third has no room
+	err := sink.Publish(context.Background(), event)
+	assert.Equal(t, events.ErrQueueFull, err)
+	if assert.Len(t, deadLetters.letters, 1) {
+		assert.Equal(t, 0, deadLetters.letters[0].Attempts)
+		assert.Equal(t, events.ErrQueueFull.Error(), deadLetters.letters[0].LastError)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, sink.Wait(ctx))
+	assert.Len(t, deadLetters.letters, 1)
+}
+
+func TestWebhookSink_WaitStopsRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	deadLetters := &memoryDeadLetters{}
+	sink := events.NewWebhookSink(server.URL, "shared-secret",
+		events.WithRetries(3, time.Hour),
+		events.WithDeadLetters(deadLetters))
+
+	event := transactionmanager.TransactionCreated{TransactionID: uuid.New(), UserID: uuid.New()}
+	assert.Nil(t, sink.Publish(context.Background(), event))
+
+	// Wait gives up on the event instead of sleeping through the backoff
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, sink.Wait(ctx))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	if assert.Len(t, deadLetters.letters, 1) {
+		assert.Equal(t, 1, deadLetters.letters[0].Attempts)
+		assert.Contains(t, deadLetters.letters[0].LastError, "stopped")
+	}
+}
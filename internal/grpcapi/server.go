@@ -0,0 +1,335 @@
+// Package grpcapi serves the ledger over gRPC for internal clients that
+// prefer it to JSON over HTTP. It mirrors the REST user endpoints and
+// delegates to the same transaction manager.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ledgerpb/ledger.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/grpcapi/ledgerpb"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// tenantMetadata is the metadata key carrying the tenant of a call, the
+	// counterpart of the REST API's X-Tenant-ID header
+	tenantMetadata = "x-tenant-id"
+
+	// responseContentType marks the AddTransaction responses stored for
+	// replay by this API, so the REST API never replays them and the other
+	// way around
+	responseContentType = "application/grpc+proto"
+
+	defaultPageSize = 10
+)
+
+// TransactionManager is what the gRPC service needs of the transaction
+// manager
+type TransactionManager interface {
+	AddTransaction(ctx context.Context, transaction transactionmanager.Transaction) (transactionmanager.Transaction, error)
+	GetDisplayBalance(ctx context.Context, userID uuid.UUID, convertTo string) (transactionmanager.DisplayBalance, error)
+	GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter transactionmanager.HistoryFilter) ([]transactionmanager.Transaction, error)
+	CountUserTransactions(ctx context.Context, userID uuid.UUID, filter transactionmanager.HistoryFilter) (int64, bool, error)
+	FindStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal) (transactionmanager.StoredResponse, bool, error)
+	SaveStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal, response transactionmanager.StoredResponse) error
+}
+
+// Option configures optional Server behaviour
+type Option func(*config)
+
+type config struct {
+	tenantMetadata bool
+}
+
+// WithTenantMetadata requires every call to carry an x-tenant-id metadata
+// entry and scopes it to that tenant, like the REST API's WithTenantHeader
+func WithTenantMetadata() Option {
+	return func(c *config) {
+		c.tenantMetadata = true
+	}
+}
+
+// Server implements the Ledger gRPC service
+type Server struct {
+	ledgerpb.UnimplementedLedgerServer
+
+	transactionmanager TransactionManager
+}
+
+// NewServer returns a gRPC server with the Ledger service registered
+func NewServer(transactionManager TransactionManager, opts ...Option) *grpc.Server {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var serverOptions []grpc.ServerOption
+	if cfg.tenantMetadata {
+		serverOptions = append(serverOptions, grpc.UnaryInterceptor(tenantInterceptor))
+	}
+
+	server := grpc.NewServer(serverOptions...)
+	ledgerpb.RegisterLedgerServer(server, &Server{transactionmanager: transactionManager})
+	return server
+}
+
+// Run serves on addr until ctx is done, then stops taking calls and gives
+// the ones in flight up to shutdownTimeout to finish before cutting them off
+func Run(ctx context.Context, server *grpc.Server, addr string, shutdownTimeout time.Duration) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(shutdownTimeout):
+		server.Stop()
+		return fmt.Errorf("calls still running after %s were cut off: %w", shutdownTimeout, context.DeadlineExceeded)
+	}
+}
+
+func tenantInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var tenantID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(tenantMetadata); len(values) > 0 {
+			tenantID = strings.TrimSpace(values[0])
+		}
+	}
+	if tenantID == "" {
+		return nil, status.Error(codes.InvalidArgument, tenantMetadata+" metadata is required")
+	}
+	return handler(transactionmanager.WithTenant(ctx, tenantID), req)
+}
+
+// GetBalance returns the user's balance, converted to convert_to or the
+// user's display currency
+func (s *Server) GetBalance(ctx context.Context, req *ledgerpb.GetBalanceRequest) (*ledgerpb.GetBalanceResponse, error) {
+	userID, err := uuid.Parse(req.GetUserId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid user ID %v", err)
+	}
+
+	balance, err := s.transactionmanager.GetDisplayBalance(ctx, userID, req.GetConvertTo())
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	response := &ledgerpb.GetBalanceResponse{
+		Balance:          balance.Balance.String(),
+		AvailableBalance: balance.AvailableBalance.String(),
+		Currency:         balance.Currency,
+	}
+	if converted := balance.Converted; converted != nil {
+		response.Converted = &ledgerpb.ConvertedBalance{
+			Currency:         converted.Currency,
+			Balance:          converted.Balance.String(),
+			AvailableBalance: converted.AvailableBalance.String(),
+			Rate:             converted.Rate.String(),
+		}
+	}
+	return response, nil
+}
+
+// GetHistory returns a page of the user's transactions, newest first, along
+// with how many there are in all
+func (s *Server) GetHistory(ctx context.Context, req *ledgerpb.GetHistoryRequest) (*ledgerpb.GetHistoryResponse, error) {
+	userID, err := uuid.Parse(req.GetUserId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid user ID %v", err)
+	}
+
+	page, pageSize := int(req.GetPage()), int(req.GetPageSize())
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	filter := transactionmanager.HistoryFilter{
+		IncludeVoided: req.GetIncludeVoided(),
+		Channel:       req.GetChannel(),
+	}
+
+	transactions, err := s.transactionmanager.GetUserTransactionHistory(ctx, userID, page, pageSize, filter)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	totalCount, estimated, err := s.transactionmanager.CountUserTransactions(ctx, userID, filter)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	response := &ledgerpb.GetHistoryResponse{
+		Transactions:    make([]*ledgerpb.Transaction, 0, len(transactions)),
+		Page:            int32(page),
+		PageSize:        int32(pageSize),
+		TotalCount:      totalCount,
+		TotalPages:      (totalCount + int64(pageSize) - 1) / int64(pageSize),
+		CountIsEstimate: estimated,
+	}
+	for _, transaction := range transactions {
+		response.Transactions = append(response.Transactions, toProtoTransaction(transaction))
+	}
+	return response, nil
+}
+
+// AddTransaction adds a transaction to the user's account
+func (s *Server) AddTransaction(ctx context.Context, req *ledgerpb.AddTransactionRequest) (*ledgerpb.AddTransactionResponse, error) {
+	userID, err := uuid.Parse(req.GetUserId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid user ID %v", err)
+	}
+
+	amount, err := decimal.NewFromString(req.GetAmount())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid amount %q", req.GetAmount())
+	}
+
+	idempotencyKey, err := transactionmanager.ParseIdempotencyKey(req.GetIdempotencyKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid idempotency key %v", err)
+	}
+
+	// A retry of a transaction added within the replay TTL gets the
+	// original response
+	stored, found, err := s.transactionmanager.FindStoredResponse(ctx, userID, idempotencyKey, amount)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if found && stored.ContentType == responseContentType {
+		response := &ledgerpb.AddTransactionResponse{}
+		if err := proto.Unmarshal(stored.Body, response); err != nil {
+			return nil, statusError(fmt.Errorf("decoding the stored response: %w", err))
+		}
+		response.Replayed = true
+		return response, nil
+	}
+
+	// CreatedAt is left for the manager to stamp
+	added, err := s.transactionmanager.AddTransaction(ctx, transactionmanager.Transaction{
+		ID:             uuid.New(),
+		UserID:         userID,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		ReasonCode:     req.GetReasonCode(),
+		Currency:       req.GetCurrency(),
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	response := &ledgerpb.AddTransactionResponse{
+		Transaction: toProtoTransaction(added),
+		Replayed:    added.Replayed,
+		Version:     added.UserVersion,
+	}
+	for _, derived := range added.Derived {
+		response.Derived = append(response.Derived, toProtoTransaction(derived))
+	}
+
+	if !added.Replayed {
+		// The transaction is in, so failing to keep the response only costs
+		// a retry its replay
+		body, err := proto.Marshal(response)
+		if err == nil {
+			err = s.transactionmanager.SaveStoredResponse(ctx, userID, idempotencyKey, amount, transactionmanager.StoredResponse{
+				StatusCode:  int(codes.OK),
+				ContentType: responseContentType,
+				Body:        body,
+			})
+		}
+		if err != nil {
+			log.Printf("storing the response for idempotency key %s: %v", idempotencyKey, err)
+		}
+	}
+	return response, nil
+}
+
+func toProtoTransaction(transaction transactionmanager.Transaction) *ledgerpb.Transaction {
+	return &ledgerpb.Transaction{
+		Id:             transaction.ID.String(),
+		UserId:         transaction.UserID.String(),
+		Amount:         transaction.Amount.String(),
+		CreatedAt:      timestamppb.New(transaction.CreatedAt),
+		IdempotencyKey: transaction.IdempotencyKey.String(),
+		Sequence:       transaction.Sequence,
+		Status:         string(transaction.Status),
+		ReasonCode:     transaction.ReasonCode,
+		Currency:       transaction.Currency,
+		BalanceAfter:   transaction.BalanceAfter.String(),
+		Channel:        transaction.Channel,
+	}
+}
+
+// statusError maps errors returned by the transaction manager to the gRPC
+// status reported to the client, following the REST API's status codes.
+// Unexpected errors are logged rather than sent, so their details don't
+// reach the client.
+func statusError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, transactionmanager.ErrUserNotFound),
+		errors.Is(err, transactionmanager.ErrTransactionNotFound):
+		code = codes.NotFound
+	case errors.Is(err, transactionmanager.ErrIdempotencyKeyTaken),
+		errors.Is(err, transactionmanager.ErrPossibleDuplicate),
+		errors.Is(err, transactionmanager.ErrTransactionAlreadyExist):
+		code = codes.AlreadyExists
+	case errors.Is(err, transactionmanager.ErrInsufficientFunds):
+		code = codes.FailedPrecondition
+	case errors.Is(err, transactionmanager.ErrTooManyConcurrentTransactions):
+		code = codes.ResourceExhausted
+	case errors.Is(err, transactionmanager.ErrAddTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, transactionmanager.ErrNoExchangeRates):
+		code = codes.Unimplemented
+	case errors.Is(err, transactionmanager.ErrInvalidTransaction):
+		code = codes.InvalidArgument
+	case errors.Is(err, transactionmanager.ErrDailyLimitExceeded),
+		errors.Is(err, transactionmanager.ErrCreditCapExceeded),
+		errors.Is(err, transactionmanager.ErrTenantMismatch):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	default:
+		log.Printf("grpc call failed: %v", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	return status.Error(code, err.Error())
+}
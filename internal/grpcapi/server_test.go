@@ -0,0 +1,200 @@
+package grpcapi_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/tebrizetayi/ledgerservice/internal/grpcapi"
+	"github.com/tebrizetayi/ledgerservice/internal/grpcapi/ledgerpb"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+	"github.com/tebrizetayi/ledgerservice/internal/transactionmanager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dial serves server in memory and returns a client connected to it
+func dial(t *testing.T, server *grpc.Server) ledgerpb.LedgerClient {
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ledgerpb.NewLedgerClient(conn)
+}
+
+// failingManager fails every call with err
+type failingManager struct {
+	err error
+}
+
+func (m failingManager) AddTransaction(context.Context, transactionmanager.Transaction) (transactionmanager.Transaction, error) {
+	return transactionmanager.Transaction{}, m.err
+}
+
+func (m failingManager) GetDisplayBalance(context.Context, uuid.UUID, string) (transactionmanager.DisplayBalance, error) {
+	return transactionmanager.DisplayBalance{}, m.err
+}
+
+func (m failingManager) GetUserTransactionHistory(context.Context, uuid.UUID, int, int, transactionmanager.HistoryFilter) ([]transactionmanager.Transaction, error) {
+	return nil, m.err
+}
+
+func (m failingManager) CountUserTransactions(context.Context, uuid.UUID, transactionmanager.HistoryFilter) (int64, bool, error) {
+	return 0, false, m.err
+}
+
+func (m failingManager) FindStoredResponse(context.Context, uuid.UUID, uuid.UUID, decimal.Decimal) (transactionmanager.StoredResponse, bool, error) {
+	return transactionmanager.StoredResponse{}, false, nil
+}
+
+func (m failingManager) SaveStoredResponse(context.Context, uuid.UUID, uuid.UUID, decimal.Decimal, transactionmanager.StoredResponse) error {
+	return nil
+}
+
+func TestServer_ErrorCodes(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		request      *ledgerpb.AddTransactionRequest
+		expectedCode codes.Code
+	}{
+		{name: "Invalid transaction", err: transactionmanager.ErrInvalidTransaction, expectedCode: codes.InvalidArgument},
+		{name: "Unknown currency", err: transactionmanager.ErrUnsupportedCurrency, expectedCode: codes.InvalidArgument},
+		{name: "Unknown user", err: transactionmanager.ErrUserNotFound, expectedCode: codes.NotFound},
+		{name: "Insufficient funds", err: transactionmanager.ErrInsufficientFunds, expectedCode: codes.FailedPrecondition},
+		{name: "Key taken", err: transactionmanager.ErrIdempotencyKeyTaken, expectedCode: codes.AlreadyExists},
+		{name: "Daily limit", err: transactionmanager.ErrDailyLimitExceeded, expectedCode: codes.PermissionDenied},
+		{name: "Unexpected", err: fmt.Errorf("connection reset"), expectedCode: codes.Internal},
+		{
+			name:         "Invalid user ID",
+			request:      &ledgerpb.AddTransactionRequest{UserId: "nope", Amount: "10"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "Invalid amount",
+			request:      &ledgerpb.AddTransactionRequest{UserId: uuid.NewString(), Amount: "ten"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "Idempotency key too long",
+			request:      &ledgerpb.AddTransactionRequest{UserId: uuid.NewString(), Amount: "10", IdempotencyKey: strings.Repeat("k", 256)},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "Idempotency key with control character",
+			request:      &ledgerpb.AddTransactionRequest{UserId: uuid.NewString(), Amount: "10", IdempotencyKey: "retry\t1"},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := dial(t, grpcapi.NewServer(failingManager{err: tc.err}))
+
+			request := tc.request
+			if request == nil {
+				request = &ledgerpb.AddTransactionRequest{UserId: uuid.NewString(), Amount: "10"}
+			}
+			_, err := client.AddTransaction(context.Background(), request)
+			assert.Equal(t, tc.expectedCode, status.Code(err), "got %v", err)
+			if tc.expectedCode == codes.Internal {
+				// The cause is logged, not sent to the client
+				assert.Equal(t, "internal error", status.Convert(err).Message())
+			}
+		})
+	}
+}
+
+func TestServer_TenantMetadata(t *testing.T) {
+	client := dial(t, grpcapi.NewServer(failingManager{err: transactionmanager.ErrUserNotFound}, grpcapi.WithTenantMetadata()))
+
+	_, err := client.GetBalance(context.Background(), &ledgerpb.GetBalanceRequest{UserId: uuid.NewString()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+	_, err = client.GetBalance(ctx, &ledgerpb.GetBalanceRequest{UserId: uuid.NewString()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer(t *testing.T) {
+	// Create a test environment
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := transactionmanager.NewTransactionManagerClient(storageClient, transactionmanager.WithResponseReplay(time.Hour))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	client := dial(t, grpcapi.NewServer(transactionManager))
+	ctx := context.Background()
+
+	// Amounts keep every digit they are sent with
+	key := uuid.NewString()
+	added, err := client.AddTransaction(ctx, &ledgerpb.AddTransactionRequest{UserId: user.ID.String(), Amount: "100.10", IdempotencyKey: key})
+	assert.Nil(t, err)
+	assert.Equal(t, "100.1", added.GetTransaction().GetAmount())
+	assert.Equal(t, "100.1", added.GetTransaction().GetBalanceAfter())
+	assert.Equal(t, key, added.GetTransaction().GetIdempotencyKey())
+
+	// Free-form keys are taken as over REST, and a retry gets the stored
+	// response
+	debit, err := client.AddTransaction(ctx, &ledgerpb.AddTransactionRequest{UserId: user.ID.String(), Amount: "-0.30", IdempotencyKey: "order-1"})
+	assert.Nil(t, err)
+	assert.False(t, debit.GetReplayed())
+	retried, err := client.AddTransaction(ctx, &ledgerpb.AddTransactionRequest{UserId: user.ID.String(), Amount: "-0.30", IdempotencyKey: "order-1"})
+	assert.Nil(t, err)
+	assert.True(t, retried.GetReplayed())
+	assert.Equal(t, debit.GetTransaction().GetId(), retried.GetTransaction().GetId())
+
+	// A debit beyond the balance is refused like over REST
+	_, err = client.AddTransaction(ctx, &ledgerpb.AddTransactionRequest{UserId: user.ID.String(), Amount: "-1000", IdempotencyKey: uuid.NewString()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	balance, err := client.GetBalance(ctx, &ledgerpb.GetBalanceRequest{UserId: user.ID.String()})
+	assert.Nil(t, err)
+	assert.Equal(t, "99.8", balance.GetBalance())
+	assert.Equal(t, "99.8", balance.GetAvailableBalance())
+	assert.Nil(t, balance.GetConverted())
+
+	history, err := client.GetHistory(ctx, &ledgerpb.GetHistoryRequest{UserId: user.ID.String(), PageSize: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), history.GetTotalCount())
+	assert.Equal(t, int64(2), history.GetTotalPages())
+	if assert.Len(t, history.GetTransactions(), 1) {
+		assert.Equal(t, "-0.3", history.GetTransactions()[0].GetAmount())
+	}
+
+	_, err = client.GetBalance(ctx, &ledgerpb.GetBalanceRequest{UserId: uuid.NewString()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
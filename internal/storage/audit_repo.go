@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// AuditEntry records who adjusted a user's balance by hand and why, along
+// with the transaction that booked it and the balance on either side of it
+type AuditEntry struct {
+	ID            uuid.UUID
+	UserID        uuid.UUID
+	TransactionID uuid.UUID
+	Operator      string
+	Reason        string
+	BalanceBefore decimal.Decimal
+	BalanceAfter  decimal.Decimal
+	CreatedAt     time.Time
+}
+
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// FindByUserID returns the audit entries of a user, oldest first
+func (a *AuditRepository) FindByUserID(ctx context.Context, userID uuid.UUID) ([]AuditEntry, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id, user_id, transaction_id, operator, reason, balance_before, balance_after, created_at
+		FROM audit_entries WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.ID,
+			&entry.UserID,
+			&entry.TransactionID,
+			&entry.Operator,
+			&entry.Reason,
+			&entry.BalanceBefore,
+			&entry.BalanceAfter,
+			&entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func insertAuditEntry(ctx context.Context, tx *sql.Tx, entry AuditEntry) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO audit_entries (id, user_id, transaction_id, operator, reason, balance_before, balance_after, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		entry.ID,
+		entry.UserID,
+		entry.TransactionID,
+		entry.Operator,
+		entry.Reason,
+		entry.BalanceBefore,
+		entry.BalanceAfter,
+		entry.CreatedAt)
+	return err
+}
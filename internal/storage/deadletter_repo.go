@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeadLetter is an event that couldn't be posted to its endpoint, kept so
+// it can be looked into or sent again by hand
+type DeadLetter struct {
+	ID      uuid.UUID
+	Event   string
+	URL     string
+	Payload []byte
+	// Attempts counts the posts made before giving up
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+}
+
+type DeadLetterRepository struct {
+	db *sql.DB
+}
+
+func NewDeadLetterRepository(db *sql.DB) *DeadLetterRepository {
+	return &DeadLetterRepository{db: db}
+}
+
+// Add stores a dead letter
+func (r *DeadLetterRepository) Add(ctx context.Context, letter DeadLetter) error {
+	if letter.CreatedAt.IsZero() {
+		letter.CreatedAt = time.Now().UTC()
+	}
+	_, err := r.db.ExecContext(ctx, `INSERT INTO event_dead_letters (id, event, url, payload, attempts, last_error, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		letter.ID,
+		letter.Event,
+		letter.URL,
+		string(letter.Payload),
+		letter.Attempts,
+		letter.LastError,
+		letter.CreatedAt.UTC())
+	return err
+}
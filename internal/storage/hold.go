@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// insertHold holds back part of a credit that was just written in tx until
+// the transaction's HoldUntil
+func insertHold(ctx context.Context, tx *sql.Tx, transaction Transaction) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO balance_holds (id, user_id, transaction_id, amount, release_at) VALUES ($1, $2, $3, $4, $5)`,
+		uuid.New(),
+		transaction.UserID,
+		transaction.ID,
+		transaction.HoldAmount,
+		transaction.HoldUntil)
+	return err
+}
+
+// queryer is what heldAmount needs, so it can run inside or outside a
+// database transaction
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func heldAmount(ctx context.Context, q queryer, userID uuid.UUID) (decimal.Decimal, error) {
+	var held decimal.Decimal
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM balance_holds WHERE user_id = $1 AND NOT released`, userID).Scan(&held)
+	return held, err
+}
+
+// HeldAmount returns how much of the user's balance is held back and not yet
+// available
+func (t *TransactionRepository) HeldAmount(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
+	return heldAmount(ctx, t.db, userID)
+}
+
+// ReleaseDueHolds releases every hold whose release time is at or before now
+// and returns how many were released
+func (t *TransactionRepository) ReleaseDueHolds(ctx context.Context, now time.Time) (int64, error) {
+	result, err := t.db.ExecContext(ctx, `UPDATE balance_holds SET released = TRUE WHERE release_at <= $1 AND NOT released`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+var ErrIdempotentResponseNotFound = errors.New("idempotent response not found")
+
+// IdempotentResponse is the response sent for a user's write, kept so a
+// retry with the same idempotency key and amount can be answered with it
+type IdempotentResponse struct {
+	UserID         uuid.UUID
+	IdempotencyKey uuid.UUID
+	Amount         decimal.Decimal
+	StatusCode     int
+	ContentType    string
+	Payload        []byte
+	CreatedAt      time.Time
+}
+
+type IdempotencyRepository struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepository(db *sql.DB) *IdempotencyRepository {
+	return &IdempotencyRepository{db: db}
+}
+
+// Find returns the response stored for the user's idempotency key and
+// amount. Responses for users of another tenant than the one ctx is scoped
+// to are never found.
+func (i *IdempotencyRepository) Find(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal) (IdempotentResponse, error) {
+	response := IdempotentResponse{UserID: userID, IdempotencyKey: idempotencyKey, Amount: amount}
+	condition, args := tenantCondition(ctx, "(SELECT tenant_id FROM users WHERE users.id = idempotency_responses.user_id)", 4)
+	err := i.db.QueryRowContext(ctx, `SELECT status_code, content_type, response, created_at FROM idempotency_responses WHERE user_id = $1 AND idempotency_key = $2 AND amount = $3`+condition,
+		append([]interface{}{userID, idempotencyKey, amount}, args...)...).
+		Scan(&response.StatusCode,
+			&response.ContentType,
+			&response.Payload,
+			&response.CreatedAt)
+	if err == sql.ErrNoRows {
+		return IdempotentResponse{}, ErrIdempotentResponseNotFound
+	}
+	if err != nil {
+		return IdempotentResponse{}, err
+	}
+
+	return response, nil
+}
+
+// Save stores the response for the user's idempotency key and amount,
+// replacing one stored before
+func (i *IdempotencyRepository) Save(ctx context.Context, response IdempotentResponse) error {
+	if response.CreatedAt.IsZero() {
+		response.CreatedAt = time.Now().UTC()
+	}
+
+	_, err := i.db.ExecContext(ctx, `INSERT INTO idempotency_responses (user_id, idempotency_key, amount, status_code, content_type, response, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, idempotency_key, amount) DO UPDATE SET status_code = EXCLUDED.status_code, content_type = EXCLUDED.content_type, response = EXCLUDED.response, created_at = EXCLUDED.created_at`,
+		response.UserID,
+		response.IdempotencyKey,
+		response.Amount,
+		response.StatusCode,
+		response.ContentType,
+		response.Payload,
+		response.CreatedAt.UTC())
+	return err
+}
+
+// Release forgets the response stored for the user's idempotency key and
+// amount created at or before createdAt, and frees the key held by the transaction
+// it answered, so the key can be used for a new transaction. A response
+// stored again since then is left alone.
+func (i *IdempotencyRepository) Release(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal, createdAt time.Time) error {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM idempotency_responses WHERE user_id = $1 AND idempotency_key = $2 AND amount = $3 AND created_at <= $4`,
+		userID,
+		idempotencyKey,
+		amount,
+		createdAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if deleted == 0 {
+		// Someone else released it first
+		tx.Rollback()
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE transactions SET key_released = TRUE WHERE user_id = $1 AND idempotency_key = $2 AND amount = $3 AND NOT key_released`,
+		userID,
+		idempotencyKey,
+		amount)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// UserLimits holds the per-user overrides of the global transaction limits.
+// A null field means the global default applies.
+type UserLimits struct {
+	UserID        uuid.UUID
+	DailyLimit    decimal.NullDecimal
+	CreditCap     decimal.NullDecimal
+	MaxAmount     decimal.NullDecimal
+	AllowNegative sql.NullBool
+}
+
+type LimitsRepository struct {
+	db *sql.DB
+}
+
+func NewLimitsRepository(db *sql.DB) *LimitsRepository {
+	return &LimitsRepository{db: db}
+}
+
+// FindByUserID returns the limit overrides of a user. A user without
+// overrides gets UserLimits with every field null.
+func (l *LimitsRepository) FindByUserID(ctx context.Context, userID uuid.UUID) (UserLimits, error) {
+	limits := UserLimits{UserID: userID}
+	err := l.db.QueryRowContext(ctx, `SELECT daily_limit, credit_cap, max_amount, allow_negative FROM user_limits WHERE user_id = $1`, userID).
+		Scan(&limits.DailyLimit,
+			&limits.CreditCap,
+			&limits.MaxAmount,
+			&limits.AllowNegative)
+	if err == sql.ErrNoRows {
+		return limits, nil
+	}
+	if err != nil {
+		return UserLimits{}, err
+	}
+
+	return limits, nil
+}
+
+// Upsert replaces the limit overrides of a user
+func (l *LimitsRepository) Upsert(ctx context.Context, limits UserLimits) error {
+	_, err := l.db.ExecContext(ctx, `INSERT INTO user_limits (user_id, daily_limit, credit_cap, max_amount, allow_negative) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET daily_limit = EXCLUDED.daily_limit, credit_cap = EXCLUDED.credit_cap, max_amount = EXCLUDED.max_amount, allow_negative = EXCLUDED.allow_negative`,
+		limits.UserID,
+		limits.DailyLimit,
+		limits.CreditCap,
+		limits.MaxAmount,
+		limits.AllowNegative)
+	return err
+}
@@ -7,11 +7,28 @@ import (
 type StorageClient struct {
 	TransactionRepository *TransactionRepository
 	UserRepository        *UserRepository
+	LimitsRepository      *LimitsRepository
+	TransferRepository    *TransferRepository
+	IdempotencyRepository *IdempotencyRepository
+	AuditRepository       *AuditRepository
+	WebhookRepository     *WebhookRepository
+	RecurringRepository   *RecurringRepository
+	ScheduledRepository   *ScheduledRepository
+	DeadLetterRepository  *DeadLetterRepository
 }
 
 func NewStorageClient(db *sql.DB) StorageClient {
+	transactionRepository := NewTransactionRepository(db)
 	return StorageClient{
-		TransactionRepository: NewTransactionRepository(db),
+		TransactionRepository: transactionRepository,
 		UserRepository:        NewUserRepository(db),
+		LimitsRepository:      NewLimitsRepository(db),
+		TransferRepository:    NewTransferRepository(db, transactionRepository),
+		IdempotencyRepository: NewIdempotencyRepository(db),
+		AuditRepository:       NewAuditRepository(db),
+		WebhookRepository:     NewWebhookRepository(db),
+		RecurringRepository:   NewRecurringRepository(db),
+		ScheduledRepository:   NewScheduledRepository(db),
+		DeadLetterRepository:  NewDeadLetterRepository(db),
 	}
 }
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// RecurringTransaction is an amount booked for a user on a schedule, every
+// Interval starting at NextRunAt
+type RecurringTransaction struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Amount    decimal.Decimal
+	Interval  string
+	NextRunAt time.Time
+	CreatedAt time.Time
+}
+
+type RecurringRepository struct {
+	db *sql.DB
+}
+
+func NewRecurringRepository(db *sql.DB) *RecurringRepository {
+	return &RecurringRepository{db: db}
+}
+
+// Add stores a recurring transaction
+func (r *RecurringRepository) Add(ctx context.Context, recurring RecurringTransaction) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO recurring_transactions (id, user_id, amount, run_interval, next_run_at, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		recurring.ID,
+		recurring.UserID,
+		recurring.Amount,
+		recurring.Interval,
+		recurring.NextRunAt,
+		recurring.CreatedAt)
+	return err
+}
+
+// FindByUserID returns the user's recurring transactions, soonest first
+func (r *RecurringRepository) FindByUserID(ctx context.Context, userID uuid.UUID) ([]RecurringTransaction, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, amount, run_interval, next_run_at, created_at FROM recurring_transactions WHERE user_id = $1 ORDER BY next_run_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recurring := []RecurringTransaction{}
+	for rows.Next() {
+		var entry RecurringTransaction
+		err = rows.Scan(&entry.ID,
+			&entry.UserID,
+			&entry.Amount,
+			&entry.Interval,
+			&entry.NextRunAt,
+			&entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		recurring = append(recurring, entry)
+	}
+	return recurring, rows.Err()
+}
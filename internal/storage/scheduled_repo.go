@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrScheduledNotFound   = errors.New("scheduled transaction not found")
+	ErrScheduledNotPending = errors.New("scheduled transaction is no longer scheduled")
+)
+
+// ScheduledStatus tracks a scheduled transaction until it is posted
+type ScheduledStatus string
+
+const (
+	ScheduledStatusScheduled ScheduledStatus = "scheduled"
+	// ScheduledStatusExecuting means the executor has picked it up. It can no
+	// longer be cancelled, and is picked up again if the executor stopped
+	// before posting it.
+	ScheduledStatusExecuting ScheduledStatus = "executing"
+	ScheduledStatusExecuted  ScheduledStatus = "executed"
+	ScheduledStatusCancelled ScheduledStatus = "cancelled"
+	// ScheduledStatusFailed means the transaction was rejected when posted,
+	// e.g. for insufficient funds
+	ScheduledStatusFailed ScheduledStatus = "failed"
+)
+
+// ScheduledTransaction is a transaction to be posted for a user at ExecuteAt.
+// It is posted with its own idempotency key, so posting it twice is a no-op.
+type ScheduledTransaction struct {
+	ID             uuid.UUID
+	UserID         uuid.UUID
+	Amount         decimal.Decimal
+	IdempotencyKey uuid.UUID
+	ExecuteAt      time.Time
+	Status         ScheduledStatus
+	// TransactionID is the transaction posted, once executed
+	TransactionID uuid.NullUUID
+	LastError     string
+	CreatedAt     time.Time
+	ExecutedAt    sql.NullTime
+}
+
+type ScheduledRepository struct {
+	db *sql.DB
+}
+
+func NewScheduledRepository(db *sql.DB) *ScheduledRepository {
+	return &ScheduledRepository{db: db}
+}
+
+const scheduledColumns = `id, user_id, amount, idempotency_key, execute_at, status, transaction_id, last_error, created_at, executed_at`
+
+func scanScheduled(row rowScanner) (ScheduledTransaction, error) {
+	var scheduled ScheduledTransaction
+	err := row.Scan(&scheduled.ID,
+		&scheduled.UserID,
+		&scheduled.Amount,
+		&scheduled.IdempotencyKey,
+		&scheduled.ExecuteAt,
+		&scheduled.Status,
+		&scheduled.TransactionID,
+		&scheduled.LastError,
+		&scheduled.CreatedAt,
+		&scheduled.ExecutedAt)
+	return scheduled, err
+}
+
+func scanScheduledRows(rows *sql.Rows) ([]ScheduledTransaction, error) {
+	scheduled := []ScheduledTransaction{}
+	for rows.Next() {
+		entry, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, entry)
+	}
+	return scheduled, rows.Err()
+}
+
+// Add stores a scheduled transaction. A key the user already scheduled with
+// fails the unique index, see IsUniqueViolation.
+func (s *ScheduledRepository) Add(ctx context.Context, scheduled ScheduledTransaction) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO scheduled_transactions (id, user_id, amount, idempotency_key, execute_at, status, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		scheduled.ID,
+		scheduled.UserID,
+		scheduled.Amount,
+		scheduled.IdempotencyKey,
+		scheduled.ExecuteAt,
+		ScheduledStatusScheduled,
+		scheduled.CreatedAt)
+	return err
+}
+
+// FindByKey returns the user's scheduled transaction with the idempotency
+// key, or ErrScheduledNotFound
+func (s *ScheduledRepository) FindByKey(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID) (ScheduledTransaction, error) {
+	scheduled, err := scanScheduled(s.db.QueryRowContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_transactions WHERE user_id = $1 AND idempotency_key = $2`, userID, idempotencyKey))
+	if err == sql.ErrNoRows {
+		return ScheduledTransaction{}, ErrScheduledNotFound
+	}
+	return scheduled, err
+}
+
+// FindByUserID returns the user's scheduled transactions, the soonest due
+// first
+func (s *ScheduledRepository) FindByUserID(ctx context.Context, userID uuid.UUID) ([]ScheduledTransaction, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_transactions WHERE user_id = $1 ORDER BY execute_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanScheduledRows(rows)
+}
+
+// FindDue returns up to limit scheduled transactions due at now that haven't
+// been posted, including those an executor picked up but didn't finish,
+// oldest due first
+func (s *ScheduledRepository) FindDue(ctx context.Context, now time.Time, limit int) ([]ScheduledTransaction, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_transactions WHERE status IN ($1, $2) AND execute_at <= $3 ORDER BY execute_at, id LIMIT $4`,
+		ScheduledStatusScheduled, ScheduledStatusExecuting, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanScheduledRows(rows)
+}
+
+// Claim marks a scheduled transaction as executing so it can no longer be
+// cancelled. It returns false if it was cancelled or finished in the
+// meantime.
+func (s *ScheduledRepository) Claim(ctx context.Context, id uuid.UUID) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `UPDATE scheduled_transactions SET status = $2 WHERE id = $1 AND status IN ($3, $2)`,
+		id, ScheduledStatusExecuting, ScheduledStatusScheduled)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// MarkExecuted records the transaction a scheduled transaction was posted as
+func (s *ScheduledRepository) MarkExecuted(ctx context.Context, id uuid.UUID, transactionID uuid.UUID, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE scheduled_transactions SET status = $2, transaction_id = $3, last_error = '', executed_at = $4 WHERE id = $1`,
+		id, ScheduledStatusExecuted, transactionID, at)
+	return err
+}
+
+// MarkFailed records why a scheduled transaction was rejected when posted
+func (s *ScheduledRepository) MarkFailed(ctx context.Context, id uuid.UUID, lastError string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE scheduled_transactions SET status = $2, last_error = $3, executed_at = $4 WHERE id = $1`,
+		id, ScheduledStatusFailed, lastError, at)
+	return err
+}
+
+// Cancel cancels one of the user's scheduled transactions that hasn't been
+// picked up yet. It returns ErrScheduledNotFound for unknown ones and
+// ErrScheduledNotPending for those already executing, executed, failed or
+// cancelled.
+func (s *ScheduledRepository) Cancel(ctx context.Context, userID uuid.UUID, id uuid.UUID) (ScheduledTransaction, error) {
+	scheduled, err := scanScheduled(s.db.QueryRowContext(ctx, `UPDATE scheduled_transactions SET status = $3 WHERE id = $1 AND user_id = $2 AND status = $4 RETURNING `+scheduledColumns,
+		id, userID, ScheduledStatusCancelled, ScheduledStatusScheduled))
+	if err != sql.ErrNoRows {
+		return scheduled, err
+	}
+
+	var exists bool
+	err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM scheduled_transactions WHERE id = $1 AND user_id = $2)`, id, userID).Scan(&exists)
+	if err != nil {
+		return ScheduledTransaction{}, err
+	}
+	if !exists {
+		return ScheduledTransaction{}, ErrScheduledNotFound
+	}
+	return ScheduledTransaction{}, ErrScheduledNotPending
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrTenantMismatch is returned when a write for a user comes from a tenant
+// other than the user's
+var ErrTenantMismatch = errors.New("user belongs to another tenant")
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx scoped to tenantID. Queries run with it
+// only see users, and their transactions and transfers, of that tenant, and
+// writes for another tenant's user return ErrTenantMismatch.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant ctx is scoped to, if any
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantKey{}).(string)
+	return tenantID, ok
+}
+
+// tenantCondition returns the condition limiting a query to the tenant ctx is
+// scoped to, comparing column against placeholder next, along with its
+// argument. Without a tenant it returns no condition.
+func tenantCondition(ctx context.Context, column string, next int) (string, []interface{}) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	return fmt.Sprintf(" AND %s = $%d", column, next), []interface{}{tenantID}
+}
+
+// checkTenant returns the tenant of a user whose row the caller has locked,
+// or ErrTenantMismatch when ctx is scoped to another tenant
+func checkTenant(ctx context.Context, tx *sql.Tx, userID uuid.UUID) (string, error) {
+	var tenantID string
+	err := tx.QueryRowContext(ctx, "SELECT tenant_id FROM users WHERE id = $1", userID).Scan(&tenantID)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if requested, ok := TenantFromContext(ctx); ok && requested != tenantID {
+		return "", ErrTenantMismatch
+	}
+	return tenantID, nil
+}
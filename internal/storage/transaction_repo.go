@@ -3,18 +3,163 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
 )
 
+// TransactionType tells credits (positive amounts) and debits (negative
+// amounts) apart in queries
+type TransactionType string
+
+const (
+	TransactionTypeCredit TransactionType = "credit"
+	TransactionTypeDebit  TransactionType = "debit"
+)
+
+// TransactionStatus tracks where a transaction is in its lifecycle
+type TransactionStatus string
+
+const (
+	TransactionStatusPending TransactionStatus = "pending"
+	TransactionStatusSettled TransactionStatus = "settled"
+	TransactionStatusVoided  TransactionStatus = "voided"
+)
+
+var (
+	ErrTransactionNotFound      = errors.New("transaction not found")
+	ErrTransactionAlreadyVoided = errors.New("transaction already voided")
+	ErrTransactionDeleted       = errors.New("transaction already deleted")
+	ErrRefundExceedsOriginal    = errors.New("refund exceeds the original transaction")
+	ErrAlreadyReversed          = errors.New("transaction already reversed")
+	ErrHasCompensations         = errors.New("transaction has refunds or reversals, void those first")
+	ErrTransferLeg              = errors.New("transaction is a leg of a transfer, settle or cancel the transfer instead")
+	ErrIdempotencyKeyTaken      = errors.New("idempotency key already used")
+	ErrBatchMixesUsers          = errors.New("batch holds transactions of another user")
+)
+
+// uniqueViolation is the SQLSTATE Postgres reports when a write breaks a
+// unique constraint
+const uniqueViolation = "23505"
+
+// IsUniqueViolation reports whether err is Postgres rejecting a write for
+// breaking a unique constraint, such as a repeated idempotency key. It checks
+// the SQLSTATE rather than the message, which depends on the driver and the
+// server's locale.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
+// DefaultChannel is the channel of transactions written without one
+const DefaultChannel = "api"
+
+// countedInBalance is the condition a transaction row must meet to count
+// towards the user's balance
+const countedInBalance = `status <> 'voided'`
+
 type Transaction struct {
 	ID             uuid.UUID
 	UserID         uuid.UUID
 	Amount         decimal.Decimal
 	CreatedAt      time.Time
 	IdempotencyKey uuid.UUID
+	// Sequence is the position of the transaction in the user's ledger,
+	// starting at 1 and increasing without gaps.
+	Sequence int64
+	Status   TransactionStatus
+	// ReasonCode classifies the transaction for reporting, empty if unset
+	ReasonCode string
+	// ReversesID is the transaction this one refunds, if any
+	ReversesID uuid.NullUUID
+	// BatchID groups transactions that were created together
+	BatchID uuid.NullUUID
+	// Channel is where the transaction came in through, e.g. web or mobile.
+	// It defaults to DefaultChannel.
+	Channel string
+	// ServerTimestamp marks CreatedAt as generated by the server rather than
+	// given by the client, so it may be moved forward to keep the user's
+	// timestamps monotonic. It isn't stored.
+	ServerTimestamp bool
+	// MonotonicTimestamp moves a server generated CreatedAt that isn't later
+	// than the user's latest transaction, as when the clock was set back, to
+	// a microsecond after it. It isn't stored.
+	MonotonicTimestamp bool
+	// ReuseSettledKey lets the idempotency key of a settled or voided
+	// transaction be used again, so only a pending transaction blocks it.
+	// It isn't stored.
+	ReuseSettledKey bool
+	// DirtyBalanceOnFailure keeps the transaction when updating the stored
+	// balance fails, flagging the balance dirty so it can be recomputed on
+	// read instead of rolling back. It isn't stored.
+	DirtyBalanceOnFailure bool
+	// HoldAmount is the part of a credit held back from the available
+	// balance until HoldUntil, none when zero. Holds are stored on their own.
+	HoldAmount decimal.Decimal
+	HoldUntil  time.Time
+	// AllowOverdraft lets a debit take the user's available balance below
+	// zero. It isn't stored.
+	AllowOverdraft bool
+	// OverdraftTolerance is how far below zero a debit may still take the
+	// available balance when overdraft isn't allowed. It isn't stored.
+	OverdraftTolerance decimal.Decimal
+	// TenantID is the tenant of the transaction's user. insertTransaction
+	// sets it.
+	TenantID string
+	// Currency is the ISO 4217 code of the amount. It defaults to the
+	// currency of the user's account.
+	Currency string
+	// DeletedAt is when the transaction was soft deleted, nil while it
+	// isn't. Deleted transactions are voided and left out of the history.
+	DeletedAt *time.Time
+	// BalanceAfter is the user's balance right after this transaction was
+	// written. Voiding the transaction later doesn't change it.
+	BalanceAfter decimal.Decimal
+	// UserVersion is the user's version after this transaction was applied.
+	// It is only set on the result of a write.
+	UserVersion int64
+	// TransferLeg marks the legs of a transfer, empty for any other
+	// transaction. It is written but not read back.
+	TransferLeg TransferLeg
+	// Outbox, when set, announces the write with a webhook delivery stored
+	// in the same database transaction. In a batch only the first
+	// transaction's is used, rendered from every transaction of the batch.
+	// It isn't stored.
+	Outbox *Outbox
+}
+
+// transactionColumns is the column list every transaction query selects,
+// in the order scanTransaction expects them.
+const transactionColumns = `id, user_id, amount, created_at, idempotency_key, sequence, status, reason_code, reverses_id, batch_id, channel, balance_after, tenant_id, currency, deleted_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(row rowScanner) (Transaction, error) {
+	var transaction Transaction
+	err := row.Scan(&transaction.ID,
+		&transaction.UserID,
+		&transaction.Amount,
+		&transaction.CreatedAt,
+		&transaction.IdempotencyKey,
+		&transaction.Sequence,
+		&transaction.Status,
+		&transaction.ReasonCode,
+		&transaction.ReversesID,
+		&transaction.BatchID,
+		&transaction.Channel,
+		&transaction.BalanceAfter,
+		&transaction.TenantID,
+		&transaction.Currency,
+		&transaction.DeletedAt)
+	return transaction, err
 }
 
 type TransactionRepository struct {
@@ -25,18 +170,47 @@ func NewTransactionRepository(db *sql.DB) *TransactionRepository {
 	return &TransactionRepository{db: db}
 }
 
+// FindTransactionByID returns a transaction by ID
+// If the transaction is not found, or belongs to another tenant than the one
+// ctx is scoped to, ErrTransactionNotFound is returned
 func (t *TransactionRepository) FindTransactionByID(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
-	var transaction Transaction
-	err := t.db.QueryRowContext(ctx, `SELECT id, user_id, amount, created_at,idempotency_key FROM transactions WHERE id = $1`, transactionID).
-		Scan(&transaction.ID,
-			&transaction.UserID,
-			&transaction.Amount,
-			&transaction.CreatedAt,
-			&transaction.IdempotencyKey)
-
+	condition, args := tenantCondition(ctx, "tenant_id", 2)
+	row := t.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE id = $1`+condition, append([]interface{}{transactionID}, args...)...)
+	transaction, err := scanTransaction(row)
+	if err == sql.ErrNoRows {
+		return Transaction{}, ErrTransactionNotFound
+	}
 	return transaction, err
 }
 
+// FindTransactionsByIDs returns the transactions with the given IDs, in no
+// particular order. IDs without a transaction, or of another tenant than the
+// one ctx is scoped to, are skipped.
+func (t *TransactionRepository) FindTransactionsByIDs(ctx context.Context, ids []uuid.UUID) ([]Transaction, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, id.String())
+	}
+
+	condition, args := tenantCondition(ctx, "tenant_id", 2)
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE id = ANY($1::uuid[])`+condition, append([]interface{}{pq.Array(keys)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
 func (t *TransactionRepository) AddTransaction(ctx context.Context, transaction Transaction) (Transaction, error) {
 	// Begin a new transaction
 	tx, err := t.db.BeginTx(ctx, nil)
@@ -45,8 +219,7 @@ func (t *TransactionRepository) AddTransaction(ctx context.Context, transaction
 	}
 
 	// Lock the user row using SELECT FOR UPDATE
-	var currentBalance decimal.Decimal
-	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = $1 FOR UPDATE", transaction.UserID).Scan(&currentBalance)
+	currentBalance, err := lockUserBalance(ctx, tx, transaction.UserID)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
 		return Transaction{}, ErrUserNotFound
@@ -57,87 +230,1528 @@ func (t *TransactionRepository) AddTransaction(ctx context.Context, transaction
 		return Transaction{}, err
 	}
 
-	// Insert the transaction
-	err = tx.QueryRowContext(ctx, `INSERT INTO transactions (id, user_id, amount, created_at,idempotency_key) VALUES ($1, $2, $3, $4,$5) RETURNING id, created_at`,
-		transaction.ID,
-		transaction.UserID,
-		transaction.Amount,
-		transaction.CreatedAt,
-		transaction.IdempotencyKey).
-		Scan(&transaction.ID,
-			&transaction.CreatedAt)
-	if err != nil {
+	// The user row stays locked until we commit, so a concurrent debit waits
+	// for this one and sees the balance it leaves
+	if err = checkFunds(ctx, tx, transaction, currentBalance); err != nil {
 		tx.Rollback()
 		return Transaction{}, err
 	}
 
-	// Update the user's balance
-	newBalance := currentBalance.Add(transaction.Amount)
-	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1 WHERE id = $2", newBalance, transaction.UserID)
+	transaction, err = t.insertTransaction(ctx, tx, transaction, currentBalance)
 	if err != nil {
 		tx.Rollback()
 		return Transaction{}, err
 	}
 
+	if err = writeOutbox(ctx, tx, transaction.Outbox, []Transaction{transaction}); err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
 	// Commit the transaction
 	err = tx.Commit()
 	if err != nil {
 		return Transaction{}, err
 	}
 
-	return Transaction{
-		ID:             transaction.ID,
-		UserID:         transaction.UserID,
-		Amount:         transaction.Amount,
-		CreatedAt:      transaction.CreatedAt,
-		IdempotencyKey: transaction.IdempotencyKey,
-	}, nil
+	return transaction, nil
 }
 
-func (t *TransactionRepository) GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int) ([]Transaction, error) {
-	if page <= 0 {
-		page = 1
+// OpenAccount adds a user with a zero balance and, when opening is given a
+// non-zero amount, books it as the user's first transaction, all in one
+// database transaction so the balance always matches the ledger. When
+// creationKey has an idempotency key it is stored for the user in the same
+// transaction; a key the tenant already used fails with a unique violation
+// and adds nothing.
+func (t *TransactionRepository) OpenAccount(ctx context.Context, user User, opening Transaction, creationKey UserCreationKey) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
 
-	if pageSize <= 0 {
-		pageSize = 10
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now().UTC()
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO users (id, balance, external_id, currency, created_at, tenant_id) VALUES ($1, 0, $2, $3, $4, $5)", user.ID, user.ExternalID, user.Currency, user.CreatedAt, user.TenantID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if creationKey.IdempotencyKey != uuid.Nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO user_creation_keys (tenant_id, idempotency_key, user_id, initial_balance, currency) VALUES ($1, $2, $3, $4, $5)",
+			user.TenantID, creationKey.IdempotencyKey, user.ID, creationKey.InitialBalance, creationKey.Currency)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if !opening.Amount.IsZero() {
+		opening.UserID = user.ID
+		if _, err = t.insertTransaction(ctx, tx, opening, decimal.Zero); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddAdjustment books a manual adjustment of the user's balance as
+// transaction and writes entry, linked to it, in the same database
+// transaction. The entry gets the balance from before and after the
+// adjustment. Adjustments aren't held to the user's funds.
+func (t *TransactionRepository) AddAdjustment(ctx context.Context, transaction Transaction, entry AuditEntry) (Transaction, AuditEntry, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, AuditEntry{}, err
+	}
+
+	currentBalance, err := lockUserBalance(ctx, tx, transaction.UserID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return Transaction{}, AuditEntry{}, ErrUserNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, AuditEntry{}, err
+	}
+
+	transaction, err = t.insertTransaction(ctx, tx, transaction, currentBalance)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, AuditEntry{}, err
+	}
+
+	entry.UserID = transaction.UserID
+	entry.TransactionID = transaction.ID
+	entry.BalanceBefore = currentBalance
+	entry.BalanceAfter = currentBalance.Add(transaction.Amount)
+	entry.CreatedAt = transaction.CreatedAt
+	if err = insertAuditEntry(ctx, tx, entry); err != nil {
+		tx.Rollback()
+		return Transaction{}, AuditEntry{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Transaction{}, AuditEntry{}, err
+	}
+
+	return transaction, entry, nil
+}
+
+// AddTransactionBatch writes all the transactions in a single database
+// transaction, moving the balances of their users. If any of them fails,
+// none are written. The users are locked in a fixed order so concurrent
+// batches and transfers can't deadlock.
+func (t *TransactionRepository) AddTransactionBatch(ctx context.Context, transactions []Transaction) ([]Transaction, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := t.db.QueryContext(ctx, `SELECT id,user_id, amount, created_at,idempotency_key FROM transactions WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, userID, pageSize, (page-1)*pageSize)
+	userIDs := make([]uuid.UUID, 0, len(transactions))
+	for _, transaction := range transactions {
+		userIDs = append(userIDs, transaction.UserID)
+	}
+	balances, err := lockUsers(ctx, tx, userIDs...)
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
 
-	transactions := []Transaction{}
+	added := make([]Transaction, 0, len(transactions))
+	for _, transaction := range transactions {
+		if err = checkFunds(ctx, tx, transaction, balances[transaction.UserID]); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		transaction, err = t.insertTransaction(ctx, tx, transaction, balances[transaction.UserID])
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		balances[transaction.UserID] = balances[transaction.UserID].Add(transaction.Amount)
+		added = append(added, transaction)
+	}
+
+	if len(transactions) > 0 {
+		if err = writeOutbox(ctx, tx, transactions[0].Outbox, added); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// AddTransactionsBatch writes the transactions, all of one user, with a
+// single multi-row INSERT in one database transaction and moves the user's
+// balance once by their net sum. Only the net sum is held to the user's
+// funds. The transactions are filled in with their sequence, status,
+// channel and balance after as stored. A transaction repeating the key of
+// one the user already has, or of an earlier one in the batch, writes
+// nothing and returns ErrIdempotencyKeyTaken naming its index. Transactions
+// with a HoldAmount have it held like in AddTransaction.
+func (t *TransactionRepository) AddTransactionsBatch(ctx context.Context, transactions []Transaction) error {
+	_, err := t.addTransactionsBatch(ctx, transactions, false)
+	return err
+}
+
+// AddNewTransactionsBatch writes the transactions like AddTransactionsBatch,
+// except that those repeating a key are skipped instead of failing the
+// batch. It returns the indices of the skipped transactions, each with the
+// ID of the transaction holding its key. Skipped transactions aren't filled
+// in.
+func (t *TransactionRepository) AddNewTransactionsBatch(ctx context.Context, transactions []Transaction) (map[int]uuid.UUID, error) {
+	return t.addTransactionsBatch(ctx, transactions, true)
+}
+
+func (t *TransactionRepository) addTransactionsBatch(ctx context.Context, transactions []Transaction, skipDuplicates bool) (map[int]uuid.UUID, error) {
+	if len(transactions) == 0 {
+		return nil, nil
+	}
+	userID := transactions[0].UserID
+	for i, transaction := range transactions {
+		if transaction.UserID != userID {
+			return nil, fmt.Errorf("transaction %d: %w", i, ErrBatchMixesUsers)
+		}
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	currentBalance, err := lockUserBalance(ctx, tx, userID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	tenantID, err := checkTenant(ctx, tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	currency, err := accountCurrency(ctx, tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// The user row is locked, so no other insert can take one of the keys
+	// between this check and the insert
+	duplicates, err := t.checkBatchKeys(ctx, tx, transactions, skipDuplicates)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	kept := make([]*Transaction, 0, len(transactions))
+	for i := range transactions {
+		if _, ok := duplicates[i]; !ok {
+			kept = append(kept, &transactions[i])
+		}
+	}
+	if len(kept) == 0 {
+		// Nothing to write, though keys may have been released
+		return duplicates, tx.Commit()
+	}
+
+	net := decimal.Zero
+	for _, transaction := range kept {
+		net = net.Add(transaction.Amount)
+	}
+	err = checkFunds(ctx, tx, Transaction{
+		UserID:             userID,
+		Amount:             net,
+		AllowOverdraft:     transactions[0].AllowOverdraft,
+		OverdraftTolerance: transactions[0].OverdraftTolerance,
+	}, currentBalance)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var sequence int64
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(sequence), 0) FROM transactions WHERE user_id = $1", userID).Scan(&sequence)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	const columns = 14
+	placeholders := make([]string, 0, len(kept))
+	args := make([]interface{}, 0, len(kept)*columns)
+	balance := currentBalance
+	for _, transaction := range kept {
+		sequence++
+		balance = balance.Add(transaction.Amount)
+
+		transaction.Sequence = sequence
+		transaction.BalanceAfter = balance
+		transaction.TenantID = tenantID
+		if transaction.Currency == "" {
+			transaction.Currency = currency
+		}
+		if transaction.Status == "" {
+			transaction.Status = TransactionStatusSettled
+		}
+		if transaction.Channel == "" {
+			transaction.Channel = DefaultChannel
+		}
+
+		row := make([]string, 0, columns)
+		for column := 1; column <= columns; column++ {
+			row = append(row, fmt.Sprintf("$%d", len(args)+column))
+		}
+		placeholders = append(placeholders, "("+strings.Join(row, ", ")+")")
+		args = append(args,
+			transaction.ID,
+			transaction.UserID,
+			transaction.Amount,
+			transaction.CreatedAt,
+			transaction.IdempotencyKey,
+			transaction.Sequence,
+			transaction.Status,
+			transaction.ReasonCode,
+			transaction.ReversesID,
+			transaction.BatchID,
+			transaction.Channel,
+			transaction.BalanceAfter,
+			transaction.TenantID,
+			transaction.Currency)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO transactions (id, user_id, amount, created_at, idempotency_key, sequence, status, reason_code, reverses_id, batch_id, channel, balance_after, tenant_id, currency) VALUES `+strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, transaction := range kept {
+		if transaction.HoldAmount.IsPositive() {
+			if err = insertHold(ctx, tx, *transaction); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+
+	version, err := updateBalance(ctx, tx, userID, balance, transactions[0].DirtyBalanceOnFailure)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, transaction := range kept {
+		transaction.UserVersion = version
+	}
+	return duplicates, nil
+}
+
+// checkBatchKeys finds the transactions that repeat the key and amount of an
+// earlier one or of a transaction the user already has, returning their
+// indices with the ID of the transaction holding the key. Unless
+// skipDuplicates is set, the first of them fails the batch with
+// ErrIdempotencyKeyTaken naming its index instead. A key repeated with
+// another amount always does. If the first transaction has ReuseSettledKey,
+// keys held by settled or voided transactions are released rather than
+// repeated. The caller must hold the lock on the user row.
+func (t *TransactionRepository) checkBatchKeys(ctx context.Context, tx *sql.Tx, transactions []Transaction, skipDuplicates bool) (map[int]uuid.UUID, error) {
+	type holder struct {
+		id      uuid.UUID
+		amount  decimal.Decimal
+		settled bool
+	}
+
+	keys := make([]string, 0, len(transactions))
+	for _, transaction := range transactions {
+		keys = append(keys, transaction.IdempotencyKey.String())
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, idempotency_key, amount, status FROM transactions WHERE user_id = $1 AND idempotency_key = ANY($2::uuid[]) AND NOT key_released`, transactions[0].UserID, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := map[uuid.UUID]holder{}
 	for rows.Next() {
-		var transaction Transaction
-		err = rows.Scan(&transaction.ID,
-			&transaction.UserID,
-			&transaction.Amount,
-			&transaction.CreatedAt,
-			&transaction.IdempotencyKey,
+		var (
+			h              holder
+			idempotencyKey uuid.UUID
+			status         TransactionStatus
 		)
+		if err := rows.Scan(&h.id, &idempotencyKey, &h.amount, &status); err != nil {
+			return nil, err
+		}
+		h.settled = status != TransactionStatusPending
+		held[idempotencyKey] = h
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var release []string
+	duplicates := map[int]uuid.UUID{}
+	seen := map[uuid.UUID]holder{}
+	for i, transaction := range transactions {
+		h, ok := seen[transaction.IdempotencyKey]
+		if !ok {
+			h, ok = held[transaction.IdempotencyKey]
+			if ok && transactions[0].ReuseSettledKey && h.settled {
+				release = append(release, h.id.String())
+				ok = false
+			}
+		}
+		if !ok {
+			seen[transaction.IdempotencyKey] = holder{id: transaction.ID, amount: transaction.Amount}
+			continue
+		}
+		if !skipDuplicates || !h.amount.Equal(transaction.Amount) {
+			return nil, fmt.Errorf("transaction %d: %w", i, ErrIdempotencyKeyTaken)
+		}
+		duplicates[i] = h.id
+		seen[transaction.IdempotencyKey] = h
+	}
+
+	if len(release) > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE transactions SET key_released = TRUE WHERE id = ANY($1::uuid[])`, pq.Array(release))
+	}
+	return duplicates, err
+}
+
+// FindTransactionsByBatchID returns the transactions of a batch in the order
+// they were added, leaving out those of other tenants than the one ctx is
+// scoped to
+func (t *TransactionRepository) FindTransactionsByBatchID(ctx context.Context, batchID uuid.UUID) ([]Transaction, error) {
+	condition, args := tenantCondition(ctx, "tenant_id", 2)
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE batch_id = $1`+condition+` ORDER BY created_at, user_id, sequence`, append([]interface{}{batchID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
 		if err != nil {
 			return nil, err
 		}
 		transactions = append(transactions, transaction)
 	}
 
-	rows.Close()
-	if err = rows.Err(); err != nil {
-		return nil, err
+	return transactions, rows.Err()
+}
+
+// accountCurrency returns the currency of a user's account, empty when the
+// account is in the ledger's implicit currency
+func accountCurrency(ctx context.Context, tx *sql.Tx, userID uuid.UUID) (string, error) {
+	var currency string
+	err := tx.QueryRowContext(ctx, "SELECT currency FROM users WHERE id = $1", userID).Scan(&currency)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
 	}
+	return currency, err
+}
 
-	return transactions, nil
+// checkFunds returns ErrInsufficientFunds when transaction is a debit that
+// would take the user's available balance, currentBalance without held
+// credits, further below zero than its overdraft tolerance and overdraft
+// isn't allowed for it. The caller must hold the lock on the user row.
+func checkFunds(ctx context.Context, tx *sql.Tx, transaction Transaction, currentBalance decimal.Decimal) error {
+	if !transaction.Amount.IsNegative() || transaction.AllowOverdraft {
+		return nil
+	}
+
+	// Another tenant mustn't learn whether the user could cover the debit
+	if _, err := checkTenant(ctx, tx, transaction.UserID); err != nil {
+		return err
+	}
+
+	held, err := heldAmount(ctx, tx, transaction.UserID)
+	if err != nil {
+		return err
+	}
+	if currentBalance.Sub(held).Add(transaction.Amount).Add(transaction.OverdraftTolerance).IsNegative() {
+		return ErrInsufficientFunds
+	}
+	return nil
 }
 
-func (t *TransactionRepository) FindTransactionByIdempotencyKey(ctx context.Context, idempotencyKey uuid.UUID) (Transaction, error) {
-	var transaction Transaction
-	err := t.db.QueryRowContext(ctx, `SELECT id, user_id, amount, created_at,idempotency_key FROM transactions WHERE idempotency_key = $1`, idempotencyKey).
-		Scan(&transaction.ID,
-			&transaction.UserID,
-			&transaction.Amount,
-			&transaction.CreatedAt,
-			&transaction.IdempotencyKey)
-	return transaction, err
+// insertTransaction writes a transaction for a user whose row the caller has
+// locked, and moves the user's balance from currentBalance by its amount.
+func (t *TransactionRepository) insertTransaction(ctx context.Context, tx *sql.Tx, transaction Transaction, currentBalance decimal.Decimal) (Transaction, error) {
+	var err error
+	transaction.TenantID, err = checkTenant(ctx, tx, transaction.UserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	// The user row is locked, so no other insert for this user can race us
+	// for the next sequence number.
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(sequence), 0) + 1 FROM transactions WHERE user_id = $1", transaction.UserID).Scan(&transaction.Sequence)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if transaction.Status == "" {
+		transaction.Status = TransactionStatusSettled
+	}
+	if transaction.Channel == "" {
+		transaction.Channel = DefaultChannel
+	}
+	if transaction.Currency == "" {
+		transaction.Currency, err = accountCurrency(ctx, tx, transaction.UserID)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	if transaction.ServerTimestamp && transaction.MonotonicTimestamp {
+		// Stored timestamps only keep microseconds
+		transaction.CreatedAt = transaction.CreatedAt.Truncate(time.Microsecond)
+
+		var latest sql.NullTime
+		err = tx.QueryRowContext(ctx, "SELECT MAX(created_at) FROM transactions WHERE user_id = $1", transaction.UserID).Scan(&latest)
+		if err != nil {
+			return Transaction{}, err
+		}
+		if latest.Valid && !transaction.CreatedAt.After(latest.Time) {
+			transaction.CreatedAt = latest.Time.Add(time.Microsecond)
+		}
+	}
+
+	// Free the key held by a settled or voided transaction. The updated rows
+	// stay locked until we commit, and the unique index only covers keys that
+	// haven't been released, so two inserts reusing the same key still
+	// conflict with each other.
+	if transaction.ReuseSettledKey {
+		_, err = tx.ExecContext(ctx, `UPDATE transactions SET key_released = TRUE WHERE user_id = $1 AND idempotency_key = $2 AND status <> $3 AND NOT key_released`,
+			transaction.UserID,
+			transaction.IdempotencyKey,
+			TransactionStatusPending)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	// The user row is locked, so currentBalance is the balance this
+	// transaction is applied to
+	transaction.BalanceAfter = currentBalance.Add(transaction.Amount)
+
+	// Insert the transaction
+	err = tx.QueryRowContext(ctx, `INSERT INTO transactions (id, user_id, amount, created_at, idempotency_key, sequence, status, reason_code, reverses_id, batch_id, channel, balance_after, tenant_id, currency, transfer_leg) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id, created_at`,
+		transaction.ID,
+		transaction.UserID,
+		transaction.Amount,
+		transaction.CreatedAt,
+		transaction.IdempotencyKey,
+		transaction.Sequence,
+		transaction.Status,
+		transaction.ReasonCode,
+		transaction.ReversesID,
+		transaction.BatchID,
+		transaction.Channel,
+		transaction.BalanceAfter,
+		transaction.TenantID,
+		transaction.Currency,
+		transaction.TransferLeg).
+		Scan(&transaction.ID,
+			&transaction.CreatedAt)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if transaction.HoldAmount.IsPositive() {
+		if err = insertHold(ctx, tx, transaction); err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	// Update the user's balance
+	transaction.UserVersion, err = updateBalance(ctx, tx, transaction.UserID, transaction.BalanceAfter, transaction.DirtyBalanceOnFailure)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return transaction, nil
+}
+
+// VoidTransaction marks a transaction voided and takes its amount back out of
+// the user's balance. Voiding an already voided transaction returns
+// ErrTransactionAlreadyVoided. A transaction with refunds or reversals that
+// aren't voided returns ErrHasCompensations, as their amounts already undo
+// part of it, and a leg of a transfer ErrTransferLeg.
+func (t *TransactionRepository) VoidTransaction(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
+	return t.voidTransaction(ctx, transactionID, nil)
+}
+
+// SoftDelete marks a transaction deleted at deletedAt, voiding it unless it
+// already is, so its amount leaves the user's balance. The row is kept for
+// audits. Deleting it again returns ErrTransactionDeleted.
+func (t *TransactionRepository) SoftDelete(ctx context.Context, transactionID uuid.UUID, deletedAt time.Time) (Transaction, error) {
+	deletedAt = deletedAt.UTC()
+	return t.voidTransaction(ctx, transactionID, &deletedAt)
+}
+
+// voidTransaction voids a transaction and, given deletedAt, stamps it
+// deleted
+func (t *TransactionRepository) voidTransaction(ctx context.Context, transactionID uuid.UUID, deletedAt *time.Time) (Transaction, error) {
+	transaction, err := t.FindTransactionByID(ctx, transactionID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	// Voiding changes which rows count towards the balance, so wait for any
+	// chunked recompute of the user to finish first
+	if err = waitForRecompute(ctx, tx, transaction.UserID); err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	// Lock the user before the transaction row, in the same order as
+	// AddTransaction, so the two can't deadlock
+	currentBalance, err := lockUserBalance(ctx, tx, transaction.UserID)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	// Read the status again under the row lock. A concurrent void of the
+	// same transaction waits here until we commit, then sees it voided.
+	transaction, err = scanTransaction(tx.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE id = $1 FOR UPDATE`, transactionID))
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	if deletedAt != nil && transaction.DeletedAt != nil {
+		tx.Rollback()
+		return Transaction{}, ErrTransactionDeleted
+	}
+	if deletedAt == nil && transaction.Status == TransactionStatusVoided {
+		tx.Rollback()
+		return Transaction{}, ErrTransactionAlreadyVoided
+	}
+	if transaction.Status != TransactionStatusVoided {
+		if err = checkVoidable(ctx, tx, transactionID); err != nil {
+			tx.Rollback()
+			return Transaction{}, err
+		}
+	}
+
+	if deletedAt != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE transactions SET deleted_at = $1 WHERE id = $2", *deletedAt, transactionID)
+		if err != nil {
+			tx.Rollback()
+			return Transaction{}, err
+		}
+		transaction.DeletedAt = deletedAt
+
+		// Already out of the balance
+		if transaction.Status == TransactionStatusVoided {
+			return transaction, tx.Commit()
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", TransactionStatusVoided, transactionID)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	// The voided amount leaves the balance, so a hold on it has nothing left
+	// to hold back
+	_, err = tx.ExecContext(ctx, "UPDATE balance_holds SET released = TRUE WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	transaction.UserVersion, err = updateBalance(ctx, tx, transaction.UserID, currentBalance.Sub(transaction.Amount), false)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Transaction{}, err
+	}
+
+	transaction.Status = TransactionStatusVoided
+	return transaction, nil
+}
+
+// checkVoidable returns why a transaction that still counts towards the
+// balance can't be voided on its own, if it can't: live compensations
+// would take its amount out a second time, and a transfer's legs are only
+// undone through the transfer
+func checkVoidable(ctx context.Context, tx *sql.Tx, transactionID uuid.UUID) error {
+	var compensated bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM transactions WHERE reverses_id = $1 AND status <> $2)", transactionID, TransactionStatusVoided).Scan(&compensated)
+	if err != nil {
+		return err
+	}
+	if compensated {
+		return ErrHasCompensations
+	}
+
+	var leg bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM transfers WHERE debit_transaction_id = $1 OR credit_transaction_id = $1)", transactionID).Scan(&leg)
+	if err != nil {
+		return err
+	}
+	if leg {
+		return ErrTransferLeg
+	}
+	return nil
+}
+
+// lockUserBalance locks the user row and returns the balance a write is
+// applied to. A balance left dirty by a failed update is recomputed from the
+// transactions and stored first, so funds checks and BalanceAfter never
+// build on a stale balance. A missing user returns sql.ErrNoRows.
+func lockUserBalance(ctx context.Context, tx *sql.Tx, userID uuid.UUID) (decimal.Decimal, error) {
+	var (
+		balance decimal.Decimal
+		dirty   bool
+	)
+	err := tx.QueryRowContext(ctx, "SELECT balance, balance_dirty FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&balance, &dirty)
+	if err != nil || !dirty {
+		return balance, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND "+countedInBalance, userID).Scan(&balance)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, balance_dirty = FALSE WHERE id = $2", balance, userID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return balance, nil
+}
+
+// updateBalance stores the new balance of a locked user row and bumps the
+// user's version, returning the new version. If that fails and
+// dirtyOnFailure is set, the failed update is undone up to a savepoint and
+// the balance is flagged dirty instead.
+func updateBalance(ctx context.Context, tx *sql.Tx, userID uuid.UUID, balance decimal.Decimal, dirtyOnFailure bool) (int64, error) {
+	var version int64
+	if !dirtyOnFailure {
+		err := tx.QueryRowContext(ctx, "UPDATE users SET balance = $1, version = version + 1 WHERE id = $2 RETURNING version", balance, userID).Scan(&version)
+		return version, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT balance_update"); err != nil {
+		return 0, err
+	}
+
+	err := tx.QueryRowContext(ctx, "UPDATE users SET balance = $1, version = version + 1 WHERE id = $2 RETURNING version", balance, userID).Scan(&version)
+	if err == nil {
+		return version, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT balance_update"); err != nil {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, "UPDATE users SET balance_dirty = TRUE, version = version + 1 WHERE id = $1 RETURNING version", userID).Scan(&version)
+	return version, err
+}
+
+// RecomputeBalance sets the user's stored balance to the sum of their
+// transactions and clears the dirty flag, holding the user row lock so no
+// transaction can be added in between. It returns the stored balance from
+// before and after the recompute.
+func (t *TransactionRepository) RecomputeBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, decimal.Decimal, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	var previous decimal.Decimal
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, ErrUserNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	var balance decimal.Decimal
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND "+countedInBalance, userID).Scan(&balance)
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, balance_dirty = FALSE, version = version + 1 WHERE id = $2", balance, userID)
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	return previous, balance, nil
+}
+
+// HistoryFilter narrows down the transactions a history query returns
+type HistoryFilter struct {
+	// IncludeVoided also returns voided transactions, which are left out by
+	// default
+	IncludeVoided bool
+	// IncludeDeleted also returns soft deleted transactions, which are left
+	// out by default even with IncludeVoided
+	IncludeDeleted bool
+	// Channel only returns transactions that came in through it, when set
+	Channel string
+	// From and To only return transactions created at or after From and at
+	// or before To. Zero values leave that side open.
+	From time.Time
+	To   time.Time
+}
+
+// condition returns the SQL condition, starting with AND, that applies the
+// filter to the transactions table, along with the arguments it takes. Its
+// placeholders are numbered from next.
+func (f HistoryFilter) condition(next int) (string, []interface{}) {
+	var condition string
+	var args []interface{}
+	switch {
+	case f.IncludeVoided:
+	case f.IncludeDeleted:
+		// Deleted transactions are voided too
+		condition += ` AND (` + countedInBalance + ` OR deleted_at IS NOT NULL)`
+	default:
+		condition += ` AND ` + countedInBalance
+	}
+	if !f.IncludeDeleted {
+		condition += ` AND deleted_at IS NULL`
+	}
+	if f.Channel != "" {
+		condition += fmt.Sprintf(` AND channel = $%d`, next+len(args))
+		args = append(args, f.Channel)
+	}
+	if !f.From.IsZero() {
+		condition += fmt.Sprintf(` AND created_at >= $%d`, next+len(args))
+		args = append(args, f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		condition += fmt.Sprintf(` AND created_at <= $%d`, next+len(args))
+		args = append(args, f.To.UTC())
+	}
+	return condition, args
+}
+
+func (t *TransactionRepository) GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter HistoryFilter) ([]Transaction, error) {
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	condition, args := filter.condition(4)
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE user_id = $1`+condition+` ORDER BY created_at DESC, sequence DESC LIMIT $2 OFFSET $3`,
+		append([]interface{}{userID, pageSize, (page - 1) * pageSize}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// GetUserTransactionHistoryByDay returns the user's transactions on a page
+// of the UTC days that have any, newest first. Pages count days rather than
+// transactions, so a day is never split across pages.
+func (t *TransactionRepository) GetUserTransactionHistoryByDay(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter HistoryFilter) ([]Transaction, error) {
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	// The filter applies to both the days and their transactions and shares
+	// its placeholders between them
+	condition, args := filter.condition(4)
+	rows, err := t.db.QueryContext(ctx, `WITH days AS (
+			SELECT DISTINCT date_trunc('day', created_at) AS day FROM transactions WHERE user_id = $1`+condition+`
+			ORDER BY day DESC LIMIT $2 OFFSET $3
+		)
+		SELECT `+transactionColumns+` FROM transactions
+		WHERE user_id = $1`+condition+` AND date_trunc('day', created_at) IN (SELECT day FROM days)
+		ORDER BY created_at DESC, sequence DESC`,
+		append([]interface{}{userID, pageSize, (page - 1) * pageSize}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+// CountUserTransactions returns how many of the user's transactions the
+// filter lets through
+func (t *TransactionRepository) CountUserTransactions(ctx context.Context, userID uuid.UUID, filter HistoryFilter) (int64, error) {
+	condition, args := filter.condition(2)
+	var count int64
+	err := t.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transactions WHERE user_id = $1`+condition, append([]interface{}{userID}, args...)...).Scan(&count)
+	return count, err
+}
+
+// EstimateUserTransactions returns the planner's estimate of how many of the
+// user's transactions the filter lets through. It comes from the table
+// statistics rather than a scan, so it is cheap on huge tables but only as
+// good as the last ANALYZE. The planner never estimates fewer than one row.
+func (t *TransactionRepository) EstimateUserTransactions(ctx context.Context, userID uuid.UUID, filter HistoryFilter) (int64, error) {
+	condition, args := filter.condition(2)
+	var plan []byte
+	err := t.db.QueryRowContext(ctx, `EXPLAIN (FORMAT JSON) SELECT 1 FROM transactions WHERE user_id = $1`+condition, append([]interface{}{userID}, args...)...).Scan(&plan)
+	if err != nil {
+		return 0, err
+	}
+
+	var explained []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &explained); err != nil {
+		return 0, err
+	}
+	if len(explained) == 0 {
+		return 0, errors.New("empty query plan")
+	}
+	return int64(explained[0].Plan.Rows), nil
+}
+
+// FindOrphanedTransactions returns up to limit transactions with IDs greater
+// than after, in ID order, whose user row doesn't exist. The foreign key
+// should make these impossible, so any found point at a data integrity
+// problem.
+func (t *TransactionRepository) FindOrphanedTransactions(ctx context.Context, after uuid.UUID, limit int) ([]Transaction, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE id > $1 AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = transactions.user_id)
+		ORDER BY id
+		LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+// HistoryCursor marks a position in a user's history by the creation time
+// and sequence of the last transaction seen. The zero cursor is the start.
+type HistoryCursor struct {
+	CreatedAt time.Time
+	Sequence  int64
+}
+
+// GetUserTransactionHistoryAfter returns up to limit of the user's
+// transactions that come after cursor, newest first by creation time and
+// sequence, in the same order as GetUserTransactionHistory.
+// Unlike offset pages, the next page doesn't shift when transactions are
+// added in the meantime.
+func (t *TransactionRepository) GetUserTransactionHistoryAfter(ctx context.Context, userID uuid.UUID, cursor HistoryCursor, limit int, filter HistoryFilter) ([]Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE user_id = $1`
+	args := []interface{}{userID, limit}
+	if cursor != (HistoryCursor{}) {
+		query += ` AND (created_at, sequence) < ($3, $4)`
+		args = append(args, cursor.CreatedAt.UTC(), cursor.Sequence)
+	}
+	condition, filterArgs := filter.condition(len(args) + 1)
+	query += condition + ` ORDER BY created_at DESC, sequence DESC LIMIT $2`
+
+	rows, err := t.db.QueryContext(ctx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+func (t *TransactionRepository) FindTransactionByIdempotencyKey(ctx context.Context, idempotencyKey uuid.UUID) (Transaction, error) {
+	// Once keys are released several transactions can share one; prefer the
+	// transaction still holding it, then the newest
+	row := t.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE idempotency_key = $1 ORDER BY key_released, created_at DESC LIMIT 1`, idempotencyKey)
+	return scanTransaction(row)
+}
+
+// StreamUserTransactions calls fn for every transaction of the user, newest
+// first, as rows are read from the database cursor. Nothing is buffered, so
+// it is suitable for exporting large histories. Streaming stops at the first
+// error returned by fn.
+func (t *TransactionRepository) StreamUserTransactions(ctx context.Context, userID uuid.UUID, filter HistoryFilter, fn func(Transaction) error) error {
+	condition, args := filter.condition(2)
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE user_id = $1`+condition+` ORDER BY created_at DESC, sequence DESC`, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// FindLargestTransaction returns the user's credit with the highest amount, or
+// for debits the one with the lowest (most negative) amount. Voided and
+// deleted transactions are left out. If the user has no transaction of that
+// type, ErrTransactionNotFound is returned.
+func (t *TransactionRepository) FindLargestTransaction(ctx context.Context, userID uuid.UUID, transactionType TransactionType) (Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE user_id = $1 AND amount > 0 AND ` + countedInBalance + ` AND deleted_at IS NULL ORDER BY amount DESC LIMIT 1`
+	if transactionType == TransactionTypeDebit {
+		query = `SELECT ` + transactionColumns + ` FROM transactions WHERE user_id = $1 AND amount < 0 AND ` + countedInBalance + ` AND deleted_at IS NULL ORDER BY amount ASC LIMIT 1`
+	}
+
+	transaction, err := scanTransaction(t.db.QueryRowContext(ctx, query, userID))
+	if err == sql.ErrNoRows {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	return transaction, err
+}
+
+// AverageAmount returns the mean amount of the user's transactions created in
+// [from, to) that count towards the balance, only credits or debits when
+// transactionType is set. Debits keep their negative sign. Zero is returned
+// when no transaction matches.
+func (t *TransactionRepository) AverageAmount(ctx context.Context, userID uuid.UUID, transactionType TransactionType, from time.Time, to time.Time) (decimal.Decimal, error) {
+	query := `SELECT COALESCE(AVG(amount), 0) FROM transactions WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND ` + countedInBalance
+	switch transactionType {
+	case TransactionTypeCredit:
+		query += ` AND amount > 0`
+	case TransactionTypeDebit:
+		query += ` AND amount < 0`
+	}
+
+	var average decimal.Decimal
+	err := t.db.QueryRowContext(ctx, query, userID, from, to).Scan(&average)
+	return average, err
+}
+
+// TransactionGaps summarizes the time between a user's consecutive
+// transactions, in seconds. Average and Max are null with fewer than two
+// transactions.
+type TransactionGaps struct {
+	Count   int64
+	Average sql.NullFloat64
+	Max     sql.NullFloat64
+}
+
+// FindTransactionGaps returns the average and longest time between the
+// user's consecutive transactions that count towards the balance, ordered by
+// creation time
+func (t *TransactionRepository) FindTransactionGaps(ctx context.Context, userID uuid.UUID) (TransactionGaps, error) {
+	var gaps TransactionGaps
+	err := t.db.QueryRowContext(ctx, `SELECT COUNT(*), AVG(gap), MAX(gap) FROM (
+			SELECT EXTRACT(EPOCH FROM created_at - LAG(created_at) OVER (ORDER BY created_at, sequence)) AS gap
+			FROM transactions
+			WHERE user_id = $1 AND `+countedInBalance+`
+		) gaps`, userID).
+		Scan(&gaps.Count, &gaps.Average, &gaps.Max)
+	return gaps, err
+}
+
+// DailyChange is the net amount a user's balance moved by on one UTC day
+type DailyChange struct {
+	Day    time.Time
+	Amount decimal.Decimal
+}
+
+// DailyNetChanges returns the net change of the user's balance for every day
+// in [from, to) with transactions that count towards it, oldest first. Days
+// without any are left out.
+func (t *TransactionRepository) DailyNetChanges(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time) ([]DailyChange, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT date_trunc('day', created_at) AS day, SUM(amount)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND `+countedInBalance+`
+		GROUP BY day
+		ORDER BY day`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []DailyChange{}
+	for rows.Next() {
+		var change DailyChange
+		if err := rows.Scan(&change.Day, &change.Amount); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
+
+// FindTransactionHoldingKey returns the user's transaction that still holds
+// the idempotency key, the one a new transaction of the user with the same
+// key conflicts with whatever its amount. If there is none,
+// ErrTransactionNotFound is returned.
+func (t *TransactionRepository) FindTransactionHoldingKey(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID) (Transaction, error) {
+	row := t.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE user_id = $1 AND idempotency_key = $2 AND NOT key_released`, userID, idempotencyKey)
+	transaction, err := scanTransaction(row)
+	if err == sql.ErrNoRows {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	return transaction, err
+}
+
+// FindRecentDuplicate returns the user's latest transaction with the given
+// amount created at or after since, leaving voided ones out. If there is
+// none, ErrTransactionNotFound is returned.
+func (t *TransactionRepository) FindRecentDuplicate(ctx context.Context, userID uuid.UUID, amount decimal.Decimal, since time.Time) (Transaction, error) {
+	row := t.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE user_id = $1 AND amount = $2 AND created_at >= $3 AND `+countedInBalance+` ORDER BY created_at DESC LIMIT 1`, userID, amount, since)
+	transaction, err := scanTransaction(row)
+	if err == sql.ErrNoRows {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	return transaction, err
+}
+
+// IdempotencyKeyUsage is an idempotency key together with the transactions
+// of a user that were written with it
+type IdempotencyKeyUsage struct {
+	Key            uuid.UUID
+	TransactionIDs []uuid.UUID
+	// FirstUsedAt is the creation time of the key's oldest transaction
+	FirstUsedAt time.Time
+}
+
+// FindUserIdempotencyKeys returns a page of the distinct idempotency keys of
+// the user's transactions created in [from, to), in the order they were first
+// used, each with its transactions oldest first
+func (t *TransactionRepository) FindUserIdempotencyKeys(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time, page int, pageSize int) ([]IdempotencyKeyUsage, error) {
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	rows, err := t.db.QueryContext(ctx, `SELECT idempotency_key, array_agg(id::text ORDER BY created_at, sequence), MIN(created_at)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		GROUP BY idempotency_key
+		ORDER BY MIN(created_at), idempotency_key
+		LIMIT $4 OFFSET $5`, userID, from, to, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := []IdempotencyKeyUsage{}
+	for rows.Next() {
+		var usage IdempotencyKeyUsage
+		var transactionIDs pq.StringArray
+		if err := rows.Scan(&usage.Key, &transactionIDs, &usage.FirstUsedAt); err != nil {
+			return nil, err
+		}
+		for _, id := range transactionIDs {
+			transactionID, err := uuid.Parse(id)
+			if err != nil {
+				return nil, err
+			}
+			usage.TransactionIDs = append(usage.TransactionIDs, transactionID)
+		}
+		usages = append(usages, usage)
+	}
+
+	return usages, rows.Err()
+}
+
+// SumSince returns the total absolute amount of the user's transactions of
+// the given type created at or after since
+func (t *TransactionRepository) SumSince(ctx context.Context, userID uuid.UUID, since time.Time, transactionType TransactionType) (decimal.Decimal, error) {
+	query := `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND created_at >= $2 AND amount > 0 AND ` + countedInBalance
+	if transactionType == TransactionTypeDebit {
+		query = `SELECT COALESCE(SUM(-amount), 0) FROM transactions WHERE user_id = $1 AND created_at >= $2 AND amount < 0 AND ` + countedInBalance
+	}
+
+	var sum decimal.Decimal
+	err := t.db.QueryRowContext(ctx, query, userID, since).Scan(&sum)
+	return sum, err
+}
+
+// FindUserTransactionsBetween returns the user's transactions created in
+// [from, to), oldest first
+func (t *TransactionRepository) FindUserTransactionsBetween(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time) ([]Transaction, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 ORDER BY created_at, sequence`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+// BalanceBefore returns the user's balance as it stood just before the given
+// time, summing every transaction created earlier that counts towards it
+func (t *TransactionRepository) BalanceBefore(ctx context.Context, userID uuid.UUID, before time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND created_at < $2 AND `+countedInBalance, userID, before).Scan(&balance)
+	return balance, err
+}
+
+// BalanceAsOf returns the user's balance as it stood at the given time,
+// summing every transaction created at or before it that counts towards it
+func (t *TransactionRepository) BalanceAsOf(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND created_at <= $2 AND `+countedInBalance, userID, at.UTC()).Scan(&balance)
+	return balance, err
+}
+
+// BalanceExcludingReasonCode returns the user's balance summed from every
+// transaction that counts towards it, leaving out those with the reason code
+func (t *TransactionRepository) BalanceExcludingReasonCode(ctx context.Context, userID uuid.UUID, reasonCode string) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND reason_code <> $2 AND `+countedInBalance, userID, reasonCode).Scan(&balance)
+	return balance, err
+}
+
+// RefundTransaction adds refund as a compensating transaction for part or
+// all of the transaction it reverses. The refund amount is given as a positive
+// magnitude and booked with the opposite sign of the original. Refunds that
+// aren't voided add up, and one that would take them past the original amount
+// returns ErrRefundExceedsOriginal. Refunding a voided transaction returns
+// ErrTransactionAlreadyVoided, and a refund of a credit the user can't cover
+// ErrInsufficientFunds.
+func (t *TransactionRepository) RefundTransaction(ctx context.Context, refund Transaction) (Transaction, error) {
+	return t.addCompensation(ctx, refund, func(original Transaction, refunded decimal.Decimal, refund *Transaction) error {
+		if refunded.Abs().Add(refund.Amount).GreaterThan(original.Amount.Abs()) {
+			return ErrRefundExceedsOriginal
+		}
+		if original.Amount.IsPositive() {
+			refund.Amount = refund.Amount.Neg()
+		}
+		return nil
+	})
+}
+
+// ReverseTransaction adds reversal as a compensating transaction for the
+// whole of the transaction it reverses, with the negated amount and the
+// original's reason code. A transaction that was already reversed or
+// refunded returns ErrAlreadyReversed, a voided one
+// ErrTransactionAlreadyVoided and a credit the user can't cover
+// ErrInsufficientFunds.
+func (t *TransactionRepository) ReverseTransaction(ctx context.Context, reversal Transaction) (Transaction, error) {
+	return t.addCompensation(ctx, reversal, func(original Transaction, compensated decimal.Decimal, reversal *Transaction) error {
+		if !compensated.IsZero() {
+			return ErrAlreadyReversed
+		}
+		reversal.Amount = original.Amount.Neg()
+		reversal.ReasonCode = original.ReasonCode
+		return nil
+	})
+}
+
+// addCompensation books compensation against the transaction named by its
+// ReversesID. With the user and the original locked, prepare is given the
+// original and the sum of the compensations it already has that aren't
+// voided, and fills in the compensation or returns why it can't be booked.
+// Holding the original's row keeps concurrent compensations of it from both
+// passing prepare. A compensation taking money back out of the balance is
+// held to the user's funds like any other debit, after the hold on the
+// original credit was cut down to what is left of the credit.
+func (t *TransactionRepository) addCompensation(ctx context.Context, compensation Transaction, prepare func(original Transaction, compensated decimal.Decimal, compensation *Transaction) error) (Transaction, error) {
+	original, err := t.FindTransactionByID(ctx, compensation.ReversesID.UUID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	// Lock the user before the original, in the same order as
+	// VoidTransaction
+	currentBalance, err := lockUserBalance(ctx, tx, original.UserID)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT status FROM transactions WHERE id = $1 FOR UPDATE", original.ID).Scan(&original.Status)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+	if original.Status == TransactionStatusVoided {
+		tx.Rollback()
+		return Transaction{}, ErrTransactionAlreadyVoided
+	}
+
+	var compensated decimal.Decimal
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = $1 AND "+countedInBalance, original.ID).Scan(&compensated)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+	if err = prepare(original, compensated, &compensation); err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	compensation.UserID = original.UserID
+	compensation.Currency = original.Currency
+
+	// A hold can't hold back more of a credit than is left of it once
+	// compensated, so compensating all of it releases the hold, as voiding
+	// does
+	if original.Amount.IsPositive() {
+		remaining := original.Amount.Add(compensated).Add(compensation.Amount)
+		_, err = tx.ExecContext(ctx, "UPDATE balance_holds SET amount = LEAST(amount, $2), released = $2 <= 0 WHERE transaction_id = $1 AND NOT released", original.ID, remaining)
+		if err != nil {
+			tx.Rollback()
+			return Transaction{}, err
+		}
+	}
+
+	if err = checkFunds(ctx, tx, compensation, currentBalance); err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	compensation, err = t.insertTransaction(ctx, tx, compensation, currentBalance)
+	if err != nil {
+		tx.Rollback()
+		return Transaction{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Transaction{}, err
+	}
+
+	return compensation, nil
+}
+
+// FindCompensations returns a page of the refunds and reversals of a
+// transaction, voided ones included, oldest first
+func (t *TransactionRepository) FindCompensations(ctx context.Context, transactionID uuid.UUID, page int, pageSize int) ([]Transaction, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE reverses_id = $1 ORDER BY created_at, sequence LIMIT $2 OFFSET $3`, transactionID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+// CompensationTotals returns how many refunds and reversals a transaction
+// has, voided ones included, and the sum of those that aren't voided
+func (t *TransactionRepository) CompensationTotals(ctx context.Context, transactionID uuid.UUID) (int64, decimal.Decimal, error) {
+	var count int64
+	var compensated decimal.Decimal
+	err := t.db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(amount) FILTER (WHERE `+countedInBalance+`), 0) FROM transactions WHERE reverses_id = $1`, transactionID).Scan(&count, &compensated)
+	return count, compensated, err
+}
+
+// BalanceBeforeTransaction returns the user's balance as it stood just before
+// the given transaction in history order, i.e. by creation time with the
+// sequence breaking ties
+func (t *TransactionRepository) BalanceBeforeTransaction(ctx context.Context, transaction Transaction) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND (created_at, sequence) < ($2, $3) AND `+countedInBalance, transaction.UserID, transaction.CreatedAt, transaction.Sequence).Scan(&balance)
+	return balance, err
+}
+
+// recomputeLockKey derives the advisory lock key of a user's chunked
+// recompute from the user ID passed as $1
+const recomputeLockKey = `hashtextextended($1::text, 0)`
+
+// waitForRecompute takes the user's recompute advisory lock until the end of
+// tx. Writes that change whether existing rows count towards the balance take
+// it before locking the user row, so they can't slip in behind a chunked
+// recompute that has already summed those rows.
+func waitForRecompute(ctx context.Context, tx *sql.Tx, userID uuid.UUID) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(`+recomputeLockKey+`)`, userID)
+	return err
+}
+
+// RecomputeBalanceChunked does the same as RecomputeBalance without holding
+// the user row lock while it reads the whole history. The transactions up to
+// a sequence watermark are summed chunkSize rows at a time, in short
+// statements, while inserts carry on. Only the final step locks the user row,
+// adds the rows inserted past the watermark in the meantime and writes the
+// balance. An advisory lock keeps voids, which would change rows already
+// summed, out until the recompute is done. It returns the stored balance from
+// before and after the recompute.
+func (t *TransactionRepository) RecomputeBalanceChunked(ctx context.Context, userID uuid.UUID, chunkSize int) (decimal.Decimal, decimal.Decimal, error) {
+	if chunkSize <= 0 {
+		return t.RecomputeBalance(ctx, userID)
+	}
+
+	// Session level advisory locks belong to a connection, so keep one
+	conn, err := t.db.Conn(ctx)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock(`+recomputeLockKey+`)`, userID); err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(`+recomputeLockKey+`)`, userID)
+
+	var watermark int64
+	err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(sequence), 0) FROM transactions WHERE user_id = $1", userID).Scan(&watermark)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	sum := decimal.Zero
+	for after := int64(0); after < watermark; {
+		var chunkSum decimal.Decimal
+		var last int64
+		err = conn.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount) FILTER (WHERE `+countedInBalance+`), 0), MAX(sequence)
+			FROM (SELECT amount, status, sequence FROM transactions
+				WHERE user_id = $1 AND sequence > $2 AND sequence <= $3
+				ORDER BY sequence LIMIT $4) AS chunk`,
+			userID, after, watermark, chunkSize).Scan(&chunkSum, &last)
+		if err != nil {
+			return decimal.Decimal{}, decimal.Decimal{}, err
+		}
+		sum = sum.Add(chunkSum)
+		after = last
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	var previous decimal.Decimal
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, ErrUserNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	// Rows inserted while the chunks were summed
+	var tail decimal.Decimal
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = $1 AND sequence > $2 AND "+countedInBalance, userID, watermark).Scan(&tail)
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	balance := sum.Add(tail)
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, balance_dirty = FALSE, version = version + 1 WHERE id = $2", balance, userID)
+	if err != nil {
+		tx.Rollback()
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+
+	return previous, balance, nil
 }
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -10,6 +12,7 @@ import (
 	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -149,6 +152,14 @@ func TestAddTransaction_AlreadyExistingTransaction_Success(t *testing.T) {
 	})
 	assert.Error(t, err, "should return error when adding transaction with existing id")
 }
+func TestIsUniqueViolation(t *testing.T) {
+	assert.True(t, IsUniqueViolation(&pq.Error{Code: "23505", Message: "doppelter Schlüsselwert verletzt Unique-Constraint"}))
+	assert.True(t, IsUniqueViolation(fmt.Errorf("insert: %w", &pq.Error{Code: "23505"})))
+	assert.False(t, IsUniqueViolation(&pq.Error{Code: "23503", Message: "duplicate key value violates unique constraint"}))
+	assert.False(t, IsUniqueViolation(errors.New("duplicate key value violates unique constraint")))
+	assert.False(t, IsUniqueViolation(nil))
+}
+
 func TestAddTransaction_SingleUser_Concurrent(t *testing.T) {
 	// Assign
 	testEnv, err := utils.CreateTestEnv()
@@ -347,7 +358,7 @@ func TestGetUserTransactionHistory_MultipleTransaction_Success(t *testing.T) {
 		},
 	})
 
-	actualTransactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId, 1, 10)
+	actualTransactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId, 1, 10, HistoryFilter{})
 	if err != nil {
 		t.Fatalf("failed to get user transaction history: %v", err)
 	}
@@ -471,12 +482,12 @@ func TestGetUserTransactionHistory_MultipleTransactionAndMultipleUser_Success(t
 		},
 	})
 
-	actualTransactions1, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId1, 1, 10)
+	actualTransactions1, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId1, 1, 10, HistoryFilter{})
 	if err != nil {
 		t.Fatalf("failed to get user transaction history: %v", err)
 	}
 
-	actualTransactions2, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId2, 1, 10)
+	actualTransactions2, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId2, 1, 10, HistoryFilter{})
 	if err != nil {
 		t.Fatalf("failed to get user transaction history: %v", err)
 	}
@@ -545,7 +556,7 @@ func TestGetUserTransactionHistory_MultiplePages(t *testing.T) {
 
 	// Act and Assert
 	for pageNum := 1; pageNum <= (numTransactions / pageSize); pageNum++ {
-		transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, pageNum, pageSize)
+		transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, pageNum, pageSize, HistoryFilter{})
 		assert.NoError(t, err)
 		assert.Len(t, transactions, pageSize)
 
@@ -567,7 +578,7 @@ func TestGetUserTransactionHistory_EmptyResult_Success(t *testing.T) {
 	transactionRepository := NewTransactionRepository(testEnv.DB)
 
 	// Act
-	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, uuid.New(), 1, 10)
+	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, uuid.New(), 1, 10, HistoryFilter{})
 
 	// Assert
 	assert.NoError(t, err)
@@ -585,7 +596,7 @@ func TestGetUserTransactionHistory_InvalidUserID_Success(t *testing.T) {
 	transactionRepository := NewTransactionRepository(testEnv.DB)
 
 	// Act
-	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, uuid.New(), 1, 10)
+	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, uuid.New(), 1, 10, HistoryFilter{})
 
 	// Assert
 	assert.NoError(t, err)
@@ -629,7 +640,7 @@ func TestGetUserTransactionHistory_InvalidPageAndInvalidPageSize_Error(t *testin
 	}
 
 	// Act and Assert
-	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, -1, -1)
+	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, -1, -1, HistoryFilter{})
 	assert.NoError(t, err)
 	assert.Equal(t, 10, len(transactions))
 
@@ -676,7 +687,7 @@ func TestGetUserTransactionHistory_SingleTransaction_Success(t *testing.T) {
 		},
 	})
 
-	actualTransactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId, 1, 10)
+	actualTransactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, userId, 1, 10, HistoryFilter{})
 	if err != nil {
 		t.Fatalf("failed to get user transaction history: %v", err)
 	}
@@ -839,6 +850,160 @@ func TestGetUserBalance_InvalidUserID_Error(t *testing.T) {
 	assert.Equal(t, ErrUserNotFound, err)
 }
 
+func TestAddTransaction_Sequence_ContiguousUnderConcurrency(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+
+	user := User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = userRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	numTransactions := 100
+
+	// Act
+	var wg sync.WaitGroup
+	wg.Add(numTransactions)
+
+	for i := 0; i < numTransactions; i++ {
+		go func() {
+			defer wg.Done()
+
+			_, err := transactionRepository.AddTransaction(testEnv.Context, Transaction{
+				ID:             uuid.New(),
+				UserID:         user.ID,
+				Amount:         decimal.NewFromFloat(1),
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			if err != nil {
+				t.Errorf("failed to add transaction: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Assert
+	transactions, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, 1, numTransactions, HistoryFilter{})
+	if err != nil {
+		t.Fatalf("failed to get transactions: %v", err)
+	}
+	assert.Equal(t, numTransactions, len(transactions))
+
+	sequences := make([]int64, 0, len(transactions))
+	for _, transaction := range transactions {
+		sequences = append(sequences, transaction.Sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	for i, sequence := range sequences {
+		assert.Equal(t, int64(i+1), sequence, "sequences should be contiguous starting at 1")
+	}
+}
+
+func TestRecomputeBalanceChunked_ConcurrentInserts(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+
+	user := User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = userRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		_, err = transactionRepository.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(1),
+			CreatedAt:      time.Now(),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	// Knock the stored balance out so the recompute has something to fix
+	_, err = testEnv.DB.Exec("UPDATE users SET balance = balance + 1000 WHERE id = $1", user.ID)
+	if err != nil {
+		t.Fatalf("failed to corrupt balance: %v", err)
+	}
+
+	numConcurrent := 50
+
+	// Act
+	var wg sync.WaitGroup
+	wg.Add(numConcurrent + 1)
+
+	go func() {
+		defer wg.Done()
+
+		_, _, err := transactionRepository.RecomputeBalanceChunked(testEnv.Context, user.ID, 7)
+		if err != nil {
+			t.Errorf("failed to recompute balance: %v", err)
+		}
+	}()
+
+	for i := 0; i < numConcurrent; i++ {
+		go func() {
+			defer wg.Done()
+
+			_, err := transactionRepository.AddTransaction(testEnv.Context, Transaction{
+				ID:             uuid.New(),
+				UserID:         user.ID,
+				Amount:         decimal.NewFromFloat(1),
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			if err != nil {
+				t.Errorf("failed to add transaction: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Assert
+	// Inserts committed before the final write are picked up past the
+	// watermark and later ones build on the corrected balance, so the stored
+	// balance matches the ledger either way
+	var sum decimal.Decimal
+	err = testEnv.DB.QueryRow("SELECT SUM(amount) FROM transactions WHERE user_id = $1", user.ID).Scan(&sum)
+	if err != nil {
+		t.Fatalf("failed to sum transactions: %v", err)
+	}
+	assert.True(t, sum.Equal(decimal.NewFromInt(100)))
+
+	stored, err := userRepository.FindByID(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to find user: %v", err)
+	}
+	assert.True(t, stored.Balance.Equal(sum))
+}
+
 func createTransactions(testEnv utils.TestEnv, transactionRepository *TransactionRepository, transactions []Transaction) error {
 	for i := range transactions {
 		_, err := transactionRepository.AddTransaction(testEnv.Context, transactions[i])
@@ -856,3 +1021,445 @@ func transactionsEqual(a, b Transaction) bool {
 		a.CreatedAt.Equal(b.CreatedAt) &&
 		a.IdempotencyKey == b.IdempotencyKey
 }
+
+func TestSoftDelete_LeavesBalanceAndHistory(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+
+	user := User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = userRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	var transactions []Transaction
+	for _, amount := range []float64{100, 20, 5} {
+		transaction, err := transactionRepository.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(amount),
+			CreatedAt:      time.Now(),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	_, err = transactionRepository.VoidTransaction(testEnv.Context, transactions[2].ID)
+	if err != nil {
+		t.Fatalf("failed to void transaction: %v", err)
+	}
+
+	// Act
+	deletedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	deleted, deleteErr := transactionRepository.SoftDelete(testEnv.Context, transactions[1].ID, deletedAt)
+	_, voidedDeleteErr := transactionRepository.SoftDelete(testEnv.Context, transactions[2].ID, deletedAt)
+	_, againErr := transactionRepository.SoftDelete(testEnv.Context, transactions[1].ID, deletedAt)
+
+	// Assert
+	assert.NoError(t, deleteErr)
+	if assert.NotNil(t, deleted.DeletedAt) {
+		assert.True(t, deletedAt.Equal(*deleted.DeletedAt), "got %s", deleted.DeletedAt)
+	}
+	assert.Equal(t, TransactionStatusVoided, deleted.Status)
+	assert.NoError(t, voidedDeleteErr, "a voided transaction can still be deleted")
+	assert.ErrorIs(t, againErr, ErrTransactionDeleted)
+
+	// Deleting the voided transaction didn't take its amount out twice
+	stored, err := userRepository.FindByID(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	assert.True(t, stored.Balance.Equal(decimal.NewFromFloat(100)), "got %s", stored.Balance)
+
+	history, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, HistoryFilter{IncludeVoided: true})
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, transactions[0].ID, history[0].ID)
+	}
+
+	history, err = transactionRepository.GetUserTransactionHistory(testEnv.Context, user.ID, 1, 10, HistoryFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	assert.Len(t, history, 3)
+	for _, transaction := range history {
+		assert.Equal(t, transaction.ID != transactions[0].ID, transaction.DeletedAt != nil)
+	}
+}
+
+func TestCreateTransfer_RetryAfterCrashBetweenLegs(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+	transferRepository := NewTransferRepository(testEnv.DB, transactionRepository)
+
+	sender := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []User{sender, receiver} {
+		err = userRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	_, err = transactionRepository.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(100),
+		CreatedAt:      time.Now(),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// The process died after the sender's leg was written, before the
+	// receiver's leg and the transfer record
+	idempotencyKey := uuid.New()
+	debit, err := transactionRepository.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(-40),
+		CreatedAt:      time.Now(),
+		IdempotencyKey: idempotencyKey,
+		TransferLeg:    TransferLegDebit,
+	})
+	if err != nil {
+		t.Fatalf("failed to add debit leg: %v", err)
+	}
+
+	retry := func() (Transfer, error) {
+		return transferRepository.CreateTransfer(testEnv.Context, Transfer{
+			ID:             uuid.New(),
+			FromUserID:     sender.ID,
+			ToUserID:       receiver.ID,
+			Amount:         decimal.NewFromFloat(40),
+			IdempotencyKey: idempotencyKey,
+			CreatedAt:      time.Now(),
+		}, false)
+	}
+
+	// Act
+	finished, finishErr := retry()
+	replayed, replayErr := retry()
+	_, otherErr := transferRepository.CreateTransfer(testEnv.Context, Transfer{
+		ID:             uuid.New(),
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         decimal.NewFromFloat(10),
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}, false)
+
+	// Assert
+	assert.NoError(t, finishErr)
+	assert.False(t, finished.Replayed)
+	assert.Equal(t, TransferStatusSettled, finished.Status)
+	assert.Equal(t, debit.ID, finished.DebitTransactionID, "the debit leg already written is reused")
+	assert.True(t, finished.CreditTransactionID.Valid)
+
+	assert.NoError(t, replayErr)
+	assert.True(t, replayed.Replayed)
+	assert.Equal(t, finished.ID, replayed.ID)
+	assert.Equal(t, finished.CreditTransactionID, replayed.CreditTransactionID)
+
+	assert.ErrorIs(t, otherErr, ErrIdempotencyKeyTaken)
+
+	// Each user got exactly one leg and the money moved once
+	for _, expected := range []struct {
+		userID  uuid.UUID
+		balance float64
+		legs    int
+	}{
+		{sender.ID, 60, 1},
+		{receiver.ID, 40, 1},
+	} {
+		stored, err := userRepository.FindByID(testEnv.Context, expected.userID)
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		assert.True(t, stored.Balance.Equal(decimal.NewFromFloat(expected.balance)), "got %s", stored.Balance)
+
+		history, err := transactionRepository.GetUserTransactionHistory(testEnv.Context, expected.userID, 1, 10, HistoryFilter{})
+		if err != nil {
+			t.Fatalf("failed to get history: %v", err)
+		}
+		legs := 0
+		for _, transaction := range history {
+			if transaction.IdempotencyKey == idempotencyKey {
+				legs++
+			}
+		}
+		assert.Equal(t, expected.legs, legs)
+	}
+}
+
+func TestFinishTransfer_DebitLegNotPending(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+	transferRepository := NewTransferRepository(testEnv.DB, transactionRepository)
+
+	sender := User{ID: uuid.New(), Balance: decimal.NewFromFloat(100)}
+	receiver := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []User{sender, receiver} {
+		err = userRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	transfer, err := transferRepository.CreateTransfer(testEnv.Context, Transfer{
+		ID:             uuid.New(),
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         decimal.NewFromFloat(40),
+		IdempotencyKey: uuid.New(),
+		CreatedAt:      time.Now(),
+	}, true)
+	if err != nil {
+		t.Fatalf("failed to reserve transfer: %v", err)
+	}
+
+	// The debit leg was voided behind the transfer's back
+	_, err = testEnv.DB.ExecContext(testEnv.Context, "UPDATE transactions SET status = $1 WHERE id = $2", TransactionStatusVoided, transfer.DebitTransactionID)
+	if err != nil {
+		t.Fatalf("failed to void debit leg: %v", err)
+	}
+
+	// Act
+	_, settleErr := transferRepository.SettleTransfer(testEnv.Context, transfer.ID, decimal.Zero, time.Time{})
+	_, cancelErr := transferRepository.CancelTransfer(testEnv.Context, transfer.ID)
+
+	// Assert
+	assert.ErrorIs(t, settleErr, ErrTransferNotPending)
+	assert.ErrorIs(t, cancelErr, ErrTransferNotPending)
+
+	stored, err := userRepository.FindByID(testEnv.Context, receiver.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	assert.True(t, stored.Balance.IsZero(), "got %s", stored.Balance)
+}
+
+func TestAddTransaction_Outbox(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+	webhookRepository := NewWebhookRepository(testEnv.DB)
+
+	user := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = userRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	outbox := func(payloadErr error) *Outbox {
+		return &Outbox{
+			Delivery: WebhookDelivery{ID: uuid.New(), Event: "transaction.created", NextAttemptAt: time.Now(), CreatedAt: time.Now()},
+			Payload: func(added []Transaction) ([]byte, error) {
+				if payloadErr != nil {
+					return nil, payloadErr
+				}
+				return []byte(fmt.Sprintf(`{"id": %q, "sequence": %d}`, added[0].ID, added[0].Sequence)), nil
+			},
+		}
+	}
+	transaction := func(outbox *Outbox) Transaction {
+		return Transaction{
+			ID:             uuid.New(),
+			UserID:         user.ID,
+			Amount:         decimal.NewFromFloat(10),
+			CreatedAt:      time.Now(),
+			IdempotencyKey: uuid.New(),
+			Outbox:         outbox,
+		}
+	}
+
+	// Act
+	added, addErr := transactionRepository.AddTransaction(testEnv.Context, transaction(outbox(nil)))
+	failedPayload := errors.New("payload failed")
+	_, failedErr := transactionRepository.AddTransaction(testEnv.Context, transaction(outbox(failedPayload)))
+
+	// Assert
+	assert.NoError(t, addErr)
+	assert.ErrorIs(t, failedErr, failedPayload)
+
+	deliveries, err := webhookRepository.FindByStatus(testEnv.Context, "", 10)
+	if err != nil {
+		t.Fatalf("failed to get deliveries: %v", err)
+	}
+	if assert.Len(t, deliveries, 1, "the failed write should leave no delivery") {
+		assert.JSONEq(t, fmt.Sprintf(`{"id": %q, "sequence": %d}`, added.ID, added.Sequence), string(deliveries[0].Payload))
+	}
+
+	stored, err := userRepository.FindByID(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	assert.True(t, stored.Balance.Equal(decimal.NewFromFloat(10)), "the failed write should be rolled back, got %s", stored.Balance)
+}
+
+func TestCreateTransfer_KeyOfPlainTransaction(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+	transferRepository := NewTransferRepository(testEnv.DB, transactionRepository)
+
+	sender := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []User{sender, receiver} {
+		err = userRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	_, err = transactionRepository.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(100),
+		CreatedAt:      time.Now(),
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// A withdrawal that happens to share the key and amount of the transfer
+	idempotencyKey := uuid.New()
+	_, err = transactionRepository.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		UserID:         sender.ID,
+		Amount:         decimal.NewFromFloat(-40),
+		CreatedAt:      time.Now(),
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// Act
+	_, transferErr := transferRepository.CreateTransfer(testEnv.Context, Transfer{
+		ID:             uuid.New(),
+		FromUserID:     sender.ID,
+		ToUserID:       receiver.ID,
+		Amount:         decimal.NewFromFloat(40),
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}, false)
+
+	// Assert
+	assert.True(t, IsUniqueViolation(transferErr), "the withdrawal must not be taken for the debit leg, got %v", transferErr)
+
+	stored, err := userRepository.FindByID(testEnv.Context, receiver.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	assert.True(t, stored.Balance.IsZero(), "the receiver must not be credited, got %s", stored.Balance)
+}
+
+func TestCreateTransfer_SameKeyDifferentSenders(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	userRepository := NewUserRepository(testEnv.DB)
+	transactionRepository := NewTransactionRepository(testEnv.DB)
+	transferRepository := NewTransferRepository(testEnv.DB, transactionRepository)
+
+	senders := []User{
+		{ID: uuid.New(), Balance: decimal.NewFromFloat(0)},
+		{ID: uuid.New(), Balance: decimal.NewFromFloat(0)},
+	}
+	receiver := User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range append(senders, receiver) {
+		err = userRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+	for _, sender := range senders {
+		_, err = transactionRepository.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			UserID:         sender.ID,
+			Amount:         decimal.NewFromFloat(100),
+			CreatedAt:      time.Now(),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	// Act
+	// Both senders pick the same key for a transfer to the same receiver
+	idempotencyKey := uuid.New()
+	var transfers []Transfer
+	for _, sender := range senders {
+		transfer, err := transferRepository.CreateTransfer(testEnv.Context, Transfer{
+			ID:             uuid.New(),
+			FromUserID:     sender.ID,
+			ToUserID:       receiver.ID,
+			Amount:         decimal.NewFromFloat(40),
+			IdempotencyKey: idempotencyKey,
+			CreatedAt:      time.Now(),
+		}, false)
+		assert.NoError(t, err)
+		transfers = append(transfers, transfer)
+	}
+
+	// Assert
+	if assert.Len(t, transfers, 2) {
+		assert.NotEqual(t, transfers[0].ID, transfers[1].ID)
+		assert.False(t, transfers[1].Replayed, "another sender's transfer must not be replayed")
+	}
+
+	stored, err := userRepository.FindByID(testEnv.Context, receiver.ID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	assert.True(t, stored.Balance.Equal(decimal.NewFromFloat(80)), "got %s", stored.Balance)
+}
@@ -0,0 +1,500 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// TransferStatus tracks a transfer through its two phases
+type TransferStatus string
+
+const (
+	// TransferStatusPending means the sender has been debited but the
+	// receiver not yet credited
+	TransferStatusPending   TransferStatus = "pending"
+	TransferStatusSettled   TransferStatus = "settled"
+	TransferStatusCancelled TransferStatus = "cancelled"
+)
+
+// TransferLeg tells the two transactions of a transfer apart
+type TransferLeg string
+
+const (
+	TransferLegDebit  TransferLeg = "debit"
+	TransferLegCredit TransferLeg = "credit"
+)
+
+var (
+	ErrTransferNotFound   = errors.New("transfer not found")
+	ErrTransferNotPending = errors.New("transfer is not pending")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+)
+
+// Transfer moves an amount from one user to another through two ledger rows,
+// a debit on the sender and a credit on the receiver
+type Transfer struct {
+	ID             uuid.UUID
+	FromUserID     uuid.UUID
+	ToUserID       uuid.UUID
+	Amount         decimal.Decimal
+	IdempotencyKey uuid.UUID
+	Status         TransferStatus
+	CreatedAt      time.Time
+	// DebitTransactionID is the sender's leg
+	DebitTransactionID uuid.UUID
+	// CreditTransactionID is the receiver's leg, written on settlement
+	CreditTransactionID uuid.NullUUID
+	// CreditAmount is what the receiver is credited, Amount when it is null.
+	// It differs from Amount when the receiver's account is in another
+	// currency than the sender's, converted at ExchangeRate, the price of
+	// one unit of the sender's currency in the receiver's. ExchangeRate is
+	// null for transfers that weren't converted.
+	CreditAmount decimal.NullDecimal
+	ExchangeRate decimal.NullDecimal
+	// FromUserVersion and ToUserVersion are the users' versions after a
+	// write. They are only set on the result of a write.
+	FromUserVersion int64
+	ToUserVersion   int64
+	// Replayed is set when CreateTransfer found the transfer already written
+	// under its idempotency key and returned it instead
+	Replayed bool
+	// AllowOverdraft and OverdraftTolerance relax the check of the sender's
+	// funds like those of a Transaction. They aren't stored.
+	AllowOverdraft     bool
+	OverdraftTolerance decimal.Decimal
+	// CreditHoldAmount is the part of the receiver's leg held back from the
+	// available balance until CreditHoldUntil, none when zero. It isn't
+	// stored with the transfer, the hold is stored on its own.
+	CreditHoldAmount decimal.Decimal
+	CreditHoldUntil  time.Time
+}
+
+const transferColumns = `id, from_user_id, to_user_id, amount, idempotency_key, status, created_at, debit_transaction_id, credit_transaction_id, credit_amount, exchange_rate`
+
+func scanTransfer(row rowScanner) (Transfer, error) {
+	var transfer Transfer
+	err := row.Scan(&transfer.ID,
+		&transfer.FromUserID,
+		&transfer.ToUserID,
+		&transfer.Amount,
+		&transfer.IdempotencyKey,
+		&transfer.Status,
+		&transfer.CreatedAt,
+		&transfer.DebitTransactionID,
+		&transfer.CreditTransactionID,
+		&transfer.CreditAmount,
+		&transfer.ExchangeRate)
+	return transfer, err
+}
+
+// Credited returns the amount the transfer credits the receiver with
+func (t Transfer) Credited() decimal.Decimal {
+	if t.CreditAmount.Valid {
+		return t.CreditAmount.Decimal
+	}
+	return t.Amount
+}
+
+// creditKey is the idempotency key of the receiver's leg. Transfer keys are
+// the sender's own, so the receiver's leg carries one derived from the key
+// and the sender, which two senders picking the same key can't share.
+func (t Transfer) creditKey() uuid.UUID {
+	return uuid.NewSHA1(t.IdempotencyKey, t.FromUserID[:])
+}
+
+type TransferRepository struct {
+	db           *sql.DB
+	transactions *TransactionRepository
+}
+
+func NewTransferRepository(db *sql.DB, transactions *TransactionRepository) *TransferRepository {
+	return &TransferRepository{db: db, transactions: transactions}
+}
+
+// FindTransferByID returns a transfer, or ErrTransferNotFound. Transfers
+// belong to the sender's tenant.
+func (r *TransferRepository) FindTransferByID(ctx context.Context, transferID uuid.UUID) (Transfer, error) {
+	condition, args := tenantCondition(ctx, "(SELECT tenant_id FROM users WHERE users.id = transfers.from_user_id)", 2)
+	transfer, err := scanTransfer(r.db.QueryRowContext(ctx, `SELECT `+transferColumns+` FROM transfers WHERE id = $1`+condition, append([]interface{}{transferID}, args...)...))
+	if err == sql.ErrNoRows {
+		return Transfer{}, ErrTransferNotFound
+	}
+	return transfer, err
+}
+
+// TransferDirection tells a user's sent transfers from their received ones
+type TransferDirection string
+
+const (
+	TransferDirectionSent     TransferDirection = "sent"
+	TransferDirectionReceived TransferDirection = "received"
+)
+
+// FindUserTransfers returns a page of the transfers the user sent or
+// received, newest first. An empty direction returns both.
+func (r *TransferRepository) FindUserTransfers(ctx context.Context, userID uuid.UUID, direction TransferDirection, page int, pageSize int) ([]Transfer, error) {
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	condition := `(from_user_id = $1 OR to_user_id = $1)`
+	switch direction {
+	case TransferDirectionSent:
+		condition = `from_user_id = $1`
+	case TransferDirectionReceived:
+		condition = `to_user_id = $1`
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT `+transferColumns+` FROM transfers WHERE `+condition+` ORDER BY created_at DESC, id LIMIT $2 OFFSET $3`, userID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
+
+// NetFlow returns the total of the settled transfers from one user to another
+// created in [from, to), less the total of those going the other way
+func (r *TransferRepository) NetFlow(ctx context.Context, fromUserID uuid.UUID, toUserID uuid.UUID, from time.Time, to time.Time) (decimal.Decimal, error) {
+	var net decimal.Decimal
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(CASE WHEN from_user_id = $1 THEN amount ELSE -amount END), 0)
+		FROM transfers
+		WHERE ((from_user_id = $1 AND to_user_id = $2) OR (from_user_id = $2 AND to_user_id = $1))
+			AND status = $3 AND created_at >= $4 AND created_at < $5`,
+		fromUserID, toUserID, TransferStatusSettled, from, to).Scan(&net)
+	return net, err
+}
+
+// CreateTransfer debits the sender and, unless pending is set, credits the
+// receiver in a single database transaction. A pending transfer only reserves
+// the amount on the sender until it is settled or cancelled. The sender's
+// funds are checked like those of a debit, see checkFunds: unless
+// AllowOverdraft is set, the available balance, without held credits, plus
+// the OverdraftTolerance must cover the amount, otherwise
+// ErrInsufficientFunds is returned and nothing is written.
+//
+// Idempotency keys are scoped to the sender. The transfer and the sender's
+// leg carry the key and the receiver's leg one derived from it. A retry of a
+// transfer that was written returns it, marked Replayed, and a retry of one
+// interrupted between its legs reuses the legs already written, so neither
+// leg is ever written twice. A key the sender already used for a different
+// transfer returns ErrIdempotencyKeyTaken.
+func (r *TransferRepository) CreateTransfer(ctx context.Context, transfer Transfer, pending bool) (Transfer, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	// Retries lock the same users, so they wait for each other and see what
+	// the one before them wrote
+	balances, err := lockUsers(ctx, tx, transfer.FromUserID, transfer.ToUserID)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	existing, err := scanTransfer(tx.QueryRowContext(ctx, `SELECT `+transferColumns+` FROM transfers WHERE from_user_id = $1 AND idempotency_key = $2`, transfer.FromUserID, transfer.IdempotencyKey))
+	switch {
+	case err == nil:
+		tx.Rollback()
+		if existing.ToUserID != transfer.ToUserID || !existing.Amount.Equal(transfer.Amount) {
+			return Transfer{}, ErrIdempotencyKeyTaken
+		}
+		existing.Replayed = true
+		return existing, nil
+	case err != sql.ErrNoRows:
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	debit, debitFound, err := findTransferLeg(ctx, tx, TransferLegDebit, transfer.FromUserID, transfer.IdempotencyKey, transfer.Amount.Neg())
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+	credit, creditFound, err := findTransferLeg(ctx, tx, TransferLegCredit, transfer.ToUserID, transfer.creditKey(), transfer.Credited())
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	// Once the receiver has been credited the transfer can't be held back
+	if creditFound {
+		pending = false
+	}
+
+	transfer.Status = TransferStatusSettled
+	debitStatus := TransactionStatusSettled
+	if pending {
+		transfer.Status = TransferStatusPending
+		debitStatus = TransactionStatusPending
+	}
+
+	if debitFound {
+		// The amount was taken from the sender when the leg was written
+		if debit.Status != debitStatus {
+			_, err = tx.ExecContext(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", debitStatus, debit.ID)
+			if err != nil {
+				tx.Rollback()
+				return Transfer{}, err
+			}
+		}
+	} else {
+		// Held credits can't be moved on yet
+		err = checkFunds(ctx, tx, Transaction{
+			UserID:             transfer.FromUserID,
+			Amount:             transfer.Amount.Neg(),
+			AllowOverdraft:     transfer.AllowOverdraft,
+			OverdraftTolerance: transfer.OverdraftTolerance,
+		}, balances[transfer.FromUserID])
+		if err != nil {
+			tx.Rollback()
+			return Transfer{}, err
+		}
+
+		debit, err = r.transactions.insertTransaction(ctx, tx, Transaction{
+			ID:             uuid.New(),
+			UserID:         transfer.FromUserID,
+			Amount:         transfer.Amount.Neg(),
+			CreatedAt:      transfer.CreatedAt,
+			IdempotencyKey: transfer.IdempotencyKey,
+			Status:         debitStatus,
+			TransferLeg:    TransferLegDebit,
+		}, balances[transfer.FromUserID])
+		if err != nil {
+			tx.Rollback()
+			return Transfer{}, err
+		}
+		transfer.FromUserVersion = debit.UserVersion
+	}
+	transfer.DebitTransactionID = debit.ID
+
+	if !pending {
+		if !creditFound {
+			credit, err = r.insertCredit(ctx, tx, transfer, balances[transfer.ToUserID])
+			if err != nil {
+				tx.Rollback()
+				return Transfer{}, err
+			}
+			transfer.ToUserVersion = credit.UserVersion
+		}
+		transfer.CreditTransactionID = uuid.NullUUID{UUID: credit.ID, Valid: true}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO transfers (`+transferColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		transfer.ID,
+		transfer.FromUserID,
+		transfer.ToUserID,
+		transfer.Amount,
+		transfer.IdempotencyKey,
+		transfer.Status,
+		transfer.CreatedAt,
+		transfer.DebitTransactionID,
+		transfer.CreditTransactionID,
+		transfer.CreditAmount,
+		transfer.ExchangeRate)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Transfer{}, err
+	}
+
+	return transfer, nil
+}
+
+// findTransferLeg returns the user's live leg of the given amount carrying a
+// transfer's idempotency key, if one was written. Only transactions written
+// as that leg of a transfer count, another transaction that happens to share
+// the key and amount is never taken for one. Voided legs don't count.
+func findTransferLeg(ctx context.Context, tx *sql.Tx, leg TransferLeg, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal) (Transaction, bool, error) {
+	found, err := scanTransaction(tx.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE transfer_leg = $1 AND user_id = $2 AND idempotency_key = $3 AND amount = $4 AND status <> $5 AND NOT key_released
+		ORDER BY sequence LIMIT 1`,
+		leg, userID, idempotencyKey, amount, TransactionStatusVoided))
+	if err == sql.ErrNoRows {
+		return Transaction{}, false, nil
+	}
+	if err != nil {
+		return Transaction{}, false, err
+	}
+	return found, true, nil
+}
+
+// SettleTransfer completes a pending transfer by crediting the receiver,
+// holding back holdAmount of the credit until holdUntil. Transfers that
+// aren't pending return ErrTransferNotPending.
+func (r *TransferRepository) SettleTransfer(ctx context.Context, transferID uuid.UUID, holdAmount decimal.Decimal, holdUntil time.Time) (Transfer, error) {
+	return r.finishTransfer(ctx, transferID, func(tx *sql.Tx, transfer Transfer, balances map[uuid.UUID]decimal.Decimal) (Transfer, error) {
+		transfer.CreditHoldAmount = holdAmount
+		transfer.CreditHoldUntil = holdUntil
+
+		_, err := tx.ExecContext(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", TransactionStatusSettled, transfer.DebitTransactionID)
+		if err != nil {
+			return Transfer{}, err
+		}
+
+		credit, err := r.insertCredit(ctx, tx, transfer, balances[transfer.ToUserID])
+		if err != nil {
+			return Transfer{}, err
+		}
+
+		transfer.Status = TransferStatusSettled
+		transfer.CreditTransactionID = uuid.NullUUID{UUID: credit.ID, Valid: true}
+		transfer.ToUserVersion = credit.UserVersion
+		return transfer, nil
+	})
+}
+
+// CancelTransfer voids the sender's leg of a pending transfer, giving the
+// reserved amount back. Transfers that aren't pending return
+// ErrTransferNotPending.
+func (r *TransferRepository) CancelTransfer(ctx context.Context, transferID uuid.UUID) (Transfer, error) {
+	return r.finishTransfer(ctx, transferID, func(tx *sql.Tx, transfer Transfer, balances map[uuid.UUID]decimal.Decimal) (Transfer, error) {
+		_, err := tx.ExecContext(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", TransactionStatusVoided, transfer.DebitTransactionID)
+		if err != nil {
+			return Transfer{}, err
+		}
+
+		transfer.FromUserVersion, err = updateBalance(ctx, tx, transfer.FromUserID, balances[transfer.FromUserID].Add(transfer.Amount), false)
+		if err != nil {
+			return Transfer{}, err
+		}
+
+		transfer.Status = TransferStatusCancelled
+		return transfer, nil
+	})
+}
+
+// finishTransfer locks a pending transfer, its pending debit leg and both its
+// users, applies finish and stores the resulting transfer status, all in one
+// database transaction.
+func (r *TransferRepository) finishTransfer(ctx context.Context, transferID uuid.UUID, finish func(*sql.Tx, Transfer, map[uuid.UUID]decimal.Decimal) (Transfer, error)) (Transfer, error) {
+	transfer, err := r.FindTransferByID(ctx, transferID)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	// Cancelling voids the sender's leg, so wait for any chunked recompute
+	// of the sender first
+	if err = waitForRecompute(ctx, tx, transfer.FromUserID); err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	// Users first, then the transfer, in the same order as CreateTransfer
+	balances, err := lockUsers(ctx, tx, transfer.FromUserID, transfer.ToUserID)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	transfer, err = scanTransfer(tx.QueryRowContext(ctx, `SELECT `+transferColumns+` FROM transfers WHERE id = $1 FOR UPDATE`, transferID))
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	if transfer.Status != TransferStatusPending {
+		tx.Rollback()
+		return Transfer{}, ErrTransferNotPending
+	}
+
+	// The sender's leg is locked too and must still be pending, so a leg
+	// changed outside the transfer isn't settled or voided a second time
+	var debitStatus TransactionStatus
+	err = tx.QueryRowContext(ctx, "SELECT status FROM transactions WHERE id = $1 FOR UPDATE", transfer.DebitTransactionID).Scan(&debitStatus)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+	if debitStatus != TransactionStatusPending {
+		tx.Rollback()
+		return Transfer{}, ErrTransferNotPending
+	}
+
+	transfer, err = finish(tx, transfer, balances)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE transfers SET status = $1, credit_transaction_id = $2 WHERE id = $3", transfer.Status, transfer.CreditTransactionID, transfer.ID)
+	if err != nil {
+		tx.Rollback()
+		return Transfer{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Transfer{}, err
+	}
+
+	return transfer, nil
+}
+
+func (r *TransferRepository) insertCredit(ctx context.Context, tx *sql.Tx, transfer Transfer, currentBalance decimal.Decimal) (Transaction, error) {
+	return r.transactions.insertTransaction(ctx, tx, Transaction{
+		ID:             uuid.New(),
+		UserID:         transfer.ToUserID,
+		Amount:         transfer.Credited(),
+		CreatedAt:      transfer.CreatedAt,
+		IdempotencyKey: transfer.creditKey(),
+		Status:         TransactionStatusSettled,
+		TransferLeg:    TransferLegCredit,
+		HoldAmount:     transfer.CreditHoldAmount,
+		HoldUntil:      transfer.CreditHoldUntil,
+	}, currentBalance)
+}
+
+// lockUsers locks the rows of the given users and returns their balances.
+// Rows are always locked in ID order so two transfers between the same users
+// in opposite directions can't deadlock.
+func lockUsers(ctx context.Context, tx *sql.Tx, userIDs ...uuid.UUID) (map[uuid.UUID]decimal.Decimal, error) {
+	ordered := append([]uuid.UUID(nil), userIDs...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].String() < ordered[j].String() })
+
+	balances := map[uuid.UUID]decimal.Decimal{}
+	for _, userID := range ordered {
+		if _, ok := balances[userID]; ok {
+			continue
+		}
+
+		balance, err := lockUserBalance(ctx, tx, userID)
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		balances[userID] = balance
+	}
+
+	return balances, nil
+}
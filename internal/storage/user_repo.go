@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
@@ -12,6 +13,26 @@ import (
 type User struct {
 	ID      uuid.UUID
 	Balance decimal.Decimal
+	// BalanceDirty is set when a transaction was recorded but the stored
+	// balance could not be updated, so Balance can't be trusted.
+	BalanceDirty bool
+	// ExternalID is the client's own identifier for the user, if any
+	ExternalID sql.NullString
+	// Version goes up by one with every change to the user's balance
+	Version int64
+	// Currency is the ISO 4217 code of the user's account, which Balance and
+	// the user's transactions are in. It is empty for accounts in the
+	// ledger's implicit currency.
+	Currency string
+	// CreatedAt is when the user was added. Add sets it to the current time
+	// when it is zero.
+	CreatedAt time.Time
+	// TenantID is the tenant the user and their transactions belong to,
+	// empty in single tenant deployments
+	TenantID string
+	// DisplayCurrency is the currency the user prefers to see their balance
+	// in, empty when they have no preference
+	DisplayCurrency string
 }
 
 type UserRepository struct {
@@ -25,10 +46,36 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 var ErrUserNotFound = errors.New("user not found")
 
 // FindByID returns a user by ID
-// If the user is not found, ErrUserNotFound is returned
+// If the user is not found, or belongs to another tenant than the one ctx is
+// scoped to, ErrUserNotFound is returned
 func (r *UserRepository) FindByID(ctx context.Context, id uuid.UUID) (User, error) {
+	condition, args := tenantCondition(ctx, "tenant_id", 2)
+	return r.findOne(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1"+condition, append([]interface{}{id}, args...)...)
+}
+
+// FindByExternalID returns the user with the given external ID
+// External IDs are only unique within a tenant, so the lookup is always
+// scoped to one: the tenant ctx is scoped to or, without one, the users that
+// have no tenant. If the user is not found there, ErrUserNotFound is returned
+func (r *UserRepository) FindByExternalID(ctx context.Context, externalID string) (User, error) {
+	if _, ok := TenantFromContext(ctx); !ok {
+		ctx = WithTenant(ctx, "")
+	}
+	condition, args := tenantCondition(ctx, "tenant_id", 2)
+	return r.findOne(ctx, "SELECT "+userColumns+" FROM users WHERE external_id = $1"+condition, append([]interface{}{externalID}, args...)...)
+}
+
+// userColumns is the column list scanUser expects, in order
+const userColumns = `id, balance, balance_dirty, external_id, version, currency, created_at, tenant_id, display_currency`
+
+func scanUser(row rowScanner) (User, error) {
 	var user User
-	err := r.db.QueryRowContext(ctx, "SELECT id, balance FROM users WHERE id = $1", id).Scan(&user.ID, &user.Balance)
+	err := row.Scan(&user.ID, &user.Balance, &user.BalanceDirty, &user.ExternalID, &user.Version, &user.Currency, &user.CreatedAt, &user.TenantID, &user.DisplayCurrency)
+	return user, err
+}
+
+func (r *UserRepository) findOne(ctx context.Context, query string, args ...interface{}) (User, error) {
+	user, err := scanUser(r.db.QueryRowContext(ctx, query, args...))
 
 	if err == sql.ErrNoRows {
 		return User{}, ErrUserNotFound
@@ -43,9 +90,156 @@ func (r *UserRepository) FindByID(ctx context.Context, id uuid.UUID) (User, erro
 
 // Add adds a new user to the database
 func (r *UserRepository) Add(ctx context.Context, u User) error {
-	_, err := r.db.ExecContext(ctx, "INSERT INTO users (id, balance) VALUES ($1, $2)", u.ID, u.Balance)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+	_, err := r.db.ExecContext(ctx, "INSERT INTO users (id, balance, external_id, currency, created_at, tenant_id) VALUES ($1, $2, $3, $4, $5, $6)", u.ID, u.Balance, u.ExternalID, u.Currency, u.CreatedAt, u.TenantID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// SetDisplayCurrency sets the currency the user's balance is shown in, empty
+// to clear it. ErrUserNotFound is returned for users of other tenants than
+// the one ctx is scoped to.
+func (r *UserRepository) SetDisplayCurrency(ctx context.Context, id uuid.UUID, currency string) error {
+	condition, args := tenantCondition(ctx, "tenant_id", 3)
+	result, err := r.db.ExecContext(ctx, "UPDATE users SET display_currency = $1 WHERE id = $2"+condition, append([]interface{}{currency, id}, args...)...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+var ErrUserCreationKeyNotFound = errors.New("user creation key not found")
+
+// UserCreationKey is the idempotency key a user was created with, along with
+// what the creation asked for, so a retry can be told from a reused key
+type UserCreationKey struct {
+	TenantID       string
+	IdempotencyKey uuid.UUID
+	UserID         uuid.UUID
+	InitialBalance decimal.Decimal
+	Currency       string
+}
+
+// FindCreationKey returns the tenant's user creation key, or
+// ErrUserCreationKeyNotFound
+func (r *UserRepository) FindCreationKey(ctx context.Context, tenantID string, idempotencyKey uuid.UUID) (UserCreationKey, error) {
+	key := UserCreationKey{TenantID: tenantID, IdempotencyKey: idempotencyKey}
+	err := r.db.QueryRowContext(ctx, "SELECT user_id, initial_balance, currency FROM user_creation_keys WHERE tenant_id = $1 AND idempotency_key = $2", tenantID, idempotencyKey).
+		Scan(&key.UserID, &key.InitialBalance, &key.Currency)
+	if err == sql.ErrNoRows {
+		return UserCreationKey{}, ErrUserCreationKeyNotFound
+	}
+	if err != nil {
+		return UserCreationKey{}, err
+	}
+	return key, nil
+}
+
+// ListIDs returns up to limit user IDs greater than after, in order, for
+// walking through all users in batches
+func (r *UserRepository) ListIDs(ctx context.Context, after uuid.UUID, limit int) ([]uuid.UUID, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT $2", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ListUsers returns up to limit users with IDs greater than after, in order,
+// for walking through all users in pages
+func (r *UserRepository) ListUsers(ctx context.Context, after uuid.UUID, limit int) ([]User, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users WHERE id > $1 ORDER BY id LIMIT $2", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// FindRecentUsers returns up to limit users, most recently created first
+func (r *UserRepository) FindRecentUsers(ctx context.Context, limit int) ([]User, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY created_at DESC, id LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// BalanceMismatch is a user whose stored balance differs from the sum of
+// their transactions
+type BalanceMismatch struct {
+	UserID          uuid.UUID
+	StoredBalance   decimal.Decimal
+	ComputedBalance decimal.Decimal
+}
+
+// FindBalanceMismatches scans users in ID order, starting after the given
+// user ID, and returns up to limit users whose stored balance doesn't match
+// the sum of their transactions
+func (r *UserRepository) FindBalanceMismatches(ctx context.Context, after uuid.UUID, limit int) ([]BalanceMismatch, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT u.id, u.balance::numeric, COALESCE(SUM(t.amount::numeric), 0)
+		FROM users u LEFT JOIN transactions t ON t.user_id = u.id AND t.`+countedInBalance+`
+		WHERE u.id > $1
+		GROUP BY u.id, u.balance
+		HAVING u.balance::numeric <> COALESCE(SUM(t.amount::numeric), 0)
+		ORDER BY u.id
+		LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := []BalanceMismatch{}
+	for rows.Next() {
+		var mismatch BalanceMismatch
+		if err := rows.Scan(&mismatch.UserID, &mismatch.StoredBalance, &mismatch.ComputedBalance); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+
+	return mismatches, rows.Err()
+}
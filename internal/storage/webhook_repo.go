@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookDeliveryStatus tracks whether a webhook event reached its endpoint
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery is an event waiting to be, or already, posted to the
+// webhook endpoint. Its ID is sent along so the endpoint can drop events it
+// has seen before.
+type WebhookDelivery struct {
+	ID      uuid.UUID
+	Event   string
+	Payload []byte
+	Status  WebhookDeliveryStatus
+	// Attempts counts the posts made so far, successful or not
+	Attempts  int
+	LastError string
+	// NextAttemptAt is when an undelivered event is due to be posted
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	DeliveredAt   sql.NullTime
+}
+
+type WebhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+const webhookDeliveryColumns = `id, event, payload, status, attempts, last_error, next_attempt_at, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := row.Scan(&delivery.ID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.LastError,
+		&delivery.NextAttemptAt,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt)
+	return delivery, err
+}
+
+// Outbox is a webhook delivery announcing a write. It is stored in the same
+// database transaction as the write, so the event is neither lost when the
+// process stops after the commit nor sent for a write that was rolled back.
+type Outbox struct {
+	// Delivery is stored pending, with the payload rendered by Payload
+	Delivery WebhookDelivery
+	// Payload renders the event from the transactions as they were written
+	Payload func(added []Transaction) ([]byte, error)
+}
+
+// writeOutbox stores the outbox's delivery for the added transactions in tx.
+// A nil outbox writes nothing.
+func writeOutbox(ctx context.Context, tx *sql.Tx, outbox *Outbox, added []Transaction) error {
+	if outbox == nil {
+		return nil
+	}
+	payload, err := outbox.Payload(added)
+	if err != nil {
+		return err
+	}
+	delivery := outbox.Delivery
+	delivery.Payload = payload
+	return insertWebhookDelivery(ctx, tx, delivery)
+}
+
+// Add stores a pending delivery, due at its NextAttemptAt
+func (w *WebhookRepository) Add(ctx context.Context, delivery WebhookDelivery) error {
+	return insertWebhookDelivery(ctx, w.db, delivery)
+}
+
+// execer is a connection pool or a database transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertWebhookDelivery stores a pending delivery
+func insertWebhookDelivery(ctx context.Context, db execer, delivery WebhookDelivery) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO webhook_deliveries (id, event, payload, status, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		delivery.ID,
+		delivery.Event,
+		string(delivery.Payload),
+		WebhookDeliveryPending,
+		delivery.NextAttemptAt,
+		delivery.CreatedAt)
+	return err
+}
+
+// FindByStatus returns up to limit deliveries with the given status, or of
+// any status when it is empty, newest first
+func (w *WebhookRepository) FindByStatus(ctx context.Context, status WebhookDeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE $1 = '' OR status = $1 ORDER BY created_at DESC, id LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// FindDue returns up to limit undelivered deliveries whose next attempt is
+// due at now, oldest due first
+func (w *WebhookRepository) FindDue(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE status <> $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at, id LIMIT $3`,
+		WebhookDeliveryDelivered, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkDelivered records a successful attempt
+func (w *WebhookRepository) MarkDelivered(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := w.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, last_error = '', delivered_at = $3 WHERE id = $1`,
+		id, WebhookDeliveryDelivered, at)
+	return err
+}
+
+// MarkFailed records a failed attempt and when to try again
+func (w *WebhookRepository) MarkFailed(ctx context.Context, id uuid.UUID, lastError string, nextAttemptAt time.Time) error {
+	_, err := w.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4 WHERE id = $1`,
+		id, WebhookDeliveryFailed, lastError, nextAttemptAt)
+	return err
+}
+
+// RetryFailed makes every failed delivery due at now and returns how many
+// there were
+func (w *WebhookRepository) RetryFailed(ctx context.Context, now time.Time) (int64, error) {
+	result, err := w.db.ExecContext(ctx, `UPDATE webhook_deliveries SET next_attempt_at = $2 WHERE status = $1`, WebhookDeliveryFailed, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
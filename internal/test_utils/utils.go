@@ -107,8 +107,18 @@ func CreateTestDB(ctx context.Context) (*sql.DB, func(), error) {
 	// Load and execute the SQL script to create the required tables
 	script := `CREATE TABLE IF NOT EXISTS  users (
 		id UUID PRIMARY KEY,
-		balance DOUBLE PRECISION NOT NULL
+		balance DOUBLE PRECISION NOT NULL,
+		balance_dirty BOOLEAN NOT NULL DEFAULT FALSE,
+		external_id TEXT,
+		version BIGINT NOT NULL DEFAULT 0,
+		currency TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT (NOW() AT TIME ZONE 'utc'),
+		tenant_id TEXT NOT NULL DEFAULT '',
+		display_currency TEXT NOT NULL DEFAULT '',
+		UNIQUE (tenant_id, external_id)
 	);
+
+	CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
 	
 	CREATE TABLE IF NOT EXISTS  transactions (
 		id UUID PRIMARY KEY,
@@ -116,9 +126,154 @@ func CreateTestDB(ctx context.Context) (*sql.DB, func(), error) {
 		amount DOUBLE PRECISION NOT NULL,
 		created_at TIMESTAMP NOT NULL,
 		idempotency_key UUID NOT NULL,
+		sequence BIGINT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'settled',
+		key_released BOOLEAN NOT NULL DEFAULT FALSE,
+		reason_code TEXT NOT NULL DEFAULT '',
+		reverses_id UUID REFERENCES transactions (id),
+		batch_id UUID,
+		channel TEXT NOT NULL DEFAULT 'api',
+		balance_after DOUBLE PRECISION NOT NULL DEFAULT 0,
+		tenant_id TEXT NOT NULL DEFAULT '',
+		currency TEXT NOT NULL DEFAULT '',
+		deleted_at TIMESTAMP,
+		-- debit or credit on the legs of a transfer, empty otherwise
+		transfer_leg TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+		UNIQUE (user_id, sequence)
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS transactions_user_idempotency_key
+		ON transactions (user_id, idempotency_key) WHERE NOT key_released;
+
+	CREATE INDEX IF NOT EXISTS transactions_batch_id_idx ON transactions (batch_id);
+
+	CREATE INDEX IF NOT EXISTS transactions_user_created_sequence_idx ON transactions (user_id, created_at, sequence);
+
+	CREATE TABLE IF NOT EXISTS user_limits (
+		user_id UUID PRIMARY KEY,
+		daily_limit DOUBLE PRECISION,
+		credit_cap DOUBLE PRECISION,
+		max_amount DOUBLE PRECISION,
+		allow_negative BOOLEAN,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS transfers (
+		id UUID PRIMARY KEY,
+		from_user_id UUID NOT NULL,
+		to_user_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		idempotency_key UUID NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		debit_transaction_id UUID NOT NULL,
+		credit_transaction_id UUID,
+		credit_amount DOUBLE PRECISION,
+		exchange_rate DOUBLE PRECISION,
+		FOREIGN KEY (from_user_id) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (to_user_id) REFERENCES users (id) ON DELETE CASCADE,
+		UNIQUE (from_user_id, idempotency_key)
+	);
+
+	CREATE TABLE IF NOT EXISTS balance_holds (
+		id UUID PRIMARY KEY,
+		user_id UUID NOT NULL,
+		transaction_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		release_at TIMESTAMP NOT NULL,
+		released BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (transaction_id) REFERENCES transactions (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS idempotency_responses (
+		user_id UUID NOT NULL,
+		idempotency_key UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		status_code INT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT 'application/json',
+		response BYTEA NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, idempotency_key, amount),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS user_creation_keys (
+		tenant_id TEXT NOT NULL DEFAULT '',
+		idempotency_key UUID NOT NULL,
+		user_id UUID NOT NULL,
+		initial_balance DOUBLE PRECISION NOT NULL,
+		currency TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (tenant_id, idempotency_key),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS audit_entries (
+		id UUID PRIMARY KEY,
+		user_id UUID NOT NULL,
+		transaction_id UUID NOT NULL,
+		operator TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		balance_before DOUBLE PRECISION NOT NULL,
+		balance_after DOUBLE PRECISION NOT NULL,
+		created_at TIMESTAMP NOT NULL,
 		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
-		UNIQUE (idempotency_key, amount)
-	);`
+		FOREIGN KEY (transaction_id) REFERENCES transactions (id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS audit_entries_user_created_idx ON audit_entries (user_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id UUID PRIMARY KEY,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		delivered_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_status_next_attempt_idx ON webhook_deliveries (status, next_attempt_at);
+
+	CREATE TABLE IF NOT EXISTS event_dead_letters (
+		id UUID PRIMARY KEY,
+		event TEXT NOT NULL,
+		url TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INT NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS recurring_transactions (
+		id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		amount DOUBLE PRECISION NOT NULL,
+		run_interval TEXT NOT NULL,
+		next_run_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS recurring_transactions_user_next_run_idx ON recurring_transactions (user_id, next_run_at);
+
+	CREATE TABLE IF NOT EXISTS scheduled_transactions (
+		id UUID PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		amount DOUBLE PRECISION NOT NULL,
+		idempotency_key UUID NOT NULL,
+		execute_at TIMESTAMP NOT NULL,
+		status TEXT NOT NULL DEFAULT 'scheduled',
+		transaction_id UUID,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		executed_at TIMESTAMP,
+		UNIQUE (user_id, idempotency_key)
+	);
+
+	CREATE INDEX IF NOT EXISTS scheduled_transactions_status_execute_at_idx ON scheduled_transactions (status, execute_at);`
 
 	_, err = testDb.Exec(script)
 	if err != nil {
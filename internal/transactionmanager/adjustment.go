@@ -0,0 +1,127 @@
+package transactionmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// adjustmentReasonCode is given to manual adjustments when the vocabulary
+// has it
+const adjustmentReasonCode = "ADJUSTMENT"
+
+var (
+	errAdjustmentAmountZero = fmt.Errorf("%w: adjustment amount must not be zero", ErrInvalidTransaction)
+	errOperatorRequired     = fmt.Errorf("%w: operator is required", ErrInvalidTransaction)
+	errReasonRequired       = fmt.Errorf("%w: reason is required", ErrInvalidTransaction)
+)
+
+// AuditEntry records who adjusted a user's balance by hand and why, along
+// with the transaction that booked it and the balance on either side of it
+type AuditEntry struct {
+	ID            uuid.UUID       `json:"id"`
+	UserID        uuid.UUID       `json:"user_id"`
+	TransactionID uuid.UUID       `json:"transaction_id"`
+	Operator      string          `json:"operator"`
+	Reason        string          `json:"reason"`
+	BalanceBefore decimal.Decimal `json:"balance_before"`
+	BalanceAfter  decimal.Decimal `json:"balance_after"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func fromStorageAuditEntry(entry storage.AuditEntry) AuditEntry {
+	return AuditEntry{
+		ID:            entry.ID,
+		UserID:        entry.UserID,
+		TransactionID: entry.TransactionID,
+		Operator:      entry.Operator,
+		Reason:        entry.Reason,
+		BalanceBefore: entry.BalanceBefore,
+		BalanceAfter:  entry.BalanceAfter,
+		CreatedAt:     entry.CreatedAt,
+	}
+}
+
+// Adjustment is a manual balance adjustment with the audit entry written
+// along with it
+type Adjustment struct {
+	Transaction Transaction `json:"transaction"`
+	Audit       AuditEntry  `json:"audit"`
+}
+
+// AdjustBalance moves the user's balance by amount, either way, on behalf of
+// an operator. The adjustment is booked as a transaction and an audit entry
+// naming the operator, the reason and the balance before and after is
+// written in the same database transaction. Adjustments aren't held to the
+// transaction limits or the user's funds. Like other writes, repeating the
+// idempotency key returns ErrTransactionAlreadyExist.
+func (tm *TransactionManagerClient) AdjustBalance(ctx context.Context, userID uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID, operator string, reason string) (Adjustment, error) {
+	operator = strings.TrimSpace(operator)
+	reason = strings.TrimSpace(reason)
+	switch {
+	case amount.IsZero():
+		return Adjustment{}, errAdjustmentAmountZero
+	case operator == "":
+		return Adjustment{}, errOperatorRequired
+	case reason == "":
+		return Adjustment{}, errReasonRequired
+	}
+
+	if idempotencyKey == uuid.Nil {
+		idempotencyKey = uuid.New()
+	}
+
+	transaction := storage.Transaction{
+		ID:              uuid.New(),
+		UserID:          userID,
+		Amount:          amount,
+		CreatedAt:       tm.Now().UTC(),
+		IdempotencyKey:  idempotencyKey,
+		ServerTimestamp: true,
+	}
+	if tm.reasonCodes[adjustmentReasonCode] {
+		transaction.ReasonCode = adjustmentReasonCode
+	}
+	tm.applyWriteOptions(&transaction)
+
+	transaction, entry, err := tm.storageClient.TransactionRepository.AddAdjustment(ctx, transaction, storage.AuditEntry{
+		ID:       uuid.New(),
+		Operator: operator,
+		Reason:   reason,
+	})
+	if storage.IsUniqueViolation(err) {
+		return Adjustment{}, ErrTransactionAlreadyExist
+	}
+	if err != nil {
+		return Adjustment{}, err
+	}
+
+	return Adjustment{
+		Transaction: fromStorageTransaction(transaction),
+		Audit:       fromStorageAuditEntry(entry),
+	}, nil
+}
+
+// GetAuditEntries returns the audit entries of the user's manual
+// adjustments, oldest first
+func (tm *TransactionManagerClient) GetAuditEntries(ctx context.Context, userID uuid.UUID) ([]AuditEntry, error) {
+	if _, err := tm.storageClient.UserRepository.FindByID(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	entries, err := tm.storageClient.AuditRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, fromStorageAuditEntry(entry))
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package transactionmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	errCreatedAtTooOld      = fmt.Errorf("%w: created_at is older than the backdating window", ErrInvalidTransaction)
+	errCreatedAtInTheFuture = fmt.Errorf("%w: created_at is too far in the future", ErrInvalidTransaction)
+)
+
+// WithMaxBackdate rejects transactions whose client-supplied created_at is
+// more than window before the manager's clock with ErrInvalidTransaction,
+// as timestamps that old usually come from a bug. Imports of historical
+// transactions can opt out with WithBackfill. Zero accepts any timestamp.
+func WithMaxBackdate(window time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.maxBackdate = window
+	}
+}
+
+// WithMaxForwardSkew rejects transactions whose client-supplied created_at
+// is more than skew after the manager's clock with ErrInvalidTransaction.
+// Transactions dated in the future would count towards later daily limit
+// windows and drag monotonic timestamps forward, so unlike the backdating
+// window this also applies to backfills. Zero accepts any timestamp.
+func WithMaxForwardSkew(skew time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.maxForwardSkew = skew
+	}
+}
+
+type backfillKey struct{}
+
+// WithBackfill returns a copy of ctx whose transactions may be dated before
+// the manager's backdating window, for importing history
+func WithBackfill(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backfillKey{}, true)
+}
+
+// isBackfill reports whether ctx was returned by WithBackfill
+func isBackfill(ctx context.Context) bool {
+	backfill, _ := ctx.Value(backfillKey{}).(bool)
+	return backfill
+}
+
+// checkCreatedAt returns errCreatedAtTooOld when createdAt is further in the
+// past than the manager's backdating window allows and
+// errCreatedAtInTheFuture when it is further ahead than the forward skew
+// allows. Transactions the server stamps are always accepted.
+func (tm *TransactionManagerClient) checkCreatedAt(ctx context.Context, createdAt time.Time) error {
+	if createdAt.IsZero() {
+		return nil
+	}
+	now := tm.Now()
+	if tm.maxForwardSkew > 0 {
+		latest := now.Add(tm.maxForwardSkew)
+		if createdAt.After(latest) {
+			return fmt.Errorf("%w: %s is after %s", errCreatedAtInTheFuture, createdAt.UTC().Format(time.RFC3339), latest.UTC().Format(time.RFC3339))
+		}
+	}
+	if tm.maxBackdate > 0 && !isBackfill(ctx) {
+		oldest := now.Add(-tm.maxBackdate)
+		if createdAt.Before(oldest) {
+			return fmt.Errorf("%w: %s is before %s", errCreatedAtTooOld, createdAt.UTC().Format(time.RFC3339), oldest.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+// Batch is a group of transactions created together, such as a payroll run
+type Batch struct {
+	ID           uuid.UUID     `json:"id"`
+	Transactions []Transaction `json:"transactions"`
+	// Total is the sum of the batch's transactions that count towards the
+	// balance, leaving out voided ones
+	Total decimal.Decimal `json:"total"`
+}
+
+// AddTransactionBatch adds the transactions under a new batch ID, all or
+// none of them. Every transaction is validated like one given to
+// AddTransaction; the first that fails rejects the whole batch. Daily limits
+// and credit caps are checked against what was stored before the batch
+// together with the transactions before it in the batch.
+func (tm *TransactionManagerClient) AddTransactionBatch(ctx context.Context, transactions []Transaction) (Batch, error) {
+	if len(transactions) == 0 {
+		return Batch{}, fmt.Errorf("%w: batch is empty", ErrInvalidTransaction)
+	}
+
+	batchID := uuid.New()
+	now := tm.Now().UTC()
+
+	totals := batchTotals{}
+	entries := make([]storage.Transaction, 0, len(transactions))
+	for i, transaction := range transactions {
+		if transaction.IdempotencyKey == uuid.Nil {
+			transaction.IdempotencyKey = uuid.New()
+		}
+		if transaction.Channel == "" {
+			transaction.Channel = batchChannel
+		}
+
+		account, err := tm.accountCurrency(ctx, transaction.UserID)
+		if err != nil {
+			return Batch{}, err
+		}
+		transaction.Currency = transactionCurrency(transaction.Currency, account)
+
+		limits, err := tm.effectiveLimits(ctx, transaction.UserID)
+		if err != nil {
+			return Batch{}, err
+		}
+
+		if errs := tm.validate(ctx, transaction, limits, account); len(errs) > 0 {
+			return Batch{}, fmt.Errorf("transaction %d: %w", i, errs[0])
+		}
+
+		if err := tm.checkDailyLimit(ctx, transaction, limits, totals.of(transaction)); err != nil {
+			return Batch{}, fmt.Errorf("transaction %d: %w", i, err)
+		}
+
+		if err := tm.checkCreditCap(ctx, transaction, limits, totals.of(transaction)); err != nil {
+			return Batch{}, fmt.Errorf("transaction %d: %w", i, err)
+		}
+
+		holdAmount, holdUntil := tm.creditHold(transaction)
+		entry := storage.Transaction{
+			ID:                 transaction.ID,
+			Amount:             transaction.Amount,
+			UserID:             transaction.UserID,
+			CreatedAt:          now,
+			IdempotencyKey:     transaction.IdempotencyKey,
+			Status:             storage.TransactionStatus(transaction.Status),
+			ReasonCode:         transaction.ReasonCode,
+			Currency:           transaction.Currency,
+			Channel:            transaction.Channel,
+			BatchID:            uuid.NullUUID{UUID: batchID, Valid: true},
+			ServerTimestamp:    true,
+			HoldAmount:         holdAmount,
+			HoldUntil:          holdUntil,
+			AllowOverdraft:     tm.overdraftAccounts[transaction.UserID],
+			OverdraftTolerance: limits.OverdraftTolerance,
+		}
+		tm.applyWriteOptions(&entry)
+		entries = append(entries, entry)
+		totals.add(transaction)
+	}
+
+	added, err := tm.storageClient.TransactionRepository.AddTransactionBatch(ctx, entries)
+	if storage.IsUniqueViolation(err) {
+		return Batch{}, ErrTransactionAlreadyExist
+	}
+	if err != nil {
+		return Batch{}, err
+	}
+
+	return newBatch(batchID, added), nil
+}
+
+// ErrIdempotencyKeyTaken is returned, naming the index, for a transaction of
+// AddUserTransactions repeating the key of another, or any transaction of the
+// user repeating it with another amount
+var ErrIdempotencyKeyTaken = storage.ErrIdempotencyKeyTaken
+
+// AddUserTransactions imports the transactions of one user in a single
+// insert, all or none of them, moving the balance once by their net sum.
+// Each is validated like one given to AddTransaction and the first that
+// fails, or that repeats an idempotency key, rejects the import with an
+// error naming its index. Daily limits and the credit cap count the
+// transactions before each one in the import. Only the net sum is held to the user's funds. Credits
+// are held back like those given to AddTransaction.
+func (tm *TransactionManagerClient) AddUserTransactions(ctx context.Context, userID uuid.UUID, transactions []Transaction) ([]Transaction, error) {
+	if len(transactions) == 0 {
+		return nil, fmt.Errorf("%w: batch is empty", ErrInvalidTransaction)
+	}
+
+	account, err := tm.accountCurrency(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := tm.effectiveLimits(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := tm.Now().UTC()
+	totals := batchTotals{}
+	entries := make([]storage.Transaction, 0, len(transactions))
+	for i, transaction := range transactions {
+		entry, err := tm.userTransactionEntry(ctx, userID, transaction, account, limits, now, totals)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := tm.storageClient.TransactionRepository.AddTransactionsBatch(ctx, entries); err != nil {
+		return nil, err
+	}
+
+	added := make([]Transaction, 0, len(entries))
+	for _, entry := range entries {
+		added = append(added, fromStorageTransaction(entry))
+	}
+	return added, nil
+}
+
+// ImportMode decides what becomes of the valid transactions of an import
+// when some of the others are invalid
+type ImportMode string
+
+const (
+	// ImportAtomic adds the transactions only when all of them are valid
+	ImportAtomic ImportMode = "atomic"
+	// ImportPartial adds the valid transactions and reports the others
+	ImportPartial ImportMode = "partial"
+)
+
+// ImportStatus is what became of one transaction of an import
+type ImportStatus string
+
+const (
+	ImportCreated   ImportStatus = "created"
+	ImportDuplicate ImportStatus = "duplicate"
+	ImportInvalid   ImportStatus = "invalid"
+	// ImportRolledBack is a valid transaction of an atomic import that
+	// wasn't added because another one was invalid
+	ImportRolledBack ImportStatus = "rolled_back"
+)
+
+// ImportRow is one transaction given to ImportUserTransactions. Err is set
+// when the caller already found the row invalid, such as when it couldn't
+// be parsed, and is reported for it as is.
+type ImportRow struct {
+	Transaction Transaction
+	Err         error
+}
+
+// ImportResult is the outcome of the transaction at Index of an import.
+// TransactionID is the transaction added for it, or for a duplicate the one
+// already holding its idempotency key.
+type ImportResult struct {
+	Index         int          `json:"index"`
+	Status        ImportStatus `json:"status"`
+	TransactionID *uuid.UUID   `json:"transaction_id,omitempty"`
+	Error         string       `json:"error,omitempty"`
+}
+
+// ImportReport is the outcome of an import, one result per row in the order
+// given. Committed tells whether anything was written.
+type ImportReport struct {
+	Mode       ImportMode     `json:"mode"`
+	Committed  bool           `json:"committed"`
+	Created    int            `json:"created"`
+	Duplicates int            `json:"duplicates"`
+	Invalid    int            `json:"invalid"`
+	Results    []ImportResult `json:"results"`
+}
+
+// ImportUserTransactions imports the transactions of one user like
+// AddUserTransactions, but reports the outcome of every row instead of
+// failing on the first bad one. Rows repeating the idempotency key and
+// amount of a stored transaction, or of an earlier row, are skipped as
+// duplicates. Invalid rows are never added; in ImportAtomic mode they keep
+// the valid ones from being added too, while in ImportPartial mode the valid
+// ones are added without them. Failures that aren't down to a single row,
+// such as the net sum exceeding the user's funds, still fail the import.
+func (tm *TransactionManagerClient) ImportUserTransactions(ctx context.Context, userID uuid.UUID, rows []ImportRow, mode ImportMode) (ImportReport, error) {
+	if mode != ImportAtomic && mode != ImportPartial {
+		return ImportReport{}, fmt.Errorf("%w: unknown import mode %q", ErrInvalidTransaction, mode)
+	}
+	if len(rows) == 0 {
+		return ImportReport{}, fmt.Errorf("%w: batch is empty", ErrInvalidTransaction)
+	}
+
+	account, err := tm.accountCurrency(ctx, userID)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	limits, err := tm.effectiveLimits(ctx, userID)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	now := tm.Now().UTC()
+	totals := batchTotals{}
+	report := ImportReport{Mode: mode, Results: make([]ImportResult, len(rows))}
+	entries := make([]storage.Transaction, 0, len(rows))
+	// indices maps the entries back to their rows
+	indices := make([]int, 0, len(rows))
+	for i, row := range rows {
+		report.Results[i].Index = i
+
+		err := row.Err
+		var entry storage.Transaction
+		if err == nil {
+			entry, err = tm.userTransactionEntry(ctx, userID, row.Transaction, account, limits, now, totals)
+		}
+		if err != nil {
+			report.Results[i].Status = ImportInvalid
+			report.Results[i].Error = err.Error()
+			report.Invalid++
+			continue
+		}
+		entries = append(entries, entry)
+		indices = append(indices, i)
+	}
+
+	if len(entries) == 0 || (mode == ImportAtomic && report.Invalid > 0) {
+		for _, i := range indices {
+			report.Results[i].Status = ImportRolledBack
+		}
+		return report, nil
+	}
+
+	duplicates, err := tm.storageClient.TransactionRepository.AddNewTransactionsBatch(ctx, entries)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report.Committed = true
+
+	for j, i := range indices {
+		id := entries[j].ID
+		if holder, ok := duplicates[j]; ok {
+			id = holder
+			report.Results[i].Status = ImportDuplicate
+			report.Duplicates++
+		} else {
+			report.Results[i].Status = ImportCreated
+			report.Created++
+		}
+		report.Results[i].TransactionID = &id
+	}
+	return report, nil
+}
+
+// userTransactionEntry fills in the defaults of a transaction imported for
+// the user and validates it like one given to AddTransaction, counting the
+// valid transactions before it in totals, to which it is added once valid
+func (tm *TransactionManagerClient) userTransactionEntry(ctx context.Context, userID uuid.UUID, transaction Transaction, account string, limits Limits, now time.Time, totals batchTotals) (storage.Transaction, error) {
+	transaction.UserID = userID
+	if transaction.IdempotencyKey == uuid.Nil {
+		transaction.IdempotencyKey = uuid.New()
+	}
+	if transaction.Channel == "" {
+		transaction.Channel = batchChannel
+	}
+	if transaction.CreatedAt.IsZero() {
+		transaction.CreatedAt = now
+	}
+	transaction.Currency = transactionCurrency(transaction.Currency, account)
+
+	if errs := tm.validate(ctx, transaction, limits, account); len(errs) > 0 {
+		return storage.Transaction{}, errs[0]
+	}
+
+	if err := tm.checkDailyLimit(ctx, transaction, limits, totals.of(transaction)); err != nil {
+		return storage.Transaction{}, err
+	}
+
+	if err := tm.checkCreditCap(ctx, transaction, limits, totals.of(transaction)); err != nil {
+		return storage.Transaction{}, err
+	}
+
+	holdAmount, holdUntil := tm.creditHold(transaction)
+	entry := storage.Transaction{
+		ID:                 transaction.ID,
+		Amount:             transaction.Amount,
+		UserID:             userID,
+		CreatedAt:          transaction.CreatedAt,
+		IdempotencyKey:     transaction.IdempotencyKey,
+		Status:             storage.TransactionStatus(transaction.Status),
+		ReasonCode:         transaction.ReasonCode,
+		Currency:           transaction.Currency,
+		Channel:            transaction.Channel,
+		HoldAmount:         holdAmount,
+		HoldUntil:          holdUntil,
+		AllowOverdraft:     tm.overdraftAccounts[userID],
+		OverdraftTolerance: limits.OverdraftTolerance,
+	}
+	tm.applyWriteOptions(&entry)
+	totals.add(transaction)
+	return entry, nil
+}
+
+// batchTotal names a user's running total of credits or of debits within a
+// batch
+type batchTotal struct {
+	userID uuid.UUID
+	credit bool
+}
+
+// batchTotals adds up the transactions of a batch validated so far, which
+// the limits must count along with what is already stored
+type batchTotals map[batchTotal]decimal.Decimal
+
+func totalOf(transaction Transaction) batchTotal {
+	return batchTotal{userID: transaction.UserID, credit: !transaction.Amount.IsNegative()}
+}
+
+// of returns what the transactions of the batch so far add to the user's
+// total of the transaction's type
+func (b batchTotals) of(transaction Transaction) decimal.Decimal {
+	return b[totalOf(transaction)]
+}
+
+func (b batchTotals) add(transaction Transaction) {
+	key := totalOf(transaction)
+	b[key] = b[key].Add(transaction.Amount.Abs())
+}
+
+// GetBatch returns the transactions of a batch with their total
+func (tm *TransactionManagerClient) GetBatch(ctx context.Context, batchID uuid.UUID) (Batch, error) {
+	transactions, err := tm.storageClient.TransactionRepository.FindTransactionsByBatchID(ctx, batchID)
+	if err != nil {
+		return Batch{}, err
+	}
+	if len(transactions) == 0 {
+		return Batch{}, ErrBatchNotFound
+	}
+
+	return newBatch(batchID, transactions), nil
+}
+
+func newBatch(batchID uuid.UUID, transactions []storage.Transaction) Batch {
+	batch := Batch{ID: batchID, Transactions: []Transaction{}, Total: decimal.Zero}
+	for _, transaction := range transactions {
+		batch.Transactions = append(batch.Transactions, fromStorageTransaction(transaction))
+		if transaction.Status != storage.TransactionStatusVoided {
+			batch.Total = batch.Total.Add(transaction.Amount)
+		}
+	}
+	return batch
+}
@@ -0,0 +1,152 @@
+package transactionmanager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrUnsupportedCurrency = fmt.Errorf("%w: unsupported currency", ErrInvalidTransaction)
+	// ErrCurrencyMismatch is returned for a transaction in another currency
+	// than the account of its user
+	ErrCurrencyMismatch = fmt.Errorf("%w: currency doesn't match the account", ErrInvalidTransaction)
+
+	errMalformedCurrency = fmt.Errorf("%w: currency must be a three letter ISO 4217 code", ErrInvalidTransaction)
+
+	errRateNotPositive = fmt.Errorf("%w: exchange rate must be positive", ErrInvalidTransaction)
+)
+
+// transactionCurrency returns the currency of a transaction given in
+// currency for an account in account, defaulting to the account's
+func transactionCurrency(currency string, account string) string {
+	if currency == "" {
+		return account
+	}
+	return strings.ToUpper(currency)
+}
+
+// checkCurrencyCode returns errMalformedCurrency unless currency is empty or
+// three ASCII letters. Whether the code is known is not checked.
+func checkCurrencyCode(currency string) error {
+	if currency == "" {
+		return nil
+	}
+	if len(currency) != 3 {
+		return fmt.Errorf("%w, got %q", errMalformedCurrency, currency)
+	}
+	for _, r := range currency {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			return fmt.Errorf("%w, got %q", errMalformedCurrency, currency)
+		}
+	}
+	return nil
+}
+
+// checkCurrency returns ErrCurrencyMismatch when the transaction's currency
+// differs from account. Accounts in the ledger's implicit currency, with an
+// empty account currency, take transactions in any.
+func checkCurrency(transaction Transaction, account string) error {
+	if account == "" || transaction.Currency == "" || strings.EqualFold(transaction.Currency, account) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s, the account is in %s", ErrCurrencyMismatch, transaction.Currency, account)
+}
+
+// RoundingMode picks how converted amounts are rounded to the scale of the
+// target currency
+type RoundingMode string
+
+const (
+	// RoundHalfUp rounds halves away from zero. It is the default.
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundHalfEven rounds halves to the nearest even digit, as banks do
+	RoundHalfEven RoundingMode = "half_even"
+	// RoundDown truncates towards zero
+	RoundDown RoundingMode = "down"
+)
+
+// ParseRoundingMode reads a rounding mode, empty meaning RoundHalfUp
+func ParseRoundingMode(value string) (RoundingMode, error) {
+	switch mode := RoundingMode(strings.ToLower(value)); mode {
+	case "":
+		return RoundHalfUp, nil
+	case RoundHalfUp, RoundHalfEven, RoundDown:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown rounding mode %q, expected half_up, half_even or down", value)
+	}
+}
+
+func (m RoundingMode) round(amount decimal.Decimal, places int32) decimal.Decimal {
+	switch m {
+	case RoundHalfEven:
+		return amount.RoundBank(places)
+	case RoundDown:
+		return amount.RoundDown(places)
+	default:
+		return amount.Round(places)
+	}
+}
+
+// WithRoundingMode sets how ConvertAmount rounds to the target currency
+func WithRoundingMode(mode RoundingMode) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.roundingMode = mode
+	}
+}
+
+// currencyScales is the number of minor unit digits of each supported ISO
+// 4217 currency
+var currencyScales = map[string]int32{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"CAD": 2,
+	"AUD": 2,
+	"TRY": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"BHD": 3,
+}
+
+// CurrencyScale returns the number of minor unit digits of a currency code
+func CurrencyScale(currency string) (int32, error) {
+	scale, ok := currencyScales[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnsupportedCurrency, currency)
+	}
+	return scale, nil
+}
+
+// AmountFromMinor converts an integer amount in the currency's minor units,
+// e.g. cents, to a decimal amount: 10050 USD is 100.50
+func AmountFromMinor(amountMinor int64, currency string) (decimal.Decimal, error) {
+	scale, err := CurrencyScale(currency)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return decimal.New(amountMinor, -scale), nil
+}
+
+// ConvertAmount converts an amount from one currency to another at rate, the
+// price of one unit of from in to. The result is rounded to the scale of the
+// target currency with the manager's rounding mode, so it is always a valid
+// amount in that currency: 10.05 USD at 151.237 is 1520 JPY.
+func (tm *TransactionManagerClient) ConvertAmount(amount decimal.Decimal, from string, to string, rate decimal.Decimal) (decimal.Decimal, error) {
+	if _, err := CurrencyScale(from); err != nil {
+		return decimal.Decimal{}, err
+	}
+	scale, err := CurrencyScale(to)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	if !rate.IsPositive() {
+		return decimal.Decimal{}, errRateNotPositive
+	}
+
+	return tm.roundingMode.round(amount.Mul(rate), scale), nil
+}
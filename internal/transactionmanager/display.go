@@ -0,0 +1,159 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrNoExchangeRates is returned for a conversion asked for explicitly
+	// when the manager has no exchange rate provider
+	ErrNoExchangeRates = errors.New("currency conversion isn't available, no exchange rates are configured")
+	// ErrExchangeRateNotFound is returned when the provider has no rate for
+	// a pair of currencies
+	ErrExchangeRateNotFound = fmt.Errorf("%w: no exchange rate", ErrInvalidTransaction)
+
+	errNoAccountCurrency = fmt.Errorf("%w: the account has no currency to convert from", ErrInvalidTransaction)
+)
+
+// ExchangeRateProvider tells the price of one unit of a currency in another
+type ExchangeRateProvider interface {
+	Rate(ctx context.Context, from string, to string) (decimal.Decimal, error)
+}
+
+// WithExchangeRates converts balances with the rates of provider. Without
+// one, balances are only ever shown in their account currency.
+func WithExchangeRates(provider ExchangeRateProvider) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.exchangeRates = provider
+	}
+}
+
+// StaticRates is an ExchangeRateProvider with fixed rates, keyed by pairs of
+// currency codes like "USD/EUR". The inverse of a pair is used when only the
+// other direction is given.
+type StaticRates map[string]decimal.Decimal
+
+func (r StaticRates) Rate(_ context.Context, from string, to string) (decimal.Decimal, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if rate, ok := r[from+"/"+to]; ok {
+		return rate, nil
+	}
+	if rate, ok := r[to+"/"+from]; ok && rate.IsPositive() {
+		return decimal.NewFromInt(1).Div(rate), nil
+	}
+	return decimal.Decimal{}, fmt.Errorf("%w from %s to %s", ErrExchangeRateNotFound, from, to)
+}
+
+// ConvertedBalance is a balance shown in another currency than the account's
+type ConvertedBalance struct {
+	Currency         string          `json:"currency"`
+	Balance          decimal.Decimal `json:"balance"`
+	AvailableBalance decimal.Decimal `json:"available_balance"`
+	// Rate is the price of one unit of the account currency in Currency the
+	// balances were converted at
+	Rate decimal.Decimal `json:"rate"`
+}
+
+// DisplayBalance is a user's balance in their account currency, along with
+// its conversion to the currency they asked for or prefer, if any
+type DisplayBalance struct {
+	Balance          decimal.Decimal   `json:"balance"`
+	AvailableBalance decimal.Decimal   `json:"available_balance"`
+	Currency         string            `json:"currency,omitempty"`
+	Converted        *ConvertedBalance `json:"converted,omitempty"`
+}
+
+// SetDisplayCurrency sets the currency the user's balance is converted to
+// when they don't ask for one, empty to show it in the account currency
+func (tm *TransactionManagerClient) SetDisplayCurrency(ctx context.Context, userID uuid.UUID, currency string) (User, error) {
+	currency = strings.ToUpper(currency)
+	if currency != "" {
+		if _, err := CurrencyScale(currency); err != nil {
+			return User{}, err
+		}
+	}
+
+	if err := tm.storageClient.UserRepository.SetDisplayCurrency(ctx, userID, currency); err != nil {
+		return User{}, err
+	}
+
+	user, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	return fromStorageUser(user), nil
+}
+
+// GetDisplayBalance returns the user's balance and available balance,
+// converted to convertTo, or to the user's display currency when it is
+// empty. A conversion asked for explicitly fails when it can't be made:
+// ErrNoExchangeRates without a provider, ErrInvalidTransaction for accounts
+// in the ledger's implicit currency or pairs without a rate. The display
+// currency is only a preference, so the balance is returned unconverted
+// instead.
+func (tm *TransactionManagerClient) GetDisplayBalance(ctx context.Context, userID uuid.UUID, convertTo string) (DisplayBalance, error) {
+	user, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return DisplayBalance{}, err
+	}
+	balance, err := tm.GetUserBalance(ctx, userID)
+	if err != nil {
+		return DisplayBalance{}, err
+	}
+	held, err := tm.storageClient.TransactionRepository.HeldAmount(ctx, userID)
+	if err != nil {
+		return DisplayBalance{}, err
+	}
+	result := DisplayBalance{Balance: balance, AvailableBalance: balance.Sub(held), Currency: user.Currency}
+
+	explicit := convertTo != ""
+	target := strings.ToUpper(convertTo)
+	if !explicit {
+		target = user.DisplayCurrency
+	}
+	if target == "" || strings.EqualFold(target, user.Currency) {
+		return result, nil
+	}
+
+	converted, err := tm.convertBalance(ctx, result, target)
+	if err != nil {
+		if explicit {
+			return DisplayBalance{}, err
+		}
+		if tm.exchangeRates != nil && user.Currency != "" {
+			tm.log(ctx).Warn("converting balance to display currency", "user_id", userID, "display_currency", target, "error", err)
+		}
+		return result, nil
+	}
+	result.Converted = &converted
+	return result, nil
+}
+
+func (tm *TransactionManagerClient) convertBalance(ctx context.Context, balance DisplayBalance, to string) (ConvertedBalance, error) {
+	if tm.exchangeRates == nil {
+		return ConvertedBalance{}, ErrNoExchangeRates
+	}
+	if balance.Currency == "" {
+		return ConvertedBalance{}, errNoAccountCurrency
+	}
+
+	rate, err := tm.exchangeRates.Rate(ctx, balance.Currency, to)
+	if err != nil {
+		return ConvertedBalance{}, err
+	}
+	amount, err := tm.ConvertAmount(balance.Balance, balance.Currency, to, rate)
+	if err != nil {
+		return ConvertedBalance{}, err
+	}
+	available, err := tm.ConvertAmount(balance.AvailableBalance, balance.Currency, to, rate)
+	if err != nil {
+		return ConvertedBalance{}, err
+	}
+	return ConvertedBalance{Currency: to, Balance: amount, AvailableBalance: available, Rate: rate}, nil
+}
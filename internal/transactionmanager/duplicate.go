@@ -0,0 +1,43 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var ErrPossibleDuplicate = errors.New("possible duplicate transaction")
+
+// WithDuplicateWindow flags a transaction sent without an idempotency key
+// when the user already has one of the same amount created less than window
+// earlier, which is likely an accidental double submit. Flagged transactions
+// are stored with PossibleDuplicateOf set, or rejected with
+// ErrPossibleDuplicate when reject is true. Amounts are compared as is, as
+// the ledger has no per-transaction currency.
+func WithDuplicateWindow(window time.Duration, reject bool) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.duplicateWindow = window
+		tm.rejectDuplicates = reject
+	}
+}
+
+// findDuplicate returns the ID of the user's transaction that transaction
+// looks like a double submit of, or nil if there is none
+func (tm *TransactionManagerClient) findDuplicate(ctx context.Context, transaction Transaction) (*uuid.UUID, error) {
+	since := transaction.CreatedAt.Add(-tm.duplicateWindow)
+	duplicate, err := tm.storageClient.TransactionRepository.FindRecentDuplicate(ctx, transaction.UserID, transaction.Amount, since)
+	if errors.Is(err, storage.ErrTransactionNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tm.rejectDuplicates {
+		return nil, ErrPossibleDuplicate
+	}
+	return &duplicate.ID, nil
+}
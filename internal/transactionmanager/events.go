@@ -0,0 +1,83 @@
+package transactionmanager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Event is something that happened in the ledger that downstream systems may
+// want to react to
+type Event interface {
+	// EventType names the event, e.g. transaction.created
+	EventType() string
+}
+
+// EventSink receives the manager's events. Events are published after the
+// change they report is committed, so a failed Publish is only logged and
+// never undoes it.
+type EventSink interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// TransactionCreated is published for every transaction added with
+// AddTransaction. Balance is the user's balance once the transaction and any
+// fees derived from it were written, so consumers don't have to query it.
+type TransactionCreated struct {
+	TransactionID uuid.UUID       `json:"transaction_id"`
+	UserID        uuid.UUID       `json:"user_id"`
+	Amount        decimal.Decimal `json:"amount"`
+	Currency      string          `json:"currency,omitempty"`
+	Balance       decimal.Decimal `json:"balance"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func (TransactionCreated) EventType() string {
+	return EventTransactionCreated
+}
+
+// WithEventSink publishes the manager's events to sink instead of dropping
+// them
+func WithEventSink(sink EventSink) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.events = sink
+	}
+}
+
+// NopEventSink drops every event. It is the manager's sink unless
+// WithEventSink sets another.
+type NopEventSink struct{}
+
+func (NopEventSink) Publish(context.Context, Event) error {
+	return nil
+}
+
+// MemoryEventSink keeps every event published to it, for tests
+type MemoryEventSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *MemoryEventSink) Publish(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the events published so far, oldest first
+func (s *MemoryEventSink) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// publish hands event to the manager's sink, logging a failure
+func (tm *TransactionManagerClient) publish(ctx context.Context, event Event) {
+	if err := tm.events.Publish(ctx, event); err != nil {
+		tm.log(ctx).Error("publishing event", "event", event.EventType(), "error", err)
+	}
+}
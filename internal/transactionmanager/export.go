@@ -0,0 +1,34 @@
+package transactionmanager
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// balanceExportPageSize is how many users StreamUserBalances reads per query
+const balanceExportPageSize = 500
+
+// StreamUserBalances calls fn for every user, in ID order, reading them a page
+// at a time so the whole user table is never held in memory. It stops at the
+// first error fn returns.
+func (tm *TransactionManagerClient) StreamUserBalances(ctx context.Context, fn func(User) error) error {
+	after := uuid.Nil
+	for {
+		users, err := tm.storageClient.UserRepository.ListUsers(ctx, after, balanceExportPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			if err := fn(fromStorageUser(user)); err != nil {
+				return err
+			}
+		}
+
+		if len(users) < balanceExportPageSize {
+			return nil
+		}
+		after = users[len(users)-1].ID
+	}
+}
@@ -0,0 +1,70 @@
+package transactionmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// WithCreditHold holds back percent of every credit, whether added with
+// AddTransaction, in a batch or by a transfer, from the user's available
+// balance for duration. Held amounts still count
+// towards the balance but can't be transferred until a sweeper, see
+// RunHoldSweeper, releases them.
+func WithCreditHold(percent decimal.Decimal, duration time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.holdPercent = percent
+		tm.holdDuration = duration
+	}
+}
+
+// creditHold returns how much of a transaction to hold back and until when,
+// nothing for debits or without a hold configured
+func (tm *TransactionManagerClient) creditHold(transaction Transaction) (decimal.Decimal, time.Time) {
+	if !tm.holdPercent.IsPositive() || !transaction.Amount.IsPositive() {
+		return decimal.Zero, time.Time{}
+	}
+	hold := transaction.Amount.Mul(tm.holdPercent).Div(decimal.NewFromInt(100))
+	return hold, tm.Now().UTC().Add(tm.holdDuration)
+}
+
+// GetAvailableBalance returns the user's balance without the credits that are
+// still held back
+func (tm *TransactionManagerClient) GetAvailableBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
+	balance, err := tm.GetUserBalance(ctx, userID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	held, err := tm.storageClient.TransactionRepository.HeldAmount(ctx, userID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	return balance.Sub(held), nil
+}
+
+// ReleaseDueHolds makes every held credit whose hold has run out available
+// and returns how many holds were released
+func (tm *TransactionManagerClient) ReleaseDueHolds(ctx context.Context) (int64, error) {
+	return tm.storageClient.TransactionRepository.ReleaseDueHolds(ctx, tm.Now().UTC())
+}
+
+// RunHoldSweeper releases due holds every interval until ctx is done
+func (tm *TransactionManagerClient) RunHoldSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := tm.ReleaseDueHolds(ctx); err != nil {
+				tm.log(ctx).Error("releasing due holds", "error", err)
+			}
+		}
+	}
+}
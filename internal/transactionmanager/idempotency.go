@@ -0,0 +1,123 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// MaxIdempotencyKeyLength caps free-form idempotency keys so they can't be
+// used to bloat requests or logs
+const MaxIdempotencyKeyLength = 255
+
+// idempotencyKeyNamespace is the UUIDv5 namespace free-form idempotency keys
+// are hashed into. It must never change, or retries made across a deploy
+// would no longer be recognised as duplicates.
+var idempotencyKeyNamespace = uuid.MustParse("6f1c3c2e-8d4b-4f53-9a55-2b1f0c7e4d10")
+
+var (
+	ErrIdempotencyKeyTooLong     = fmt.Errorf("idempotency key must be at most %d characters", MaxIdempotencyKeyLength)
+	ErrIdempotencyKeyInvalidChar = errors.New("idempotency key must only contain printable ASCII characters")
+)
+
+// StoredResponse is the response a write was answered with, replayed to
+// retries carrying the same idempotency key and amount. ContentType tells
+// the transports apart, so each only replays the responses it stored.
+type StoredResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// ParseIdempotencyKey turns the idempotency key sent by a client into the
+// UUID the ledger stores. UUID keys are used as they are, any other key is
+// checked for length and charset and mapped to a stable UUIDv5. An empty key
+// maps to uuid.Nil.
+func ParseIdempotencyKey(key string) (uuid.UUID, error) {
+	if key == "" {
+		return uuid.Nil, nil
+	}
+
+	if parsed, err := uuid.Parse(key); err == nil {
+		return parsed, nil
+	}
+
+	if len(key) > MaxIdempotencyKeyLength {
+		return uuid.Nil, ErrIdempotencyKeyTooLong
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return uuid.Nil, ErrIdempotencyKeyInvalidChar
+		}
+	}
+
+	return uuid.NewSHA1(idempotencyKeyNamespace, []byte(key)), nil
+}
+
+// WithResponseReplay keeps the response to every keyed transaction for ttl,
+// so a retry within it gets the same response instead of
+// ErrTransactionAlreadyExist. Once the ttl has passed the key is released and
+// a retry is taken for a new transaction. Zero turns it off.
+func WithResponseReplay(ttl time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.responseTTL = ttl
+	}
+}
+
+// FindStoredResponse returns the response stored for the user's transaction
+// with the idempotency key and amount, if there is one younger than the
+// replay TTL. An expired response is dropped and its key released.
+func (tm *TransactionManagerClient) FindStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal) (StoredResponse, bool, error) {
+	if tm.responseTTL <= 0 || idempotencyKey == uuid.Nil {
+		return StoredResponse{}, false, nil
+	}
+
+	stored, err := tm.storageClient.IdempotencyRepository.Find(ctx, userID, idempotencyKey, amount)
+	if errors.Is(err, storage.ErrIdempotentResponseNotFound) {
+		return StoredResponse{}, false, nil
+	}
+	if err != nil {
+		return StoredResponse{}, false, err
+	}
+	if !tm.Now().Before(stored.CreatedAt.Add(tm.responseTTL)) {
+		err = tm.storageClient.IdempotencyRepository.Release(ctx, userID, idempotencyKey, amount, stored.CreatedAt)
+		return StoredResponse{}, false, err
+	}
+
+	return StoredResponse{
+		StatusCode:  stored.StatusCode,
+		ContentType: stored.ContentType,
+		Body:        stored.Payload,
+		CreatedAt:   stored.CreatedAt,
+	}, true, nil
+}
+
+// SaveStoredResponse keeps the response to the user's transaction with the
+// idempotency key and amount for replay. It does nothing unless response
+// replay is on.
+func (tm *TransactionManagerClient) SaveStoredResponse(ctx context.Context, userID uuid.UUID, idempotencyKey uuid.UUID, amount decimal.Decimal, response StoredResponse) error {
+	if tm.responseTTL <= 0 || idempotencyKey == uuid.Nil {
+		return nil
+	}
+
+	createdAt := response.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = tm.Now().UTC()
+	}
+	return tm.storageClient.IdempotencyRepository.Save(ctx, storage.IdempotentResponse{
+		UserID:         userID,
+		IdempotencyKey: idempotencyKey,
+		Amount:         amount,
+		StatusCode:     response.StatusCode,
+		ContentType:    response.ContentType,
+		Payload:        response.Body,
+		CreatedAt:      createdAt,
+	})
+}
@@ -0,0 +1,92 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var ErrTooManyConcurrentTransactions = errors.New("too many concurrent transactions for user")
+
+// inflightLimiter caps how many AddTransaction calls can run at once for the
+// same user. Calls over the cap either wait for a slot or fail straight away.
+type inflightLimiter struct {
+	limit int
+	wait  bool
+
+	mu    sync.Mutex
+	users map[uuid.UUID]*userSlots
+}
+
+// userSlots holds the semaphore of one user. refs counts the callers holding
+// or waiting for a slot, so the entry can be dropped once nobody uses it.
+type userSlots struct {
+	sem  chan struct{}
+	refs int
+}
+
+func newInflightLimiter(limit int, wait bool) *inflightLimiter {
+	return &inflightLimiter{
+		limit: limit,
+		wait:  wait,
+		users: map[uuid.UUID]*userSlots{},
+	}
+}
+
+// WithMaxConcurrentPerUser caps the number of AddTransaction calls in flight
+// for a single user. When wait is set, calls over the cap queue until a slot
+// frees up or their context ends; otherwise they fail with
+// ErrTooManyConcurrentTransactions. A limit of zero or less disables the cap.
+func WithMaxConcurrentPerUser(limit int, wait bool) Option {
+	return func(tm *TransactionManagerClient) {
+		if limit <= 0 {
+			tm.inflight = nil
+			return
+		}
+		tm.inflight = newInflightLimiter(limit, wait)
+	}
+}
+
+// acquire takes a slot for the user and returns the function releasing it
+func (l *inflightLimiter) acquire(ctx context.Context, userID uuid.UUID) (func(), error) {
+	l.mu.Lock()
+	slots, ok := l.users[userID]
+	if !ok {
+		slots = &userSlots{sem: make(chan struct{}, l.limit)}
+		l.users[userID] = slots
+	}
+	slots.refs++
+	l.mu.Unlock()
+
+	if l.wait {
+		select {
+		case slots.sem <- struct{}{}:
+		case <-ctx.Done():
+			l.unref(userID, slots)
+			return nil, ctx.Err()
+		}
+	} else {
+		select {
+		case slots.sem <- struct{}{}:
+		default:
+			l.unref(userID, slots)
+			return nil, ErrTooManyConcurrentTransactions
+		}
+	}
+
+	return func() {
+		<-slots.sem
+		l.unref(userID, slots)
+	}, nil
+}
+
+func (l *inflightLimiter) unref(userID uuid.UUID, slots *userSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots.refs--
+	if slots.refs == 0 {
+		delete(l.users, userID)
+	}
+}
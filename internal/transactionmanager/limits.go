@@ -0,0 +1,216 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var (
+	ErrDailyLimitExceeded = errors.New("daily limit exceeded")
+	ErrCreditCapExceeded  = errors.New("credit cap exceeded")
+
+	errAmountZero            = fmt.Errorf("%w: amount must not be zero", ErrInvalidTransaction)
+	errAmountExceedsMaxLimit = fmt.Errorf("%w: amount exceeds the maximum allowed", ErrInvalidTransaction)
+	errAmountBelowMinLimit   = fmt.Errorf("%w: amount is below the minimum allowed", ErrInvalidTransaction)
+)
+
+// Limits bounds the transactions of a user. Zero values mean unlimited.
+type Limits struct {
+	// DailyLimit caps the total amount of credits, and separately of
+	// debits, a user can make per UTC day
+	DailyLimit decimal.Decimal
+	// CreditCap caps the total amount ever credited to a user, e.g. for
+	// prepaid accounts
+	CreditCap decimal.Decimal
+	// MaxAmount caps the absolute amount of a single transaction
+	MaxAmount decimal.Decimal
+	// MinAmount is the smallest absolute amount of a non-zero transaction
+	MinAmount decimal.Decimal
+	// MaxTransferAmount caps the amount of a single transfer. Transfers are
+	// not bound by MaxAmount.
+	MaxTransferAmount decimal.Decimal
+	// CurrencyAmounts replaces MinAmount and MaxAmount for transactions in
+	// the listed currencies, keyed by ISO 4217 code
+	CurrencyAmounts map[string]AmountLimits
+	// AllowNegative permits transactions with a negative amount
+	AllowNegative bool
+	// AllowZeroAmount permits zero-value entries, such as status markers,
+	// which leave the balance untouched
+	AllowZeroAmount bool
+	// OverdraftTolerance lets a debit exceed the available balance by up to
+	// this much, e.g. to absorb rounding. The balance still goes negative by
+	// the difference. Zero means debits must be fully covered.
+	OverdraftTolerance decimal.Decimal
+}
+
+// AmountLimits bounds the absolute amount of a single transaction. Zero
+// values mean unlimited.
+type AmountLimits struct {
+	MinAmount decimal.Decimal
+	MaxAmount decimal.Decimal
+}
+
+// amountLimits returns the bounds for a transaction in currency, falling back
+// to MinAmount and MaxAmount when the currency has none of its own
+func (l Limits) amountLimits(currency string) AmountLimits {
+	if amounts, ok := l.CurrencyAmounts[currency]; ok && currency != "" {
+		return amounts
+	}
+	return AmountLimits{MinAmount: l.MinAmount, MaxAmount: l.MaxAmount}
+}
+
+// UserLimits overrides the global Limits for a single user. A nil field
+// falls back to the global value.
+type UserLimits struct {
+	DailyLimit    *decimal.Decimal `json:"daily_limit"`
+	CreditCap     *decimal.Decimal `json:"credit_cap"`
+	MaxAmount     *decimal.Decimal `json:"max_amount"`
+	AllowNegative *bool            `json:"allow_negative"`
+}
+
+// WithLimits sets the limits that apply to users without overrides
+func WithLimits(limits Limits) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.limits = limits
+	}
+}
+
+// GetUserLimits returns the limit overrides stored for a user
+func (tm *TransactionManagerClient) GetUserLimits(ctx context.Context, userID uuid.UUID) (UserLimits, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return UserLimits{}, err
+	}
+
+	limits, err := tm.storageClient.LimitsRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return UserLimits{}, err
+	}
+
+	return fromStorageLimits(limits), nil
+}
+
+// SetUserLimits replaces the limit overrides of a user
+func (tm *TransactionManagerClient) SetUserLimits(ctx context.Context, userID uuid.UUID, limits UserLimits) (UserLimits, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return UserLimits{}, err
+	}
+
+	stored := storage.UserLimits{UserID: userID}
+	if limits.DailyLimit != nil {
+		stored.DailyLimit = decimal.NewNullDecimal(*limits.DailyLimit)
+	}
+	if limits.CreditCap != nil {
+		stored.CreditCap = decimal.NewNullDecimal(*limits.CreditCap)
+	}
+	if limits.MaxAmount != nil {
+		stored.MaxAmount = decimal.NewNullDecimal(*limits.MaxAmount)
+	}
+	if limits.AllowNegative != nil {
+		stored.AllowNegative.Bool = *limits.AllowNegative
+		stored.AllowNegative.Valid = true
+	}
+
+	if err := tm.storageClient.LimitsRepository.Upsert(ctx, stored); err != nil {
+		return UserLimits{}, err
+	}
+
+	return limits, nil
+}
+
+// effectiveLimits merges the user's overrides into the global limits
+func (tm *TransactionManagerClient) effectiveLimits(ctx context.Context, userID uuid.UUID) (Limits, error) {
+	stored, err := tm.storageClient.LimitsRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return Limits{}, err
+	}
+
+	limits := tm.limits
+	if stored.DailyLimit.Valid {
+		limits.DailyLimit = stored.DailyLimit.Decimal
+	}
+	if stored.CreditCap.Valid {
+		limits.CreditCap = stored.CreditCap.Decimal
+	}
+	if stored.MaxAmount.Valid {
+		limits.MaxAmount = stored.MaxAmount.Decimal
+	}
+	if stored.AllowNegative.Valid {
+		limits.AllowNegative = stored.AllowNegative.Bool
+	}
+	return limits, nil
+}
+
+// checkDailyLimit rejects the transaction if, together with the user's other
+// transactions of the same type today, it would exceed the daily limit.
+// batched is what the transactions of the same type before it in a batch
+// add, as they aren't stored yet. The check runs outside the user lock, so
+// concurrent requests may overshoot the limit by at most one transaction
+// each.
+func (tm *TransactionManagerClient) checkDailyLimit(ctx context.Context, transaction Transaction, limits Limits, batched decimal.Decimal) error {
+	if !limits.DailyLimit.IsPositive() {
+		return nil
+	}
+
+	transactionType := storage.TransactionTypeCredit
+	if transaction.Amount.IsNegative() {
+		transactionType = storage.TransactionTypeDebit
+	}
+
+	now := tm.Now().UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	spent, err := tm.storageClient.TransactionRepository.SumSince(ctx, transaction.UserID, startOfDay, transactionType)
+	if err != nil {
+		return err
+	}
+
+	if spent.Add(batched).Add(transaction.Amount.Abs()).GreaterThan(limits.DailyLimit) {
+		return ErrDailyLimitExceeded
+	}
+	return nil
+}
+
+// checkCreditCap rejects a credit that would take the total ever credited to
+// the user beyond the credit cap. batched is what the credits before it in a
+// batch add. Like checkDailyLimit it runs outside the user lock.
+func (tm *TransactionManagerClient) checkCreditCap(ctx context.Context, transaction Transaction, limits Limits, batched decimal.Decimal) error {
+	if !limits.CreditCap.IsPositive() || !transaction.Amount.IsPositive() {
+		return nil
+	}
+
+	credited, err := tm.storageClient.TransactionRepository.SumSince(ctx, transaction.UserID, time.Time{}, storage.TransactionTypeCredit)
+	if err != nil {
+		return err
+	}
+
+	if credited.Add(batched).Add(transaction.Amount).GreaterThan(limits.CreditCap) {
+		return ErrCreditCapExceeded
+	}
+	return nil
+}
+
+func fromStorageLimits(stored storage.UserLimits) UserLimits {
+	var limits UserLimits
+	if stored.DailyLimit.Valid {
+		limits.DailyLimit = &stored.DailyLimit.Decimal
+	}
+	if stored.CreditCap.Valid {
+		limits.CreditCap = &stored.CreditCap.Decimal
+	}
+	if stored.MaxAmount.Valid {
+		limits.MaxAmount = &stored.MaxAmount.Decimal
+	}
+	if stored.AllowNegative.Valid {
+		limits.AllowNegative = &stored.AllowNegative.Bool
+	}
+	return limits
+}
@@ -0,0 +1,40 @@
+package transactionmanager
+
+import (
+	"context"
+	"log/slog"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the request it serves,
+// which the manager adds to everything it logs for that request
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID carried by ctx, or "" without one
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// WithLogger sets the logger the manager writes to, slog.Default() by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.logger = logger
+	}
+}
+
+// log returns the manager's logger, tagged with the request ID of ctx if it
+// carries one
+func (tm *TransactionManagerClient) log(ctx context.Context) *slog.Logger {
+	logger := tm.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if requestID := RequestID(ctx); requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	return logger
+}
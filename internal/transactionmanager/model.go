@@ -1,6 +1,8 @@
 package transactionmanager
 
 import (
+	"log/slog"
+	"net/http"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +16,37 @@ type Storage interface {
 
 type TransactionManagerClient struct {
 	storageClient storage.StorageClient
+
+	balanceFallback     bool
+	keyReuse            bool
+	monotonicTimestamps bool
+	limits              Limits
+	statements          *statementJobStore
+	inflight            *inflightLimiter
+	reasonCodes         map[string]bool
+	clock               func() time.Time
+
+	recomputeChunkSize int
+	duplicateWindow    time.Duration
+	rejectDuplicates   bool
+	holdPercent        decimal.Decimal
+	holdDuration       time.Duration
+	roundingMode       RoundingMode
+	returnExisting     bool
+	addTimeout         time.Duration
+	overdraftAccounts  map[uuid.UUID]bool
+	responseTTL        time.Duration
+	estimateCountsFrom int64
+	webhookURL         string
+	webhookBackoff     time.Duration
+	webhookClient      *http.Client
+	logger             *slog.Logger
+	amountTransformer  AmountTransformer
+	events             EventSink
+	exchangeRates      ExchangeRateProvider
+	maxDecimalPlaces   int32
+	maxBackdate        time.Duration
+	maxForwardSkew     time.Duration
 }
 
 type Transaction struct {
@@ -22,9 +55,153 @@ type Transaction struct {
 	UserID         uuid.UUID       `json:"user_id"`
 	CreatedAt      time.Time       `json:"created_at"`
 	IdempotencyKey uuid.UUID       `json:"idempotency_key"` // Add idempotency key to the transaction struct
+	Sequence       int64           `json:"sequence"`
+	// Status defaults to settled when a transaction is added without one
+	Status TransactionStatus `json:"status"`
+	// ReasonCode classifies the transaction, e.g. DEPOSIT or FEE. It must be
+	// one of the manager's reason codes when set.
+	ReasonCode string `json:"reason_code,omitempty"`
+	// Currency is the ISO 4217 code of the amount. It defaults to the user's
+	// account currency and must match it, and picks the currency's amount
+	// limits.
+	Currency string `json:"currency,omitempty"`
+	// TenantID is the tenant of the transaction's user, if any
+	TenantID string `json:"tenant_id,omitempty"`
+	// BalanceAfter is the user's balance right after the transaction was
+	// written, so a page of history shows the running balance
+	BalanceAfter decimal.Decimal `json:"balance_after"`
+	// UserVersion is the user's version after the transaction was applied,
+	// for clients doing compare-and-set. It is only set on write results.
+	UserVersion int64 `json:"user_version,omitempty"`
+	// ReversesID is the transaction this one refunds, if any
+	ReversesID *uuid.UUID `json:"reverses_id,omitempty"`
+	// BatchID is the batch the transaction was created in, if any
+	BatchID *uuid.UUID `json:"batch_id,omitempty"`
+	// DeletedAt is when the transaction was soft deleted, if it was
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Channel is where the transaction came in through, one of Channels.
+	// It defaults to api.
+	Channel string `json:"channel,omitempty"`
+	// PossibleDuplicateOf is set on a write result when the transaction came
+	// without an idempotency key and looks like a double submit of this one
+	PossibleDuplicateOf *uuid.UUID `json:"possible_duplicate_of,omitempty"`
+	// Derived are the entries, e.g. fees, the manager's AmountTransformer
+	// booked along with the transaction. It is only set on write results.
+	Derived []Transaction `json:"derived,omitempty"`
+	// Replayed is set on a write result that is the original transaction
+	// returned for a retry, rather than a new one
+	Replayed bool `json:"-"`
+}
+
+// TransactionStatus tracks where a transaction is in its lifecycle. Pending
+// and settled transactions count towards the balance, voided ones don't.
+type TransactionStatus string
+
+const (
+	TransactionStatusPending TransactionStatus = "pending"
+	TransactionStatusSettled TransactionStatus = "settled"
+	TransactionStatusVoided  TransactionStatus = "voided"
+)
+
+// HistoryFilter narrows down the transactions returned from a user's history
+type HistoryFilter struct {
+	// IncludeVoided also returns voided transactions, which are left out by
+	// default
+	IncludeVoided bool
+	// IncludeDeleted also returns soft deleted transactions, for auditors
+	IncludeDeleted bool
+	// Channel only returns transactions that came in through it, when set
+	Channel string
+	// From and To only return transactions created within them, both
+	// included. Zero values leave that side open.
+	From time.Time
+	To   time.Time
 }
 
+func (f HistoryFilter) toStorage() storage.HistoryFilter {
+	return storage.HistoryFilter{IncludeVoided: f.IncludeVoided, IncludeDeleted: f.IncludeDeleted, Channel: f.Channel, From: f.From, To: f.To}
+}
+
+// HistoryCursor marks a position in a user's history by the creation time
+// and sequence of the last transaction seen. The zero cursor is the start.
+type HistoryCursor struct {
+	CreatedAt time.Time
+	Sequence  int64
+}
+
+// Channels are the channels a transaction can come in through
+var Channels = []string{"web", "mobile", storage.DefaultChannel, "batch", "scheduled"}
+
+// batchChannel is the channel of transactions added in a batch
+const batchChannel = "batch"
+
+// scheduledChannel is the channel of transactions posted by the scheduler
+const scheduledChannel = "scheduled"
+
+// ValidChannel reports whether channel is one of Channels
+func ValidChannel(channel string) bool {
+	for _, valid := range Channels {
+		if channel == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryPage is one page of a user's history along with the balance just
+// before its oldest transaction and just after its newest, so each page of a
+// statement can be checked on its own
+type HistoryPage struct {
+	Transactions       []Transaction   `json:"transactions"`
+	PageOpeningBalance decimal.Decimal `json:"page_opening_balance"`
+	PageClosingBalance decimal.Decimal `json:"page_closing_balance"`
+}
+
+// TransactionImpact is how a transaction moved its user's balance. Voided
+// transactions left it where it was.
+type TransactionImpact struct {
+	TransactionID uuid.UUID       `json:"transaction_id"`
+	Amount        decimal.Decimal `json:"amount"`
+	BalanceBefore decimal.Decimal `json:"balance_before"`
+	BalanceAfter  decimal.Decimal `json:"balance_after"`
+}
+
+// IdempotencyKeyUsage is an idempotency key and the user's transactions
+// written with it
+type IdempotencyKeyUsage struct {
+	IdempotencyKey uuid.UUID   `json:"idempotency_key"`
+	TransactionIDs []uuid.UUID `json:"transaction_ids"`
+	FirstUsedAt    time.Time   `json:"first_used_at"`
+}
+
+// TransactionType is either a credit (positive amount) or a debit (negative
+// amount)
+type TransactionType string
+
+const (
+	TransactionTypeCredit TransactionType = "credit"
+	TransactionTypeDebit  TransactionType = "debit"
+)
+
 type User struct {
-	ID      uuid.UUID
-	Balance decimal.Decimal
+	ID      uuid.UUID       `json:"id"`
+	Balance decimal.Decimal `json:"balance"`
+	// ExternalID is the client's own identifier for the user, if any
+	ExternalID string `json:"external_id,omitempty"`
+	// Version goes up by one with every change to the user's balance
+	Version int64 `json:"version"`
+	// Currency is the user's account currency, which their balance and
+	// transactions are in. It is empty for accounts in the ledger's implicit
+	// currency.
+	Currency string `json:"currency,omitempty"`
+	// CreatedAt is when the user was added
+	CreatedAt time.Time `json:"created_at"`
+	// TenantID is the tenant the user belongs to, if any
+	TenantID string `json:"tenant_id,omitempty"`
+	// DisplayCurrency is the currency the user's balance is converted to
+	// when shown, if any
+	DisplayCurrency string `json:"display_currency,omitempty"`
+	// Replayed is set on a created user that is the one returned for a
+	// retry, rather than a new one
+	Replayed bool `json:"-"`
 }
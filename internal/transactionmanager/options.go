@@ -0,0 +1,128 @@
+package transactionmanager
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Option configures optional TransactionManagerClient behaviour
+type Option func(*TransactionManagerClient)
+
+// WithClock replaces the clock the manager reads the current time from,
+// which is time.Now by default
+func WithClock(now func() time.Time) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.clock = now
+	}
+}
+
+// WithBalanceFallback keeps a transaction even when updating the stored
+// balance fails, flagging the balance dirty instead. GetUserBalance then
+// recomputes dirty balances from the transactions before returning them.
+func WithBalanceFallback(enabled bool) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.balanceFallback = enabled
+	}
+}
+
+// WithKeyReuseAfterSettlement lets an idempotency key be used again once the
+// transaction holding it is settled or voided. Only a pending transaction
+// still blocks its key.
+func WithKeyReuseAfterSettlement(enabled bool) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.keyReuse = enabled
+	}
+}
+
+// WithMonotonicTimestamps keeps the timestamps the manager gives transactions
+// from going backwards for a user when the clock is set back, e.g. by NTP.
+// A timestamp that isn't later than the user's latest transaction is moved to
+// a microsecond after it. Timestamps set by the client are kept as they are.
+func WithMonotonicTimestamps(enabled bool) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.monotonicTimestamps = enabled
+	}
+}
+
+// WithReturnExisting makes AddTransaction answer a retry, a transaction
+// repeating the idempotency key and amount of one the user already has, with
+// that transaction marked Replayed instead of ErrTransactionAlreadyExist. A
+// key repeated with another amount returns ErrIdempotencyKeyTaken.
+func WithReturnExisting(enabled bool) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.returnExisting = enabled
+	}
+}
+
+// WithAddTimeout bounds how long AddTransaction may take as a whole, from
+// validation to the balance update. When it runs out the database
+// transaction is rolled back and ErrAddTimeout is returned. When the
+// caller's context ends first its error is returned instead. Zero means no
+// bound beyond the caller's context.
+func WithAddTimeout(timeout time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.addTimeout = timeout
+	}
+}
+
+// WithOverdraftAccounts lets debits of the given users take their balance
+// below zero. Debits of every other user that the available balance doesn't
+// cover are rejected with ErrInsufficientFunds.
+func WithOverdraftAccounts(userIDs ...uuid.UUID) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.overdraftAccounts = map[uuid.UUID]bool{}
+		for _, userID := range userIDs {
+			tm.overdraftAccounts[userID] = true
+		}
+	}
+}
+
+// DefaultReasonCodes are the reason codes a transaction may carry unless
+// WithReasonCodes sets others
+var DefaultReasonCodes = []string{"DEPOSIT", "WITHDRAWAL", "FEE", "REFUND", "ADJUSTMENT"}
+
+// WithReasonCodes replaces the vocabulary of reason codes transactions are
+// validated against
+func WithReasonCodes(codes ...string) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.reasonCodes = reasonCodeSet(codes)
+	}
+}
+
+func reasonCodeSet(codes []string) map[string]bool {
+	set := map[string]bool{}
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}
+
+// WithRecomputeChunkSize makes balance recomputes sum the transactions
+// chunkSize rows at a time, holding the user row lock only for the final
+// write, so large users can be recomputed without blocking their writes
+func WithRecomputeChunkSize(chunkSize int) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.recomputeChunkSize = chunkSize
+	}
+}
+
+// WithEstimatedCounts lets CountUserTransactions answer with the planner's
+// estimate instead of counting when the estimate is at least threshold rows,
+// so paging through huge histories doesn't wait on COUNT(*). Smaller results
+// are still counted exactly. Zero always counts exactly.
+func WithEstimatedCounts(threshold int64) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.estimateCountsFrom = threshold
+	}
+}
+
+// WithMaxDecimalPlaces rejects amounts with more than places digits after
+// the decimal point with ErrTooManyDecimalPlaces, e.g. 2 for a fiat ledger,
+// rather than rounding them. Negative means any number of places, the
+// default.
+func WithMaxDecimalPlaces(places int32) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.maxDecimalPlaces = places
+	}
+}
@@ -0,0 +1,144 @@
+package transactionmanager
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// BalanceMismatch reports a user whose stored balance disagrees with the sum
+// of their transactions
+type BalanceMismatch struct {
+	UserID          uuid.UUID       `json:"user_id"`
+	StoredBalance   decimal.Decimal `json:"stored_balance"`
+	ComputedBalance decimal.Decimal `json:"computed_balance"`
+	// Discrepancy is the stored balance minus the computed balance
+	Discrepancy decimal.Decimal `json:"discrepancy"`
+}
+
+// ReconciliationReport is one page of balance mismatches. NextCursor is set
+// when there may be more mismatches after this page.
+type ReconciliationReport struct {
+	Mismatches []BalanceMismatch `json:"mismatches"`
+	NextCursor *uuid.UUID        `json:"next_cursor,omitempty"`
+}
+
+// GetReconciliationReport recomputes the balances of all users with an ID
+// greater than after and returns up to limit users whose stored balance does
+// not match their transactions
+func (tm *TransactionManagerClient) GetReconciliationReport(ctx context.Context, after uuid.UUID, limit int) (ReconciliationReport, error) {
+	mismatches, err := tm.storageClient.UserRepository.FindBalanceMismatches(ctx, after, limit)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+
+	report := ReconciliationReport{Mismatches: []BalanceMismatch{}}
+	for _, mismatch := range mismatches {
+		report.Mismatches = append(report.Mismatches, BalanceMismatch{
+			UserID:          mismatch.UserID,
+			StoredBalance:   mismatch.StoredBalance,
+			ComputedBalance: mismatch.ComputedBalance,
+			Discrepancy:     mismatch.StoredBalance.Sub(mismatch.ComputedBalance),
+		})
+	}
+
+	if len(mismatches) == limit && limit > 0 {
+		next := mismatches[len(mismatches)-1].UserID
+		report.NextCursor = &next
+	}
+
+	return report, nil
+}
+
+// OrphanedTransactionsReport is one page of transactions without a user.
+// NextCursor is set when there may be more after this page.
+type OrphanedTransactionsReport struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   *uuid.UUID    `json:"next_cursor,omitempty"`
+}
+
+// GetOrphanedTransactions returns up to limit transactions with an ID
+// greater than after whose user doesn't exist
+func (tm *TransactionManagerClient) GetOrphanedTransactions(ctx context.Context, after uuid.UUID, limit int) (OrphanedTransactionsReport, error) {
+	orphans, err := tm.storageClient.TransactionRepository.FindOrphanedTransactions(ctx, after, limit)
+	if err != nil {
+		return OrphanedTransactionsReport{}, err
+	}
+
+	report := OrphanedTransactionsReport{Transactions: []Transaction{}}
+	for _, orphan := range orphans {
+		report.Transactions = append(report.Transactions, fromStorageTransaction(orphan))
+	}
+
+	if len(orphans) == limit && limit > 0 {
+		next := orphans[len(orphans)-1].ID
+		report.NextCursor = &next
+	}
+
+	return report, nil
+}
+
+// DefaultRecomputeBatchSize is how many users RecomputeBalances loads at once
+// when no batch size is given
+const DefaultRecomputeBatchSize = 100
+
+// RecomputeProgress counts the users a balance recompute has gone through
+// and how many of them had a wrong stored balance
+type RecomputeProgress struct {
+	Processed int `json:"processed"`
+	Corrected int `json:"corrected"`
+}
+
+// RecomputeBalances rebuilds stored balances from the transactions, either
+// for a single user or, when userID is uuid.Nil, for every user in batches of
+// batchSize. Each user is recomputed in its own database transaction, so a
+// failure part way leaves the users already processed fixed. progress, if not
+// nil, is called after every batch.
+func (tm *TransactionManagerClient) RecomputeBalances(ctx context.Context, userID uuid.UUID, batchSize int, progress func(RecomputeProgress)) (RecomputeProgress, error) {
+	var result RecomputeProgress
+
+	if userID != uuid.Nil {
+		err := tm.recomputeUserBalance(ctx, userID, &result)
+		return result, err
+	}
+
+	if batchSize <= 0 {
+		batchSize = DefaultRecomputeBatchSize
+	}
+
+	after := uuid.Nil
+	for {
+		ids, err := tm.storageClient.UserRepository.ListIDs(ctx, after, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(ids) == 0 {
+			return result, nil
+		}
+
+		for _, id := range ids {
+			if err := tm.recomputeUserBalance(ctx, id, &result); err != nil {
+				return result, err
+			}
+		}
+		after = ids[len(ids)-1]
+
+		if progress != nil {
+			progress(result)
+		}
+	}
+}
+
+func (tm *TransactionManagerClient) recomputeUserBalance(ctx context.Context, userID uuid.UUID, result *RecomputeProgress) error {
+	previous, balance, err := tm.recomputeBalance(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	result.Processed++
+	if !previous.Equal(balance) {
+		result.Corrected++
+	}
+	return nil
+}
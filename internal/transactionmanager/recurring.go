@@ -0,0 +1,185 @@
+package transactionmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// maxProjectionHorizon bounds how far ahead a balance can be projected, so
+// a daily schedule can't be walked for centuries
+const maxProjectionHorizon = 10 * 365 * 24 * time.Hour
+
+var (
+	errUnknownInterval      = fmt.Errorf("%w: interval must be daily, weekly or monthly", ErrInvalidTransaction)
+	errRecurringAmountZero  = fmt.Errorf("%w: recurring amount must not be zero", ErrInvalidTransaction)
+	errRecurringNextRunZero = fmt.Errorf("%w: next_run_at is required", ErrInvalidTransaction)
+	errProjectionInPast     = fmt.Errorf("%w: until must not be in the past", ErrInvalidTransaction)
+	errProjectionTooFar     = fmt.Errorf("%w: until must be within ten years", ErrInvalidTransaction)
+)
+
+// RecurringInterval is how often a recurring transaction is booked
+type RecurringInterval string
+
+const (
+	RecurringDaily   RecurringInterval = "daily"
+	RecurringWeekly  RecurringInterval = "weekly"
+	RecurringMonthly RecurringInterval = "monthly"
+)
+
+// occurrence returns the time of the nth run of a schedule whose first run is
+// at start. Runs are counted from start rather than from the previous run, so
+// a schedule starting on the 31st comes back to the 31st whenever a month has
+// one.
+func (i RecurringInterval) occurrence(start time.Time, n int) time.Time {
+	switch i {
+	case RecurringDaily:
+		return start.AddDate(0, 0, n)
+	case RecurringWeekly:
+		return start.AddDate(0, 0, 7*n)
+	default:
+		return start.AddDate(0, n, 0)
+	}
+}
+
+func (i RecurringInterval) valid() bool {
+	switch i {
+	case RecurringDaily, RecurringWeekly, RecurringMonthly:
+		return true
+	}
+	return false
+}
+
+// RecurringTransaction is an amount booked for a user every Interval,
+// starting at NextRunAt. Schedules only feed balance projections, nothing
+// books them yet.
+type RecurringTransaction struct {
+	ID        uuid.UUID         `json:"id"`
+	UserID    uuid.UUID         `json:"user_id"`
+	Amount    decimal.Decimal   `json:"amount"`
+	Interval  RecurringInterval `json:"interval"`
+	NextRunAt time.Time         `json:"next_run_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// BalanceProjection is a user's balance projected forward by their recurring
+// transactions
+type BalanceProjection struct {
+	Balance          decimal.Decimal `json:"balance"`
+	ProjectedBalance decimal.Decimal `json:"projected_balance"`
+	Until            time.Time       `json:"until"`
+	// Occurrences is the number of recurring runs due up to Until
+	Occurrences int `json:"occurrences"`
+}
+
+// CreateRecurringTransaction schedules an amount for a user. The interval
+// must be daily, weekly or monthly and the amount non-zero, negative for a
+// recurring debit.
+func (tm *TransactionManagerClient) CreateRecurringTransaction(ctx context.Context, recurring RecurringTransaction) (RecurringTransaction, error) {
+	switch {
+	case !recurring.Interval.valid():
+		return RecurringTransaction{}, errUnknownInterval
+	case recurring.Amount.IsZero():
+		return RecurringTransaction{}, errRecurringAmountZero
+	case recurring.NextRunAt.IsZero():
+		return RecurringTransaction{}, errRecurringNextRunZero
+	}
+
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, recurring.UserID)
+	if err != nil {
+		return RecurringTransaction{}, err
+	}
+
+	recurring.ID = uuid.New()
+	recurring.NextRunAt = recurring.NextRunAt.UTC()
+	recurring.CreatedAt = tm.Now().UTC()
+	err = tm.storageClient.RecurringRepository.Add(ctx, storage.RecurringTransaction{
+		ID:        recurring.ID,
+		UserID:    recurring.UserID,
+		Amount:    recurring.Amount,
+		Interval:  string(recurring.Interval),
+		NextRunAt: recurring.NextRunAt,
+		CreatedAt: recurring.CreatedAt,
+	})
+	if err != nil {
+		return RecurringTransaction{}, err
+	}
+	return recurring, nil
+}
+
+// GetRecurringTransactions returns the user's recurring transactions, the
+// soonest due first
+func (tm *TransactionManagerClient) GetRecurringTransactions(ctx context.Context, userID uuid.UUID) ([]RecurringTransaction, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := tm.storageClient.RecurringRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	recurring := make([]RecurringTransaction, 0, len(stored))
+	for _, entry := range stored {
+		recurring = append(recurring, fromStorageRecurringTransaction(entry))
+	}
+	return recurring, nil
+}
+
+// ProjectBalance returns the user's balance with every run of their
+// recurring transactions due up to and including until added to it. until
+// must be between now and ten years from now.
+func (tm *TransactionManagerClient) ProjectBalance(ctx context.Context, userID uuid.UUID, until time.Time) (BalanceProjection, error) {
+	now := tm.Now()
+	switch {
+	case until.Before(now):
+		return BalanceProjection{}, errProjectionInPast
+	case until.Sub(now) > maxProjectionHorizon:
+		return BalanceProjection{}, errProjectionTooFar
+	}
+
+	balance, err := tm.GetUserBalance(ctx, userID)
+	if err != nil {
+		return BalanceProjection{}, err
+	}
+
+	recurring, err := tm.storageClient.RecurringRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return BalanceProjection{}, err
+	}
+
+	projection := BalanceProjection{
+		Balance:          balance,
+		ProjectedBalance: balance,
+		Until:            until.UTC(),
+	}
+	for _, entry := range recurring {
+		interval := RecurringInterval(entry.Interval)
+		for n := 0; ; n++ {
+			if interval.occurrence(entry.NextRunAt, n).After(until) {
+				break
+			}
+			projection.ProjectedBalance = projection.ProjectedBalance.Add(entry.Amount)
+			projection.Occurrences++
+		}
+	}
+	return projection, nil
+}
+
+func fromStorageRecurringTransaction(recurring storage.RecurringTransaction) RecurringTransaction {
+	return RecurringTransaction{
+		ID:        recurring.ID,
+		UserID:    recurring.UserID,
+		Amount:    recurring.Amount,
+		Interval:  RecurringInterval(recurring.Interval),
+		NextRunAt: recurring.NextRunAt,
+		CreatedAt: recurring.CreatedAt,
+	}
+}
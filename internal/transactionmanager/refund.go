@@ -0,0 +1,156 @@
+package transactionmanager
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var (
+	ErrRefundExceedsOriginal = storage.ErrRefundExceedsOriginal
+	ErrAlreadyReversed       = storage.ErrAlreadyReversed
+	ErrHasCompensations      = storage.ErrHasCompensations
+	ErrTransferLeg           = storage.ErrTransferLeg
+)
+
+// Compensations is a page of the refunds and reversals of a transaction
+type Compensations struct {
+	TransactionID uuid.UUID `json:"transaction_id"`
+	// Amount is the amount of the transaction itself
+	Amount decimal.Decimal `json:"amount"`
+	// Compensated is the magnitude refunded or reversed so far, leaving out
+	// voided refunds
+	Compensated decimal.Decimal `json:"compensated"`
+	// Refundable is how much can still be refunded, zero once the
+	// transaction is voided
+	Refundable decimal.Decimal `json:"refundable"`
+	// Total is the number of refunds and reversals on every page
+	Total         int64         `json:"total"`
+	Compensations []Transaction `json:"compensations"`
+}
+
+// refundReasonCode is given to refunds when the vocabulary has it
+const refundReasonCode = "REFUND"
+
+// RefundTransaction refunds amount, a positive magnitude, of a transaction
+// with a compensating transaction of the opposite sign. A transaction can be
+// refunded in several parts, but never by more than its own amount in total:
+// ErrRefundExceedsOriginal is returned instead.
+func (tm *TransactionManagerClient) RefundTransaction(ctx context.Context, transactionID uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (Transaction, error) {
+	if !amount.IsPositive() {
+		return Transaction{}, errAmountNotPositive
+	}
+
+	// Refunds without a key get one of their own, so two equal partial
+	// refunds are never taken for retries of each other
+	if idempotencyKey == uuid.Nil {
+		idempotencyKey = uuid.New()
+	}
+
+	refund := storage.Transaction{
+		ID:              uuid.New(),
+		Amount:          amount,
+		CreatedAt:       tm.Now().UTC(),
+		IdempotencyKey:  idempotencyKey,
+		ReversesID:      uuid.NullUUID{UUID: transactionID, Valid: true},
+		ServerTimestamp: true,
+	}
+	if tm.reasonCodes[refundReasonCode] {
+		refund.ReasonCode = refundReasonCode
+	}
+	if err := tm.compensationFunds(ctx, &refund); err != nil {
+		return Transaction{}, err
+	}
+
+	refund, err := tm.storageClient.TransactionRepository.RefundTransaction(ctx, refund)
+	if storage.IsUniqueViolation(err) {
+		return Transaction{}, ErrTransactionAlreadyExist
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(refund), nil
+}
+
+// ReverseTransaction undoes a transaction with a compensating transaction of
+// the negated amount, linked to it by ReversesID, moving the balance in the
+// same database transaction. A transaction can only be reversed once, and not
+// after it was refunded: ErrAlreadyReversed is returned instead.
+func (tm *TransactionManagerClient) ReverseTransaction(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
+	reversal := storage.Transaction{
+		ID:              uuid.New(),
+		CreatedAt:       tm.Now().UTC(),
+		IdempotencyKey:  uuid.New(),
+		ReversesID:      uuid.NullUUID{UUID: transactionID, Valid: true},
+		ServerTimestamp: true,
+	}
+	if err := tm.compensationFunds(ctx, &reversal); err != nil {
+		return Transaction{}, err
+	}
+
+	reversal, err := tm.storageClient.TransactionRepository.ReverseTransaction(ctx, reversal)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(reversal), nil
+}
+
+// compensationFunds lets compensation take the balance of the original
+// transaction's user as far below zero as a debit added for them could go
+func (tm *TransactionManagerClient) compensationFunds(ctx context.Context, compensation *storage.Transaction) error {
+	original, err := tm.storageClient.TransactionRepository.FindTransactionByID(ctx, compensation.ReversesID.UUID)
+	if err != nil {
+		return err
+	}
+	limits, err := tm.effectiveLimits(ctx, original.UserID)
+	if err != nil {
+		return err
+	}
+
+	compensation.AllowOverdraft = tm.overdraftAccounts[original.UserID]
+	compensation.OverdraftTolerance = limits.OverdraftTolerance
+	tm.applyWriteOptions(compensation)
+	return nil
+}
+
+// GetCompensations returns a page of the refunds and reversals of a
+// transaction, oldest first, along with how much of it can still be
+// refunded. Voided refunds are listed but don't count as refunded.
+func (tm *TransactionManagerClient) GetCompensations(ctx context.Context, transactionID uuid.UUID, page int, pageSize int) (Compensations, error) {
+	original, err := tm.storageClient.TransactionRepository.FindTransactionByID(ctx, transactionID)
+	if err != nil {
+		return Compensations{}, err
+	}
+
+	total, compensated, err := tm.storageClient.TransactionRepository.CompensationTotals(ctx, transactionID)
+	if err != nil {
+		return Compensations{}, err
+	}
+
+	stored, err := tm.storageClient.TransactionRepository.FindCompensations(ctx, transactionID, page, pageSize)
+	if err != nil {
+		return Compensations{}, err
+	}
+
+	result := Compensations{
+		TransactionID: original.ID,
+		Amount:        original.Amount,
+		Compensated:   compensated.Abs(),
+		Refundable:    decimal.Zero,
+		Total:         total,
+		Compensations: make([]Transaction, 0, len(stored)),
+	}
+	if original.Status != storage.TransactionStatusVoided {
+		if refundable := original.Amount.Abs().Sub(result.Compensated); refundable.IsPositive() {
+			result.Refundable = refundable
+		}
+	}
+	for _, compensation := range stored {
+		result.Compensations = append(result.Compensations, fromStorageTransaction(compensation))
+	}
+	return result, nil
+}
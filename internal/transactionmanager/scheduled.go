@@ -0,0 +1,257 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var (
+	ErrScheduledNotFound   = storage.ErrScheduledNotFound
+	ErrScheduledNotPending = storage.ErrScheduledNotPending
+
+	errExecuteAtNotFuture = fmt.Errorf("%w: execute_at must be in the future", ErrInvalidTransaction)
+)
+
+// scheduledBatchSize is how many due transactions one scheduler pass posts
+// at most
+const scheduledBatchSize = 100
+
+// ScheduledStatus tracks a scheduled transaction until it is posted
+type ScheduledStatus string
+
+const (
+	ScheduledStatusScheduled ScheduledStatus = "scheduled"
+	ScheduledStatusExecuting ScheduledStatus = "executing"
+	ScheduledStatusExecuted  ScheduledStatus = "executed"
+	ScheduledStatusCancelled ScheduledStatus = "cancelled"
+	ScheduledStatusFailed    ScheduledStatus = "failed"
+)
+
+// ScheduledTransaction is a transaction posted for a user once ExecuteAt
+// arrives. The idempotency key is the one the transaction is posted with.
+type ScheduledTransaction struct {
+	ID             uuid.UUID       `json:"id"`
+	UserID         uuid.UUID       `json:"user_id"`
+	Amount         decimal.Decimal `json:"amount"`
+	IdempotencyKey uuid.UUID       `json:"idempotency_key"`
+	ExecuteAt      time.Time       `json:"execute_at"`
+	Status         ScheduledStatus `json:"status"`
+	// TransactionID is the transaction posted, once executed
+	TransactionID *uuid.UUID `json:"transaction_id,omitempty"`
+	// LastError is why the transaction was rejected, for failed ones
+	LastError  string     `json:"last_error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExecutedAt *time.Time `json:"executed_at,omitempty"`
+	// Replayed is set on a write result that is the transaction scheduled
+	// earlier with the same idempotency key
+	Replayed bool `json:"-"`
+}
+
+// ScheduleTransaction stores a transaction to be posted at ExecuteAt, which
+// must be in the future. The amount is checked against the user's limits
+// now and again when it is posted. Scheduling again with the same key
+// returns the transaction already scheduled, marked Replayed, or
+// ErrIdempotencyKeyTaken if it differs.
+func (tm *TransactionManagerClient) ScheduleTransaction(ctx context.Context, scheduled ScheduledTransaction) (ScheduledTransaction, error) {
+	if !scheduled.ExecuteAt.After(tm.Now()) {
+		return ScheduledTransaction{}, errExecuteAtNotFuture
+	}
+
+	account, err := tm.accountCurrency(ctx, scheduled.UserID)
+	if err != nil {
+		return ScheduledTransaction{}, err
+	}
+	limits, err := tm.effectiveLimits(ctx, scheduled.UserID)
+	if err != nil {
+		return ScheduledTransaction{}, err
+	}
+	if errs := tm.validate(ctx, Transaction{UserID: scheduled.UserID, Amount: scheduled.Amount}, limits, account); len(errs) > 0 {
+		return ScheduledTransaction{}, validationError(errs)
+	}
+
+	if scheduled.IdempotencyKey == uuid.Nil {
+		scheduled.IdempotencyKey = uuid.New()
+	}
+	stored := storage.ScheduledTransaction{
+		ID:             uuid.New(),
+		UserID:         scheduled.UserID,
+		Amount:         scheduled.Amount,
+		IdempotencyKey: scheduled.IdempotencyKey,
+		ExecuteAt:      scheduled.ExecuteAt.UTC(),
+		Status:         storage.ScheduledStatusScheduled,
+		CreatedAt:      tm.Now().UTC(),
+	}
+	err = tm.storageClient.ScheduledRepository.Add(ctx, stored)
+	if storage.IsUniqueViolation(err) {
+		existing, err := tm.storageClient.ScheduledRepository.FindByKey(ctx, scheduled.UserID, scheduled.IdempotencyKey)
+		if err != nil {
+			return ScheduledTransaction{}, err
+		}
+		if !existing.Amount.Equal(stored.Amount) || !existing.ExecuteAt.Equal(stored.ExecuteAt) {
+			return ScheduledTransaction{}, ErrIdempotencyKeyTaken
+		}
+		replayed := fromStorageScheduled(existing)
+		replayed.Replayed = true
+		return replayed, nil
+	}
+	if err != nil {
+		return ScheduledTransaction{}, err
+	}
+
+	return fromStorageScheduled(stored), nil
+}
+
+// GetScheduledTransactions returns the user's scheduled transactions, the
+// soonest due first, whatever their status
+func (tm *TransactionManagerClient) GetScheduledTransactions(ctx context.Context, userID uuid.UUID) ([]ScheduledTransaction, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := tm.storageClient.ScheduledRepository.FindByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := make([]ScheduledTransaction, 0, len(stored))
+	for _, entry := range stored {
+		scheduled = append(scheduled, fromStorageScheduled(entry))
+	}
+	return scheduled, nil
+}
+
+// CancelScheduledTransaction cancels one of the user's scheduled
+// transactions. Once the scheduler has picked it up it can't be cancelled
+// any more and ErrScheduledNotPending is returned.
+func (tm *TransactionManagerClient) CancelScheduledTransaction(ctx context.Context, userID uuid.UUID, scheduledID uuid.UUID) (ScheduledTransaction, error) {
+	cancelled, err := tm.storageClient.ScheduledRepository.Cancel(ctx, userID, scheduledID)
+	if err != nil {
+		return ScheduledTransaction{}, err
+	}
+	return fromStorageScheduled(cancelled), nil
+}
+
+// ExecuteDueScheduled posts the scheduled transactions that are due and
+// returns how many were posted. Each is posted with its idempotency key, so
+// one posted by a pass that stopped before recording it is only linked to
+// its transaction by the next. Transactions rejected for good, e.g. for
+// insufficient funds, are marked failed; other errors stop the pass and the
+// transaction is retried by the next one.
+func (tm *TransactionManagerClient) ExecuteDueScheduled(ctx context.Context) (int, error) {
+	due, err := tm.storageClient.ScheduledRepository.FindDue(ctx, tm.Now().UTC(), scheduledBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	executed := 0
+	for _, scheduled := range due {
+		claimed, err := tm.storageClient.ScheduledRepository.Claim(ctx, scheduled.ID)
+		if err != nil {
+			return executed, err
+		}
+		if !claimed {
+			// Cancelled since it was read
+			continue
+		}
+
+		transactionID, err := tm.postScheduled(ctx, scheduled)
+		if err != nil {
+			if !rejectedForGood(err) {
+				return executed, err
+			}
+			tm.log(ctx).Warn("scheduled transaction rejected", "scheduled_id", scheduled.ID, "error", err)
+			if err = tm.storageClient.ScheduledRepository.MarkFailed(ctx, scheduled.ID, err.Error(), tm.Now().UTC()); err != nil {
+				return executed, err
+			}
+			continue
+		}
+
+		if err = tm.storageClient.ScheduledRepository.MarkExecuted(ctx, scheduled.ID, transactionID, tm.Now().UTC()); err != nil {
+			return executed, err
+		}
+		executed++
+	}
+	return executed, nil
+}
+
+// postScheduled adds the transaction of a scheduled one and returns its ID,
+// or the ID of the transaction an earlier attempt already added
+func (tm *TransactionManagerClient) postScheduled(ctx context.Context, scheduled storage.ScheduledTransaction) (uuid.UUID, error) {
+	transaction, err := tm.AddTransaction(ctx, Transaction{
+		ID:             uuid.New(),
+		UserID:         scheduled.UserID,
+		Amount:         scheduled.Amount,
+		IdempotencyKey: scheduled.IdempotencyKey,
+		Channel:        scheduledChannel,
+	})
+	if errors.Is(err, ErrTransactionAlreadyExist) {
+		existing, findErr := tm.storageClient.TransactionRepository.FindTransactionHoldingKey(ctx, scheduled.UserID, scheduled.IdempotencyKey)
+		if findErr != nil || !existing.Amount.Equal(scheduled.Amount) {
+			return uuid.Nil, err
+		}
+		return existing.ID, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return transaction.ID, nil
+}
+
+// rejectedForGood reports whether posting a transaction failed in a way a
+// retry won't fix
+func rejectedForGood(err error) bool {
+	return errors.Is(err, ErrInvalidTransaction) ||
+		errors.Is(err, ErrTransactionAlreadyExist) ||
+		errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrDailyLimitExceeded) ||
+		errors.Is(err, ErrCreditCapExceeded) ||
+		errors.Is(err, ErrUserNotFound)
+}
+
+// RunScheduler posts due scheduled transactions every interval until ctx is
+// done
+func (tm *TransactionManagerClient) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := tm.ExecuteDueScheduled(ctx); err != nil {
+				tm.log(ctx).Error("executing scheduled transactions", "error", err)
+			}
+		}
+	}
+}
+
+func fromStorageScheduled(scheduled storage.ScheduledTransaction) ScheduledTransaction {
+	result := ScheduledTransaction{
+		ID:             scheduled.ID,
+		UserID:         scheduled.UserID,
+		Amount:         scheduled.Amount,
+		IdempotencyKey: scheduled.IdempotencyKey,
+		ExecuteAt:      scheduled.ExecuteAt,
+		Status:         ScheduledStatus(scheduled.Status),
+		LastError:      scheduled.LastError,
+		CreatedAt:      scheduled.CreatedAt,
+	}
+	if scheduled.TransactionID.Valid {
+		transactionID := scheduled.TransactionID.UUID
+		result.TransactionID = &transactionID
+	}
+	if scheduled.ExecutedAt.Valid {
+		executedAt := scheduled.ExecutedAt.Time
+		result.ExecutedAt = &executedAt
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+var ErrStatementJobNotFound = errors.New("statement job not found")
+
+// ErrStatementQueueFull is returned by PrepareStatement when as many jobs as
+// the queue holds are already waiting for a worker
+var ErrStatementQueueFull = errors.New("too many statement jobs waiting")
+
+// StatementJobStatus is the state of an asynchronous statement job
+type StatementJobStatus string
+
+const (
+	StatementJobPending StatementJobStatus = "pending"
+	StatementJobRunning StatementJobStatus = "running"
+	StatementJobDone    StatementJobStatus = "done"
+	StatementJobFailed  StatementJobStatus = "failed"
+)
+
+// Statement lists a user's transactions over a period together with the
+// balance before and after it
+type Statement struct {
+	UserID         uuid.UUID       `json:"user_id"`
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	OpeningBalance decimal.Decimal `json:"opening_balance"`
+	ClosingBalance decimal.Decimal `json:"closing_balance"`
+	Transactions   []Transaction   `json:"transactions"`
+}
+
+// StatementJob tracks the generation of a statement. Statement is set once
+// the job is done and Error once it failed.
+type StatementJob struct {
+	ID        uuid.UUID          `json:"id"`
+	Status    StatementJobStatus `json:"status"`
+	Error     string             `json:"error,omitempty"`
+	Statement *Statement         `json:"statement,omitempty"`
+
+	// userID is whose statement the job prepares, for scoping it to the
+	// user's tenant
+	userID uuid.UUID
+}
+
+const (
+	// DefaultStatementWorkers is how many statements are generated at once
+	DefaultStatementWorkers = 4
+	// DefaultStatementQueueSize is how many statement jobs may wait for a
+	// worker
+	DefaultStatementQueueSize = 100
+	// DefaultMaxStatementJobs is how many finished statement jobs are kept
+	DefaultMaxStatementJobs = 1000
+	// DefaultStatementJobTTL is how long a finished statement job is kept
+	DefaultStatementJobTTL = time.Hour
+)
+
+// statementRequest is a queued statement job
+type statementRequest struct {
+	jobID  uuid.UUID
+	userID uuid.UUID
+	from   time.Time
+	to     time.Time
+}
+
+// statementJobStore keeps statement jobs in memory, along with the queue of
+// jobs waiting for a worker. Jobs are lost when the process restarts.
+// Finished jobs are dropped once they are older than ttl, or oldest first
+// once more than maxFinished of them are kept.
+type statementJobStore struct {
+	mu   sync.Mutex
+	jobs map[uuid.UUID]StatementJob
+	// finished lists the IDs of finished jobs with when they finished,
+	// oldest first
+	finished    []finishedStatementJob
+	maxFinished int
+	ttl         time.Duration
+	queue       chan statementRequest
+}
+
+type finishedStatementJob struct {
+	id uuid.UUID
+	at time.Time
+}
+
+func newStatementJobStore(queueSize int, maxFinished int, ttl time.Duration) *statementJobStore {
+	return &statementJobStore{
+		jobs:        map[uuid.UUID]StatementJob{},
+		maxFinished: maxFinished,
+		ttl:         ttl,
+		queue:       make(chan statementRequest, queueSize),
+	}
+}
+
+// WithStatementJobs sets how many statement jobs may wait for a worker, and
+// how many finished jobs are kept for how long. A ttl of zero keeps finished
+// jobs until the cap drops them.
+func WithStatementJobs(queueSize int, maxFinished int, ttl time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.statements = newStatementJobStore(queueSize, maxFinished, ttl)
+	}
+}
+
+// enqueue stores the pending job and queues it for a worker, reporting
+// whether the queue had room for it
+func (s *statementJobStore) enqueue(job StatementJob, request statementRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.queue <- request:
+		s.jobs[job.ID] = job
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *statementJobStore) put(job StatementJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+}
+
+// finish stores a done or failed job and drops the finished jobs that are
+// no longer kept
+func (s *statementJobStore) finish(job StatementJob, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	s.finished = append(s.finished, finishedStatementJob{id: job.ID, at: now})
+	s.drop(now)
+}
+
+func (s *statementJobStore) get(id uuid.UUID, now time.Time) (StatementJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop(now)
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// drop removes finished jobs over the cap or older than the ttl. The caller
+// must hold the lock.
+func (s *statementJobStore) drop(now time.Time) {
+	for len(s.finished) > 0 {
+		oldest := s.finished[0]
+		if len(s.finished) <= s.maxFinished && (s.ttl <= 0 || now.Sub(oldest.at) < s.ttl) {
+			return
+		}
+		delete(s.jobs, oldest.id)
+		s.finished = s.finished[1:]
+	}
+}
+
+// PrepareStatement queues generating the user's statement for [from, to) and
+// returns the pending job, or ErrStatementQueueFull when the queue has no
+// room. Poll GetStatementJob with the job ID for the result. Jobs are only
+// picked up while RunStatementWorkers is running.
+func (tm *TransactionManagerClient) PrepareStatement(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time) (StatementJob, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return StatementJob{}, err
+	}
+
+	job := StatementJob{ID: uuid.New(), Status: StatementJobPending, userID: userID}
+	if !tm.statements.enqueue(job, statementRequest{jobID: job.ID, userID: userID, from: from, to: to}) {
+		return StatementJob{}, ErrStatementQueueFull
+	}
+
+	return job, nil
+}
+
+// GetStatementJob returns the current state of a statement job
+func (tm *TransactionManagerClient) GetStatementJob(ctx context.Context, jobID uuid.UUID) (StatementJob, error) {
+	job, ok := tm.statements.get(jobID, tm.Now())
+	if !ok {
+		return StatementJob{}, ErrStatementJobNotFound
+	}
+
+	// Jobs belong to the tenant of their user
+	if _, scoped := TenantFromContext(ctx); scoped {
+		_, err := tm.storageClient.UserRepository.FindByID(ctx, job.userID)
+		if errors.Is(err, ErrUserNotFound) {
+			return StatementJob{}, ErrStatementJobNotFound
+		}
+		if err != nil {
+			return StatementJob{}, err
+		}
+	}
+	return job, nil
+}
+
+// RunStatementWorkers generates queued statements, up to workers at once,
+// until ctx is done. Jobs run with ctx, so shutting down cancels them.
+func (tm *TransactionManagerClient) RunStatementWorkers(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case request := <-tm.statements.queue:
+					tm.runStatementJob(ctx, request)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (tm *TransactionManagerClient) runStatementJob(ctx context.Context, request statementRequest) {
+	tm.statements.put(StatementJob{ID: request.jobID, Status: StatementJobRunning, userID: request.userID})
+
+	statement, err := tm.buildStatement(ctx, request.userID, request.from, request.to)
+	if err != nil {
+		tm.statements.finish(StatementJob{ID: request.jobID, Status: StatementJobFailed, Error: err.Error(), userID: request.userID}, tm.Now())
+		return
+	}
+
+	tm.statements.finish(StatementJob{ID: request.jobID, Status: StatementJobDone, Statement: &statement, userID: request.userID}, tm.Now())
+}
+
+func (tm *TransactionManagerClient) buildStatement(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time) (Statement, error) {
+	opening, err := tm.storageClient.TransactionRepository.BalanceBefore(ctx, userID, from)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	transactionResult, err := tm.storageClient.TransactionRepository.FindUserTransactionsBetween(ctx, userID, from, to)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	statement := Statement{
+		UserID:         userID,
+		From:           from,
+		To:             to,
+		OpeningBalance: opening,
+		ClosingBalance: opening,
+		Transactions:   []Transaction{},
+	}
+	for _, transaction := range transactionResult {
+		statement.Transactions = append(statement.Transactions, fromStorageTransaction(transaction))
+		if TransactionStatus(transaction.Status) != TransactionStatusVoided {
+			statement.ClosingBalance = statement.ClosingBalance.Add(transaction.Amount)
+		}
+	}
+
+	return statement, nil
+}
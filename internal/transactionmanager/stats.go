@@ -0,0 +1,106 @@
+package transactionmanager
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// DefaultVolatilityWindow is how many days GetBalanceVolatility looks back
+// when no window is given
+const DefaultVolatilityWindow = 30
+
+// GetBalanceVolatility returns the standard deviation of the user's daily net
+// balance changes over the last days UTC days, today included. Days without
+// transactions count as a change of zero. With fewer than two days, or no
+// transactions in the window, there is nothing to deviate from and zero is
+// returned.
+func (tm *TransactionManagerClient) GetBalanceVolatility(ctx context.Context, userID uuid.UUID, days int) (decimal.Decimal, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	if days < 2 {
+		return decimal.Zero, nil
+	}
+
+	now := tm.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := today.AddDate(0, 0, -(days - 1))
+	to := today.AddDate(0, 0, 1)
+
+	changes, err := tm.storageClient.TransactionRepository.DailyNetChanges(ctx, userID, from, to)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	if len(changes) == 0 {
+		return decimal.Zero, nil
+	}
+
+	daily := make([]decimal.Decimal, days)
+	for i := range daily {
+		daily[i] = decimal.Zero
+	}
+	for _, change := range changes {
+		day := int(change.Day.Sub(from).Hours() / 24)
+		if day >= 0 && day < days {
+			daily[day] = change.Amount
+		}
+	}
+
+	return standardDeviation(daily), nil
+}
+
+// standardDeviation returns the population standard deviation of values
+func standardDeviation(values []decimal.Decimal) decimal.Decimal {
+	count := decimal.NewFromInt(int64(len(values)))
+	mean := decimal.Sum(decimal.Zero, values...).Div(count)
+
+	variance := decimal.Zero
+	for _, value := range values {
+		deviation := value.Sub(mean)
+		variance = variance.Add(deviation.Mul(deviation))
+	}
+	variance = variance.Div(count)
+
+	// decimal has no square root
+	return decimal.NewFromFloat(math.Sqrt(variance.InexactFloat64()))
+}
+
+// Cadence is how regularly a user transacts. The gaps are in seconds and nil
+// for users with fewer than two transactions.
+type Cadence struct {
+	Transactions      int64    `json:"transactions"`
+	AverageGapSeconds *float64 `json:"average_gap_seconds"`
+	MaxGapSeconds     *float64 `json:"max_gap_seconds"`
+}
+
+// GetTransactionCadence returns the average and longest time between the
+// user's consecutive transactions, in the order they were created. Voided
+// transactions are left out.
+func (tm *TransactionManagerClient) GetTransactionCadence(ctx context.Context, userID uuid.UUID) (Cadence, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return Cadence{}, err
+	}
+
+	gaps, err := tm.storageClient.TransactionRepository.FindTransactionGaps(ctx, userID)
+	if err != nil {
+		return Cadence{}, err
+	}
+
+	cadence := Cadence{Transactions: gaps.Count}
+	if gaps.Average.Valid {
+		cadence.AverageGapSeconds = &gaps.Average.Float64
+	}
+	if gaps.Max.Valid {
+		cadence.MaxGapSeconds = &gaps.Max.Float64
+	}
+	return cadence, nil
+}
@@ -0,0 +1,24 @@
+package transactionmanager
+
+import (
+	"context"
+
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// ErrTenantMismatch is returned when a write for a user comes from another
+// tenant than the user's
+var ErrTenantMismatch = storage.ErrTenantMismatch
+
+// WithTenant returns a copy of ctx scoped to tenantID. Reads made with it
+// only find users, transactions, transfers and batches of that tenant,
+// others are reported as not found. Writes for another tenant's user return
+// ErrTenantMismatch, and users created with it belong to the tenant.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return storage.WithTenant(ctx, tenantID)
+}
+
+// TenantFromContext returns the tenant ctx is scoped to, if any
+func TenantFromContext(ctx context.Context) (string, bool) {
+	return storage.TenantFromContext(ctx)
+}
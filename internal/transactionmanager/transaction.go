@@ -2,7 +2,9 @@ package transactionmanager
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/shopspring/decimal"
 	"github.com/tebrizetayi/ledgerservice/internal/storage"
@@ -15,40 +17,430 @@ import (
 var (
 	ErrInvalidTransaction      = errors.New("invalid transaction")
 	ErrTransactionAlreadyExist = errors.New("transaction already exist")
+	ErrUserNotFound            = storage.ErrUserNotFound
+	ErrTransactionNotFound     = storage.ErrTransactionNotFound
+	ErrAlreadyVoided           = storage.ErrTransactionAlreadyVoided
+	ErrAlreadyDeleted          = storage.ErrTransactionDeleted
+	ErrAddTimeout              = errors.New("adding the transaction took too long, nothing was written")
+	// ErrTooManyDecimalPlaces is returned for an amount with more digits
+	// after the decimal point than the manager's scale allows
+	ErrTooManyDecimalPlaces = fmt.Errorf("%w: too many decimal places", ErrInvalidTransaction)
+
+	errAmountNotPositive = fmt.Errorf("%w: amount must be positive", ErrInvalidTransaction)
+	errInvalidStatus     = fmt.Errorf("%w: status must be pending or settled", ErrInvalidTransaction)
+	errUnknownReasonCode = fmt.Errorf("%w: unknown reason code", ErrInvalidTransaction)
+	errUnknownChannel    = fmt.Errorf("%w: unknown channel", ErrInvalidTransaction)
+
+	errInitialBalanceNegative = fmt.Errorf("%w: initial balance must not be negative", ErrInvalidTransaction)
+
+	errPageBalancesFiltered = fmt.Errorf("%w: page balances can't be combined with a channel filter", ErrInvalidTransaction)
 )
 
-func NewTransactionManagerClient(storage storage.StorageClient) *TransactionManagerClient {
-	return &TransactionManagerClient{
+func NewTransactionManagerClient(storage storage.StorageClient, opts ...Option) *TransactionManagerClient {
+	tm := &TransactionManagerClient{
 		storageClient: storage,
+		statements:    newStatementJobStore(DefaultStatementQueueSize, DefaultMaxStatementJobs, DefaultStatementJobTTL),
+		reasonCodes:   reasonCodeSet(DefaultReasonCodes),
+		clock:         time.Now,
+		events:        NopEventSink{},
+
+		maxDecimalPlaces: -1,
+	}
+	for _, opt := range opts {
+		opt(tm)
 	}
+	return tm
 }
 
+// Now returns the current time according to the manager's clock
+func (tm *TransactionManagerClient) Now() time.Time {
+	return tm.clock()
+}
+
+// AddTransaction stores a transaction and moves the user's balance by its
+// amount. A debit, a negative amount, that the user's available balance
+// doesn't cover returns ErrInsufficientFunds unless the user is one of the
+// overdraft accounts.
 func (tm *TransactionManagerClient) AddTransaction(ctx context.Context, transactionEntity Transaction) (Transaction, error) {
-	if !tm.ValidateTransaction(ctx, transactionEntity) {
-		return Transaction{}, ErrInvalidTransaction
+	if tm.addTimeout <= 0 {
+		return tm.addTransaction(ctx, transactionEntity)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, tm.addTimeout)
+	defer cancel()
+
+	transaction, err := tm.addTransaction(timeoutCtx, transactionEntity)
+	// Only our own timer running out is a timeout, the caller's context
+	// ending first is reported as it is
+	if err != nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		// The database transaction is rolled back along with the context
+		return Transaction{}, ErrAddTimeout
+	}
+	return transaction, err
+}
+
+func (tm *TransactionManagerClient) addTransaction(ctx context.Context, transactionEntity Transaction) (Transaction, error) {
+	if tm.inflight != nil {
+		release, err := tm.inflight.acquire(ctx, transactionEntity.UserID)
+		if err != nil {
+			return Transaction{}, err
+		}
+		defer release()
+	}
+
+	// Transactions without a key get one of their own, so two of them are
+	// never taken for retries of each other
+	keyless := transactionEntity.IdempotencyKey == uuid.Nil
+	if keyless {
+		transactionEntity.IdempotencyKey = uuid.New()
+	}
+
+	// Transactions without a timestamp get the server's
+	serverTimestamp := transactionEntity.CreatedAt.IsZero()
+	if serverTimestamp {
+		transactionEntity.CreatedAt = tm.Now().UTC()
+	}
+
+	account, err := tm.accountCurrency(ctx, transactionEntity.UserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	transactionEntity.Currency = transactionCurrency(transactionEntity.Currency, account)
+
+	limits, err := tm.effectiveLimits(ctx, transactionEntity.UserID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	if errs := tm.validate(ctx, transactionEntity, limits, account); len(errs) > 0 {
+		return Transaction{}, validationError(errs)
+	}
+
+	if err := tm.checkDailyLimit(ctx, transactionEntity, limits, decimal.Zero); err != nil {
+		return Transaction{}, err
+	}
+
+	if err := tm.checkCreditCap(ctx, transactionEntity, limits, decimal.Zero); err != nil {
+		return Transaction{}, err
+	}
+
+	if keyless && tm.duplicateWindow > 0 {
+		transactionEntity.PossibleDuplicateOf, err = tm.findDuplicate(ctx, transactionEntity)
+		if err != nil {
+			return Transaction{}, err
+		}
 	}
 
-	_, err := tm.storageClient.TransactionRepository.AddTransaction(ctx, storage.Transaction{
-		ID:             transactionEntity.ID,
-		Amount:         transactionEntity.Amount,
-		UserID:         transactionEntity.UserID,
-		CreatedAt:      transactionEntity.CreatedAt,
-		IdempotencyKey: transactionEntity.IdempotencyKey,
+	holdAmount, holdUntil := tm.creditHold(transactionEntity)
+
+	derived, err := tm.deriveEntries(transactionEntity)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	principal := storage.Transaction{
+		ID:                 transactionEntity.ID,
+		Amount:             transactionEntity.Amount,
+		UserID:             transactionEntity.UserID,
+		CreatedAt:          transactionEntity.CreatedAt,
+		IdempotencyKey:     transactionEntity.IdempotencyKey,
+		Status:             storage.TransactionStatus(transactionEntity.Status),
+		ReasonCode:         transactionEntity.ReasonCode,
+		Currency:           transactionEntity.Currency,
+		Channel:            transactionEntity.Channel,
+		ServerTimestamp:    serverTimestamp,
+		HoldAmount:         holdAmount,
+		HoldUntil:          holdUntil,
+		AllowOverdraft:     tm.overdraftAccounts[transactionEntity.UserID],
+		OverdraftTolerance: limits.OverdraftTolerance,
+	}
+	tm.applyWriteOptions(&principal)
+	// The webhook announcing the transaction is written along with it
+	principal.Outbox = tm.webhookOutbox(EventTransactionCreated, func(added []storage.Transaction) interface{} {
+		return storedTransaction(transactionEntity, added, serverTimestamp)
 	})
 
-	if err != nil && strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+	var added []storage.Transaction
+	if len(derived) == 0 {
+		var transaction storage.Transaction
+		transaction, err = tm.storageClient.TransactionRepository.AddTransaction(ctx, principal)
+		added = []storage.Transaction{transaction}
+	} else {
+		// The principal and its derived entries are written together
+		entries := []storage.Transaction{principal}
+		for _, entry := range derived {
+			entries = append(entries, toStorageDerived(entry, principal))
+		}
+		added, err = tm.storageClient.TransactionRepository.AddTransactionBatch(ctx, entries)
+	}
+
+	if storage.IsUniqueViolation(err) {
+		if tm.returnExisting {
+			return tm.replayTransaction(ctx, transactionEntity)
+		}
 		return Transaction{}, ErrTransactionAlreadyExist
 	}
 	if err != nil {
 		return Transaction{}, err
 	}
 
+	transactionEntity = storedTransaction(transactionEntity, added, serverTimestamp)
+	balance := added[len(added)-1].BalanceAfter
+
+	tm.log(ctx).Debug("transaction added",
+		"transaction_id", transactionEntity.ID,
+		"user_id", transactionEntity.UserID,
+		"amount", transactionEntity.Amount.String(),
+		"sequence", transactionEntity.Sequence)
+
+	tm.publish(ctx, TransactionCreated{
+		TransactionID: transactionEntity.ID,
+		UserID:        transactionEntity.UserID,
+		Amount:        transactionEntity.Amount,
+		Currency:      transactionEntity.Currency,
+		Balance:       balance,
+		CreatedAt:     transactionEntity.CreatedAt,
+	})
 	return transactionEntity, nil
 }
 
-func (tm *TransactionManagerClient) ValidateTransaction(ctx context.Context, transaction Transaction) bool {
-	// Validate the transaction
-	return transaction.Amount.IsPositive()
+// applyWriteOptions passes the manager's balance fallback, key reuse and
+// monotonic timestamp options to the repository along with a transaction
+// about to be written
+func (tm *TransactionManagerClient) applyWriteOptions(transaction *storage.Transaction) {
+	transaction.DirtyBalanceOnFailure = tm.balanceFallback
+	transaction.ReuseSettledKey = tm.keyReuse
+	transaction.MonotonicTimestamp = tm.monotonicTimestamps
+}
+
+// storedTransaction fills in what writing the transaction set, from added:
+// the principal as stored followed by its derived entries
+func storedTransaction(entity Transaction, added []storage.Transaction, serverTimestamp bool) Transaction {
+	principal := added[0]
+	if serverTimestamp {
+		// Monotonic timestamps may have moved it
+		entity.CreatedAt = principal.CreatedAt
+	}
+	entity.Sequence = principal.Sequence
+	entity.Status = TransactionStatus(principal.Status)
+	entity.Channel = principal.Channel
+	entity.UserVersion = principal.UserVersion
+	entity.BalanceAfter = principal.BalanceAfter
+	entity.Derived = nil
+	for _, entry := range added[1:] {
+		entity.Derived = append(entity.Derived, fromStorageTransaction(entry))
+	}
+	return entity
+}
+
+// replayTransaction returns the user's transaction a retry collided with.
+// Keys are scoped per user, so it is never another user's. A transaction
+// holding the key for another amount isn't the one retried and returns
+// ErrIdempotencyKeyTaken.
+func (tm *TransactionManagerClient) replayTransaction(ctx context.Context, retry Transaction) (Transaction, error) {
+	existing, err := tm.storageClient.TransactionRepository.FindTransactionHoldingKey(ctx, retry.UserID, retry.IdempotencyKey)
+	if errors.Is(err, storage.ErrTransactionNotFound) {
+		// Released since the insert failed
+		return Transaction{}, ErrTransactionAlreadyExist
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !existing.Amount.Equal(retry.Amount) {
+		return Transaction{}, ErrIdempotencyKeyTaken
+	}
+
+	transaction := fromStorageTransaction(existing)
+	transaction.Replayed = true
+	transaction.Derived, err = tm.findDerivedEntries(ctx, retry)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return transaction, nil
+}
+
+// VoidTransaction cancels a transaction, removing its amount from the user's
+// balance. Transactions with live refunds or reversals return
+// ErrHasCompensations and legs of transfers ErrTransferLeg.
+func (tm *TransactionManagerClient) VoidTransaction(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
+	transaction, err := tm.storageClient.TransactionRepository.VoidTransaction(ctx, transactionID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(transaction), nil
+}
+
+// DeleteTransaction soft deletes a transaction for compliance. It is voided,
+// removing its amount from the user's balance unless it already was, and
+// left out of the history, but kept for auditors.
+func (tm *TransactionManagerClient) DeleteTransaction(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
+	transaction, err := tm.storageClient.TransactionRepository.SoftDelete(ctx, transactionID, tm.Now())
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(transaction), nil
+}
+
+// GetTransaction returns a transaction by ID, or ErrTransactionNotFound
+func (tm *TransactionManagerClient) GetTransaction(ctx context.Context, transactionID uuid.UUID) (Transaction, error) {
+	transaction, err := tm.storageClient.TransactionRepository.FindTransactionByID(ctx, transactionID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(transaction), nil
+}
+
+// GetTransactionImpact returns the user's balance just before and just after
+// one of their transactions, summing their history in order up to it. A
+// transaction of another user is reported as ErrTransactionNotFound, so its
+// existence isn't given away.
+func (tm *TransactionManagerClient) GetTransactionImpact(ctx context.Context, userID uuid.UUID, transactionID uuid.UUID) (TransactionImpact, error) {
+	transaction, err := tm.storageClient.TransactionRepository.FindTransactionByID(ctx, transactionID)
+	if err != nil {
+		return TransactionImpact{}, err
+	}
+	if transaction.UserID != userID {
+		return TransactionImpact{}, ErrTransactionNotFound
+	}
+
+	before, err := tm.storageClient.TransactionRepository.BalanceBeforeTransaction(ctx, transaction)
+	if err != nil {
+		return TransactionImpact{}, err
+	}
+
+	impact := TransactionImpact{
+		TransactionID: transaction.ID,
+		Amount:        transaction.Amount,
+		BalanceBefore: before,
+		BalanceAfter:  before,
+	}
+	if transaction.Status != storage.TransactionStatusVoided {
+		impact.BalanceAfter = before.Add(transaction.Amount)
+	}
+	return impact, nil
+}
+
+// GetTransactionsByIDs returns the transactions with the given IDs in the
+// order the IDs were given. IDs without a transaction are left out.
+func (tm *TransactionManagerClient) GetTransactionsByIDs(ctx context.Context, ids []uuid.UUID) ([]Transaction, error) {
+	found, err := tm.storageClient.TransactionRepository.FindTransactionsByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uuid.UUID]storage.Transaction, len(found))
+	for _, transaction := range found {
+		byID[transaction.ID] = transaction
+	}
+
+	transactions := []Transaction{}
+	for _, id := range ids {
+		if transaction, ok := byID[id]; ok {
+			transactions = append(transactions, fromStorageTransaction(transaction))
+			// Asked twice, returned once
+			delete(byID, id)
+		}
+	}
+	return transactions, nil
+}
+
+// ValidateTransaction runs the checks a transaction must pass before it can
+// be stored and returns every problem it finds, without storing anything, so
+// it is safe to call for previews. The limits are the user's, overrides
+// included, when the transaction has a user, and the global ones otherwise;
+// the error is only set when they can't be read. The currency is only
+// checked to be a well-formed ISO 4217 code, whether it matches the user's
+// account is left to AddTransaction.
+func (tm *TransactionManagerClient) ValidateTransaction(ctx context.Context, transaction Transaction) ([]error, error) {
+	limits := tm.limits
+	if transaction.UserID != uuid.Nil {
+		var err error
+		limits, err = tm.effectiveLimits(ctx, transaction.UserID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tm.validate(ctx, transaction, limits, ""), nil
+}
+
+// accountCurrency returns the currency of the user's account, empty when it
+// is in the ledger's implicit currency
+func (tm *TransactionManagerClient) accountCurrency(ctx context.Context, userID uuid.UUID) (string, error) {
+	user, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return user.Currency, nil
+}
+
+// validate runs the stateless checks against limits and, unless it is empty,
+// the currency of the user's account, which callers read beforehand. ctx only
+// tells whether it is a backfill.
+func (tm *TransactionManagerClient) validate(ctx context.Context, transaction Transaction, limits Limits, account string) []error {
+	var errs []error
+	switch {
+	case transaction.Amount.IsZero() && !limits.AllowZeroAmount:
+		errs = append(errs, errAmountZero)
+	case transaction.Amount.IsNegative() && !limits.AllowNegative:
+		errs = append(errs, errAmountNotPositive)
+	}
+
+	amounts := limits.amountLimits(transaction.Currency)
+	if amounts.MaxAmount.IsPositive() && transaction.Amount.Abs().GreaterThan(amounts.MaxAmount) {
+		errs = append(errs, errAmountExceedsMaxLimit)
+	}
+	if amounts.MinAmount.IsPositive() && !transaction.Amount.IsZero() && transaction.Amount.Abs().LessThan(amounts.MinAmount) {
+		errs = append(errs, errAmountBelowMinLimit)
+	}
+	if err := tm.checkDecimalPlaces(transaction.Amount); err != nil {
+		errs = append(errs, err)
+	}
+	if err := tm.checkCreatedAt(ctx, transaction.CreatedAt); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch transaction.Status {
+	case "", TransactionStatusPending, TransactionStatusSettled:
+	default:
+		errs = append(errs, errInvalidStatus)
+	}
+
+	if transaction.ReasonCode != "" && !tm.reasonCodes[transaction.ReasonCode] {
+		errs = append(errs, fmt.Errorf("%w %q", errUnknownReasonCode, transaction.ReasonCode))
+	}
+
+	if transaction.Channel != "" && !ValidChannel(transaction.Channel) {
+		errs = append(errs, fmt.Errorf("%w %q", errUnknownChannel, transaction.Channel))
+	}
+
+	if err := checkCurrencyCode(transaction.Currency); err != nil {
+		errs = append(errs, err)
+	} else if err := checkCurrency(transaction, account); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// checkDecimalPlaces returns ErrTooManyDecimalPlaces when amount can't be
+// written with the manager's scale. Amounts are never rounded to fit it.
+// Trailing zeros don't count, 10.500 fits a scale of 2.
+func (tm *TransactionManagerClient) checkDecimalPlaces(amount decimal.Decimal) error {
+	if tm.maxDecimalPlaces < 0 || amount.Truncate(tm.maxDecimalPlaces).Equal(amount) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s has more than %d", ErrTooManyDecimalPlaces, amount, tm.maxDecimalPlaces)
+}
+
+// validationError picks the error AddTransaction reports for a failed
+// validation. Detailed messages wrapping ErrInvalidTransaction collapse to it.
+func validationError(errs []error) error {
+	if errors.Is(errs[0], ErrInvalidTransaction) {
+		return ErrInvalidTransaction
+	}
+	return errs[0]
 }
 
 func (tm *TransactionManagerClient) GetUserBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
@@ -57,30 +449,421 @@ func (tm *TransactionManagerClient) GetUserBalance(ctx context.Context, userID u
 		return decimal.NewFromFloat(0), err
 	}
 
+	if tm.balanceFallback && user.BalanceDirty {
+		return tm.RecomputeBalance(ctx, userID)
+	}
+
 	return user.Balance, nil
 }
 
-func (tm *TransactionManagerClient) GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int) ([]Transaction, error) {
+// GetBalanceAsOf returns the user's balance as it stood at the given time,
+// the sum of the transactions created at or before it. Voided transactions
+// are left out, even if they were voided after that time.
+func (tm *TransactionManagerClient) GetBalanceAsOf(ctx context.Context, userID uuid.UUID, at time.Time) (decimal.Decimal, error) {
+	if _, err := tm.storageClient.UserRepository.FindByID(ctx, userID); err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	return tm.storageClient.TransactionRepository.BalanceAsOf(ctx, userID, at)
+}
+
+// GetUserBalanceExcluding returns the user's balance without the
+// transactions of one reason code, e.g. the balance before fees. The reason
+// code is matched case-insensitively and must be one of the manager's.
+func (tm *TransactionManagerClient) GetUserBalanceExcluding(ctx context.Context, userID uuid.UUID, reasonCode string) (decimal.Decimal, error) {
+	reasonCode = strings.ToUpper(reasonCode)
+	if !tm.reasonCodes[reasonCode] {
+		return decimal.Decimal{}, errUnknownReasonCode
+	}
+
+	if _, err := tm.storageClient.UserRepository.FindByID(ctx, userID); err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	return tm.storageClient.TransactionRepository.BalanceExcludingReasonCode(ctx, userID, reasonCode)
+}
+
+// openingReasonCode is given to the transaction booking a new user's initial
+// balance when the vocabulary has it
+const openingReasonCode = "DEPOSIT"
+
+// CreateUser adds a user with a new ID and an account in currency, or in the
+// ledger's implicit currency when it is empty. A positive initial balance is
+// booked as the user's first transaction, so the balance matches the ledger
+// from the start. The user belongs to the tenant ctx is scoped to, if any.
+// A retry with the idempotency key of a user already created returns that
+// user marked Replayed, and ErrIdempotencyKeyTaken if it asked for another
+// initial balance or currency. uuid.Nil means no key.
+func (tm *TransactionManagerClient) CreateUser(ctx context.Context, initialBalance decimal.Decimal, currency string, idempotencyKey uuid.UUID) (User, error) {
+	if initialBalance.IsNegative() {
+		return User{}, errInitialBalanceNegative
+	}
+	if currency != "" {
+		if _, err := CurrencyScale(currency); err != nil {
+			return User{}, err
+		}
+	}
+
+	now := tm.Now().UTC()
+	tenantID, _ := TenantFromContext(ctx)
+	user := storage.User{ID: uuid.New(), Currency: strings.ToUpper(currency), CreatedAt: now, TenantID: tenantID}
+	opening := storage.Transaction{
+		ID:              uuid.New(),
+		Amount:          initialBalance,
+		CreatedAt:       now,
+		IdempotencyKey:  uuid.New(),
+		ServerTimestamp: true,
+	}
+	if tm.reasonCodes[openingReasonCode] {
+		opening.ReasonCode = openingReasonCode
+	}
+
+	creationKey := storage.UserCreationKey{
+		TenantID:       tenantID,
+		IdempotencyKey: idempotencyKey,
+		UserID:         user.ID,
+		InitialBalance: initialBalance,
+		Currency:       user.Currency,
+	}
+	if idempotencyKey != uuid.Nil {
+		replayed, err := tm.replayUserCreation(ctx, creationKey)
+		if !errors.Is(err, storage.ErrUserCreationKeyNotFound) {
+			return replayed, err
+		}
+	}
+
+	err := tm.storageClient.TransactionRepository.OpenAccount(ctx, user, opening, creationKey)
+	if storage.IsUniqueViolation(err) && idempotencyKey != uuid.Nil {
+		// A concurrent retry created the user first
+		return tm.replayUserCreation(ctx, creationKey)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	created, err := tm.storageClient.UserRepository.FindByID(ctx, user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	return fromStorageUser(created), nil
+}
+
+// replayUserCreation returns the user created with the idempotency key of
+// retry, or storage.ErrUserCreationKeyNotFound when there is none
+func (tm *TransactionManagerClient) replayUserCreation(ctx context.Context, retry storage.UserCreationKey) (User, error) {
+	existing, err := tm.storageClient.UserRepository.FindCreationKey(ctx, retry.TenantID, retry.IdempotencyKey)
+	if err != nil {
+		return User{}, err
+	}
+	if !existing.InitialBalance.Equal(retry.InitialBalance) || existing.Currency != retry.Currency {
+		return User{}, ErrIdempotencyKeyTaken
+	}
+
+	user, err := tm.storageClient.UserRepository.FindByID(ctx, existing.UserID)
+	if err != nil {
+		return User{}, err
+	}
+	replayed := fromStorageUser(user)
+	replayed.Replayed = true
+	return replayed, nil
+}
+
+// GetUserByExternalID looks a user up by the identifier the client knows
+// them by, which is only unique within the tenant ctx is scoped to
+func (tm *TransactionManagerClient) GetUserByExternalID(ctx context.Context, externalID string) (User, error) {
+	user, err := tm.storageClient.UserRepository.FindByExternalID(ctx, externalID)
+	if err != nil {
+		return User{}, err
+	}
+
+	return fromStorageUser(user), nil
+}
+
+func fromStorageUser(user storage.User) User {
+	return User{
+		ID:              user.ID,
+		Balance:         user.Balance,
+		ExternalID:      user.ExternalID.String,
+		Version:         user.Version,
+		Currency:        user.Currency,
+		CreatedAt:       user.CreatedAt,
+		TenantID:        user.TenantID,
+		DisplayCurrency: user.DisplayCurrency,
+	}
+}
+
+// GetRecentUsers returns up to limit users, newest first
+func (tm *TransactionManagerClient) GetRecentUsers(ctx context.Context, limit int) ([]User, error) {
+	stored, err := tm.storageClient.UserRepository.FindRecentUsers(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(stored))
+	for _, user := range stored {
+		users = append(users, fromStorageUser(user))
+	}
+	return users, nil
+}
+
+// RecomputeBalance rebuilds the user's stored balance from their transactions
+// and clears the dirty flag
+func (tm *TransactionManagerClient) RecomputeBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
+	_, balance, err := tm.recomputeBalance(ctx, userID)
+	return balance, err
+}
+
+// recomputeBalance recomputes in chunks when a chunk size is configured and
+// returns the stored balance from before and after
+func (tm *TransactionManagerClient) recomputeBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, decimal.Decimal, error) {
+	if tm.recomputeChunkSize > 0 {
+		return tm.storageClient.TransactionRepository.RecomputeBalanceChunked(ctx, userID, tm.recomputeChunkSize)
+	}
+	return tm.storageClient.TransactionRepository.RecomputeBalance(ctx, userID)
+}
+
+func (tm *TransactionManagerClient) GetUserTransactionHistory(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter HistoryFilter) ([]Transaction, error) {
 	// Validate the user
 	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
 	if err != nil {
 		return []Transaction{}, err
 	}
 
-	transactionResult, err := tm.storageClient.TransactionRepository.GetUserTransactionHistory(ctx, userID, page, pageSize)
+	transactionResult, err := tm.storageClient.TransactionRepository.GetUserTransactionHistory(ctx, userID, page, pageSize, filter.toStorage())
 	if err != nil {
 		return []Transaction{}, err
 	}
 
 	transactions := []Transaction{}
 	for _, transaction := range transactionResult {
-		transactions = append(transactions, Transaction{
-			ID:             transaction.ID,
-			Amount:         transaction.Amount,
-			UserID:         transaction.UserID,
-			CreatedAt:      transaction.CreatedAt,
-			IdempotencyKey: transaction.IdempotencyKey,
-		})
+		transactions = append(transactions, fromStorageTransaction(transaction))
 	}
 	return transactions, nil
 }
+
+// DayGroup is one UTC day of a user's history with its net amount, the sum
+// of the day's transactions that count towards the balance
+type DayGroup struct {
+	Date         string          `json:"date"`
+	Transactions []Transaction   `json:"transactions"`
+	Net          decimal.Decimal `json:"net"`
+}
+
+// dayLayout formats the date of a DayGroup
+const dayLayout = "2006-01-02"
+
+// GetUserTransactionHistoryByDay returns a page of the user's history grouped
+// by UTC day, newest first. Pages count days, so a day's transactions are
+// always returned together.
+func (tm *TransactionManagerClient) GetUserTransactionHistoryByDay(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter HistoryFilter) ([]DayGroup, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions, err := tm.storageClient.TransactionRepository.GetUserTransactionHistoryByDay(ctx, userID, page, pageSize, filter.toStorage())
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []DayGroup{}
+	for _, transaction := range transactions {
+		date := transaction.CreatedAt.UTC().Format(dayLayout)
+		if len(groups) == 0 || groups[len(groups)-1].Date != date {
+			groups = append(groups, DayGroup{Date: date, Transactions: []Transaction{}})
+		}
+		group := &groups[len(groups)-1]
+		group.Transactions = append(group.Transactions, fromStorageTransaction(transaction))
+		if transaction.Status != storage.TransactionStatusVoided {
+			group.Net = group.Net.Add(transaction.Amount)
+		}
+	}
+	return groups, nil
+}
+
+// CountUserTransactions returns how many of the user's transactions the
+// filter lets through, the total the history is paged over. With
+// WithEstimatedCounts a large total is estimated rather than counted, which
+// the returned flag reports.
+func (tm *TransactionManagerClient) CountUserTransactions(ctx context.Context, userID uuid.UUID, filter HistoryFilter) (int64, bool, error) {
+	if tm.estimateCountsFrom > 0 {
+		estimate, err := tm.storageClient.TransactionRepository.EstimateUserTransactions(ctx, userID, filter.toStorage())
+		if err != nil {
+			return 0, false, err
+		}
+		if estimate >= tm.estimateCountsFrom {
+			return estimate, true, nil
+		}
+	}
+
+	count, err := tm.storageClient.TransactionRepository.CountUserTransactions(ctx, userID, filter.toStorage())
+	return count, false, err
+}
+
+// GetUserTransactionHistoryAfter returns up to limit of the user's
+// transactions following cursor, newest first, along with the cursor of the
+// next page. The next cursor is zero once there are no more transactions.
+func (tm *TransactionManagerClient) GetUserTransactionHistoryAfter(ctx context.Context, userID uuid.UUID, cursor HistoryCursor, limit int, filter HistoryFilter) ([]Transaction, HistoryCursor, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, HistoryCursor{}, err
+	}
+
+	// One more than asked tells whether another page follows
+	stored, err := tm.storageClient.TransactionRepository.GetUserTransactionHistoryAfter(ctx, userID, storage.HistoryCursor(cursor), limit+1, filter.toStorage())
+	if err != nil {
+		return nil, HistoryCursor{}, err
+	}
+
+	var next HistoryCursor
+	if len(stored) > limit {
+		stored = stored[:limit]
+		last := stored[len(stored)-1]
+		next = HistoryCursor{CreatedAt: last.CreatedAt, Sequence: last.Sequence}
+	}
+
+	transactions := make([]Transaction, 0, len(stored))
+	for _, transaction := range stored {
+		transactions = append(transactions, fromStorageTransaction(transaction))
+	}
+	return transactions, next, nil
+}
+
+// GetUserTransactionHistoryPage returns a page of the user's history like
+// GetUserTransactionHistory, bracketed by the balances before and after it.
+// Pages run from newest to oldest, so a page past the end opens and closes
+// at zero. The balances cover the whole ledger, so they can't be combined
+// with a channel filter.
+func (tm *TransactionManagerClient) GetUserTransactionHistoryPage(ctx context.Context, userID uuid.UUID, page int, pageSize int, filter HistoryFilter) (HistoryPage, error) {
+	if filter.Channel != "" {
+		return HistoryPage{}, errPageBalancesFiltered
+	}
+
+	transactions, err := tm.GetUserTransactionHistory(ctx, userID, page, pageSize, filter)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+
+	historyPage := HistoryPage{Transactions: transactions}
+	if len(transactions) == 0 {
+		return historyPage, nil
+	}
+
+	oldest := transactions[len(transactions)-1]
+	historyPage.PageOpeningBalance, err = tm.storageClient.TransactionRepository.BalanceBeforeTransaction(ctx, storage.Transaction{
+		UserID:    oldest.UserID,
+		CreatedAt: oldest.CreatedAt,
+		Sequence:  oldest.Sequence,
+	})
+	if err != nil {
+		return HistoryPage{}, err
+	}
+
+	historyPage.PageClosingBalance = historyPage.PageOpeningBalance
+	for _, transaction := range transactions {
+		if transaction.Status != TransactionStatusVoided {
+			historyPage.PageClosingBalance = historyPage.PageClosingBalance.Add(transaction.Amount)
+		}
+	}
+	return historyPage, nil
+}
+
+// StreamUserTransactionHistory calls fn for every transaction of the user,
+// newest first, without loading the whole history into memory
+func (tm *TransactionManagerClient) StreamUserTransactionHistory(ctx context.Context, userID uuid.UUID, filter HistoryFilter, fn func(Transaction) error) error {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return tm.storageClient.TransactionRepository.StreamUserTransactions(ctx, userID, filter.toStorage(), func(transaction storage.Transaction) error {
+		return fn(fromStorageTransaction(transaction))
+	})
+}
+
+// GetLargestTransaction returns the user's biggest credit, or biggest debit
+// when transactionType is TransactionTypeDebit
+func (tm *TransactionManagerClient) GetLargestTransaction(ctx context.Context, userID uuid.UUID, transactionType TransactionType) (Transaction, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	transaction, err := tm.storageClient.TransactionRepository.FindLargestTransaction(ctx, userID, storage.TransactionType(transactionType))
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return fromStorageTransaction(transaction), nil
+}
+
+// GetAverageTransactionAmount returns the mean amount of the user's
+// transactions created in [from, to), of any type when transactionType is
+// empty. Users without matching transactions average zero.
+func (tm *TransactionManagerClient) GetAverageTransactionAmount(ctx context.Context, userID uuid.UUID, transactionType TransactionType, from time.Time, to time.Time) (decimal.Decimal, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	return tm.storageClient.TransactionRepository.AverageAmount(ctx, userID, storage.TransactionType(transactionType), from, to)
+}
+
+// GetUserIdempotencyKeys returns a page of the distinct idempotency keys the
+// user's transactions created in [from, to) were written with, for
+// diagnosing client retries and key collisions
+func (tm *TransactionManagerClient) GetUserIdempotencyKeys(ctx context.Context, userID uuid.UUID, from time.Time, to time.Time, page int, pageSize int) ([]IdempotencyKeyUsage, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usages, err := tm.storageClient.TransactionRepository.FindUserIdempotencyKeys(ctx, userID, from, to, page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []IdempotencyKeyUsage{}
+	for _, usage := range usages {
+		result = append(result, IdempotencyKeyUsage{
+			IdempotencyKey: usage.Key,
+			TransactionIDs: usage.TransactionIDs,
+			FirstUsedAt:    usage.FirstUsedAt,
+		})
+	}
+	return result, nil
+}
+
+func fromStorageTransaction(transaction storage.Transaction) Transaction {
+	result := Transaction{
+		ID:             transaction.ID,
+		Amount:         transaction.Amount,
+		UserID:         transaction.UserID,
+		CreatedAt:      transaction.CreatedAt,
+		IdempotencyKey: transaction.IdempotencyKey,
+		Sequence:       transaction.Sequence,
+		Status:         TransactionStatus(transaction.Status),
+		ReasonCode:     transaction.ReasonCode,
+		Currency:       transaction.Currency,
+		Channel:        transaction.Channel,
+		TenantID:       transaction.TenantID,
+		BalanceAfter:   transaction.BalanceAfter,
+		UserVersion:    transaction.UserVersion,
+		DeletedAt:      transaction.DeletedAt,
+	}
+	if transaction.ReversesID.Valid {
+		reversesID := transaction.ReversesID.UUID
+		result.ReversesID = &reversesID
+	}
+	if transaction.BatchID.Valid {
+		batchID := transaction.BatchID.UUID
+		result.BatchID = &batchID
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package transactionmanager
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+	utils "github.com/tebrizetayi/ledgerservice/internal/test_utils"
+)
+
+// benchmarkParallelism multiplies GOMAXPROCS to get the number of goroutines
+// driving AddTransaction
+const benchmarkParallelism = 4
+
+// BenchmarkAddTransactionConcurrent measures AddTransaction throughput with
+// every goroutine writing to its own user, so they only contend on the
+// database itself
+func BenchmarkAddTransactionConcurrent(b *testing.B) {
+	benchmarkAddTransaction(b, false)
+}
+
+// BenchmarkAddTransactionConcurrentSingleUser measures AddTransaction
+// throughput with every goroutine writing to the same user, serialised by
+// the user row lock
+func BenchmarkAddTransactionConcurrentSingleUser(b *testing.B) {
+	benchmarkAddTransaction(b, true)
+}
+
+func benchmarkAddTransaction(b *testing.B, singleUser bool) {
+	// The database is shared by every iteration, only the rows are new
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		b.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient)
+
+	newUser := func() uuid.UUID {
+		user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+		if err := storageClient.UserRepository.Add(testEnv.Context, user); err != nil {
+			b.Fatalf("failed to add user: %v", err)
+		}
+		return user.ID
+	}
+
+	sharedUserID := newUser()
+	var failures int64
+
+	b.SetParallelism(benchmarkParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		userID := sharedUserID
+		if !singleUser {
+			userID = newUser()
+		}
+
+		for pb.Next() {
+			_, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(1),
+				UserID:         userID,
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+			}
+		}
+	})
+	b.StopTimer()
+
+	if failures > 0 {
+		b.Fatalf("%d of %d transactions failed", failures, b.N)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "tx/s")
+}
@@ -1,6 +1,7 @@
 package transactionmanager
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -192,3 +193,1515 @@ func TestAddTransaction_IdempotencyDifferentAmount_Concurrency(t *testing.T) {
 	// Assert
 	assert.Equal(t, int32(concurrentRequests), successCount, "only one transaction should be added")
 }
+
+func TestGetUserBalance_DirtyBalance_Recomputed(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithBalanceFallback(true))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	for _, amount := range []float64{100, 50} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(amount),
+			UserID:         user.ID,
+			CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	// Simulate a balance update that failed after the transaction was stored
+	_, err = testEnv.DB.ExecContext(testEnv.Context, "UPDATE users SET balance = 0, balance_dirty = TRUE WHERE id = $1", user.ID)
+	if err != nil {
+		t.Fatalf("failed to mark balance dirty: %v", err)
+	}
+
+	// Act
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+
+	// Assert
+	assert.True(t, balance.Equal(decimal.NewFromFloat(150)), "balance should be recomputed to 150, got %s", balance)
+
+	storedUser, err := transactionManager.storageClient.UserRepository.FindByID(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to find user: %v", err)
+	}
+	assert.False(t, storedUser.BalanceDirty, "dirty flag should be cleared")
+	assert.True(t, storedUser.Balance.Equal(decimal.NewFromFloat(150)), "stored balance should be repaired")
+}
+
+func TestAddTransaction_DirtyBalance_RepairedBeforeWrite(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithBalanceFallback(true), WithLimits(Limits{AllowNegative: true}))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	for _, amount := range []float64{100, 50} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(amount),
+			UserID:         user.ID,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	// Leave a stale balance that would cover far more than the user has
+	_, err = testEnv.DB.ExecContext(testEnv.Context, "UPDATE users SET balance = 1000, balance_dirty = TRUE WHERE id = $1", user.ID)
+	if err != nil {
+		t.Fatalf("failed to mark balance dirty: %v", err)
+	}
+
+	// Act
+	_, overdraftErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(-200),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	debit, debitErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(-100),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+
+	// Assert
+	assert.ErrorIs(t, overdraftErr, ErrInsufficientFunds, "the debit should be checked against the recomputed balance")
+	assert.NoError(t, debitErr)
+	assert.True(t, debit.BalanceAfter.Equal(decimal.NewFromFloat(50)), "balance_after should build on the recomputed balance, got %s", debit.BalanceAfter)
+
+	storedUser, err := transactionManager.storageClient.UserRepository.FindByID(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to find user: %v", err)
+	}
+	assert.False(t, storedUser.BalanceDirty, "dirty flag should be cleared")
+	assert.True(t, storedUser.Balance.Equal(decimal.NewFromFloat(50)))
+}
+
+func TestAddTransaction_UserLimitOverridesGlobal(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithLimits(Limits{
+		MaxAmount: decimal.NewFromFloat(100),
+	}))
+
+	limitedUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	overriddenUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{limitedUser, overriddenUser} {
+		err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	maxAmount := decimal.NewFromFloat(500)
+	_, err = transactionManager.SetUserLimits(testEnv.Context, overriddenUser.ID, UserLimits{MaxAmount: &maxAmount})
+	if err != nil {
+		t.Fatalf("failed to set user limits: %v", err)
+	}
+
+	// Act
+	_, limitedErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(300),
+		UserID:         limitedUser.ID,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: uuid.New(),
+	})
+	_, overriddenErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(300),
+		UserID:         overriddenUser.ID,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: uuid.New(),
+	})
+
+	limitedValidation, err := transactionManager.ValidateTransaction(testEnv.Context, Transaction{
+		Amount:         decimal.NewFromFloat(300),
+		UserID:         limitedUser.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to validate transaction: %v", err)
+	}
+	overriddenValidation, err := transactionManager.ValidateTransaction(testEnv.Context, Transaction{
+		Amount:         decimal.NewFromFloat(300),
+		UserID:         overriddenUser.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to validate transaction: %v", err)
+	}
+
+	// Assert
+	assert.Equal(t, ErrInvalidTransaction, limitedErr, "global limit should reject the amount")
+	assert.NoError(t, overriddenErr, "user limit should allow the amount")
+	assert.Len(t, limitedValidation, 1, "validation should apply the global limit")
+	assert.Empty(t, overriddenValidation, "validation should apply the user limit")
+}
+
+func TestAddTransaction_CreditCap(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithLimits(Limits{
+		AllowNegative: true,
+		CreditCap:     decimal.NewFromFloat(100),
+	}))
+
+	cappedUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	overriddenUser := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{cappedUser, overriddenUser} {
+		err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	creditCap := decimal.NewFromFloat(200)
+	_, err = transactionManager.SetUserLimits(testEnv.Context, overriddenUser.ID, UserLimits{CreditCap: &creditCap})
+	if err != nil {
+		t.Fatalf("failed to set user limits: %v", err)
+	}
+
+	add := func(userID uuid.UUID, amount float64) error {
+		_, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(amount),
+			UserID:         userID,
+			IdempotencyKey: uuid.New(),
+		})
+		return err
+	}
+
+	// Act
+	firstErr := add(cappedUser.ID, 60)
+	atCapErr := add(cappedUser.ID, 40)
+	debitErr := add(cappedUser.ID, -30)
+	beyondCapErr := add(cappedUser.ID, 0.01)
+	overriddenErr := add(overriddenUser.ID, 150)
+	// Each credit fits under the cap on its own, but not together
+	_, batchErr := transactionManager.AddUserTransactions(testEnv.Context, overriddenUser.ID, []Transaction{
+		{ID: uuid.New(), Amount: decimal.NewFromFloat(30), IdempotencyKey: uuid.New()},
+		{ID: uuid.New(), Amount: decimal.NewFromFloat(30), IdempotencyKey: uuid.New()},
+	})
+
+	// Assert
+	assert.NoError(t, firstErr)
+	assert.NoError(t, atCapErr, "credits up to the cap should be accepted")
+	assert.NoError(t, debitErr, "debits should not count towards the cap")
+	assert.ErrorIs(t, beyondCapErr, ErrCreditCapExceeded, "debits should not free up room under the cap")
+	assert.NoError(t, overriddenErr, "user cap should allow the amount")
+	assert.ErrorIs(t, batchErr, ErrCreditCapExceeded, "earlier credits of a batch should count towards the cap")
+	assert.Contains(t, batchErr.Error(), "transaction 1")
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, cappedUser.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, decimal.NewFromFloat(70).Equal(balance), "rejected credit should not change the balance")
+}
+
+func TestAddTransaction_OverdraftTolerance(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithLimits(Limits{
+		AllowNegative:      true,
+		OverdraftTolerance: decimal.NewFromFloat(0.5),
+	}))
+
+	testCases := []struct {
+		name          string
+		debit         float64
+		expectedError error
+	}{
+		{name: "at the tolerance", debit: -10.5},
+		{name: "just within the tolerance", debit: -10.25},
+		{name: "beyond the tolerance", debit: -10.75, expectedError: ErrInsufficientFunds},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+			err := transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+			if err != nil {
+				t.Fatalf("failed to add user: %v", err)
+			}
+			_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(10),
+				UserID:         user.ID,
+				IdempotencyKey: uuid.New(),
+			})
+			if err != nil {
+				t.Fatalf("failed to add transaction: %v", err)
+			}
+
+			// Act
+			_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(tc.debit),
+				UserID:         user.ID,
+				IdempotencyKey: uuid.New(),
+			})
+
+			// Assert
+			balance, balanceErr := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+			assert.NoError(t, balanceErr)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				assert.True(t, balance.Equal(decimal.NewFromFloat(10)))
+				return
+			}
+			assert.NoError(t, err)
+			// The balance records the true shortfall
+			assert.True(t, balance.Equal(decimal.NewFromFloat(10+tc.debit)), "got %s", balance)
+		})
+	}
+}
+
+func TestTransfer_LimitsAndHolds(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient,
+		WithLimits(Limits{
+			CreditCap:          decimal.NewFromFloat(100),
+			OverdraftTolerance: decimal.NewFromFloat(0.5),
+		}),
+		WithCreditHold(decimal.NewFromInt(20), time.Hour))
+
+	sender := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	receiver := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	for _, user := range []storage.User{sender, receiver} {
+		err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+	}
+
+	// 80 of the sender's 100 is available, 24 of the receiver's 30
+	for _, credit := range []struct {
+		userID uuid.UUID
+		amount float64
+	}{{sender.ID, 100}, {receiver.ID, 30}} {
+		_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(credit.amount),
+			UserID:         credit.userID,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+
+	transfer := func(amount float64) error {
+		_, err := transactionManager.Transfer(testEnv.Context, sender.ID, receiver.ID, decimal.NewFromFloat(amount), uuid.New())
+		return err
+	}
+
+	// Act
+	cappedErr := transfer(80.5)
+
+	creditCap := decimal.NewFromFloat(200)
+	_, err = transactionManager.SetUserLimits(testEnv.Context, receiver.ID, UserLimits{CreditCap: &creditCap})
+	if err != nil {
+		t.Fatalf("failed to set user limits: %v", err)
+	}
+	toleratedErr := transfer(80.5)
+	beyondToleranceErr := transfer(0.01)
+
+	// Assert
+	assert.ErrorIs(t, cappedErr, ErrCreditCapExceeded, "the receiver's credit should be held to their cap")
+	assert.NoError(t, toleratedErr, "the sender's overdraft tolerance should apply")
+	assert.ErrorIs(t, beyondToleranceErr, ErrInsufficientFunds)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, receiver.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(110.5)), "got %s", balance)
+
+	available, err := transactionManager.GetAvailableBalance(testEnv.Context, receiver.ID)
+	assert.Nil(t, err)
+	assert.True(t, available.Equal(decimal.NewFromFloat(88.4)), "expected 20%% of the transferred credit held back, got %s available", available)
+}
+
+func TestAddTransaction_KeyReusedAfterVoid(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithKeyReuseAfterSettlement(true))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	idempotencyKey := uuid.New()
+	pending, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(50),
+		UserID:         user.ID,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: idempotencyKey,
+		Status:         TransactionStatusPending,
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// Act & Assert: the key is blocked while the transaction is pending
+	_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(50),
+		UserID:         user.ID,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: idempotencyKey,
+	})
+	assert.Equal(t, ErrTransactionAlreadyExist, err)
+
+	voided, err := transactionManager.VoidTransaction(testEnv.Context, pending.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, TransactionStatusVoided, voided.Status)
+
+	// Once voided the key is free again
+	reused, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(50),
+		UserID:         user.ID,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: idempotencyKey,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TransactionStatusSettled, reused.Status)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(50)))
+
+	recomputed, err := transactionManager.RecomputeBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, recomputed.Equal(balance))
+}
+
+func TestValidateTransaction_AllowZeroAmount(t *testing.T) {
+	testCases := []struct {
+		name            string
+		allowZeroAmount bool
+		amount          decimal.Decimal
+		expectedErrors  int
+	}{
+		{name: "Zero rejected by default", allowZeroAmount: false, amount: decimal.Zero, expectedErrors: 1},
+		{name: "Zero allowed when enabled", allowZeroAmount: true, amount: decimal.Zero, expectedErrors: 0},
+		{name: "Negative still rejected when enabled", allowZeroAmount: true, amount: decimal.NewFromFloat(-1), expectedErrors: 1},
+		{name: "Positive accepted when enabled", allowZeroAmount: true, amount: decimal.NewFromFloat(1), expectedErrors: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Without a user there are no limit overrides to read, so no
+			// database is needed
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil),
+				WithLimits(Limits{AllowZeroAmount: tc.allowZeroAmount}))
+
+			errs, err := transactionManager.ValidateTransaction(context.Background(), Transaction{
+				ID:             uuid.New(),
+				Amount:         tc.amount,
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.expectedErrors, len(errs))
+		})
+	}
+}
+
+func TestValidateTransaction_CurrencyAmountLimits(t *testing.T) {
+	limits := Limits{
+		MinAmount: decimal.NewFromFloat(1),
+		MaxAmount: decimal.NewFromFloat(1000),
+		CurrencyAmounts: map[string]AmountLimits{
+			"USD": {MinAmount: decimal.NewFromFloat(5), MaxAmount: decimal.NewFromFloat(500)},
+			"JPY": {MinAmount: decimal.NewFromFloat(100), MaxAmount: decimal.NewFromFloat(100000)},
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		currency      string
+		amount        decimal.Decimal
+		expectedError error
+	}{
+		{name: "USD within limits", currency: "USD", amount: decimal.NewFromFloat(50)},
+		{name: "USD below minimum", currency: "USD", amount: decimal.NewFromFloat(2), expectedError: errAmountBelowMinLimit},
+		{name: "USD above maximum", currency: "USD", amount: decimal.NewFromFloat(600), expectedError: errAmountExceedsMaxLimit},
+		{name: "JPY within limits", currency: "JPY", amount: decimal.NewFromFloat(50000)},
+		{name: "JPY below minimum", currency: "JPY", amount: decimal.NewFromFloat(50), expectedError: errAmountBelowMinLimit},
+		{name: "JPY above maximum", currency: "JPY", amount: decimal.NewFromFloat(200000), expectedError: errAmountExceedsMaxLimit},
+		{name: "Other currency falls back to global", currency: "EUR", amount: decimal.NewFromFloat(800)},
+		{name: "No currency falls back to global", currency: "", amount: decimal.NewFromFloat(1500), expectedError: errAmountExceedsMaxLimit},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Without a user there is no account currency to read, so no
+			// database is needed
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil), WithLimits(limits))
+
+			errs, err := transactionManager.ValidateTransaction(context.Background(), Transaction{
+				ID:             uuid.New(),
+				Amount:         tc.amount,
+				Currency:       tc.currency,
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			if tc.expectedError == nil {
+				assert.Empty(t, errs)
+				return
+			}
+			if assert.Len(t, errs, 1) {
+				assert.ErrorIs(t, errs[0], tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestValidateTransaction_MaxDecimalPlaces(t *testing.T) {
+	testCases := []struct {
+		name          string
+		places        int32
+		amount        string
+		expectedError error
+	}{
+		{name: "Within the scale", places: 2, amount: "10.05"},
+		{name: "Fewer places", places: 2, amount: "10.5"},
+		{name: "Trailing zeros don't count", places: 2, amount: "10.500"},
+		{name: "One place too many", places: 2, amount: "10.005", expectedError: ErrTooManyDecimalPlaces},
+		{name: "Debit beyond the scale", places: 2, amount: "-0.001", expectedError: ErrTooManyDecimalPlaces},
+		{name: "Whole units only", places: 0, amount: "1.5", expectedError: ErrTooManyDecimalPlaces},
+		{name: "Negative means unlimited", places: -1, amount: "0.123456789"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil),
+				WithLimits(Limits{AllowNegative: true}), WithMaxDecimalPlaces(tc.places))
+
+			errs, err := transactionManager.ValidateTransaction(context.Background(), Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.RequireFromString(tc.amount),
+				CreatedAt:      time.Now(),
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			if tc.expectedError == nil {
+				assert.Empty(t, errs)
+				return
+			}
+			if assert.Len(t, errs, 1) {
+				assert.ErrorIs(t, errs[0], tc.expectedError)
+				assert.ErrorIs(t, errs[0], ErrInvalidTransaction)
+			}
+		})
+	}
+}
+
+func TestValidateTransaction_MaxBackdate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		createdAt     time.Time
+		backfill      bool
+		expectedError error
+	}{
+		{name: "Server timestamp", createdAt: time.Time{}},
+		{name: "Within the window", createdAt: now.Add(-29 * 24 * time.Hour)},
+		{name: "Beyond the window", createdAt: now.AddDate(-2, 0, 0), expectedError: errCreatedAtTooOld},
+		{name: "Backfill beyond the window", createdAt: now.AddDate(-2, 0, 0), backfill: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil),
+				WithClock(func() time.Time { return now }), WithMaxBackdate(30*24*time.Hour))
+
+			ctx := context.Background()
+			if tc.backfill {
+				ctx = WithBackfill(ctx)
+			}
+			errs, err := transactionManager.ValidateTransaction(ctx, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(10),
+				CreatedAt:      tc.createdAt,
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			if tc.expectedError == nil {
+				assert.Empty(t, errs)
+				return
+			}
+			if assert.Len(t, errs, 1) {
+				assert.ErrorIs(t, errs[0], tc.expectedError)
+				assert.ErrorIs(t, errs[0], ErrInvalidTransaction)
+			}
+		})
+	}
+}
+
+func TestValidateTransaction_MaxForwardSkew(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		createdAt     time.Time
+		backfill      bool
+		expectedError error
+	}{
+		{name: "Server timestamp", createdAt: time.Time{}},
+		{name: "Within the skew", createdAt: now.Add(4 * time.Minute)},
+		{name: "Beyond the skew", createdAt: now.Add(time.Hour), expectedError: errCreatedAtInTheFuture},
+		{name: "Backfill beyond the skew", createdAt: now.AddDate(1, 0, 0), backfill: true, expectedError: errCreatedAtInTheFuture},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil),
+				WithClock(func() time.Time { return now }), WithMaxForwardSkew(5*time.Minute))
+
+			ctx := context.Background()
+			if tc.backfill {
+				ctx = WithBackfill(ctx)
+			}
+			errs, err := transactionManager.ValidateTransaction(ctx, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(10),
+				CreatedAt:      tc.createdAt,
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			if tc.expectedError == nil {
+				assert.Empty(t, errs)
+				return
+			}
+			if assert.Len(t, errs, 1) {
+				assert.ErrorIs(t, errs[0], tc.expectedError)
+				assert.ErrorIs(t, errs[0], ErrInvalidTransaction)
+			}
+		})
+	}
+}
+
+func TestValidateTransaction_CurrencyCode(t *testing.T) {
+	testCases := []struct {
+		name          string
+		currency      string
+		expectedError error
+	}{
+		{name: "No currency", currency: ""},
+		{name: "Upper case", currency: "EUR"},
+		{name: "Lower case", currency: "eur"},
+		{name: "Too short", currency: "EU", expectedError: errMalformedCurrency},
+		{name: "Digits", currency: "E1R", expectedError: errMalformedCurrency},
+		{name: "Name instead of code", currency: "Euro", expectedError: errMalformedCurrency},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Without a user nothing is looked up, so no database is needed
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil))
+
+			errs, err := transactionManager.ValidateTransaction(context.Background(), Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(10),
+				Currency:       tc.currency,
+				IdempotencyKey: uuid.New(),
+			})
+			assert.NoError(t, err)
+
+			if tc.expectedError == nil {
+				assert.Empty(t, errs)
+				return
+			}
+			if assert.Len(t, errs, 1) {
+				assert.ErrorIs(t, errs[0], tc.expectedError)
+				assert.ErrorIs(t, errs[0], ErrInvalidTransaction)
+			}
+		})
+	}
+}
+
+func TestAddTransaction_AccountCurrency(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient)
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0), Currency: "EUR"}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Act
+	defaulted, defaultedErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(10),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	_, matchingErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(10),
+		UserID:         user.ID,
+		Currency:       "eur",
+		IdempotencyKey: uuid.New(),
+	})
+	_, mismatchErr := transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(10),
+		UserID:         user.ID,
+		Currency:       "USD",
+		IdempotencyKey: uuid.New(),
+	})
+	validationErrs, validationErr := transactionManager.ValidateTransaction(testEnv.Context, Transaction{
+		Amount:   decimal.NewFromFloat(10),
+		UserID:   user.ID,
+		Currency: "USD",
+	})
+
+	// Assert
+	assert.NoError(t, defaultedErr)
+	assert.Equal(t, "EUR", defaulted.Currency, "currency should default to the account's")
+	assert.NoError(t, matchingErr)
+	assert.ErrorIs(t, mismatchErr, ErrInvalidTransaction)
+	assert.NoError(t, validationErr)
+	assert.Empty(t, validationErrs, "validation doesn't read the account's currency")
+
+	stored, err := transactionManager.GetTransaction(testEnv.Context, defaulted.ID)
+	if err != nil {
+		t.Fatalf("failed to get transaction: %v", err)
+	}
+	assert.Equal(t, "EUR", stored.Currency)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+	assert.True(t, decimal.NewFromFloat(20).Equal(balance), "rejected transaction should not change the balance")
+}
+
+func TestAmountFromMinor(t *testing.T) {
+	testCases := []struct {
+		name           string
+		amountMinor    int64
+		currency       string
+		expectedAmount decimal.Decimal
+		expectedError  error
+	}{
+		{name: "USD cents", amountMinor: 10050, currency: "USD", expectedAmount: decimal.RequireFromString("100.50")},
+		{name: "Lowercase currency", amountMinor: 10050, currency: "usd", expectedAmount: decimal.RequireFromString("100.50")},
+		{name: "No minor units", amountMinor: 500, currency: "JPY", expectedAmount: decimal.NewFromInt(500)},
+		{name: "Three digit scale", amountMinor: 1005, currency: "KWD", expectedAmount: decimal.RequireFromString("1.005")},
+		{name: "Unknown currency", amountMinor: 100, currency: "XXX", expectedError: ErrUnsupportedCurrency},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			amount, err := AmountFromMinor(tc.amountMinor, tc.currency)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			assert.Nil(t, err)
+			assert.True(t, tc.expectedAmount.Equal(amount), "expected %s, got %s", tc.expectedAmount, amount)
+		})
+	}
+}
+
+func TestAddTransaction_UserVersionIncrements(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Act & Assert
+	for expectedVersion := int64(1); expectedVersion <= 3; expectedVersion++ {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(10),
+			UserID:         user.ID,
+			CreatedAt:      time.Now(),
+			IdempotencyKey: uuid.New(),
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expectedVersion, transaction.UserVersion)
+	}
+
+	stored, err := transactionManager.storageClient.UserRepository.FindByID(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), stored.Version)
+}
+
+func TestAddTransaction_MonotonicTimestamps_ClockBackwards(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	// The clock jumps back a second after the first reading
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	readings := []time.Time{start, start.Add(-time.Second), start.Add(-time.Second), start.Add(time.Minute)}
+	next := 0
+	clock := func() time.Time {
+		now := readings[next]
+		next++
+		return now
+	}
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithClock(clock), WithMonotonicTimestamps(true))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Act
+	var timestamps []time.Time
+	for range readings {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(10),
+			UserID:         user.ID,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		timestamps = append(timestamps, transaction.CreatedAt)
+	}
+
+	// Assert
+	assert.True(t, timestamps[0].Equal(start))
+	assert.True(t, timestamps[1].Equal(start.Add(time.Microsecond)), "expected a nudge past the previous timestamp, got %v", timestamps[1])
+	assert.True(t, timestamps[2].Equal(start.Add(2*time.Microsecond)), "expected a nudge past the previous timestamp, got %v", timestamps[2])
+	assert.True(t, timestamps[3].Equal(start.Add(time.Minute)), "a clock ahead of the history is used as is")
+}
+
+func TestAddTransaction_CreditHold(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient,
+		WithClock(clock),
+		WithCreditHold(decimal.NewFromInt(20), time.Hour))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	// Act
+	_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(100),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// Assert
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(100)), "the whole credit counts towards the balance")
+
+	available, err := transactionManager.GetAvailableBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, available.Equal(decimal.NewFromFloat(80)), "expected 20%% held back, got %s available", available)
+
+	// Nothing is due before the hold runs out
+	released, err := transactionManager.ReleaseDueHolds(testEnv.Context)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), released)
+
+	now = now.Add(time.Hour)
+	released, err = transactionManager.ReleaseDueHolds(testEnv.Context)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), released)
+
+	available, err = transactionManager.GetAvailableBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, available.Equal(decimal.NewFromFloat(100)), "expected the hold released, got %s available", available)
+}
+
+func TestAddUserTransactions_HoldsAndDailyLimit(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient,
+		WithLimits(Limits{DailyLimit: decimal.NewFromFloat(100)}),
+		WithCreditHold(decimal.NewFromInt(20), time.Hour))
+
+	user := storage.User{ID: uuid.New(), Balance: decimal.NewFromFloat(0)}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	credits := func(amounts ...float64) []Transaction {
+		transactions := []Transaction{}
+		for _, amount := range amounts {
+			transactions = append(transactions, Transaction{
+				ID:             uuid.New(),
+				Amount:         decimal.NewFromFloat(amount),
+				IdempotencyKey: uuid.New(),
+			})
+		}
+		return transactions
+	}
+
+	// Act
+	// Each credit is under the daily limit on its own, but not together
+	_, overLimitErr := transactionManager.AddUserTransactions(testEnv.Context, user.ID, credits(60, 50))
+	_, err = transactionManager.AddUserTransactions(testEnv.Context, user.ID, credits(60, 30))
+
+	// Assert
+	assert.ErrorIs(t, overLimitErr, ErrDailyLimitExceeded)
+	assert.Contains(t, overLimitErr.Error(), "transaction 1")
+	assert.NoError(t, err)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(90)), "got %s", balance)
+
+	available, err := transactionManager.GetAvailableBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, available.Equal(decimal.NewFromFloat(72)), "expected 20%% of both credits held back, got %s available", available)
+}
+
+func TestCompensation_FundsAndHolds(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient,
+		WithLimits(Limits{AllowNegative: true}),
+		WithCreditHold(decimal.NewFromInt(20), time.Hour))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	add := func(amount float64) Transaction {
+		transaction, err := transactionManager.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(amount),
+			UserID:         user.ID,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		return transaction
+	}
+	available := func() decimal.Decimal {
+		available, err := transactionManager.GetAvailableBalance(testEnv.Context, user.ID)
+		if err != nil {
+			t.Fatalf("failed to get available balance: %v", err)
+		}
+		return available
+	}
+
+	// 20 of the credit is held, 10 is left to spend
+	refunded := add(100)
+	add(-70)
+
+	// Act
+	_, tooMuchErr := transactionManager.RefundTransaction(testEnv.Context, refunded.ID, decimal.NewFromFloat(40), uuid.New())
+	_, refundErr := transactionManager.RefundTransaction(testEnv.Context, refunded.ID, decimal.NewFromFloat(10), uuid.New())
+	availableAfterRefund := available()
+
+	// Reversing all of a held credit releases its hold
+	reversed := add(100)
+	_, reverseErr := transactionManager.ReverseTransaction(testEnv.Context, reversed.ID)
+
+	// Assert
+	assert.ErrorIs(t, tooMuchErr, ErrInsufficientFunds)
+	assert.NoError(t, refundErr)
+	assert.True(t, availableAfterRefund.IsZero(), "the rest of the refunded credit is still held, got %s available", availableAfterRefund)
+	assert.NoError(t, reverseErr)
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(20)), "got %s", balance)
+	assert.True(t, available().IsZero(), "got %s available", available())
+}
+
+func TestAddTransaction_PercentageFee(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient,
+		WithReturnExisting(true),
+		WithAmountTransformer(PercentageFee{Percent: decimal.NewFromInt(2)}))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	credit := Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(100),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	}
+
+	// Act
+	transaction, err := transactionManager.AddTransaction(testEnv.Context, credit)
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// Assert
+	assert.True(t, transaction.Amount.Equal(decimal.NewFromFloat(100)), "the principal keeps its amount")
+	if assert.Len(t, transaction.Derived, 1) {
+		fee := transaction.Derived[0]
+		assert.True(t, fee.Amount.Equal(decimal.NewFromFloat(-2)), "expected a 2 fee, got %s", fee.Amount)
+		assert.Equal(t, "FEE", fee.ReasonCode)
+		assert.Equal(t, user.ID, fee.UserID)
+		assert.NotEqual(t, transaction.IdempotencyKey, fee.IdempotencyKey)
+	}
+
+	balance, err := transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(98)), "expected the fee taken, got %s", balance)
+
+	// A retry books nothing more and replays both entries
+	replayed, err := transactionManager.AddTransaction(testEnv.Context, credit)
+	assert.Nil(t, err)
+	assert.True(t, replayed.Replayed)
+	if assert.Len(t, replayed.Derived, 1) {
+		assert.Equal(t, transaction.Derived[0].ID, replayed.Derived[0].ID)
+	}
+
+	balance, err = transactionManager.GetUserBalance(testEnv.Context, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, balance.Equal(decimal.NewFromFloat(98)), "expected the retry to book nothing, got %s", balance)
+}
+
+func TestAddTransaction_PublishesTransactionCreated(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	sink := &MemoryEventSink{}
+	storageClient := storage.NewStorageClient(testEnv.DB)
+	transactionManager := NewTransactionManagerClient(storageClient, WithEventSink(sink))
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = transactionManager.storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	credit := Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(100),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	}
+
+	// Act
+	_, err = transactionManager.AddTransaction(testEnv.Context, credit)
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	_, err = transactionManager.AddTransaction(testEnv.Context, Transaction{
+		ID:             uuid.New(),
+		Amount:         decimal.NewFromFloat(-30),
+		UserID:         user.ID,
+		IdempotencyKey: uuid.New(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+
+	// A retry commits nothing and publishes nothing
+	_, err = transactionManager.AddTransaction(testEnv.Context, credit)
+	assert.ErrorIs(t, err, ErrTransactionAlreadyExist)
+
+	// Assert
+	events := sink.Events()
+	if assert.Len(t, events, 2) {
+		created, ok := events[0].(TransactionCreated)
+		if assert.True(t, ok, "expected TransactionCreated, got %T", events[0]) {
+			assert.Equal(t, EventTransactionCreated, created.EventType())
+			assert.Equal(t, credit.ID, created.TransactionID)
+			assert.Equal(t, user.ID, created.UserID)
+			assert.True(t, created.Amount.Equal(decimal.NewFromFloat(100)), "got %s", created.Amount)
+			assert.True(t, created.Balance.Equal(decimal.NewFromFloat(100)), "got %s", created.Balance)
+		}
+
+		debit, ok := events[1].(TransactionCreated)
+		if assert.True(t, ok, "expected TransactionCreated, got %T", events[1]) {
+			assert.True(t, debit.Amount.Equal(decimal.NewFromFloat(-30)), "got %s", debit.Amount)
+			assert.True(t, debit.Balance.Equal(decimal.NewFromFloat(70)), "got %s", debit.Balance)
+		}
+	}
+}
+
+func TestPercentageFee_Transform(t *testing.T) {
+	testCases := []struct {
+		name        string
+		amount      decimal.Decimal
+		currency    string
+		expectedFee decimal.Decimal
+	}{
+		{name: "Credit", amount: decimal.NewFromInt(100), expectedFee: decimal.NewFromInt(-2)},
+		{name: "Rounded to the currency", amount: decimal.RequireFromString("10.30"), currency: "USD", expectedFee: decimal.RequireFromString("-0.21")},
+		{name: "No minor units", amount: decimal.NewFromInt(1234), currency: "JPY", expectedFee: decimal.NewFromInt(-25)},
+		{name: "Debit", amount: decimal.NewFromInt(-100)},
+		{name: "Rounds to zero", amount: decimal.RequireFromString("0.20"), currency: "USD"},
+	}
+
+	fee := PercentageFee{Percent: decimal.NewFromInt(2)}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			derived, err := fee.Transform(Transaction{Amount: tc.amount, Currency: tc.currency})
+			assert.Nil(t, err)
+			if tc.expectedFee.IsZero() {
+				assert.Empty(t, derived)
+				return
+			}
+			if assert.Len(t, derived, 1) {
+				assert.True(t, tc.expectedFee.Equal(derived[0].Amount), "expected %s, got %s", tc.expectedFee, derived[0].Amount)
+				assert.Equal(t, "FEE", derived[0].ReasonCode)
+			}
+		})
+	}
+}
+
+func TestInflightLimiter_CapRespected(t *testing.T) {
+	testCases := []struct {
+		name string
+		wait bool
+	}{
+		{name: "Queue over the cap", wait: true},
+		{name: "Reject over the cap", wait: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limit := 3
+			limiter := newInflightLimiter(limit, tc.wait)
+			userID := uuid.New()
+
+			var inFlight, maxInFlight, rejected int64
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					release, err := limiter.acquire(context.Background(), userID)
+					if err != nil {
+						assert.Equal(t, ErrTooManyConcurrentTransactions, err)
+						atomic.AddInt64(&rejected, 1)
+						return
+					}
+					defer release()
+
+					current := atomic.AddInt64(&inFlight, 1)
+					for {
+						seen := atomic.LoadInt64(&maxInFlight)
+						if current <= seen || atomic.CompareAndSwapInt64(&maxInFlight, seen, current) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&inFlight, -1)
+				}()
+			}
+			wg.Wait()
+
+			assert.LessOrEqual(t, maxInFlight, int64(limit))
+			if tc.wait {
+				assert.Equal(t, int64(0), rejected)
+			}
+
+			// Another user isn't held up by the first one's slots
+			release, err := limiter.acquire(context.Background(), uuid.New())
+			assert.Nil(t, err)
+			release()
+
+			// Every slot was given back
+			assert.Equal(t, 0, len(limiter.users))
+		})
+	}
+}
+
+func TestConvertAmount_RoundsToTargetCurrency(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mode     RoundingMode
+		amount   decimal.Decimal
+		from     string
+		to       string
+		rate     decimal.Decimal
+		expected decimal.Decimal
+	}{
+		{name: "USD to JPY", amount: decimal.RequireFromString("10.05"), from: "USD", to: "JPY", rate: decimal.RequireFromString("151.237"), expected: decimal.NewFromInt(1520)},
+		{name: "JPY to USD", amount: decimal.NewFromInt(1000), from: "JPY", to: "USD", rate: decimal.RequireFromString("0.006612"), expected: decimal.RequireFromString("6.61")},
+		{name: "USD to KWD", amount: decimal.RequireFromString("10.01"), from: "USD", to: "KWD", rate: decimal.RequireFromString("0.30745"), expected: decimal.RequireFromString("3.078")},
+		{name: "half up", mode: RoundHalfUp, amount: decimal.RequireFromString("2.5"), from: "USD", to: "JPY", rate: decimal.NewFromInt(1), expected: decimal.NewFromInt(3)},
+		{name: "half even", mode: RoundHalfEven, amount: decimal.RequireFromString("2.5"), from: "USD", to: "JPY", rate: decimal.NewFromInt(1), expected: decimal.NewFromInt(2)},
+		{name: "down", mode: RoundDown, amount: decimal.RequireFromString("2.99"), from: "USD", to: "JPY", rate: decimal.NewFromInt(1), expected: decimal.NewFromInt(2)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tm := NewTransactionManagerClient(storage.NewStorageClient(nil), WithRoundingMode(tc.mode))
+
+			converted, err := tm.ConvertAmount(tc.amount, tc.from, tc.to, tc.rate)
+			assert.Nil(t, err)
+			assert.True(t, converted.Equal(tc.expected), "expected %s, got %s", tc.expected, converted)
+
+			scale, _ := CurrencyScale(tc.to)
+			assert.True(t, converted.Equal(converted.Truncate(scale)))
+		})
+	}
+
+	tm := NewTransactionManagerClient(storage.NewStorageClient(nil))
+	_, err := tm.ConvertAmount(decimal.NewFromInt(1), "USD", "XXX", decimal.NewFromInt(1))
+	assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+	_, err = tm.ConvertAmount(decimal.NewFromInt(1), "USD", "JPY", decimal.Zero)
+	assert.ErrorIs(t, err, ErrInvalidTransaction)
+}
+
+func TestTransfer_AmountNotPositive(t *testing.T) {
+	// Rejected before storage is touched
+	tm := NewTransactionManagerClient(storage.NewStorageClient(nil))
+
+	testCases := []struct {
+		name   string
+		amount decimal.Decimal
+	}{
+		{name: "zero", amount: decimal.Zero},
+		{name: "negative", amount: decimal.NewFromFloat(-10)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tm.Transfer(context.Background(), uuid.New(), uuid.New(), tc.amount, uuid.New())
+			assert.ErrorIs(t, err, errTransferAmountNotPositive)
+			assert.ErrorIs(t, err, ErrInvalidTransaction)
+			assert.Contains(t, err.Error(), "transfer amount must be greater than zero")
+
+			_, err = tm.ReserveTransfer(context.Background(), uuid.New(), uuid.New(), tc.amount, uuid.New())
+			assert.ErrorIs(t, err, errTransferAmountNotPositive)
+
+			_, err = tm.PreviewTransfer(context.Background(), uuid.New(), uuid.New(), tc.amount, false)
+			assert.ErrorIs(t, err, errTransferAmountNotPositive)
+		})
+	}
+}
+
+func TestCountUserTransactions_EstimateThreshold(t *testing.T) {
+	// Assign
+	testEnv, err := utils.CreateTestEnv()
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	defer testEnv.Cleanup()
+
+	storageClient := storage.NewStorageClient(testEnv.DB)
+
+	user := storage.User{
+		ID:      uuid.New(),
+		Balance: decimal.NewFromFloat(0),
+	}
+	err = storageClient.UserRepository.Add(testEnv.Context, user)
+	if err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+
+	exact := NewTransactionManagerClient(storageClient)
+	for i := 0; i < 5; i++ {
+		_, err = exact.AddTransaction(testEnv.Context, Transaction{
+			ID:             uuid.New(),
+			Amount:         decimal.NewFromFloat(10),
+			UserID:         user.ID,
+			IdempotencyKey: uuid.New(),
+		})
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	if _, err = testEnv.DB.ExecContext(testEnv.Context, "ANALYZE transactions"); err != nil {
+		t.Fatalf("failed to analyze: %v", err)
+	}
+
+	// The planner never estimates below one row, so a threshold of one
+	// always estimates and one far above the table never does
+	testCases := []struct {
+		name      string
+		threshold int64
+		estimated bool
+	}{
+		{name: "Exact without threshold", threshold: 0, estimated: false},
+		{name: "Exact below threshold", threshold: 1_000_000, estimated: false},
+		{name: "Estimate at threshold", threshold: 1, estimated: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transactionManager := NewTransactionManagerClient(storageClient, WithEstimatedCounts(tc.threshold))
+
+			// Act
+			count, estimated, err := transactionManager.CountUserTransactions(testEnv.Context, user.ID, HistoryFilter{})
+
+			// Assert
+			assert.Nil(t, err)
+			assert.Equal(t, tc.estimated, estimated)
+			if estimated {
+				assert.True(t, count >= 1, "got %d", count)
+			} else {
+				assert.Equal(t, int64(5), count)
+			}
+		})
+	}
+}
+
+func TestStatementJobStore_Bounded(t *testing.T) {
+	store := newStatementJobStore(2, 2, time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The queue takes as many jobs as it holds
+	var queued []uuid.UUID
+	for i := 0; i < 3; i++ {
+		job := StatementJob{ID: uuid.New(), Status: StatementJobPending}
+		ok := store.enqueue(job, statementRequest{jobID: job.ID})
+		assert.Equal(t, i < 2, ok)
+		if ok {
+			queued = append(queued, job.ID)
+			continue
+		}
+		_, found := store.get(job.ID, now)
+		assert.False(t, found)
+	}
+
+	// Finished jobs over the cap are dropped oldest first
+	first := StatementJob{ID: uuid.New(), Status: StatementJobDone}
+	store.finish(first, now)
+	for _, id := range queued {
+		store.finish(StatementJob{ID: id, Status: StatementJobDone}, now.Add(time.Minute))
+	}
+	_, found := store.get(first.ID, now.Add(time.Minute))
+	assert.False(t, found)
+	_, found = store.get(queued[0], now.Add(time.Minute))
+	assert.True(t, found)
+
+	// and so are those older than the TTL
+	_, found = store.get(queued[0], now.Add(time.Minute+time.Hour))
+	assert.False(t, found)
+}
+
+func TestRunStatementWorkers_StopsWithContext(t *testing.T) {
+	transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		transactionManager.RunStatementWorkers(ctx, 2)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("statement workers did not stop")
+	}
+}
+
+func TestAddTransaction_AddTimeoutOnlyForOwnTimer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		addTimeout    time.Duration
+		callerTimeout time.Duration
+		expectedError error
+	}{
+		{name: "Manager's timer runs out", addTimeout: 20 * time.Millisecond, callerTimeout: time.Hour, expectedError: ErrAddTimeout},
+		{name: "Caller's context runs out", addTimeout: time.Hour, callerTimeout: 20 * time.Millisecond, expectedError: context.DeadlineExceeded},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The user's only slot is taken, so the call waits for it until a
+			// context ends and never reaches the database
+			transactionManager := NewTransactionManagerClient(storage.NewStorageClient(nil),
+				WithAddTimeout(tc.addTimeout), WithMaxConcurrentPerUser(1, true))
+			userID := uuid.New()
+			release, err := transactionManager.inflight.acquire(context.Background(), userID)
+			if err != nil {
+				t.Fatalf("failed to take the slot: %v", err)
+			}
+			defer release()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.callerTimeout)
+			defer cancel()
+			_, err = transactionManager.AddTransaction(ctx, Transaction{
+				ID:             uuid.New(),
+				UserID:         userID,
+				Amount:         decimal.NewFromFloat(10),
+				IdempotencyKey: uuid.New(),
+			})
+
+			assert.ErrorIs(t, err, tc.expectedError)
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package transactionmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+var (
+	ErrTransferNotFound   = storage.ErrTransferNotFound
+	ErrTransferNotPending = storage.ErrTransferNotPending
+	ErrInsufficientFunds  = storage.ErrInsufficientFunds
+
+	errTransferToSelf            = fmt.Errorf("%w: cannot transfer to the same user", ErrInvalidTransaction)
+	errTransferAmountNotPositive = fmt.Errorf("%w: transfer amount must be greater than zero", ErrInvalidTransaction)
+	errTransferExceedsMaxLimit   = fmt.Errorf("%w: transfer amount exceeds the maximum allowed for transfers", ErrInvalidTransaction)
+	errTransferCreditNotPositive = fmt.Errorf("%w: transfer amount converts to nothing in the receiver's currency", ErrInvalidTransaction)
+)
+
+// TransferStatus tracks a transfer through its two phases
+type TransferStatus string
+
+const (
+	TransferStatusPending   TransferStatus = "pending"
+	TransferStatusSettled   TransferStatus = "settled"
+	TransferStatusCancelled TransferStatus = "cancelled"
+)
+
+// Transfer moves an amount from one user to another. It is backed by a debit
+// transaction on the sender and, once settled, a credit transaction on the
+// receiver. Amount is in the sender's currency and CreditAmount in the
+// receiver's, which differ only when their accounts are in different
+// currencies.
+type Transfer struct {
+	ID                  uuid.UUID       `json:"id"`
+	FromUserID          uuid.UUID       `json:"from_user_id"`
+	ToUserID            uuid.UUID       `json:"to_user_id"`
+	Amount              decimal.Decimal `json:"amount"`
+	IdempotencyKey      uuid.UUID       `json:"idempotency_key"`
+	Status              TransferStatus  `json:"status"`
+	CreatedAt           time.Time       `json:"created_at"`
+	DebitTransactionID  uuid.UUID       `json:"debit_transaction_id"`
+	CreditTransactionID *uuid.UUID      `json:"credit_transaction_id,omitempty"`
+	CreditAmount        decimal.Decimal `json:"credit_amount"`
+	// ExchangeRate is the price of one unit of the sender's currency in the
+	// receiver's that Amount was converted at, for transfers between
+	// currencies
+	ExchangeRate *decimal.Decimal `json:"exchange_rate,omitempty"`
+	// FromUserVersion and ToUserVersion are the users' versions after the
+	// write, set on the results of writes that changed their balance
+	FromUserVersion int64 `json:"from_user_version,omitempty"`
+	ToUserVersion   int64 `json:"to_user_version,omitempty"`
+	// Replayed is set on a write result that is the transfer written
+	// earlier with the same idempotency key
+	Replayed bool `json:"-"`
+}
+
+// TransferDirection tells a user's sent transfers from their received ones
+type TransferDirection string
+
+const (
+	TransferDirectionSent     TransferDirection = "sent"
+	TransferDirectionReceived TransferDirection = "received"
+)
+
+// UserTransfer is a transfer seen from one of its users
+type UserTransfer struct {
+	Transfer
+	Direction TransferDirection `json:"direction"`
+	// CounterpartyID is the other user of the transfer
+	CounterpartyID uuid.UUID `json:"counterparty_id"`
+}
+
+// TransferPreview is what a transfer would do to its users' balances
+type TransferPreview struct {
+	FromUserID           uuid.UUID       `json:"from_user_id"`
+	ToUserID             uuid.UUID       `json:"to_user_id"`
+	Amount               decimal.Decimal `json:"amount"`
+	CreditAmount         decimal.Decimal `json:"credit_amount"`
+	ProjectedFromBalance decimal.Decimal `json:"projected_from_balance"`
+	ProjectedToBalance   decimal.Decimal `json:"projected_to_balance"`
+}
+
+// Transfer moves amount from one user to another in a single database
+// transaction. If the sender's balance doesn't cover it, allowing for the
+// sender's overdraft like for a debit, ErrInsufficientFunds is returned and
+// neither user is touched. The receiver's credit is held to their daily
+// limit and credit cap and held back like a credit given to AddTransaction. The idempotency key covers the
+// whole transfer: a retry with the same key returns the transfer already
+// written, marked Replayed, finishing it first if it was interrupted between
+// its legs. A key used by a different transfer returns
+// ErrIdempotencyKeyTaken.
+//
+// Between accounts in different currencies the amount is debited in the
+// sender's currency and credited in the receiver's, converted with the
+// manager's exchange rates and rounded like ConvertAmount. Without exchange
+// rates such transfers return ErrNoExchangeRates. Accounts in the ledger's
+// implicit currency are never converted.
+func (tm *TransactionManagerClient) Transfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (Transfer, error) {
+	return tm.createTransfer(ctx, from, to, amount, idempotencyKey, false)
+}
+
+// ReserveTransfer is the first phase of a two-phase transfer: the amount is
+// debited from the sender as a pending transaction, and the transfer stays
+// pending until SettleTransfer credits the receiver or CancelTransfer gives
+// the amount back.
+func (tm *TransactionManagerClient) ReserveTransfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID) (Transfer, error) {
+	return tm.createTransfer(ctx, from, to, amount, idempotencyKey, true)
+}
+
+func (tm *TransactionManagerClient) createTransfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, idempotencyKey uuid.UUID, pending bool) (Transfer, error) {
+	if err := tm.validateTransfer(from, to, amount); err != nil {
+		return Transfer{}, err
+	}
+
+	sender, err := tm.storageClient.UserRepository.FindByID(ctx, from)
+	if err != nil {
+		return Transfer{}, err
+	}
+	receiver, err := tm.storageClient.UserRepository.FindByID(ctx, to)
+	if err != nil {
+		return Transfer{}, err
+	}
+	creditAmount, rate, err := tm.transferCredit(ctx, sender, receiver, amount)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	senderLimits, err := tm.effectiveLimits(ctx, from)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	// A pending transfer credits the receiver once it is settled
+	credit := Transaction{UserID: to, Amount: creditAmount}
+	if !pending {
+		if err := tm.checkTransferCredit(ctx, credit); err != nil {
+			return Transfer{}, err
+		}
+	}
+	holdAmount, holdUntil := tm.creditHold(credit)
+
+	transfer, err := tm.storageClient.TransferRepository.CreateTransfer(ctx, storage.Transfer{
+		ID:                 uuid.New(),
+		FromUserID:         from,
+		ToUserID:           to,
+		Amount:             amount,
+		IdempotencyKey:     idempotencyKey,
+		CreatedAt:          tm.Now(),
+		CreditAmount:       decimal.NewNullDecimal(creditAmount),
+		ExchangeRate:       rate,
+		AllowOverdraft:     tm.overdraftAccounts[from],
+		OverdraftTolerance: senderLimits.OverdraftTolerance,
+		CreditHoldAmount:   holdAmount,
+		CreditHoldUntil:    holdUntil,
+	}, pending)
+	if storage.IsUniqueViolation(err) {
+		return Transfer{}, ErrTransactionAlreadyExist
+	}
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	return fromStorageTransfer(transfer), nil
+}
+
+func (tm *TransactionManagerClient) validateTransfer(from, to uuid.UUID, amount decimal.Decimal) error {
+	if from == to {
+		return errTransferToSelf
+	}
+	// Transfers always move money from the sender to the receiver, the
+	// direction is never carried by the sign
+	if !amount.IsPositive() {
+		return errTransferAmountNotPositive
+	}
+	if tm.limits.MaxTransferAmount.IsPositive() && amount.GreaterThan(tm.limits.MaxTransferAmount) {
+		return errTransferExceedsMaxLimit
+	}
+	return nil
+}
+
+// checkTransferCredit holds the receiver's leg of a transfer to the limits a
+// credit given to AddTransaction is held to
+func (tm *TransactionManagerClient) checkTransferCredit(ctx context.Context, credit Transaction) error {
+	limits, err := tm.effectiveLimits(ctx, credit.UserID)
+	if err != nil {
+		return err
+	}
+	if err := tm.checkDailyLimit(ctx, credit, limits, decimal.Zero); err != nil {
+		return err
+	}
+	return tm.checkCreditCap(ctx, credit, limits, decimal.Zero)
+}
+
+// transferCredit returns what a transfer of amount from sender to receiver
+// credits the receiver with, along with the rate it was converted at when
+// their accounts are in different currencies
+func (tm *TransactionManagerClient) transferCredit(ctx context.Context, sender storage.User, receiver storage.User, amount decimal.Decimal) (decimal.Decimal, decimal.NullDecimal, error) {
+	if sender.Currency == "" || receiver.Currency == "" || sender.Currency == receiver.Currency {
+		return amount, decimal.NullDecimal{}, nil
+	}
+	if tm.exchangeRates == nil {
+		return decimal.Decimal{}, decimal.NullDecimal{}, ErrNoExchangeRates
+	}
+
+	rate, err := tm.exchangeRates.Rate(ctx, sender.Currency, receiver.Currency)
+	if err != nil {
+		return decimal.Decimal{}, decimal.NullDecimal{}, err
+	}
+	credit, err := tm.ConvertAmount(amount, sender.Currency, receiver.Currency, rate)
+	if err != nil {
+		return decimal.Decimal{}, decimal.NullDecimal{}, err
+	}
+	if !credit.IsPositive() {
+		return decimal.Decimal{}, decimal.NullDecimal{}, fmt.Errorf("%w: %s %s", errTransferCreditNotPositive, amount, sender.Currency)
+	}
+	return credit, decimal.NewNullDecimal(rate), nil
+}
+
+// PreviewTransfer runs the checks a transfer must pass and reports the
+// balances both users would have after it, without writing anything. A
+// pending transfer leaves the receiver's balance as it is. Like a real
+// transfer, amounts the sender's balance doesn't cover return
+// ErrInsufficientFunds.
+func (tm *TransactionManagerClient) PreviewTransfer(ctx context.Context, from, to uuid.UUID, amount decimal.Decimal, pending bool) (TransferPreview, error) {
+	if err := tm.validateTransfer(from, to, amount); err != nil {
+		return TransferPreview{}, err
+	}
+
+	sender, err := tm.storageClient.UserRepository.FindByID(ctx, from)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+	receiver, err := tm.storageClient.UserRepository.FindByID(ctx, to)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+
+	senderLimits, err := tm.effectiveLimits(ctx, from)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+	held, err := tm.storageClient.TransactionRepository.HeldAmount(ctx, from)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+	if !tm.overdraftAccounts[from] && sender.Balance.Sub(held).Add(senderLimits.OverdraftTolerance).LessThan(amount) {
+		return TransferPreview{}, ErrInsufficientFunds
+	}
+
+	credit, _, err := tm.transferCredit(ctx, sender, receiver, amount)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+	if !pending {
+		if err := tm.checkTransferCredit(ctx, Transaction{UserID: to, Amount: credit}); err != nil {
+			return TransferPreview{}, err
+		}
+	}
+
+	preview := TransferPreview{
+		FromUserID:           from,
+		ToUserID:             to,
+		Amount:               amount,
+		CreditAmount:         credit,
+		ProjectedFromBalance: sender.Balance.Sub(amount),
+		ProjectedToBalance:   receiver.Balance,
+	}
+	if !pending {
+		preview.ProjectedToBalance = receiver.Balance.Add(credit)
+	}
+	return preview, nil
+}
+
+// SettleTransfer completes a pending transfer by crediting the receiver,
+// held to the receiver's limits and held back like in Transfer. A transfer
+// that isn't pending returns ErrTransferNotPending.
+func (tm *TransactionManagerClient) SettleTransfer(ctx context.Context, transferID uuid.UUID) (Transfer, error) {
+	pending, err := tm.storageClient.TransferRepository.FindTransferByID(ctx, transferID)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	credit := Transaction{UserID: pending.ToUserID, Amount: pending.Credited()}
+	if pending.Status == storage.TransferStatusPending {
+		if err := tm.checkTransferCredit(ctx, credit); err != nil {
+			return Transfer{}, err
+		}
+	}
+	holdAmount, holdUntil := tm.creditHold(credit)
+
+	transfer, err := tm.storageClient.TransferRepository.SettleTransfer(ctx, transferID, holdAmount, holdUntil)
+	if err != nil {
+		return Transfer{}, err
+	}
+	return fromStorageTransfer(transfer), nil
+}
+
+// CancelTransfer gives the amount reserved by a pending transfer back to the
+// sender. A transfer that isn't pending returns ErrTransferNotPending.
+func (tm *TransactionManagerClient) CancelTransfer(ctx context.Context, transferID uuid.UUID) (Transfer, error) {
+	transfer, err := tm.storageClient.TransferRepository.CancelTransfer(ctx, transferID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	return fromStorageTransfer(transfer), nil
+}
+
+// GetTransfer returns a transfer by ID
+func (tm *TransactionManagerClient) GetTransfer(ctx context.Context, transferID uuid.UUID) (Transfer, error) {
+	transfer, err := tm.storageClient.TransferRepository.FindTransferByID(ctx, transferID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	return fromStorageTransfer(transfer), nil
+}
+
+// GetUserTransfers returns a page of the transfers the user sent or
+// received, newest first, each as a single transfer rather than its ledger
+// rows. An empty direction returns both.
+func (tm *TransactionManagerClient) GetUserTransfers(ctx context.Context, userID uuid.UUID, direction TransferDirection, page int, pageSize int) ([]UserTransfer, error) {
+	// Validate the user
+	_, err := tm.storageClient.UserRepository.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers, err := tm.storageClient.TransferRepository.FindUserTransfers(ctx, userID, storage.TransferDirection(direction), page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []UserTransfer{}
+	for _, transfer := range transfers {
+		userTransfer := UserTransfer{
+			Transfer:       fromStorageTransfer(transfer),
+			Direction:      TransferDirectionSent,
+			CounterpartyID: transfer.ToUserID,
+		}
+		if transfer.FromUserID != userID {
+			userTransfer.Direction = TransferDirectionReceived
+			userTransfer.CounterpartyID = transfer.FromUserID
+		}
+		result = append(result, userTransfer)
+	}
+	return result, nil
+}
+
+// GetNetFlow returns how much more one user transferred to another than they
+// got back from them over [from, to). Only settled transfers count; a
+// negative result means the money flowed the other way.
+func (tm *TransactionManagerClient) GetNetFlow(ctx context.Context, fromUserID, toUserID uuid.UUID, from time.Time, to time.Time) (decimal.Decimal, error) {
+	// Validate the users
+	for _, userID := range []uuid.UUID{fromUserID, toUserID} {
+		if _, err := tm.storageClient.UserRepository.FindByID(ctx, userID); err != nil {
+			return decimal.Decimal{}, err
+		}
+	}
+
+	return tm.storageClient.TransferRepository.NetFlow(ctx, fromUserID, toUserID, from, to)
+}
+
+func fromStorageTransfer(transfer storage.Transfer) Transfer {
+	result := Transfer{
+		ID:                 transfer.ID,
+		FromUserID:         transfer.FromUserID,
+		ToUserID:           transfer.ToUserID,
+		Amount:             transfer.Amount,
+		IdempotencyKey:     transfer.IdempotencyKey,
+		Status:             TransferStatus(transfer.Status),
+		CreatedAt:          transfer.CreatedAt,
+		DebitTransactionID: transfer.DebitTransactionID,
+		CreditAmount:       transfer.Credited(),
+		FromUserVersion:    transfer.FromUserVersion,
+		ToUserVersion:      transfer.ToUserVersion,
+		Replayed:           transfer.Replayed,
+	}
+	if transfer.CreditTransactionID.Valid {
+		creditTransactionID := transfer.CreditTransactionID.UUID
+		result.CreditTransactionID = &creditTransactionID
+	}
+	if transfer.ExchangeRate.Valid {
+		rate := transfer.ExchangeRate.Decimal
+		result.ExchangeRate = &rate
+	}
+	return result
+}
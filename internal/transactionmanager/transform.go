@@ -0,0 +1,140 @@
+package transactionmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// feeReasonCode is the reason code PercentageFee gives its fees unless told
+// otherwise
+const feeReasonCode = "FEE"
+
+// AmountTransformer derives further entries, e.g. fees or taxes, from a
+// transaction being added. They are written along with it in one database
+// transaction, so either all of them are booked or none.
+type AmountTransformer interface {
+	// Transform returns the entries to book along with principal, none when
+	// it isn't affected. Only their amount and reason code need to be set,
+	// the rest is taken from the principal.
+	Transform(principal Transaction) ([]Transaction, error)
+}
+
+// WithAmountTransformer makes AddTransaction book the entries transformer
+// derives from every transaction along with it. Derived entries are held to
+// the user's funds but not to the validation limits, which apply to what the
+// client asked for.
+func WithAmountTransformer(transformer AmountTransformer) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.amountTransformer = transformer
+	}
+}
+
+// PercentageFee takes Percent of every credit as a fee, a debit of the same
+// user booked with the FEE reason code unless ReasonCode is set. Fees are
+// rounded half up to the scale of the transaction's currency, two places
+// when it has none, and skipped when they round to zero.
+type PercentageFee struct {
+	Percent    decimal.Decimal
+	ReasonCode string
+}
+
+// Transform returns the fee on principal when it is a credit
+func (f PercentageFee) Transform(principal Transaction) ([]Transaction, error) {
+	if !principal.Amount.IsPositive() || !f.Percent.IsPositive() {
+		return nil, nil
+	}
+
+	scale := int32(2)
+	if principal.Currency != "" {
+		var err error
+		if scale, err = CurrencyScale(principal.Currency); err != nil {
+			return nil, err
+		}
+	}
+	fee := principal.Amount.Mul(f.Percent).Div(decimal.NewFromInt(100)).Round(scale)
+	if fee.IsZero() {
+		return nil, nil
+	}
+
+	reasonCode := f.ReasonCode
+	if reasonCode == "" {
+		reasonCode = feeReasonCode
+	}
+	return []Transaction{{Amount: fee.Neg(), ReasonCode: reasonCode}}, nil
+}
+
+// deriveEntries returns the entries the manager's transformer derives from
+// principal, filled in from it. Each gets an idempotency key derived from
+// the principal's, so a retry of the principal collides with them too.
+func (tm *TransactionManagerClient) deriveEntries(principal Transaction) ([]Transaction, error) {
+	if tm.amountTransformer == nil {
+		return nil, nil
+	}
+
+	derived, err := tm.amountTransformer.Transform(principal)
+	if err != nil {
+		return nil, err
+	}
+	for i := range derived {
+		entry := &derived[i]
+		if entry.ReasonCode != "" && !tm.reasonCodes[entry.ReasonCode] {
+			return nil, fmt.Errorf("%w %q", errUnknownReasonCode, entry.ReasonCode)
+		}
+		entry.ID = uuid.New()
+		entry.UserID = principal.UserID
+		entry.CreatedAt = principal.CreatedAt
+		entry.IdempotencyKey = uuid.NewSHA1(principal.IdempotencyKey, []byte(fmt.Sprintf("derived/%d", i)))
+		entry.Status = principal.Status
+		entry.Currency = principal.Currency
+		entry.Channel = principal.Channel
+	}
+	return derived, nil
+}
+
+// findDerivedEntries returns the stored entries derived from principal, for
+// replaying a retry of it. Entries that aren't stored, e.g. because the
+// principal was added before the transformer was set, are left out.
+func (tm *TransactionManagerClient) findDerivedEntries(ctx context.Context, principal Transaction) ([]Transaction, error) {
+	derived, err := tm.deriveEntries(principal)
+	if err != nil || len(derived) == 0 {
+		return nil, err
+	}
+
+	stored := make([]Transaction, 0, len(derived))
+	for _, entry := range derived {
+		existing, err := tm.storageClient.TransactionRepository.FindTransactionHoldingKey(ctx, entry.UserID, entry.IdempotencyKey)
+		if errors.Is(err, storage.ErrTransactionNotFound) || (err == nil && !existing.Amount.Equal(entry.Amount)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, fromStorageTransaction(existing))
+	}
+	return stored, nil
+}
+
+func toStorageDerived(entry Transaction, principal storage.Transaction) storage.Transaction {
+	return storage.Transaction{
+		ID:                    entry.ID,
+		Amount:                entry.Amount,
+		UserID:                entry.UserID,
+		CreatedAt:             entry.CreatedAt,
+		IdempotencyKey:        entry.IdempotencyKey,
+		Status:                storage.TransactionStatus(entry.Status),
+		ReasonCode:            entry.ReasonCode,
+		Currency:              entry.Currency,
+		Channel:               entry.Channel,
+		ServerTimestamp:       principal.ServerTimestamp,
+		AllowOverdraft:        principal.AllowOverdraft,
+		OverdraftTolerance:    principal.OverdraftTolerance,
+		MonotonicTimestamp:    principal.MonotonicTimestamp,
+		ReuseSettledKey:       principal.ReuseSettledKey,
+		DirtyBalanceOnFailure: principal.DirtyBalanceOnFailure,
+	}
+}
@@ -0,0 +1,220 @@
+package transactionmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tebrizetayi/ledgerservice/internal/storage"
+)
+
+// EventTransactionCreated is posted for every transaction added with
+// AddTransaction
+const EventTransactionCreated = "transaction.created"
+
+const (
+	// webhookIDHeader carries the delivery ID, the same on every attempt, so
+	// the endpoint can drop events it has already seen
+	webhookIDHeader    = "Webhook-ID"
+	webhookEventHeader = "Webhook-Event"
+
+	// webhookBatchSize is how many due deliveries one pass posts at most
+	webhookBatchSize = 100
+	// maxWebhookBackoff bounds the wait between attempts
+	maxWebhookBackoff = time.Hour
+)
+
+// WebhookDeliveryStatus tracks whether a webhook event reached its endpoint
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery is an event for the webhook endpoint and how its delivery
+// went so far
+type WebhookDelivery struct {
+	// ID is sent as the Webhook-ID header, the same on every attempt
+	ID            uuid.UUID             `json:"id"`
+	Event         string                `json:"event"`
+	Payload       json.RawMessage       `json:"payload"`
+	Status        WebhookDeliveryStatus `json:"status"`
+	Attempts      int                   `json:"attempts"`
+	LastError     string                `json:"last_error,omitempty"`
+	NextAttemptAt time.Time             `json:"next_attempt_at"`
+	CreatedAt     time.Time             `json:"created_at"`
+	DeliveredAt   *time.Time            `json:"delivered_at,omitempty"`
+}
+
+// WebhookRetry reports a retry of the failed deliveries
+type WebhookRetry struct {
+	// Retried is the number of failed deliveries that were retried
+	Retried int64
+	// Delivered is the number of deliveries that got through, including
+	// pending ones that happened to be due
+	Delivered int
+}
+
+// WithWebhooks posts events, as JSON, to url. Events are stored before they
+// are posted and kept until the endpoint answers with a 2xx status, so they
+// are delivered at least once. Failed posts are retried by RunWebhookRetrier,
+// waiting backoff after the first failure and twice as long after every
+// further one, up to an hour.
+func WithWebhooks(url string, backoff time.Duration) Option {
+	return func(tm *TransactionManagerClient) {
+		tm.webhookURL = url
+		tm.webhookBackoff = backoff
+		tm.webhookClient = &http.Client{Timeout: 10 * time.Second}
+	}
+}
+
+// webhookOutbox returns the delivery of event, due right away, for the
+// storage to write in the same database transaction as the change it
+// reports. data renders the event from the transactions as written. It is
+// nil without a webhook URL.
+func (tm *TransactionManagerClient) webhookOutbox(event string, data func(added []storage.Transaction) interface{}) *storage.Outbox {
+	if tm.webhookURL == "" {
+		return nil
+	}
+
+	now := tm.Now().UTC()
+	return &storage.Outbox{
+		Delivery: storage.WebhookDelivery{
+			ID:            uuid.New(),
+			Event:         event,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		},
+		Payload: func(added []storage.Transaction) ([]byte, error) {
+			return json.Marshal(data(added))
+		},
+	}
+}
+
+// DeliverWebhooks posts the deliveries that are due and returns how many got
+// through. Failed posts are rescheduled with backoff.
+func (tm *TransactionManagerClient) DeliverWebhooks(ctx context.Context) (int, error) {
+	due, err := tm.storageClient.WebhookRepository.FindDue(ctx, tm.Now().UTC(), webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, delivery := range due {
+		if postErr := tm.postWebhook(ctx, delivery); postErr != nil {
+			err = tm.storageClient.WebhookRepository.MarkFailed(ctx, delivery.ID, postErr.Error(), tm.Now().UTC().Add(tm.webhookDelay(delivery.Attempts+1)))
+			if err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		if err = tm.storageClient.WebhookRepository.MarkDelivered(ctx, delivery.ID, tm.Now().UTC()); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// RetryWebhookDeliveries makes every failed delivery due now, without
+// waiting out its backoff, and delivers them
+func (tm *TransactionManagerClient) RetryWebhookDeliveries(ctx context.Context) (WebhookRetry, error) {
+	retried, err := tm.storageClient.WebhookRepository.RetryFailed(ctx, tm.Now().UTC())
+	if err != nil {
+		return WebhookRetry{}, err
+	}
+
+	delivered, err := tm.DeliverWebhooks(ctx)
+	return WebhookRetry{Retried: retried, Delivered: delivered}, err
+}
+
+// GetWebhookDeliveries returns up to limit deliveries with the given status,
+// or of any status when it is empty, newest first
+func (tm *TransactionManagerClient) GetWebhookDeliveries(ctx context.Context, status WebhookDeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	stored, err := tm.storageClient.WebhookRepository.FindByStatus(ctx, storage.WebhookDeliveryStatus(status), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(stored))
+	for _, delivery := range stored {
+		deliveries = append(deliveries, fromStorageWebhookDelivery(delivery))
+	}
+	return deliveries, nil
+}
+
+// RunWebhookRetrier delivers due webhooks every interval until ctx is done
+func (tm *TransactionManagerClient) RunWebhookRetrier(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := tm.DeliverWebhooks(ctx); err != nil {
+				tm.log(ctx).Error("delivering webhooks", "error", err)
+			}
+		}
+	}
+}
+
+func (tm *TransactionManagerClient) postWebhook(ctx context.Context, delivery storage.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tm.webhookURL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, delivery.ID.String())
+	req.Header.Set(webhookEventHeader, delivery.Event)
+
+	resp, err := tm.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookDelay returns how long to wait after the given number of failed
+// attempts
+func (tm *TransactionManagerClient) webhookDelay(failures int) time.Duration {
+	delay := tm.webhookBackoff
+	for i := 1; i < failures && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		return maxWebhookBackoff
+	}
+	return delay
+}
+
+func fromStorageWebhookDelivery(delivery storage.WebhookDelivery) WebhookDelivery {
+	result := WebhookDelivery{
+		ID:            delivery.ID,
+		Event:         delivery.Event,
+		Payload:       delivery.Payload,
+		Status:        WebhookDeliveryStatus(delivery.Status),
+		Attempts:      delivery.Attempts,
+		LastError:     delivery.LastError,
+		NextAttemptAt: delivery.NextAttemptAt,
+		CreatedAt:     delivery.CreatedAt,
+	}
+	if delivery.DeliveredAt.Valid {
+		deliveredAt := delivery.DeliveredAt.Time
+		result.DeliveredAt = &deliveredAt
+	}
+	return result
+}